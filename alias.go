@@ -0,0 +1,73 @@
+// Copyright (c) 2023-2024, Nubificus LTD
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/distribution/reference"
+)
+
+const (
+	clientOptAlias       string = "alias:"
+	// The registry that serves the images of the Unikraft hub
+	unikraftIndex        string = "index.unikraft.io"
+	// The community catalog of Unikraft, e.g. unikraft.io/<org>/<app>
+	unikraftCommunityHub string = "unikraft.io"
+)
+
+// defaultAliases are the shortnames of the Unikraft hub and of its community
+// catalog, mapped to the repositories of the registry that serves them.
+func defaultAliases() map[string]string {
+	return map[string]string{
+		unikraftHub:          unikraftIndex + "/" + unikraftHub,
+		unikraftCommunityHub: unikraftIndex,
+	}
+}
+
+// validateAlias checks that the target of an alias is a repository prefix
+// that images can be pulled from.
+func validateAlias(alias string, target string) error {
+	_, err := reference.ParseNormalizedNamed(target)
+	if err != nil {
+		return fmt.Errorf("Invalid target %s for alias %s: %w", target, alias, err)
+	}
+
+	return nil
+}
+
+// aliasBase expands the shortname of a base with the alias with the longest
+// prefix that matches it, if any, e.g. unikraft.org/nginx:1.25 to
+// index.unikraft.io/unikraft.org/nginx:1.25. The hubs keep matching the
+// shortname, so the platform of the base does not change.
+func aliasBase(base string, aliases map[string]string) string {
+	var match string
+
+	base = strings.TrimPrefix(base, dockerImagePrefix)
+	for alias := range aliases {
+		if base != alias && !strings.HasPrefix(base, strings.TrimSuffix(alias, "/")+"/") {
+			continue
+		}
+		if len(alias) > len(match) {
+			match = alias
+		}
+	}
+	if match == "" {
+		return base
+	}
+
+	return strings.TrimSuffix(aliases[match], "/") + strings.TrimPrefix(base, strings.TrimSuffix(match, "/"))
+}
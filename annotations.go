@@ -0,0 +1,290 @@
+// Copyright (c) 2023-2024, Nubificus LTD
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+
+	digest "github.com/opencontainers/go-digest"
+)
+
+const (
+	annotationsCmd        string = "annotations"
+	uruncAnnotPrefix      string = "com.urunc."
+	uruncInitrdAnnot      string = "com.urunc.unikernel.initrd"
+	uruncBlockAnnot       string = "com.urunc.unikernel.block"
+	uruncBlkMntPointAnnot string = "com.urunc.unikernel.blkMntPoint"
+)
+
+// The types of the values of the annotations
+const (
+	annotTypeString string = "string"
+	annotTypeEnum   string = "enum"
+	annotTypeBool   string = "bool"
+	annotTypePath   string = "path"
+	annotTypeDigest string = "digest"
+)
+
+// AnnotSpec describes an annotation that urunc understands.
+type AnnotSpec struct {
+	Key         string   `json:"key"`
+	Type        string   `json:"type"`
+	Values      []string `json:"values,omitempty"` // The allowed values of enums
+	Since       string   `json:"since,omitempty"`  // The first urunc version that understands it, if released
+	Description string   `json:"description"`
+}
+
+// uruncAnnots is the registry of the annotations of urunc. The labels of
+// the Containerfile are validated against it and pun annotations prints it.
+var uruncAnnots = []AnnotSpec{
+	{
+		Key:         uruncUnikernelType,
+		Type:        annotTypeEnum,
+		Values:      []string{"rumprun", "unikraft", "mirage", "mewz", "linux"},
+		Since:       "v0.1.0",
+		Description: "The unikernel framework of the binary",
+	},
+	{
+		Key:         uruncHypervisorAnnot,
+		Type:        annotTypeEnum,
+		Values:      []string{"qemu", "firecracker", "hvt", "spt", "xen"},
+		Since:       "v0.1.0",
+		Description: "The hypervisor or monitor that executes the unikernel",
+	},
+	{
+		Key:         uruncBinaryAnnot,
+		Type:        annotTypePath,
+		Since:       "v0.1.0",
+		Description: "The path of the unikernel binary in the rootfs",
+	},
+	{
+		Key:         uruncCmdlineAnnot,
+		Type:        annotTypeString,
+		Since:       "v0.1.0",
+		Description: "The command line of the unikernel",
+	},
+	{
+		Key:         uruncInitrdAnnot,
+		Type:        annotTypePath,
+		Since:       "v0.3.0",
+		Description: "The path of the initrd in the rootfs",
+	},
+	{
+		Key:         uruncBlockAnnot,
+		Type:        annotTypePath,
+		Since:       "v0.3.0",
+		Description: "The path of a block image in the rootfs to attach to the unikernel",
+	},
+	{
+		Key:         uruncBlkMntPointAnnot,
+		Type:        annotTypePath,
+		Since:       "v0.3.0",
+		Description: "The path where the unikernel mounts the block image",
+	},
+	{
+		Key:         "com.urunc.unikernel.useDMBlock",
+		Type:        annotTypeBool,
+		Since:       "v0.3.0",
+		Description: "Pass the devmapper snapshot of the container as a block device",
+	},
+	{
+		Key:         "com.urunc.unikernel.unikernelVersion",
+		Type:        annotTypeString,
+		Since:       "v0.5.0",
+		Description: "The version of the unikernel framework",
+	},
+	{
+		Key:         "com.urunc.unikernel.mountRootfs",
+		Type:        annotTypeBool,
+		Since:       "v0.5.0",
+		Description: "Mount the rootfs of the container in the unikernel",
+	},
+	{
+		Key:         checksumAnnots[uruncBinaryAnnot],
+		Type:        annotTypeDigest,
+		Description: "The sha256 digest of the unikernel binary, set by pun",
+	},
+	{
+		Key:         checksumAnnots[uruncInitrdAnnot],
+		Type:        annotTypeDigest,
+		Description: "The sha256 digest of the initrd, set by pun",
+	},
+	{
+		Key:         checksumAnnots[uruncBlockAnnot],
+		Type:        annotTypeDigest,
+		Description: "The sha256 digest of the block image, set by pun",
+	},
+	{
+		Key:         uruncProfilesAnnot,
+		Type:        annotTypeString,
+		Description: "The profiles of the unikernel with their cmdline and initrd, in JSON, set by pun from PROFILE",
+	},
+	{
+		Key:         uruncTLSAnnot,
+		Type:        annotTypeString,
+		Description: "The comma separated paths of the TLS material in the rootfs, set by pun from COPY --tls",
+	},
+	{
+		Key:         uruncSeedAnnot,
+		Type:        annotTypePath,
+		Description: "The path of the cloud-init NoCloud seed in the rootfs, set by pun from SEED",
+	},
+	{
+		Key:         uruncScratchDisksAnnot,
+		Type:        annotTypeString,
+		Description: "The empty disks that urunc creates at runtime, in JSON, set by pun from DISK",
+	},
+	{
+		Key:         uruncMemoryAnnot,
+		Type:        annotTypeString,
+		Description: "The memory that the unikernel can use in bytes, set by pun from the device profile",
+	},
+	{
+		Key:         uruncBlockFormatAnnot,
+		Type:        annotTypeEnum,
+		Values:      []string{diskFormatRaw, diskFormatQcow2},
+		Description: "The format of the block image, set by pun",
+	},
+	{
+		Key:         uruncConsoleAnnot,
+		Type:        annotTypeEnum,
+		Values:      []string{"serial", "solo5", "xen-console"},
+		Description: "The console device of the unikernel, set by pun from the hypervisor",
+	},
+	{
+		Key:         uruncNetModelAnnot,
+		Type:        annotTypeEnum,
+		Values:      []string{"virtio-net", "solo5-net", "xen-netfront"},
+		Description: "The model of the network devices, set by pun from the hypervisor",
+	},
+	{
+		Key:         uruncBlockModelAnnot,
+		Type:        annotTypeEnum,
+		Values:      []string{"virtio-blk", "solo5-block", "xen-blkfront"},
+		Description: "The model of the block devices, set by pun from the hypervisor",
+	},
+	{
+		Key:         uruncJSONSignatureAnnot,
+		Type:        annotTypeString,
+		Description: "The signature of urunc.json, as <alg>:<base64>, set by pun in the manifest only",
+	},
+	{
+		Key:         uruncSignatureAnnot,
+		Type:        annotTypePath,
+		Description: "The path of the detached signature of the unikernel binary, set by pun",
+	},
+	{
+		Key:         uruncSignCertAnnot,
+		Type:        annotTypePath,
+		Description: "The path of the certificate that verifies the signature, set by pun",
+	},
+}
+
+// findAnnotSpec returns the spec of a urunc annotation, or nil if urunc
+// does not understand it.
+func findAnnotSpec(key string) *AnnotSpec {
+	for i := range uruncAnnots {
+		if uruncAnnots[i].Key == key {
+			return &uruncAnnots[i]
+		}
+	}
+
+	return nil
+}
+
+// validateAnnot checks the value of a urunc annotation. Annotations that do
+// not belong to urunc are not checked. Unknown urunc annotations are only
+// reported, since newer urunc versions might understand them.
+func validateAnnot(key string, val string) error {
+	if !strings.HasPrefix(key, uruncAnnotPrefix) {
+		return nil
+	}
+	spec := findAnnotSpec(key)
+	if spec == nil {
+		fmt.Printf("Unknown urunc annotation %s, see pun %s\n", key, annotationsCmd)
+		return nil
+	}
+
+	switch spec.Type {
+	case annotTypeEnum:
+		if !slices.Contains(spec.Values, val) {
+			return fmt.Errorf("Invalid value %s for %s, expected one of: %s", val, key, strings.Join(spec.Values, ", "))
+		}
+	case annotTypeBool:
+		if _, err := strconv.ParseBool(val); err != nil {
+			return fmt.Errorf("Invalid value %s for %s, expected a boolean", val, key)
+		}
+	case annotTypePath:
+		if val == "" {
+			return fmt.Errorf("The value of %s can not be empty", key)
+		}
+	case annotTypeDigest:
+		if _, err := digest.Parse(val); err != nil {
+			return fmt.Errorf("Invalid value %s for %s, expected a digest", val, key)
+		}
+	}
+
+	return nil
+}
+
+func annotationsUsage() {
+	fmt.Println("Usage of pun annotations")
+	fmt.Printf("%s %s [<args>]\n\n", os.Args[0], annotationsCmd)
+	fmt.Println("Supported command line arguments")
+	fmt.Println("\t--json bool \t\t\tPrint the annotations in JSON")
+}
+
+// annotationsMain prints the annotations that urunc understands.
+func annotationsMain(args []string) {
+	var printJSON bool
+
+	fs := flag.NewFlagSet(annotationsCmd, flag.ExitOnError)
+	fs.BoolVar(&printJSON, "json", false, "Print the annotations in JSON")
+	fs.Usage = annotationsUsage
+	fs.Parse(args)
+
+	if printJSON {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		err := enc.Encode(uruncAnnots)
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "KEY\tTYPE\tVALUES\tURUNC\tDESCRIPTION")
+	for _, spec := range uruncAnnots {
+		values := strings.Join(spec.Values, ",")
+		if values == "" {
+			values = "-"
+		}
+		since := "-"
+		if spec.Since != "" {
+			since = ">= " + spec.Since
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\n", spec.Key, spec.Type, values, since, spec.Description)
+	}
+	w.Flush()
+}
@@ -0,0 +1,293 @@
+// Copyright (c) 2023-2024, Nubificus LTD
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/containerd/platforms"
+	"github.com/moby/buildkit/frontend/dockerfile/instructions"
+	"github.com/moby/buildkit/frontend/dockerfile/parser"
+	"github.com/moby/buildkit/frontend/dockerfile/shell"
+	"github.com/moby/buildkit/frontend/gateway/client"
+	ocispecs "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+const (
+	clientOptBuildArg string = "build-arg:"
+	argBuildPlatform  string = "BUILDPLATFORM"
+	argBuildOS        string = "BUILDOS"
+	argBuildArch      string = "BUILDARCH"
+	argBuildVariant   string = "BUILDVARIANT"
+	argTargetPlatform string = "TARGETPLATFORM"
+	argTargetOS       string = "TARGETOS"
+	argTargetArch     string = "TARGETARCH"
+	argTargetVariant  string = "TARGETVARIANT"
+	conditionFlag     string = "--if="
+	// The timestamp of reproducible builds, see reproducible-builds.org
+	argSourceDateEpoch string = "SOURCE_DATE_EPOCH"
+)
+
+// The predefined args are always available, without an ARG instruction
+var predefinedArgs = []string{
+	argBuildPlatform,
+	argBuildOS,
+	argBuildArch,
+	argBuildVariant,
+	argTargetPlatform,
+	argTargetOS,
+	argTargetArch,
+	argTargetVariant,
+}
+
+// stringList is a flag which can be specified multiple times
+type stringList []string
+
+func (l *stringList) String() string {
+	return strings.Join(*l, ",")
+}
+
+func (l *stringList) Set(val string) error {
+	*l = append(*l, val)
+	return nil
+}
+
+// platformArgs returns the predefined build args, which describe the
+// platform of the build host and the platform of the unikernel.
+func platformArgs(buildPlatform ocispecs.Platform, targetPlatform ocispecs.Platform) map[string]string {
+	return map[string]string{
+		argBuildPlatform:  platforms.Format(buildPlatform),
+		argBuildOS:        buildPlatform.OS,
+		argBuildArch:      buildPlatform.Architecture,
+		argBuildVariant:   buildPlatform.Variant,
+		argTargetPlatform: platforms.Format(targetPlatform),
+		argTargetOS:       targetPlatform.OS,
+		argTargetArch:     targetPlatform.Architecture,
+		argTargetVariant:  targetPlatform.Variant,
+	}
+}
+
+// buildArgsFromOpts returns the build args the user passed through the
+// build options (e.g. docker build --build-arg).
+func buildArgsFromOpts(opts map[string]string) map[string]string {
+	args := make(map[string]string)
+
+	for key, val := range opts {
+		if strings.HasPrefix(key, clientOptBuildArg) {
+			args[strings.TrimPrefix(key, clientOptBuildArg)] = val
+		}
+	}
+
+	return args
+}
+
+// buildArgsFromCLI returns the build args given in the form KEY=VALUE from
+// the command line.
+func buildArgsFromCLI(list []string) (map[string]string, error) {
+	args := make(map[string]string)
+
+	for _, arg := range list {
+		key, val, ok := strings.Cut(arg, "=")
+		if !ok || key == "" {
+			return nil, fmt.Errorf("Invalid build arg %s, expected KEY=VALUE", arg)
+		}
+		args[key] = val
+	}
+
+	return args, nil
+}
+
+// mergeArgs returns a new map with the args of all maps. Latter maps take
+// precedence.
+func mergeArgs(maps ...map[string]string) map[string]string {
+	merged := make(map[string]string)
+
+	for _, m := range maps {
+		for key, val := range m {
+			merged[key] = val
+		}
+	}
+
+	return merged
+}
+
+// ArgDecl is the declaration of an arg, as the outline of the file shows it.
+type ArgDecl struct {
+	Name        string
+	Default     *string // The default value, if any
+	Description string  // From a preceding comment: # <name> <description>
+	Line        int     // The line of the ARG instruction
+	Global      bool    // Declared before the first FROM
+}
+
+// argDecls returns the declarations of an ARG instruction.
+func argDecls(c *instructions.ArgCommand, line int, global bool) []ArgDecl {
+	var decls []ArgDecl
+
+	for _, kvp := range c.Args {
+		decls = append(decls, ArgDecl{
+			Name:        kvp.Key,
+			Default:     kvp.Value,
+			Description: kvp.Comment,
+			Line:        line,
+			Global:      global,
+		})
+	}
+
+	return decls
+}
+
+// argScope holds the args that are visible in a part of the file. Outside of
+// any image these are the args declared before the first FROM and inside an
+// image the ones declared after its FROM.
+type argScope struct {
+	vals   map[string]string // Values of the declared args
+	global *argScope         // The scope before the first FROM, if any
+}
+
+// newArgScope creates a scope where only the predefined args are visible.
+func newArgScope(args map[string]string, global *argScope) *argScope {
+	scope := &argScope{
+		vals:   make(map[string]string),
+		global: global,
+	}
+	for _, key := range predefinedArgs {
+		if val, ok := args[key]; ok {
+			scope.vals[key] = val
+		}
+	}
+
+	return scope
+}
+
+// declare handles an ARG instruction. The value of an arg comes from the
+// args of the build, else from its default value. An ARG without a default
+// inside an image inherits the value of the global arg with the same name.
+func (s *argScope) declare(c *instructions.ArgCommand, args map[string]string) error {
+	for _, kvp := range c.Args {
+		if val, ok := args[kvp.Key]; ok {
+			s.vals[kvp.Key] = val
+			continue
+		}
+		if kvp.Value != nil {
+			val, err := s.expand(*kvp.Value)
+			if err != nil {
+				return err
+			}
+			s.vals[kvp.Key] = val
+			continue
+		}
+		if s.global != nil {
+			if val, ok := s.global.vals[kvp.Key]; ok {
+				s.vals[kvp.Key] = val
+			}
+		}
+	}
+
+	return nil
+}
+
+// expand expands any references to args of the scope in word.
+func (s *argScope) expand(word string) (string, error) {
+	return expandArgs(word, s.vals)
+}
+
+// expandWords splits words as a shell would, expanding any references to
+// args of the scope.
+func (s *argScope) expandWords(words string) ([]string, error) {
+	var env []string
+
+	for key, val := range s.vals {
+		env = append(env, key+"="+val)
+	}
+	lex := shell.NewLex('\\')
+	res, err := lex.ProcessWords(words, shell.EnvsFromSlice(env))
+	if err != nil {
+		return nil, fmt.Errorf("Failed to expand %s: %w", words, err)
+	}
+
+	return res, nil
+}
+
+// popCondition removes the --if flag from an instruction and returns its
+// value, since the dockerfile parser does not know about it.
+func popCondition(node *parser.Node) (string, bool) {
+	var cond string
+	var found bool
+	var flags []string
+
+	for _, f := range node.Flags {
+		if strings.HasPrefix(f, conditionFlag) {
+			cond = strings.TrimPrefix(f, conditionFlag)
+			found = true
+			continue
+		}
+		flags = append(flags, f)
+	}
+	node.Flags = flags
+
+	return cond, found
+}
+
+// evalCondition evaluates the condition of an --if flag, after expanding
+// any args in it. The condition is false if it expands to an empty string
+// or to a false value (e.g. 0, false) and it can be negated with a leading !.
+func (s *argScope) evalCondition(cond string) (bool, error) {
+	negate := strings.HasPrefix(cond, "!")
+	cond = strings.TrimPrefix(cond, "!")
+
+	val, err := s.expand(cond)
+	if err != nil {
+		return false, err
+	}
+	val = strings.TrimSpace(val)
+
+	res := val != ""
+	if b, err := strconv.ParseBool(val); err == nil {
+		res = b
+	}
+
+	return res != negate, nil
+}
+
+// expandArgs expands any references to build args in word.
+func expandArgs(word string, args map[string]string) (string, error) {
+	var env []string
+
+	for key, val := range args {
+		env = append(env, key+"="+val)
+	}
+	lex := shell.NewLex('\\')
+	res, _, err := lex.ProcessWord(word, shell.EnvsFromSlice(env))
+	if err != nil {
+		return "", fmt.Errorf("Failed to expand %s: %w", word, err)
+	}
+
+	return res, nil
+}
+
+// workersPlatform returns the platform of the buildkit workers, which is
+// the platform of the build host.
+func workersPlatform(workers []client.WorkerInfo) ocispecs.Platform {
+	for _, w := range workers {
+		if len(w.Platforms) > 0 {
+			return w.Platforms[0]
+		}
+	}
+
+	return platforms.DefaultSpec()
+}
@@ -0,0 +1,502 @@
+// Copyright (c) 2023-2024, Nubificus LTD
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"text/tabwriter"
+
+	bkclient "github.com/moby/buildkit/client"
+	"github.com/moby/buildkit/util/appcontext"
+	"github.com/moby/buildkit/util/grpcerrors"
+	"github.com/moby/buildkit/util/progress/progressui"
+	"google.golang.org/grpc/codes"
+)
+
+const (
+	bakeCmd         string = "bake"
+	defaultBakeFile string = "pun-bake.json"
+)
+
+// BakeDefinition is the definition of the images of a release, which pun
+// bake builds together.
+type BakeDefinition struct {
+	// The version of the release, which the tag templates refer to as
+	// {{.Version}}, by default the git describe of the definition
+	Version string                 `json:"version,omitempty"`
+	Targets map[string]*BakeTarget `json:"targets"`
+	dir     string
+}
+
+// BakeTarget is an image of a bake definition, or a matrix of images. The
+// string fields can refer to the variables of the matrix as ${name}, and the
+// tags can be templates of TagData as well.
+type BakeTarget struct {
+	// The build context, relative to the definition
+	Context  string              `json:"context,omitempty"`
+	// The Containerfile, by default the Containerfile of the context
+	File     string              `json:"file,omitempty"`
+	// The image of the Containerfile to build, if it defines many
+	Target   string              `json:"target,omitempty"`
+	// The platforms of the image, e.g. qemu/amd64
+	Platform string              `json:"platform,omitempty"`
+	Args     map[string]string   `json:"args,omitempty"`
+	// Build options of pun
+	Opts     map[string]string   `json:"opts,omitempty"`
+	Secrets  []string            `json:"secrets,omitempty"`
+	// The names of the image, which get exported to image outputs, e.g.
+	// harbor.nbfc.io/nubificus/nginx:{{.Version}}-{{.Hypervisor}}-{{.Arch}}
+	Tags     []string            `json:"tags,omitempty"`
+	// Outputs other than the tags, in the form of type=<type>,...
+	Outputs  []string            `json:"outputs,omitempty"`
+	// Variables mapped to their values, with one image for every
+	// combination of the values
+	Matrix   map[string][]string `json:"matrix,omitempty"`
+}
+
+// BakeCLIOpts are the options of pun bake.
+type BakeCLIOpts struct {
+	// The bake definition
+	File     string
+	// Print the expanded targets instead of building them
+	Print    bool
+	// Push the tags of the targets
+	Push     bool
+	// Build the rest of the targets when one fails, instead of canceling them
+	KeepGoing bool
+	// The targets to build, all of them by default
+	Targets  []string
+	// The connection to buildkitd (--addr, --driver, --driver-opt), the
+	// progress output and the pushes (--immutable-tags, --dry-run)
+	Conn     BuildCLIOpts
+}
+
+func bakeUsage() {
+	fmt.Println("Usage of pun bake")
+	fmt.Printf("%s %s [<args>] [<target>...]\n\n", os.Args[0], bakeCmd)
+	fmt.Println("Supported command line arguments")
+	fmt.Println("\t-f, --file filename \t\tThe bake definition (default " + defaultBakeFile + ")")
+	fmt.Println("\t--print bool \t\t\tPrint the expanded targets instead of building them")
+	fmt.Println("\t--push bool \t\t\tPush the tags of the targets")
+	fmt.Println("\t--keep-going bool \t\tBuild the rest of the targets when one fails")
+	fmt.Println("\t--immutable-tags bool \t\tFail if a pushed tag already exists with a different digest")
+	fmt.Println("\t--force bool \t\t\tOverwrite the existing tags despite --immutable-tags")
+	fmt.Println("\t--dry-run bool \t\t\tPrint the digests of the pushes instead of pushing")
+	fmt.Println("\t--addr address \t\t\tThe address of buildkitd (default $BUILDKIT_HOST)")
+	fmt.Println("\t--driver name \t\t\tWhere buildkitd runs, remote or kubernetes (default remote)")
+	fmt.Println("\t--driver-opt KEY=VALUE \t\tSet an option of the driver (can be used multiple times)")
+	fmt.Println("\t--progress type \t\tThe type of progress output (auto, plain, tty, quiet, json, rawjson)")
+}
+
+func parseBakeCLIOpts(args []string) BakeCLIOpts {
+	var opts BakeCLIOpts
+
+	fs := flag.NewFlagSet(bakeCmd, flag.ExitOnError)
+	fs.StringVar(&opts.File, "file", defaultBakeFile, "The bake definition")
+	fs.StringVar(&opts.File, "f", defaultBakeFile, "The bake definition")
+	fs.BoolVar(&opts.Print, "print", false, "Print the expanded targets instead of building them")
+	fs.BoolVar(&opts.Push, "push", false, "Push the tags of the targets")
+	fs.BoolVar(&opts.KeepGoing, "keep-going", false, "Build the rest of the targets when one fails")
+	fs.BoolVar(&opts.Conn.ImmutableTags, "immutable-tags", false, "Fail if a pushed tag already exists with a different digest")
+	fs.BoolVar(&opts.Conn.Force, "force", false, "Overwrite the existing tags despite --immutable-tags")
+	fs.BoolVar(&opts.Conn.DryRun, "dry-run", false, "Print the digests of the pushes instead of pushing")
+	fs.StringVar(&opts.Conn.Addr, "addr", os.Getenv("BUILDKIT_HOST"), "The address of buildkitd")
+	fs.StringVar(&opts.Conn.Driver, "driver", driverRemote, "Where buildkitd runs, remote or kubernetes")
+	fs.Var(&opts.Conn.DriverOpts, "driver-opt", "Set an option of the driver (can be used multiple times)")
+	fs.StringVar(&opts.Conn.Progress, "progress", string(progressui.AutoMode), "The type of progress output")
+	fs.Usage = bakeUsage
+	fs.Parse(args)
+	opts.Conn.Namespace = containerdNamespace()
+	opts.Conn.DebugImage = defaultDebugImage
+	opts.Targets = fs.Args()
+
+	return opts
+}
+
+// loadBakeDefinition reads a bake definition. The build contexts and the
+// files of its targets are relative to the definition.
+func loadBakeDefinition(path string) (*BakeDefinition, error) {
+	var def BakeDefinition
+
+	content, err := readLocalFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to read bake definition %s: %w", path, err)
+	}
+	err = json.Unmarshal(content, &def)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to parse bake definition %s: %w", path, err)
+	}
+	if len(def.Targets) == 0 {
+		return nil, fmt.Errorf("The bake definition %s has no targets", path)
+	}
+	dir := filepath.Dir(path)
+	def.dir = dir
+	for _, t := range def.Targets {
+		if t.Context == "" {
+			t.Context = "."
+		}
+		if !filepath.IsAbs(t.Context) {
+			t.Context = filepath.Join(dir, t.Context)
+		}
+		if t.File != "" && !filepath.IsAbs(t.File) {
+			t.File = filepath.Join(dir, t.File)
+		}
+	}
+
+	return &def, nil
+}
+
+// matrixCombinations returns every combination of the values of the
+// variables of a matrix, in the order of the sorted variable names, so that
+// the expansion is the same in every run.
+func matrixCombinations(matrix map[string][]string) ([]map[string]string, []string) {
+	var names []string
+	for name := range matrix {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+
+	combinations := []map[string]string{{}}
+	for _, name := range names {
+		var next []map[string]string
+		for _, c := range combinations {
+			for _, val := range matrix[name] {
+				n := make(map[string]string, len(c)+1)
+				for k, v := range c {
+					n[k] = v
+				}
+				n[name] = val
+				next = append(next, n)
+			}
+		}
+		combinations = next
+	}
+
+	return combinations, names
+}
+
+// bakeTemplate expands the ${name} variables of s with the values of vars,
+// failing on unknown variables, which are typos more often than not.
+func bakeTemplate(s string, vars map[string]string) (string, error) {
+	var unknown []string
+	expanded := os.Expand(s, func(name string) string {
+		val, ok := vars[name]
+		if !ok {
+			unknown = append(unknown, name)
+		}
+		return val
+	})
+	if len(unknown) > 0 {
+		return "", fmt.Errorf("Unknown variable %s in %s", unknown[0], s)
+	}
+
+	return expanded, nil
+}
+
+func bakeTemplateList(list []string, vars map[string]string) ([]string, error) {
+	var expanded []string
+	for _, s := range list {
+		e, err := bakeTemplate(s, vars)
+		if err != nil {
+			return nil, err
+		}
+		expanded = append(expanded, e)
+	}
+
+	return expanded, nil
+}
+
+func bakeTemplateMap(m map[string]string, vars map[string]string) (map[string]string, error) {
+	if m == nil {
+		return nil, nil
+	}
+	expanded := make(map[string]string, len(m))
+	for k, v := range m {
+		e, err := bakeTemplate(v, vars)
+		if err != nil {
+			return nil, err
+		}
+		expanded[k] = e
+	}
+
+	return expanded, nil
+}
+
+// expand returns the targets of a matrix, named after the target and the
+// values of the variables, e.g. nginx-1.25-qemu. A target without a matrix
+// is returned as is. The tag templates get expanded after the variables.
+func (t *BakeTarget) expand(name string, tagger *tagTemplater) (map[string]*BakeTarget, error) {
+	expanded := make(map[string]*BakeTarget)
+
+	combinations, names := matrixCombinations(t.Matrix)
+	for _, vars := range combinations {
+		fullName := name
+		for _, n := range names {
+			fullName += "-" + vars[n]
+		}
+		e := &BakeTarget{}
+		var err error
+		fields := []*string{&e.Context, &e.File, &e.Target, &e.Platform}
+		for i, val := range []string{t.Context, t.File, t.Target, t.Platform} {
+			*fields[i], err = bakeTemplate(val, vars)
+			if err != nil {
+				return nil, fmt.Errorf("Target %s: %w", name, err)
+			}
+		}
+		e.Args, err = bakeTemplateMap(t.Args, vars)
+		if err == nil {
+			e.Opts, err = bakeTemplateMap(t.Opts, vars)
+		}
+		if err == nil {
+			e.Secrets, err = bakeTemplateList(t.Secrets, vars)
+		}
+		if err == nil {
+			e.Tags, err = bakeTemplateList(t.Tags, vars)
+		}
+		if err == nil {
+			e.Outputs, err = bakeTemplateList(t.Outputs, vars)
+		}
+		if err == nil {
+			e.Tags, err = tagger.tags(fullName, e, vars)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("Target %s: %w", name, err)
+		}
+		if _, ok := expanded[fullName]; ok {
+			return nil, fmt.Errorf("Target %s: the matrix expands to %s twice", name, fullName)
+		}
+		expanded[fullName] = e
+	}
+
+	return expanded, nil
+}
+
+// expandTargets expands the matrices of the selected targets of the
+// definition, or of all of them.
+func (def *BakeDefinition) expandTargets(selected []string) (map[string]*BakeTarget, error) {
+	targets := make(map[string]*BakeTarget)
+	tagger := newTagTemplater(def.dir, def.Version)
+
+	for _, name := range selected {
+		if _, ok := def.Targets[name]; !ok {
+			return nil, fmt.Errorf("Unknown target %s", name)
+		}
+	}
+	for name, t := range def.Targets {
+		if len(selected) > 0 && !slices.Contains(selected, name) {
+			continue
+		}
+		expanded, err := t.expand(name, tagger)
+		if err != nil {
+			return nil, err
+		}
+		for n, e := range expanded {
+			if _, ok := targets[n]; ok {
+				return nil, fmt.Errorf("Target %s is defined twice after the expansion of the matrices", n)
+			}
+			targets[n] = e
+		}
+	}
+
+	return targets, nil
+}
+
+// buildOpts returns the options of pun build for an expanded target.
+func (t *BakeTarget) buildOpts(conn BuildCLIOpts, push bool) BuildCLIOpts {
+	opts := conn
+	opts.ContextDir = t.Context
+	opts.ContainerFile = t.File
+	if opts.ContainerFile == "" {
+		opts.ContainerFile = filepath.Join(t.Context, defaultContainerFile)
+	}
+	opts.Target = t.Target
+	for k, v := range t.Args {
+		opts.BuildArgs = append(opts.BuildArgs, k+"="+v)
+	}
+	for k, v := range t.Opts {
+		opts.FrontendOpts = append(opts.FrontendOpts, k+"="+v)
+	}
+	if t.Platform != "" {
+		opts.FrontendOpts = append(opts.FrontendOpts, clientOptPlatforms+"="+t.Platform)
+	}
+	opts.Secrets = t.Secrets
+	opts.Outputs = slices.Clone(t.Outputs)
+	for _, tag := range t.Tags {
+		opts.Outputs = append(opts.Outputs, fmt.Sprintf("type=%s,name=%s,push=%t", bkclient.ExporterImage, tag, push))
+	}
+
+	return opts
+}
+
+// bake builds the targets of the definition concurrently, with a single
+// connection to buildkitd and a single progress display.
+func bake(ctx context.Context, opts BakeCLIOpts) error {
+	def, err := loadBakeDefinition(opts.File)
+	if err != nil {
+		return err
+	}
+	targets, err := def.expandTargets(opts.Targets)
+	if err != nil {
+		return err
+	}
+	var names []string
+	for name := range targets {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+
+	if opts.Print {
+		dt, err := json.MarshalIndent(BakeDefinition{Targets: targets}, "", "  ")
+		if err != nil {
+			return err
+		}
+		fmt.Println(string(dt))
+		return nil
+	}
+
+	addr, cleanup, err := driverAddr(ctx, opts.Conn)
+	if err != nil {
+		return err
+	}
+	defer cleanup()
+	c, err := bkclient.New(ctx, addr)
+	if err != nil {
+		return fmt.Errorf("Failed to connect to buildkitd: %w", err)
+	}
+	defer c.Close()
+
+	progress, err := newProgressMux(ctx, opts.Conn.Progress)
+	if err != nil {
+		return err
+	}
+	// Unless we keep going, the first failure cancels the other targets
+	buildCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	errs := make([]error, len(names))
+	var wg sync.WaitGroup
+	for i, name := range names {
+		buildOpts := targets[name].buildOpts(opts.Conn, opts.Push)
+		buildOpts.progress = progress
+		buildOpts.progressPrefix = name
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, errs[i] = clientBuild(buildCtx, c, buildOpts)
+			if errs[i] != nil && !opts.KeepGoing {
+				cancel()
+			}
+		}()
+	}
+	wg.Wait()
+	err = progress.wait()
+	if err != nil {
+		return err
+	}
+
+	var failed []BakeFailure
+	for i, name := range names {
+		if errs[i] != nil {
+			failed = append(failed, BakeFailure{
+				Target: name,
+				Class:  bakeErrorClass(errs[i]),
+				Err:    errs[i],
+			})
+		}
+	}
+	if len(failed) == 0 {
+		return nil
+	}
+	printBakeFailures(os.Stderr, failed)
+
+	return fmt.Errorf("%d of %d targets failed", len(failed), len(names))
+}
+
+// BakeFailure is a target of pun bake that failed to build.
+type BakeFailure struct {
+	Target string
+	// The class of the error, so that the failures which need the same
+	// action can be told apart at a glance
+	Class  string
+	Err    error
+}
+
+// The classes of the errors of the targets, by the messages of the errors,
+// since the errors of the frontend reach the client as text
+var bakeErrorClasses = []struct {
+	class    string
+	messages []string
+}{
+	{"policy", []string{"violates the policy"}},
+	{"offline", []string{"not allowed in offline mode"}},
+	{"immutable", []string{"already exists with digest"}},
+	{"auth", []string{"unauthorized", "denied", "authentication required"}},
+	{"not-found", []string{"not found", "no such file"}},
+	{"invalid", []string{"invalid", "unknown"}},
+}
+
+// bakeErrorClass returns the class of the error of a target: canceled, when
+// another target failed first, registry for transient errors of registries,
+// one of bakeErrorClasses, or build for any other error.
+func bakeErrorClass(err error) string {
+	if errors.Is(err, context.Canceled) || grpcerrors.Code(err) == codes.Canceled {
+		return "canceled"
+	}
+	if isTransient(err) {
+		return "registry"
+	}
+	msg := strings.ToLower(err.Error())
+	for _, c := range bakeErrorClasses {
+		for _, m := range c.messages {
+			if strings.Contains(msg, m) {
+				return c.class
+			}
+		}
+	}
+
+	return "build"
+}
+
+// printBakeFailures prints the failed targets, their error classes and the
+// first line of their errors.
+func printBakeFailures(w io.Writer, failed []BakeFailure) {
+	fmt.Fprintln(w, "Failed targets:")
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "TARGET\tCLASS\tERROR")
+	for _, f := range failed {
+		msg, _, _ := strings.Cut(f.Err.Error(), "\n")
+		fmt.Fprintf(tw, "%s\t%s\t%s\n", f.Target, f.Class, msg)
+	}
+	tw.Flush()
+}
+
+func bakeMain(args []string) {
+	opts := parseBakeCLIOpts(args)
+
+	err := bake(appcontext.Context(), opts)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+}
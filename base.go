@@ -0,0 +1,356 @@
+// Copyright (c) 2023-2024, Nubificus LTD
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"path"
+	"strings"
+
+	"github.com/distribution/reference"
+	"github.com/moby/buildkit/client/llb"
+	"github.com/moby/buildkit/client/llb/sourceresolver"
+	"github.com/moby/buildkit/frontend/gateway/client"
+	"github.com/moby/buildkit/solver/pb"
+	digest "github.com/opencontainers/go-digest"
+	ocispecs "github.com/opencontainers/image-spec/specs-go/v1"
+	"golang.org/x/sync/errgroup"
+)
+
+const (
+	clientOptResolveMode string = "image-resolve-mode"
+	clientOptContext     string = "context:"
+	dockerImagePrefix    string = "docker-image://"
+	ociLayoutPrefix      string = "oci-layout://"
+	uruncBinaryAnnot     string = "com.urunc.unikernel.binary"
+	defaultKernelPath    string = "/kernel"
+	// The platform OS of the images of docker registries
+	dockerPlatformOS     string = "linux"
+)
+
+type BaseImage struct {
+	Ref      string            // The base reference pinned to its digest
+	Digest   digest.Digest     // The digest of the base image
+	Config   []byte            // The image config of the base image
+	Platform ocispecs.Platform // The platform of the base image
+	State    llb.State         // The LLB state of the resolved base
+}
+
+// basePlatform returns the platform that we need to use, when pulling
+// the base image.
+//
+// Images of unikernel hubs, such as unikraft.org, are only available for
+// hypervisor platforms (e.g. qemu/amd64). Therefore, we use the platform of
+// the hub with the longest prefix that matches the base, if any.
+func basePlatform(base string, opts LLBOpts) ocispecs.Platform {
+	var match string
+
+	base = strings.TrimPrefix(base, dockerImagePrefix)
+	for hub := range opts.Hubs {
+		if base != hub && !strings.HasPrefix(base, strings.TrimSuffix(hub, "/")+"/") {
+			continue
+		}
+		if len(hub) > len(match) {
+			match = hub
+		}
+	}
+	if match == "" {
+		return opts.Platform
+	}
+
+	// The platforms of the hubs were validated when we parsed the options
+	platform, err := hubPlatform(opts.Hubs[match], opts.Platform)
+	if err != nil {
+		return opts.Platform
+	}
+
+	return platform
+}
+
+func parseResolveMode(mode string) (llb.ResolveMode, error) {
+	switch mode {
+	case pb.AttrImageResolveModeDefault, "":
+		return llb.ResolveModeDefault, nil
+	case pb.AttrImageResolveModeForcePull:
+		return llb.ResolveModeForcePull, nil
+	case pb.AttrImageResolveModePreferLocal:
+		return llb.ResolveModePreferLocal, nil
+	default:
+		return 0, fmt.Errorf("Invalid %s: %s", clientOptResolveMode, mode)
+	}
+}
+
+// parseOCILayoutRef splits a oci-layout://<store>@<digest> reference to the
+// store ID and the digest of the image inside the store.
+func parseOCILayoutRef(base string) (string, digest.Digest, error) {
+	refSpec := strings.TrimPrefix(base, ociLayoutPrefix)
+	ref, err := reference.Parse(refSpec)
+	if err != nil {
+		return "", "", fmt.Errorf("Could not parse oci-layout reference %s: %w", refSpec, err)
+	}
+	named, ok := ref.(reference.Named)
+	if !ok {
+		return "", "", fmt.Errorf("oci-layout reference %s has no name", refSpec)
+	}
+	dgstd, ok := named.(reference.Digested)
+	if !ok {
+		return "", "", fmt.Errorf("oci-layout reference %s has no digest", refSpec)
+	}
+
+	return named.Name(), dgstd.Digest(), nil
+}
+
+// isHTTPBase returns true if the base is a raw artifact which we need to
+// fetch over HTTP(S), instead of an image.
+func isHTTPBase(base string) bool {
+	return strings.HasPrefix(base, "https://") || strings.HasPrefix(base, "http://")
+}
+
+// kernelAnnots returns the kernel annotations that the base of an image
+// implies: raw artifacts get placed in /kernel, and the kernels of the
+// Unikraft hubs are unikraft kernels in /unikraft/bin/kernel.
+func kernelAnnots(base string) map[string]string {
+	if isHTTPBase(base) {
+		return map[string]string{uruncBinaryAnnot: defaultKernelPath}
+	}
+	if strings.HasPrefix(aliasBase(base, defaultAliases()), unikraftIndex+"/") {
+		return map[string]string{
+			uruncBinaryAnnot:   unikraftKernelPath,
+			uruncUnikernelType: "unikraft",
+		}
+	}
+
+	return nil
+}
+
+// detectKernelAnnots sets the kernel annotations that the base of the image
+// implies, unless the file or its base spec sets them.
+func detectKernelAnnots(instr *PackInstructions) {
+	for key, val := range kernelAnnots(instr.Base) {
+		if _, ok := instr.Annots[key]; ok {
+			continue
+		}
+		if instr.Annots == nil {
+			instr.Annots = make(map[string]string)
+		}
+		instr.Annots[key] = val
+	}
+}
+
+// needsResolve returns true if the base is an image and we need to resolve it.
+func needsResolve(base string) bool {
+	return base != "scratch" && !isHTTPBase(base)
+}
+
+// httpBase fetches a raw artifact (e.g. a kernel from a release page) and
+// places it in an empty image at dst. The expected checksum of the artifact
+// can be given as the fragment of the URL, e.g.
+// https://example.com/kernel#sha256:<hex>. If the checksum does not match,
+// buildkit will fail the build.
+func httpBase(base string, dst string) (llb.State, error) {
+	u, err := url.Parse(base)
+	if err != nil {
+		return llb.Scratch(), fmt.Errorf("Failed to parse base URL %s: %w", base, err)
+	}
+
+	filename := path.Base(u.Path)
+	if filename == "/" || filename == "." {
+		return llb.Scratch(), fmt.Errorf("Base URL %s does not point to a file", base)
+	}
+	httpOpts := []llb.HTTPOption{llb.Filename(filename), llb.Chmod(0755)}
+	if u.Fragment != "" {
+		dgst, err := digest.Parse(u.Fragment)
+		if err != nil {
+			return llb.Scratch(), fmt.Errorf("Invalid checksum %s for %s: %w", u.Fragment, base, err)
+		}
+		httpOpts = append(httpOpts, llb.Checksum(dgst))
+		u.Fragment = ""
+	}
+
+	src := llb.HTTP(u.String(), httpOpts...)
+	return llb.Scratch().File(llb.Copy(src, filename, dst, &llb.CopyInfo{
+				CreateDestPath: true,})), nil
+}
+
+// unresolvedBase returns the LLB state of the base image, without
+// contacting buildkit. It is used when we just print the LLB.
+func unresolvedBase(base string, platform ocispecs.Platform, aliases map[string]string) (llb.State, error) {
+	if strings.HasPrefix(base, ociLayoutPrefix) {
+		storeID, dgst, err := parseOCILayoutRef(base)
+		if err != nil {
+			return llb.Scratch(), err
+		}
+		return llb.OCILayout(storeID + "@" + dgst.String(),
+				llb.OCIStore("", storeID), llb.Platform(platform)), nil
+	}
+
+	return llb.Image(aliasBase(base, aliases), llb.Platform(platform)), nil
+}
+
+// resolveBase uses the gateway client to fetch the digest and the config of
+// the base image, before we construct the LLB. In that way, any
+// authentication error or a nonexistent base will show up early and the
+// LLB will refer to a specific digest of the base image.
+//
+// The base can also be a named context (e.g. --build-context in buildx)
+// pointing to a docker image or to a local OCI layout.
+//
+// Shortnames of hubs get expanded with the aliases, e.g. to the registry that
+// serves the images of unikraft.org.
+func resolveBase(ctx context.Context, c client.Client, base string, platform ocispecs.Platform, mode llb.ResolveMode,
+		aliases map[string]string) (*BaseImage, error) {
+	bopts := c.BuildOpts()
+	if namedCtx, ok := bopts.Opts[clientOptContext+base]; ok {
+		base = namedCtx
+	}
+
+	if strings.HasPrefix(base, ociLayoutPrefix) {
+		return resolveOCILayoutBase(ctx, c, base, platform, bopts.SessionID)
+	}
+
+	return resolveImageBase(ctx, c, aliasBase(base, aliases), platform, mode)
+}
+
+// resolveOCILayoutBase resolves a base image that lives in a local OCI
+// layout store, which the client exposes through the session.
+func resolveOCILayoutBase(ctx context.Context, c client.Client, base string, platform ocispecs.Platform, sessionID string) (*BaseImage, error) {
+	storeID, dgst, err := parseOCILayoutRef(base)
+	if err != nil {
+		return nil, err
+	}
+	ref := storeID + "@" + dgst.String()
+
+	_, dgst, config, err := c.ResolveImageConfig(ctx, ref, sourceresolver.Opt{
+		LogName:  "[internal] load metadata for " + base,
+		Platform: &platform,
+		OCILayoutOpt: &sourceresolver.ResolveOCILayoutOpt{
+			Store: sourceresolver.ResolveImageConfigOptStore{
+				SessionID: sessionID,
+				StoreID:   storeID,
+			},
+		},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("Failed to resolve base image %s: %w", base, err)
+	}
+
+	return &BaseImage{
+		Ref:      ref,
+		Digest:   dgst,
+		Config:   config,
+		Platform: platform,
+		State:    llb.OCILayout(ref, llb.OCIStore(sessionID, storeID),
+				llb.Platform(platform)),
+	}, nil
+}
+
+// resolveImageBase resolves a base image from a registry or from the
+// image store of the buildkit worker (e.g. containerd).
+//
+// Registries that re-serve the images of unikernel hubs as docker schema2
+// manifests drop the hypervisor platforms of the hubs (e.g. qemu/amd64), so
+// if a base can not be resolved for a hypervisor platform, it gets resolved
+// for the linux platform of the same architecture, as docker images are.
+func resolveImageBase(ctx context.Context, c client.Client, base string, platform ocispecs.Platform, mode llb.ResolveMode) (*BaseImage, error) {
+	resolve := func(platform ocispecs.Platform) (string, digest.Digest, []byte, error) {
+		return c.ResolveImageConfig(ctx, base, sourceresolver.Opt{
+			LogName:  "[internal] load metadata for " + base,
+			Platform: &platform,
+			ImageOpt: &sourceresolver.ResolveImageOpt{
+				ResolveMode: mode.String(),
+			},
+		})
+	}
+	ref, dgst, config, err := resolve(platform)
+	if err != nil && platform.OS != dockerPlatformOS {
+		dockerPlatform := ocispecs.Platform{
+			OS:           dockerPlatformOS,
+			Architecture: platform.Architecture,
+			Variant:      platform.Variant,
+		}
+		var dockerErr error
+		ref, dgst, config, dockerErr = resolve(dockerPlatform)
+		if dockerErr == nil {
+			platform = dockerPlatform
+			err = nil
+		}
+	}
+	if err != nil {
+		return nil, fmt.Errorf("Failed to resolve base image %s: %w", base, err)
+	}
+
+	named, err := reference.ParseNormalizedNamed(ref)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to parse reference %s: %w", ref, err)
+	}
+	pinned, err := reference.WithDigest(named, dgst)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to pin %s to digest %s: %w", ref, dgst, err)
+	}
+
+	return &BaseImage{
+		Ref:      pinned.String(),
+		Digest:   dgst,
+		Config:   config,
+		Platform: platform,
+		State:    llb.Image(pinned.String(), llb.Platform(platform), mode),
+	}, nil
+}
+
+// resolveImages resolves concurrently the bases of the given images, which
+// are not scratch or other images of the file. Images with the same base
+// share a single resolution. At most opts.MaxResolves resolutions run at
+// the same time, if set. The caller needs to wait on eg for the resolution
+// to finish.
+func resolveImages(ctx context.Context, eg *errgroup.Group, c client.Client, images []*PackInstructions, toResolve []*PackInstructions, opts LLBOpts, mode llb.ResolveMode) {
+	var slots chan struct{}
+	if opts.MaxResolves > 0 {
+		slots = make(chan struct{}, opts.MaxResolves)
+	}
+
+	for _, image := range toResolve {
+		if !needsResolve(image.Base) || findImage(images, image, image.Base) != nil {
+			continue
+		}
+		image := image
+		eg.Go(func() error {
+			platform := imagePlatform(image, opts)
+			resolved, err := resolvedBases.get(ctx, baseCacheKey(c, image.Base, opts.Aliases), platform, mode, func() (*BaseImage, error) {
+				if slots != nil {
+					select {
+					case slots <- struct{}{}:
+					case <-ctx.Done():
+						return nil, ctx.Err()
+					}
+					defer func() { <-slots }()
+				}
+				var resolved *BaseImage
+				err := opts.Retry.retry(ctx, "resolve "+image.Base, func() error {
+					var err error
+					resolved, err = resolveBase(ctx, c, image.Base, platform, mode, opts.Aliases)
+					return err
+				})
+				return resolved, err
+			})
+			if err != nil {
+				return err
+			}
+			image.Resolved = resolved
+			return nil
+		})
+	}
+}
@@ -0,0 +1,167 @@
+// Copyright (c) 2023-2024, Nubificus LTD
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"path"
+	"time"
+
+	"github.com/moby/buildkit/client/llb"
+	"github.com/moby/buildkit/frontend/gateway/client"
+	ocispecs "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+const (
+	clientOptBootTest        string = "boot-test"
+	clientOptBootTestCmd     string = "boot-test-cmd"
+	clientOptBootTestMarker  string = "boot-test-marker"
+	clientOptBootTestTimeout string = "boot-test-timeout"
+	uruncHypervisorAnnot     string = "com.urunc.unikernel.hypervisor"
+	uruncCmdlineAnnot        string = "com.urunc.unikernel.cmdline"
+	// The packed image gets mounted there in the boot test container
+	bootTestRootfs           string = "/unikernel"
+)
+
+const defaultBootTestTimeout time.Duration = 60 * time.Second
+
+// defaultBootTestCmd boots the kernel with the hypervisor of the image and
+// succeeds when the marker appears in the output, or, without a marker, when
+// the hypervisor exits successfully before the timeout.
+const defaultBootTestCmd string = `
+case "$PUN_HYPERVISOR" in
+qemu|"")
+	set -- qemu-system-$(uname -m) -nographic -nodefaults -serial stdio -m 256 \
+		-kernel "$PUN_KERNEL" -append "$PUN_CMDLINE"
+	;;
+firecracker)
+	printf '{"boot-source":{"kernel_image_path":"%s","boot_args":"%s"},"drives":[],"machine-config":{"vcpu_count":1,"mem_size_mib":256}}' \
+		"$PUN_KERNEL" "$PUN_CMDLINE" > /tmp/firecracker.json
+	set -- firecracker --no-api --config-file /tmp/firecracker.json
+	;;
+*)
+	echo "There is no default boot test for $PUN_HYPERVISOR, please set boot-test-cmd"
+	exit 1
+	;;
+esac
+if [ -z "$PUN_MARKER" ]; then
+	exec timeout "$PUN_TIMEOUT" "$@"
+fi
+timeout "$PUN_TIMEOUT" "$@" > /tmp/boot.log 2>&1 &
+pid=$!
+while kill -0 $pid 2>/dev/null; do
+	if grep -q -F -- "$PUN_MARKER" /tmp/boot.log; then
+		kill $pid
+		cat /tmp/boot.log
+		exit 0
+	fi
+	sleep 1
+done
+cat /tmp/boot.log
+if ! grep -q -F -- "$PUN_MARKER" /tmp/boot.log; then
+	echo "The unikernel did not print $PUN_MARKER"
+	exit 1
+fi
+`
+
+// BootTest describes the boot test of the packed image. The test runs in
+// a privileged container of Image, which must contain the hypervisor.
+type BootTest struct {
+	Image   string        // The image with the hypervisor
+	Cmd     string        // The shell command that boots the unikernel
+	Marker  string        // The output which shows that the unikernel is ready
+	Timeout time.Duration // How long to wait for the unikernel
+}
+
+// bootTestFromBuildOpts returns the boot test of the build options, or nil
+// if the boot test is not enabled.
+func bootTestFromBuildOpts(opts map[string]string) (*BootTest, error) {
+	image := opts[clientOptBootTest]
+	if image == "" {
+		return nil, nil
+	}
+
+	bt := &BootTest{
+		Image:   image,
+		Cmd:     defaultBootTestCmd,
+		Marker:  opts[clientOptBootTestMarker],
+		Timeout: defaultBootTestTimeout,
+	}
+	if val := opts[clientOptBootTestCmd]; val != "" {
+		bt.Cmd = val
+	}
+	if val := opts[clientOptBootTestTimeout]; val != "" {
+		timeout, err := time.ParseDuration(val)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid %s %s: %w", clientOptBootTestTimeout, val, err)
+		}
+		bt.Timeout = timeout
+	}
+
+	return bt, nil
+}
+
+// runBootTest boots the unikernel of the packed image and fails if it does
+// not get ready. The command gets the details of the unikernel through the
+// PUN_* environment variables, with the image mounted in /unikernel.
+func runBootTest(ctx context.Context, c client.Client, bt *BootTest, instr *PackInstructions, ref client.Reference, platform ocispecs.Platform) error {
+	kernelPath, ok := instr.Annots[uruncBinaryAnnot]
+	if !ok {
+		return fmt.Errorf("The boot test requires the %s label", uruncBinaryAnnot)
+	}
+	rootfs, err := ref.ToState()
+	if err != nil {
+		return err
+	}
+
+	run := llb.Image(bt.Image).Run(
+		llb.Args([]string{"/bin/sh", "-c", bt.Cmd}),
+		llb.AddEnv("PUN_ROOTFS", bootTestRootfs),
+		llb.AddEnv("PUN_KERNEL", path.Join(bootTestRootfs, kernelPath)),
+		llb.AddEnv("PUN_CMDLINE", instr.Annots[uruncCmdlineAnnot]),
+		llb.AddEnv("PUN_HYPERVISOR", platformHypervisor(instr, platform)),
+		llb.AddEnv("PUN_MARKER", bt.Marker),
+		llb.AddEnv("PUN_TIMEOUT", fmt.Sprintf("%d", int(bt.Timeout.Seconds()))),
+		llb.AddMount(bootTestRootfs, rootfs, llb.Readonly),
+		// The hypervisor needs the devices of the host (e.g. /dev/kvm)
+		llb.Security(llb.SecurityModeInsecure),
+		llb.IgnoreCache,
+		llb.WithCustomName("Boot test of " + kernelPath),
+	)
+	dt, err := run.Root().Marshal(ctx)
+	if err != nil {
+		return fmt.Errorf("Failed to marshal boot test: %w", err)
+	}
+	_, err = c.Solve(ctx, client.SolveRequest{
+		Definition: dt.ToPB(),
+		Evaluate:   true,
+	})
+	if err != nil {
+		return fmt.Errorf("Boot test failed: %w", err)
+	}
+
+	return nil
+}
+
+// platformHypervisor returns the hypervisor of the image, either from its
+// label, or from the OS of its platform (e.g. qemu/amd64).
+func platformHypervisor(instr *PackInstructions, platform ocispecs.Platform) string {
+	if hv, ok := instr.Annots[uruncHypervisorAnnot]; ok {
+		return hv
+	}
+
+	return platform.OS
+}
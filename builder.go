@@ -0,0 +1,172 @@
+// Copyright (c) 2023-2024, Nubificus LTD
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"maps"
+	"slices"
+	"strings"
+
+	"github.com/moby/buildkit/frontend/dockerfile/instructions"
+	"github.com/moby/buildkit/frontend/dockerfile/parser"
+	"github.com/moby/buildkit/frontend/gateway/client"
+)
+
+// The name of the Dockerfile of the builder stages in the dockerfile input
+const builderDockerfile string = "Dockerfile"
+
+// isPunNode returns the name of the instruction if only pun supports it,
+// either because the instruction itself or one of its flags is specific to
+// pun.
+func isPunNode(node *parser.Node) (string, bool) {
+	if isMkdir(node) || isRm(node) || isMv(node) || isDisk(node) || isSeed(node) ||
+		isProfile(node) || isConfig(node) || isDNS(node) || isHost(node) ||
+		isInherits(node) || isHook(node) {
+		return strings.ToUpper(node.Value), true
+	}
+	for _, flag := range node.Flags {
+		if strings.HasPrefix(flag, "--if=") {
+			return strings.ToUpper(node.Value) + " --if", true
+		}
+	}
+
+	return "", false
+}
+
+// isContainerNode returns true if the instruction only makes sense in
+// container images, e.g. RUN.
+func isContainerNode(node *parser.Node) bool {
+	return slices.Contains(dockerfileOnlyCmds, strings.ToLower(node.Value))
+}
+
+// builderStages marks the images of the file with instructions that only
+// containers use, e.g. RUN, as builder stages, which the dockerfile frontend
+// of buildkit builds instead of pun. Builder stages get a Dockerfile with
+// the global args and all the builder stages of the file, since they can
+// depend on each other, but not on the images of pun.
+func builderStages(fileBytes []byte, images []*PackInstructions) error {
+	res, err := parser.Parse(bytes.NewReader(fileBytes))
+	if err != nil {
+		return err
+	}
+	lines := strings.Split(string(fileBytes), "\n")
+	nodeText := func(node *parser.Node) string {
+		return strings.Join(lines[node.StartLine-1:node.EndLine], "\n") + "\n"
+	}
+
+	var global strings.Builder
+	if res.EscapeToken != '\\' {
+		fmt.Fprintf(&global, "# escape=%c\n", res.EscapeToken)
+	}
+	texts := make([]strings.Builder, len(images))
+	isBuilder := make([]bool, len(images))
+	punCmds := make([]string, len(images))
+	stage := -1
+	for _, child := range res.AST.Children {
+		if strings.EqualFold(child.Value, "from") {
+			stage++
+		}
+		if stage < 0 {
+			if strings.EqualFold(child.Value, "arg") {
+				global.WriteString(nodeText(child))
+			}
+			continue
+		}
+		if stage >= len(images) {
+			break
+		}
+		texts[stage].WriteString(nodeText(child))
+		if isContainerNode(child) {
+			isBuilder[stage] = true
+		} else if name, ok := isPunNode(child); ok && punCmds[stage] == "" {
+			punCmds[stage] = name
+		}
+	}
+
+	dockerfile := global.String()
+	for i, instr := range images {
+		if !isBuilder[i] {
+			continue
+		}
+		if punCmds[i] != "" {
+			return fmt.Errorf("The builder stage %s can not use %s, which only pun supports", instr.Name, punCmds[i])
+		}
+		deps := []string{instr.Base}
+		for _, cmd := range instr.Copies {
+			if c, ok := cmd.(*instructions.CopyCommand); ok {
+				deps = append(deps, c.From)
+			}
+		}
+		for _, name := range deps {
+			dep := findImage(images, instr, name)
+			if dep != nil && !isBuilder[slices.Index(images, dep)] {
+				return fmt.Errorf("The builder stage %s can not use the image %s of pun", instr.Name, dep.Name)
+			}
+		}
+		dockerfile += texts[i].String()
+	}
+	for i, instr := range images {
+		if !isBuilder[i] {
+			continue
+		}
+		// The dockerfile frontend copies the files of builder stages
+		instr.Copies = nil
+		instr.Dockerfile = []byte(dockerfile)
+	}
+
+	return nil
+}
+
+// solveBuilders solves the builder stages that the target needs with the
+// dockerfile frontend of buildkit, so that their state can be used as the
+// base or the source of copies of the images of pun. The builder stages
+// get built for the platform of the build host, unless their FROM sets
+// another platform.
+func solveBuilders(ctx context.Context, c client.Client, b *platformBuild, reachable []*PackInstructions) error {
+	for _, instr := range reachable {
+		if instr.Dockerfile == nil {
+			continue
+		}
+		if instr == b.Target {
+			return fmt.Errorf("The target %s has instructions that only containers use, e.g. RUN", instr.Name)
+		}
+		err := b.LLBOpts.checkFeature(featureBuilderStages, "The builder stage "+instr.Name)
+		if err != nil {
+			return err
+		}
+		opts := maps.Clone(c.BuildOpts().Opts)
+		delete(opts, clientOptPlatforms)
+		opts[clientOptTarget] = instr.Name
+		opts[clientOptFilename] = builderDockerfile
+		res, err := solveDockerfile(ctx, c, opts, instr.Dockerfile)
+		if err != nil {
+			return fmt.Errorf("Failed to build the builder stage %s: %w", instr.Name, err)
+		}
+		ref, err := res.SingleRef()
+		if err != nil {
+			return err
+		}
+		st, err := ref.ToState()
+		if err != nil {
+			return fmt.Errorf("Failed to get the state of the builder stage %s: %w", instr.Name, err)
+		}
+		instr.BuilderState = &st
+	}
+
+	return nil
+}
@@ -0,0 +1,413 @@
+// Copyright (c) 2023-2024, Nubificus LTD
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"time"
+
+	"github.com/containerd/containerd/errdefs"
+	"github.com/containerd/containerd/remotes"
+	"github.com/distribution/reference"
+	"github.com/moby/buildkit/util/appcontext"
+	digest "github.com/opencontainers/go-digest"
+	ocispecs "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+const (
+	bundleCmd       string = "bundle"
+	bundleExportCmd string = "export"
+	bundleImportCmd string = "import"
+	// The metadata of the bundle, next to the OCI layout of the images
+	bundleMetaFile  string = "pun-bundle.json"
+)
+
+// BundleMeta describes the images of a bundle, which carries a release of
+// unikernel images into disconnected environments.
+type BundleMeta struct {
+	// The version of pun that exported the bundle
+	Version string         `json:"version"`
+	Created time.Time      `json:"created"`
+	Images  []BundleImage  `json:"images"`
+}
+
+// BundleImage is an image of a bundle, along with the artifacts which refer
+// to it, such as signatures or SBOMs.
+type BundleImage struct {
+	Ref       string        `json:"ref"`
+	Digest    digest.Digest `json:"digest"`
+	// The index of the referrers, as the tag fallback of the referrers API
+	// serves it, if the image has any
+	Referrers digest.Digest `json:"referrers,omitempty"`
+}
+
+func bundleUsage() {
+	fmt.Println("Usage of pun bundle")
+	fmt.Printf("%s %s %s [<args>] <image>...\n", os.Args[0], bundleCmd, bundleExportCmd)
+	fmt.Printf("%s %s %s [<args>] <bundle>\n\n", os.Args[0], bundleCmd, bundleImportCmd)
+	fmt.Println("Supported command line arguments")
+	fmt.Println("\t-o, --output path \t\tThe tarball of the bundle (export, default bundle.tar)")
+	fmt.Println("\t--registry prefix \t\tPush the images under this registry (import, default their registries)")
+}
+
+// referrersTag returns the tag that lists the referrers of a digest, in
+// registries without the referrers API.
+func referrersTag(d digest.Digest) string {
+	return d.Algorithm().String() + "-" + d.Encoded()
+}
+
+func layoutBlobPath(dir string, d digest.Digest) string {
+	return filepath.Join(dir, "blobs", d.Algorithm().String(), d.Encoded())
+}
+
+// fetchTree fetches the blob of desc and all the blobs that it refers to in
+// the OCI layout of dir. Blobs which are already there are skipped.
+func fetchTree(ctx context.Context, fetcher remotes.Fetcher, desc ocispecs.Descriptor, dir string) error {
+	blob := layoutBlobPath(dir, desc.Digest)
+	if _, err := os.Stat(blob); err != nil {
+		err = fetchBlob(ctx, fetcher, desc, blob)
+		if err != nil {
+			return fmt.Errorf("Failed to fetch %s: %w", desc.Digest, err)
+		}
+	}
+
+	var children []ocispecs.Descriptor
+	switch desc.MediaType {
+	case ocispecs.MediaTypeImageIndex, mediaTypeDockerList:
+		var index ocispecs.Index
+		err := readBlobJSON(blob, &index)
+		if err != nil {
+			return err
+		}
+		children = index.Manifests
+	case ocispecs.MediaTypeImageManifest, mediaTypeDockerManifest:
+		var manifest ocispecs.Manifest
+		err := readBlobJSON(blob, &manifest)
+		if err != nil {
+			return err
+		}
+		children = append([]ocispecs.Descriptor{manifest.Config}, manifest.Layers...)
+	}
+	for _, child := range children {
+		err := fetchTree(ctx, fetcher, child, dir)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// fetchBlob fetches a blob in the file of blob, verifying its digest.
+func fetchBlob(ctx context.Context, fetcher remotes.Fetcher, desc ocispecs.Descriptor, blob string) error {
+	rc, err := fetcher.Fetch(ctx, desc)
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+
+	err = os.MkdirAll(filepath.Dir(blob), 0755)
+	if err != nil {
+		return err
+	}
+	verifier := desc.Digest.Verifier()
+	err = writeFileFrom(blob, io.TeeReader(rc, verifier))
+	if err == nil && !verifier.Verified() {
+		err = fmt.Errorf("The digest of the blob does not match")
+	}
+	if err != nil {
+		os.Remove(blob)
+	}
+
+	return err
+}
+
+func readBlobJSON(blob string, v any) error {
+	dt, err := os.ReadFile(blob)
+	if err != nil {
+		return err
+	}
+
+	return json.Unmarshal(dt, v)
+}
+
+// exportBundle writes the images, their referrers and the version of pun in
+// a tarball, which is an OCI layout with the metadata of the bundle.
+func exportBundle(ctx context.Context, refs []string, output string) error {
+	dir, err := os.MkdirTemp(filepath.Dir(output), ".pun-bundle")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+
+	meta := BundleMeta{
+		Version: version,
+		Created: time.Now().UTC(),
+	}
+	var index ocispecs.Index
+	index.SchemaVersion = 2
+	index.MediaType = ocispecs.MediaTypeImageIndex
+	resolver := registryResolver()
+	for _, ref := range refs {
+		named, err := reference.ParseNormalizedNamed(ref)
+		if err != nil {
+			return fmt.Errorf("Invalid image reference %s: %w", ref, err)
+		}
+		named = reference.TagNameOnly(named)
+		name, desc, err := resolver.Resolve(ctx, named.String())
+		if err != nil {
+			return fmt.Errorf("Failed to resolve %s: %w", ref, err)
+		}
+		fetcher, err := resolver.Fetcher(ctx, name)
+		if err != nil {
+			return err
+		}
+		err = fetchTree(ctx, fetcher, desc, dir)
+		if err != nil {
+			return fmt.Errorf("Failed to export %s: %w", ref, err)
+		}
+		image := BundleImage{
+			Ref:    named.String(),
+			Digest: desc.Digest,
+		}
+		desc.Annotations = map[string]string{ocispecs.AnnotationRefName: image.Ref}
+		index.Manifests = append(index.Manifests, desc)
+
+		// The referrers are optional, most images have none
+		tag := named.Name() + ":" + referrersTag(desc.Digest)
+		_, refsDesc, err := resolver.Resolve(ctx, tag)
+		if err == nil {
+			err = fetchTree(ctx, fetcher, refsDesc, dir)
+			if err != nil {
+				return fmt.Errorf("Failed to export the referrers of %s: %w", ref, err)
+			}
+			image.Referrers = refsDesc.Digest
+			refsDesc.Annotations = map[string]string{ocispecs.AnnotationRefName: tag}
+			index.Manifests = append(index.Manifests, refsDesc)
+		} else if !errdefs.IsNotFound(err) {
+			return fmt.Errorf("Failed to resolve the referrers of %s: %w", ref, err)
+		}
+		meta.Images = append(meta.Images, image)
+		fmt.Fprintf(os.Stderr, "Exported %s\n", image.Ref)
+	}
+
+	files := map[string]any{
+		ocispecs.ImageLayoutFile: ocispecs.ImageLayout{Version: ocispecs.ImageLayoutVersion},
+		ocispecs.ImageIndexFile:  index,
+		bundleMetaFile:           meta,
+	}
+	for name, v := range files {
+		dt, err := json.MarshalIndent(v, "", "  ")
+		if err != nil {
+			return err
+		}
+		err = os.WriteFile(filepath.Join(dir, name), dt, 0644)
+		if err != nil {
+			return err
+		}
+	}
+	tmp := output + ".tmp"
+	err = createArchive(tmp, dir, nil)
+	if err != nil {
+		os.Remove(tmp)
+		return fmt.Errorf("Failed to write %s: %w", output, err)
+	}
+
+	return os.Rename(tmp, output)
+}
+
+// pushTree pushes the blob of desc after all the blobs that it refers to,
+// so that registries never see a manifest with missing blobs. Manifests are
+// pushed by digest, apart from the root, which gets pushed by ref.
+func pushTree(ctx context.Context, resolver remotes.Resolver, repo string, ref string, desc ocispecs.Descriptor,
+		dir string) error {
+	blob := layoutBlobPath(dir, desc.Digest)
+
+	var children []ocispecs.Descriptor
+	switch desc.MediaType {
+	case ocispecs.MediaTypeImageIndex, mediaTypeDockerList:
+		var index ocispecs.Index
+		err := readBlobJSON(blob, &index)
+		if err != nil {
+			return err
+		}
+		children = index.Manifests
+	case ocispecs.MediaTypeImageManifest, mediaTypeDockerManifest:
+		var manifest ocispecs.Manifest
+		err := readBlobJSON(blob, &manifest)
+		if err != nil {
+			return err
+		}
+		children = append([]ocispecs.Descriptor{manifest.Config}, manifest.Layers...)
+	}
+	for _, child := range children {
+		err := pushTree(ctx, resolver, repo, repo+"@"+child.Digest.String(), child, dir)
+		if err != nil {
+			return err
+		}
+	}
+
+	pusher, err := resolver.Pusher(ctx, ref)
+	if err != nil {
+		return err
+	}
+	w, err := pusher.Push(ctx, desc)
+	if errdefs.IsAlreadyExists(err) {
+		return nil
+	} else if err != nil {
+		return fmt.Errorf("Failed to push %s: %w", desc.Digest, err)
+	}
+	defer w.Close()
+	f, err := os.Open(blob)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = io.Copy(w, f)
+	if err != nil {
+		return fmt.Errorf("Failed to push %s: %w", desc.Digest, err)
+	}
+	err = w.Commit(ctx, desc.Size, desc.Digest)
+	if err != nil && !errdefs.IsAlreadyExists(err) {
+		return fmt.Errorf("Failed to push %s: %w", desc.Digest, err)
+	}
+
+	return nil
+}
+
+// importRef returns the reference to push an image of a bundle to, which is
+// the same repository under another registry, if one is given.
+func importRef(ref string, registry string) (reference.Named, error) {
+	named, err := reference.ParseNormalizedNamed(ref)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid image reference %s in the bundle: %w", ref, err)
+	}
+	if registry == "" {
+		return named, nil
+	}
+	renamed, err := reference.ParseNormalizedNamed(path.Join(registry, reference.Path(named)))
+	if err != nil {
+		return nil, fmt.Errorf("Invalid registry %s: %w", registry, err)
+	}
+	if tagged, ok := named.(reference.Tagged); ok {
+		return reference.WithTag(renamed, tagged.Tag())
+	}
+
+	return renamed, nil
+}
+
+// importBundle pushes the images of a bundle, along with their referrers.
+func importBundle(ctx context.Context, bundle string, registry string) error {
+	dir, err := os.MkdirTemp("", "pun-bundle-")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+	err = extractArchive(bundle, dir)
+	if err != nil {
+		return fmt.Errorf("Failed to extract %s: %w", bundle, err)
+	}
+	var meta BundleMeta
+	err = readBlobJSON(filepath.Join(dir, bundleMetaFile), &meta)
+	if errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("%s is not a bundle of pun", bundle)
+	} else if err != nil {
+		return fmt.Errorf("Invalid %s in %s: %w", bundleMetaFile, bundle, err)
+	}
+	var index ocispecs.Index
+	err = readBlobJSON(filepath.Join(dir, ocispecs.ImageIndexFile), &index)
+	if err != nil {
+		return fmt.Errorf("Invalid %s in %s: %w", ocispecs.ImageIndexFile, bundle, err)
+	}
+	descs := make(map[digest.Digest]ocispecs.Descriptor)
+	for _, desc := range index.Manifests {
+		descs[desc.Digest] = desc
+	}
+	fmt.Fprintf(os.Stderr, "Importing the bundle of pun %s, created at %s\n", meta.Version, meta.Created.Format(time.RFC3339))
+
+	resolver := registryResolver()
+	for _, image := range meta.Images {
+		named, err := importRef(image.Ref, registry)
+		if err != nil {
+			return err
+		}
+		desc, ok := descs[image.Digest]
+		if !ok {
+			return fmt.Errorf("The bundle has no %s for %s", image.Digest, image.Ref)
+		}
+		err = pushTree(ctx, resolver, named.Name(), named.String(), desc, dir)
+		if err != nil {
+			return fmt.Errorf("Failed to import %s: %w", image.Ref, err)
+		}
+		if image.Referrers != "" {
+			refsDesc, ok := descs[image.Referrers]
+			if !ok {
+				return fmt.Errorf("The bundle has no referrers %s for %s", image.Referrers, image.Ref)
+			}
+			tag := named.Name() + ":" + referrersTag(image.Digest)
+			err = pushTree(ctx, resolver, named.Name(), tag, refsDesc, dir)
+			if err != nil {
+				return fmt.Errorf("Failed to import the referrers of %s: %w", image.Ref, err)
+			}
+		}
+		fmt.Fprintf(os.Stderr, "Imported %s as %s\n", image.Ref, named.String())
+	}
+
+	return nil
+}
+
+func bundleMain(args []string) {
+	var output, registry string
+
+	if len(args) == 0 || (args[0] != bundleExportCmd && args[0] != bundleImportCmd) {
+		bundleUsage()
+		os.Exit(2)
+	}
+	fs := flag.NewFlagSet(bundleCmd, flag.ExitOnError)
+	fs.StringVar(&output, "output", "bundle.tar", "The tarball of the bundle")
+	fs.StringVar(&output, "o", "bundle.tar", "The tarball of the bundle")
+	fs.StringVar(&registry, "registry", "", "Push the images under this registry")
+	fs.Usage = bundleUsage
+	fs.Parse(args[1:])
+
+	var err error
+	ctx := appcontext.Context()
+	switch args[0] {
+	case bundleExportCmd:
+		if fs.NArg() == 0 {
+			bundleUsage()
+			os.Exit(2)
+		}
+		err = exportBundle(ctx, fs.Args(), output)
+	case bundleImportCmd:
+		if fs.NArg() != 1 {
+			bundleUsage()
+			os.Exit(2)
+		}
+		err = importBundle(ctx, fs.Arg(0), registry)
+	}
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,267 @@
+// Copyright (c) 2023-2024, Nubificus LTD
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"container/list"
+	"context"
+	"encoding/json"
+	"io"
+	"maps"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/containerd/platforms"
+	"github.com/distribution/reference"
+	"github.com/docker/cli/cli/config"
+	"github.com/moby/buildkit/client/llb"
+	"github.com/moby/buildkit/frontend/dockerfile/parser"
+	"github.com/moby/buildkit/frontend/gateway/client"
+	digest "github.com/opencontainers/go-digest"
+	ocispecs "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// baseCacheEntry is the result of a single base resolution. The done
+// channel gets closed as soon as the resolution finishes.
+type baseCacheEntry struct {
+	done     chan struct{}
+	image    *BaseImage
+	err      error
+	resolved time.Time
+}
+
+// baseCache keeps the resolved base images for the lifetime of the frontend
+// process. In that way, images or stages with the same base share a single
+// resolution, even if they get resolved concurrently.
+type baseCache struct {
+	mu      sync.Mutex
+	entries map[string]*baseCacheEntry
+	// How long a resolution stays valid, so that long-running processes
+	// see the tags that move. Zero means forever.
+	ttl     time.Duration
+	// Share the resolutions of registry bases only between the builds with
+	// the same credentials for the registry, as the builds of pun serve
+	scoped  bool
+}
+
+var resolvedBases = &baseCache{
+	entries: make(map[string]*baseCacheEntry),
+}
+
+// get returns the cached resolution of a base or it calls resolve to
+// resolve it. Concurrent calls for the same base wait for the first one,
+// until ctx is done.
+func (bc *baseCache) get(ctx context.Context, base string, platform ocispecs.Platform, mode llb.ResolveMode, resolve func() (*BaseImage, error)) (*BaseImage, error) {
+	key := base + "|" + platforms.Format(platform) + "|" + mode.String()
+
+	bc.mu.Lock()
+	entry, ok := bc.entries[key]
+	if ok && bc.expired(entry) {
+		ok = false
+	}
+	if !ok {
+		entry = &baseCacheEntry{done: make(chan struct{})}
+		bc.entries[key] = entry
+	}
+	bc.mu.Unlock()
+
+	if ok {
+		select {
+		case <-entry.done:
+			return entry.image, entry.err
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+
+	entry.image, entry.err = resolve()
+	entry.resolved = time.Now()
+	close(entry.done)
+	if entry.err != nil {
+		// Do not cache failures, a later attempt might succeed
+		bc.mu.Lock()
+		if bc.entries[key] == entry {
+			delete(bc.entries, key)
+		}
+		bc.mu.Unlock()
+	}
+
+	return entry.image, entry.err
+}
+
+// expired returns true if a finished resolution is older than the ttl of
+// the cache. The caller holds the lock of the cache.
+func (bc *baseCache) expired(entry *baseCacheEntry) bool {
+	if bc.ttl == 0 {
+		return false
+	}
+	select {
+	case <-entry.done:
+		return time.Since(entry.resolved) > bc.ttl
+	default:
+		return false
+	}
+}
+
+// baseCacheKey returns the key of a base in the cache, which is the base
+// that it points to in this build. Named contexts and local OCI layouts
+// depend on the client, so they can only be shared in the same build, while
+// shortnames are keyed by the image that they expand to. In a scoped cache,
+// the registry bases are also keyed by the credentials for their registry.
+func baseCacheKey(c client.Client, base string, aliases map[string]string) string {
+	bopts := c.BuildOpts()
+	if namedCtx, ok := bopts.Opts[clientOptContext+base]; ok {
+		base = namedCtx
+	}
+	if strings.HasPrefix(base, ociLayoutPrefix) {
+		return base + "|" + bopts.SessionID
+	}
+	base = aliasBase(base, aliases)
+	if !resolvedBases.scoped {
+		return base
+	}
+	scope, ok := credentialsScope(base)
+	if !ok {
+		scope = bopts.SessionID
+	}
+
+	return base + "|" + scope
+}
+
+// credentialsScope returns a digest of the credentials that pun has for the
+// registry of a base, which are the ones that the sessions of its builds
+// provide to buildkit.
+func credentialsScope(base string) (string, bool) {
+	named, err := reference.ParseNormalizedNamed(base)
+	if err != nil {
+		return "", false
+	}
+	host := reference.Domain(named)
+	if host == "docker.io" {
+		host = dockerHubConfigKey
+	}
+	auth, err := config.LoadDefaultConfigFile(io.Discard).GetAuthConfig(host)
+	if err != nil {
+		return "", false
+	}
+	dt, err := json.Marshal(auth)
+	if err != nil {
+		return "", false
+	}
+
+	return digest.FromBytes(dt).String(), true
+}
+
+// The number of parsed files that a process keeps
+const maxParsedSpecs int = 128
+
+// specCacheEntry is a parsed file in the cache.
+type specCacheEntry struct {
+	key digest.Digest
+	res *parser.Result
+}
+
+// specCache keeps the parsed files that the process used last, keyed by
+// their digest, so that every platform of a build, or the builds of the same
+// file in a long-running process, parse it only once. The least recently
+// used file goes away once the cache has max files.
+type specCache struct {
+	mu      sync.Mutex
+	entries map[digest.Digest]*list.Element
+	// The entries, from the most recently used
+	order   *list.List
+	max     int
+}
+
+var parsedSpecs = &specCache{
+	entries: make(map[digest.Digest]*list.Element),
+	order:   list.New(),
+	max:     maxParsedSpecs,
+}
+
+// lookup returns a parsed file of the cache, if it is there. The caller
+// holds the lock of the cache.
+func (sc *specCache) lookup(key digest.Digest) (*parser.Result, bool) {
+	elem, ok := sc.entries[key]
+	if !ok {
+		return nil, false
+	}
+	sc.order.MoveToFront(elem)
+
+	return elem.Value.(*specCacheEntry).res, true
+}
+
+// add adds a parsed file to the cache, removing the least recently used
+// one if the cache is full. The caller holds the lock of the cache.
+func (sc *specCache) add(key digest.Digest, res *parser.Result) {
+	if _, ok := sc.entries[key]; ok {
+		return
+	}
+	sc.entries[key] = sc.order.PushFront(&specCacheEntry{key: key, res: res})
+	for sc.order.Len() > sc.max {
+		oldest := sc.order.Back()
+		sc.order.Remove(oldest)
+		delete(sc.entries, oldest.Value.(*specCacheEntry).key)
+	}
+}
+
+// parse returns the AST of the file. Since the parsing of the instructions
+// changes the nodes, e.g. it removes the flags of pun, every call gets its
+// own copy.
+func (sc *specCache) parse(fileBytes []byte) (*parser.Result, error) {
+	key := digest.FromBytes(fileBytes)
+
+	sc.mu.Lock()
+	res, ok := sc.lookup(key)
+	sc.mu.Unlock()
+	if !ok {
+		var err error
+		res, err = parser.Parse(bytes.NewReader(fileBytes))
+		if err != nil {
+			return nil, err
+		}
+		sc.mu.Lock()
+		sc.add(key, res)
+		sc.mu.Unlock()
+	}
+
+	return &parser.Result{
+		AST:         cloneNode(res.AST),
+		EscapeToken: res.EscapeToken,
+		Warnings:    slices.Clone(res.Warnings),
+	}, nil
+}
+
+// cloneNode returns a deep copy of a node of the AST of a file.
+func cloneNode(n *parser.Node) *parser.Node {
+	if n == nil {
+		return nil
+	}
+	clone := *n
+	clone.Next = cloneNode(n.Next)
+	clone.Children = nil
+	for _, child := range n.Children {
+		clone.Children = append(clone.Children, cloneNode(child))
+	}
+	clone.Heredocs = slices.Clone(n.Heredocs)
+	clone.Attributes = maps.Clone(n.Attributes)
+	clone.Flags = slices.Clone(n.Flags)
+	clone.PrevComment = slices.Clone(n.PrevComment)
+
+	return &clone
+}
@@ -0,0 +1,315 @@
+// Copyright (c) 2023-2024, Nubificus LTD
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"text/tabwriter"
+	"time"
+
+	units "github.com/docker/go-units"
+	digest "github.com/opencontainers/go-digest"
+	ocispecs "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+const (
+	cacheCmd                string = "cache"
+	cacheDuCmd              string = "du"
+	cachePruneCmd           string = "prune"
+	// The default directory of the cache commands
+	cacheDirEnv             string = "PUN_CACHE_DIR"
+	mediaTypeDockerManifest string = "application/vnd.docker.distribution.manifest.v2+json"
+)
+
+// cacheBlob is a blob of the local build cache.
+type cacheBlob struct {
+	Digest  digest.Digest
+	Size    int64
+	ModTime time.Time
+	InUse   bool // Referenced by the last export of the cache
+}
+
+// CacheUsage is the disk usage of the local build cache of --cache-dir,
+// which is an OCI layout. Every export of buildkit replaces its index, but
+// the blobs of the previous exports stay in the layout, so the cache only
+// grows, unless it gets pruned.
+type CacheUsage struct {
+	Dir      string
+	Exported time.Time // The time of the last export, zero if none
+	Blobs    []cacheBlob
+}
+
+// markInUse marks desc and the blobs that it references, if it is an index
+// or a manifest, as in use.
+func (l *ociLayout) markInUse(desc ocispecs.Descriptor, inUse map[digest.Digest]bool) error {
+	if inUse[desc.Digest] {
+		return nil
+	}
+	inUse[desc.Digest] = true
+	switch desc.MediaType {
+	case ocispecs.MediaTypeImageIndex, mediaTypeDockerList,
+			ocispecs.MediaTypeImageManifest, mediaTypeDockerManifest:
+	default:
+		return nil
+	}
+
+	// Indexes have manifests, while manifests have a config and layers
+	var children struct {
+		Manifests []ocispecs.Descriptor `json:"manifests"`
+		Config    *ocispecs.Descriptor  `json:"config"`
+		Layers    []ocispecs.Descriptor `json:"layers"`
+	}
+	err := l.readJSON(desc, &children)
+	if err != nil {
+		return fmt.Errorf("Failed to read %s: %w", desc.Digest, err)
+	}
+	descs := append(children.Manifests, children.Layers...)
+	if children.Config != nil {
+		descs = append(descs, *children.Config)
+	}
+	for _, d := range descs {
+		err = l.markInUse(d, inUse)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// readCacheUsage reads the blobs of the cache in dir, from the oldest to
+// the newest, and finds the ones that its index references.
+func readCacheUsage(dir string) (*CacheUsage, error) {
+	u := &CacheUsage{Dir: dir}
+	l := &ociLayout{dir: dir}
+
+	inUse := make(map[digest.Digest]bool)
+	indexPath := filepath.Join(dir, ocispecs.ImageIndexFile)
+	dt, err := os.ReadFile(indexPath)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	if err == nil {
+		var index ocispecs.Index
+		err = json.Unmarshal(dt, &index)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid %s in %s: %w", ocispecs.ImageIndexFile, dir, err)
+		}
+		for _, m := range index.Manifests {
+			err = l.markInUse(m, inUse)
+			if err != nil {
+				return nil, err
+			}
+		}
+		st, err := os.Stat(indexPath)
+		if err != nil {
+			return nil, err
+		}
+		u.Exported = st.ModTime()
+	}
+
+	blobsDir := filepath.Join(dir, "blobs")
+	err = filepath.WalkDir(blobsDir, func(p string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		dgst := digest.NewDigestFromEncoded(digest.Algorithm(filepath.Base(filepath.Dir(p))), d.Name())
+		u.Blobs = append(u.Blobs, cacheBlob{
+			Digest:  dgst,
+			Size:    info.Size(),
+			ModTime: info.ModTime(),
+			InUse:   inUse[dgst],
+		})
+		return nil
+	})
+	if err != nil && !os.IsNotExist(err) {
+		return nil, fmt.Errorf("Failed to read the blobs of %s: %w", dir, err)
+	}
+	sort.Slice(u.Blobs, func(i, j int) bool {
+		return u.Blobs[i].ModTime.Before(u.Blobs[j].ModTime)
+	})
+
+	return u, nil
+}
+
+// size returns the size of the blobs of the cache and the size of the ones
+// which are not in use.
+func (u *CacheUsage) size() (int64, int64) {
+	var total, reclaimable int64
+	for _, b := range u.Blobs {
+		total += b.Size
+		if !b.InUse {
+			reclaimable += b.Size
+		}
+	}
+
+	return total, reclaimable
+}
+
+// CachePrunePolicy decides which blobs of the cache get removed, as the
+// options of buildctl prune.
+type CachePrunePolicy struct {
+	All          bool          // Remove the whole cache
+	KeepDuration time.Duration // Keep the blobs newer than that
+	KeepStorage  int64         // The maximum size of the cache, if not 0
+}
+
+// prune removes the blobs of the cache that the policy does not keep and
+// returns the removed blobs. The blobs that are not in use get removed,
+// unless they are newer than KeepDuration, since a build might be writing
+// them. The blobs in use can not be removed one by one, since the cache
+// would then miss them, so they only get removed along with the whole
+// cache, if it was exported before KeepDuration or it is still larger than
+// KeepStorage.
+func (u *CacheUsage) prune(policy CachePrunePolicy) ([]cacheBlob, error) {
+	now := time.Now()
+	keep := func(t time.Time) bool {
+		return policy.KeepDuration > 0 && now.Sub(t) < policy.KeepDuration
+	}
+
+	var removed, kept []cacheBlob
+	var keptSize int64
+	for _, b := range u.Blobs {
+		if policy.All || (!b.InUse && !keep(b.ModTime)) {
+			removed = append(removed, b)
+			continue
+		}
+		kept = append(kept, b)
+		keptSize += b.Size
+	}
+	expired := policy.KeepDuration > 0 && !u.Exported.IsZero() && !keep(u.Exported)
+	removeAll := policy.All || expired ||
+			(policy.KeepStorage > 0 && keptSize > policy.KeepStorage)
+	if removeAll && !policy.All {
+		for _, b := range kept {
+			if b.InUse {
+				removed = append(removed, b)
+			}
+		}
+	}
+
+	l := &ociLayout{dir: u.Dir}
+	if removeAll {
+		// Remove the index first, so that a failure does not leave
+		// the cache referencing missing blobs
+		err := os.Remove(filepath.Join(u.Dir, ocispecs.ImageIndexFile))
+		if err != nil && !os.IsNotExist(err) {
+			return nil, err
+		}
+	}
+	for _, b := range removed {
+		err := os.Remove(l.blobPath(b.Digest))
+		if err != nil && !os.IsNotExist(err) {
+			return nil, err
+		}
+	}
+
+	return removed, nil
+}
+
+func cacheUsage() {
+	fmt.Println("Usage of pun cache")
+	fmt.Printf("%s %s %s [<args>]\n", os.Args[0], cacheCmd, cacheDuCmd)
+	fmt.Printf("%s %s %s [<args>]\n\n", os.Args[0], cacheCmd, cachePruneCmd)
+	fmt.Println("Supported command line arguments")
+	fmt.Println("\t--cache-dir path \t\tThe local build cache of pun build (default $" + cacheDirEnv + ")")
+	fmt.Println("\t--verbose bool \t\t\tList the blobs of the cache (du)")
+	fmt.Println("\t--all bool \t\t\tRemove the whole cache (prune)")
+	fmt.Println("\t--keep-duration duration \tKeep the blobs newer than that, e.g. 24h (prune)")
+	fmt.Println("\t--keep-storage size \t\tThe maximum size of the cache, e.g. 10GB (prune)")
+}
+
+// cacheMain shows the disk usage of the local build cache of pun build or
+// prunes it, as buildctl du and buildctl prune do for buildkitd.
+func cacheMain(args []string) {
+	var dir, keepStorage string
+	var verbose bool
+	var policy CachePrunePolicy
+
+	if len(args) == 0 || (args[0] != cacheDuCmd && args[0] != cachePruneCmd) {
+		cacheUsage()
+		os.Exit(2)
+	}
+	fs := flag.NewFlagSet(cacheCmd, flag.ExitOnError)
+	fs.StringVar(&dir, "cache-dir", os.Getenv(cacheDirEnv), "The local build cache of pun build")
+	fs.BoolVar(&verbose, "verbose", false, "List the blobs of the cache")
+	fs.BoolVar(&policy.All, "all", false, "Remove the whole cache")
+	fs.DurationVar(&policy.KeepDuration, "keep-duration", 0, "Keep the blobs newer than that")
+	fs.StringVar(&keepStorage, "keep-storage", "", "The maximum size of the cache")
+	fs.Usage = cacheUsage
+	fs.Parse(args[1:])
+
+	if dir == "" {
+		fmt.Printf("Please specify the cache directory with --cache-dir or $%s\n", cacheDirEnv)
+		os.Exit(1)
+	}
+	if keepStorage != "" {
+		size, err := units.FromHumanSize(keepStorage)
+		if err != nil {
+			fmt.Printf("Invalid --keep-storage %s: %v\n", keepStorage, err)
+			os.Exit(1)
+		}
+		policy.KeepStorage = size
+	}
+	u, err := readCacheUsage(dir)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+
+	if args[0] == cachePruneCmd {
+		removed, err := u.prune(policy)
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		var size int64
+		for _, b := range removed {
+			size += b.Size
+		}
+		fmt.Printf("Removed %d blobs, total: %s\n", len(removed), units.HumanSize(float64(size)))
+		return
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	if verbose {
+		fmt.Fprintln(w, "DIGEST\tSIZE\tMODIFIED\tIN USE")
+		for _, b := range u.Blobs {
+			fmt.Fprintf(w, "%s\t%s\t%s\t%t\n", b.Digest, units.HumanSize(float64(b.Size)),
+					units.HumanDuration(time.Since(b.ModTime))+" ago", b.InUse)
+		}
+		fmt.Fprintln(w)
+	}
+	total, reclaimable := u.size()
+	exported := "never"
+	if !u.Exported.IsZero() {
+		exported = units.HumanDuration(time.Since(u.Exported)) + " ago"
+	}
+	fmt.Fprintf(w, "Blobs:\t%d\n", len(u.Blobs))
+	fmt.Fprintf(w, "Total:\t%s\n", units.HumanSize(float64(total)))
+	fmt.Fprintf(w, "Reclaimable:\t%s\n", units.HumanSize(float64(reclaimable)))
+	fmt.Fprintf(w, "Last export:\t%s\n", exported)
+	w.Flush()
+}
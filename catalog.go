@@ -0,0 +1,225 @@
+// Copyright (c) 2023-2024, Nubificus LTD
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/containerd/containerd/remotes"
+	"github.com/distribution/reference"
+	"github.com/moby/buildkit/util/appcontext"
+	ocispecs "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+const (
+	catalogCmd      string = "catalog"
+	catalogBuildCmd string = "build"
+)
+
+// CatalogImage is the kernel image of an application of the Unikraft
+// catalog, which was selected for a hypervisor and an architecture.
+type CatalogImage struct {
+	Ref      string            // The shortname of the application, pinned to the manifest
+	Platform ocispecs.Platform // The platform of the kernel image
+	Cmdline  string            // The command line of the application
+}
+
+func catalogUsage() {
+	fmt.Println("Usage of pun catalog")
+	fmt.Printf("%s %s %s <app>:<tag> [<args>]\n\n", os.Args[0], catalogCmd, catalogBuildCmd)
+	fmt.Println("Supported command line arguments")
+	fmt.Println("\t--hypervisor name \t\tThe hypervisor to run the unikernel on (default qemu)")
+	fmt.Println("\t--arch name \t\t\tThe architecture of the unikernel (default amd64)")
+	buildFlagsUsage()
+}
+
+// catalogRef returns the reference of an application of the catalog, e.g.
+// unikraft.org/nginx:1.25 for nginx:1.25. Applications of the community
+// catalog are given with their full name, e.g. unikraft.io/<org>/<app>.
+func catalogRef(app string) string {
+	if strings.Contains(app, "/") {
+		return app
+	}
+
+	return unikraftHub + "/" + app
+}
+
+// selectCatalogImage fetches the index of an application of the catalog and
+// selects the kernel image of a Unikraft platform that the hypervisor can
+// boot, for the architecture.
+func selectCatalogImage(ctx context.Context, app string, hypervisor string, arch string) (*CatalogImage, error) {
+	ref := catalogRef(app)
+	named, err := reference.ParseNormalizedNamed(ref)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid application %s: %w", app, err)
+	}
+	named = reference.TagNameOnly(named)
+
+	resolver := registryResolver()
+	pullRef := aliasBase(named.String(), defaultAliases())
+	name, desc, err := resolver.Resolve(ctx, pullRef)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to resolve %s: %w", ref, err)
+	}
+	fetcher, err := resolver.Fetcher(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+	var manifests []ocispecs.Descriptor
+	switch desc.MediaType {
+	case ocispecs.MediaTypeImageIndex, mediaTypeDockerList:
+		var index ocispecs.Index
+		err = fetchJSON(ctx, fetcher, desc, &index)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to fetch index of %s: %w", ref, err)
+		}
+		manifests = index.Manifests
+	case ocispecs.MediaTypeImageManifest, mediaTypeDockerManifest:
+		// Registries that re-serve the catalog as docker schema2 manifests
+		// have a single kernel image, whose platform is in its config
+		manifests = []ocispecs.Descriptor{desc}
+	default:
+		return nil, fmt.Errorf("%s is not a catalog application, its media type is %s", ref, desc.MediaType)
+	}
+
+	var available []string
+	for _, m := range manifests {
+		var manifest ocispecs.Manifest
+		var config ocispecs.Image
+		if m.Platform == nil {
+			err = fetchCatalogConfig(ctx, fetcher, m, &manifest, &config)
+			if err != nil {
+				return nil, fmt.Errorf("Failed to fetch %s: %w", ref, err)
+			}
+			m.Platform = &config.Platform
+		}
+		if m.Platform.OS == "unknown" {
+			continue
+		}
+		available = append(available, m.Platform.OS+"/"+m.Platform.Architecture)
+		// Docker images are for linux, which says nothing about the kernel
+		hypervisors, known := unikraftPlatHypervisors[m.Platform.OS]
+		if (known && !slices.Contains(hypervisors, hypervisor)) || m.Platform.Architecture != arch {
+			continue
+		}
+
+		if manifest.Config.Digest == "" {
+			err = fetchCatalogConfig(ctx, fetcher, m, &manifest, &config)
+			if err != nil {
+				return nil, fmt.Errorf("Failed to fetch %s: %w", ref, err)
+			}
+		}
+		pinned, err := reference.WithDigest(named, m.Digest)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to pin %s to digest %s: %w", ref, m.Digest, err)
+		}
+		return &CatalogImage{
+			Ref:      reference.FamiliarString(pinned),
+			Platform: *m.Platform,
+			Cmdline:  strings.Join(append(config.Config.Entrypoint, config.Config.Cmd...), " "),
+		}, nil
+	}
+
+	return nil, fmt.Errorf("%s has no kernel for %s on %s, available platforms: %s", ref, hypervisor, arch,
+			strings.Join(available, ", "))
+}
+
+// fetchCatalogConfig fetches the manifest of a kernel image and its config.
+func fetchCatalogConfig(ctx context.Context, fetcher remotes.Fetcher, desc ocispecs.Descriptor,
+		manifest *ocispecs.Manifest, config *ocispecs.Image) error {
+	err := fetchJSON(ctx, fetcher, desc, manifest)
+	if err != nil {
+		return fmt.Errorf("Failed to fetch manifest %s: %w", desc.Digest, err)
+	}
+	err = fetchJSON(ctx, fetcher, manifest.Config, config)
+	if err != nil {
+		return fmt.Errorf("Failed to fetch config %s: %w", manifest.Config.Digest, err)
+	}
+
+	return nil
+}
+
+// catalogSpec generates the Containerfile that packs the kernel image of a
+// catalog application for urunc.
+func catalogSpec(img *CatalogImage, hypervisor string) string {
+	var b strings.Builder
+
+	fmt.Fprintf(&b, "FROM --platform=%s/%s %s\n", img.Platform.OS, img.Platform.Architecture, img.Ref)
+	fmt.Fprintf(&b, "LABEL %s=%s\n", uruncUnikernelType, strconv.Quote("unikraft"))
+	fmt.Fprintf(&b, "LABEL %s=%s\n", uruncHypervisorAnnot, strconv.Quote(hypervisor))
+	fmt.Fprintf(&b, "LABEL %s=%s\n", uruncBinaryAnnot, strconv.Quote(unikraftKernelPath))
+	if img.Cmdline != "" {
+		fmt.Fprintf(&b, "LABEL %s=%s\n", uruncCmdlineAnnot, strconv.Quote(img.Cmdline))
+	}
+
+	return b.String()
+}
+
+// catalogBuild packs an application of the catalog without a Containerfile,
+// by generating one in an empty build context.
+func catalogBuild(ctx context.Context, app string, hypervisor string, arch string, opts BuildCLIOpts) error {
+	img, err := selectCatalogImage(ctx, app, hypervisor, arch)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(os.Stderr, "Packing %s for %s\n", img.Ref, hypervisor)
+
+	dir, err := os.MkdirTemp("", "pun-catalog-")
+	if err != nil {
+		return fmt.Errorf("Failed to create the build context: %w", err)
+	}
+	defer os.RemoveAll(dir)
+	opts.ContextDir = dir
+	opts.ContainerFile = filepath.Join(dir, defaultContainerFile)
+	err = os.WriteFile(opts.ContainerFile, []byte(catalogSpec(img, hypervisor)), 0644)
+	if err != nil {
+		return fmt.Errorf("Failed to write the Containerfile: %w", err)
+	}
+
+	return standaloneBuild(ctx, opts)
+}
+
+func catalogMain(args []string) {
+	var opts BuildCLIOpts
+	var hypervisor, arch string
+
+	if len(args) < 2 || args[0] != catalogBuildCmd || strings.HasPrefix(args[1], "-") {
+		catalogUsage()
+		os.Exit(2)
+	}
+	fs := flag.NewFlagSet(catalogCmd, flag.ExitOnError)
+	fs.StringVar(&hypervisor, "hypervisor", "qemu", "The hypervisor to run the unikernel on")
+	fs.StringVar(&arch, "arch", "amd64", "The architecture of the unikernel")
+	addBuildFlags(fs, &opts)
+	fs.Usage = catalogUsage
+	fs.Parse(args[2:])
+	if fs.NArg() > 0 {
+		fmt.Println("pun catalog build does not take a build context")
+		os.Exit(2)
+	}
+
+	err := catalogBuild(appcontext.Context(), args[1], hypervisor, arch, opts)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+}
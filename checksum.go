@@ -0,0 +1,141 @@
+// Copyright (c) 2023-2024, Nubificus LTD
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+
+	"github.com/moby/buildkit/client/llb"
+	"github.com/moby/buildkit/frontend/gateway/client"
+	digest "github.com/opencontainers/go-digest"
+)
+
+const (
+	clientOptChecksums string = "checksums"
+	// The files of the image are read in chunks of that size, since block
+	// images might not fit in memory
+	checksumChunkSize  int    = 4 << 20
+)
+
+// checksumAnnots are the annotations with the sha256 digests of the
+// artifacts, keyed by the annotations with the paths of the artifacts.
+var checksumAnnots = map[string]string{
+	uruncBinaryAnnot: "com.urunc.unikernel.binaryDigest",
+	uruncInitrdAnnot: "com.urunc.unikernel.initrdDigest",
+	uruncBlockAnnot:  "com.urunc.unikernel.blockDigest",
+}
+
+// checksumsFromBuildOpts returns true if the digests of the artifacts need
+// to be recorded.
+func checksumsFromBuildOpts(opts map[string]string) (bool, error) {
+	val := opts[clientOptChecksums]
+	if val == "" {
+		return false, nil
+	}
+	b, err := strconv.ParseBool(val)
+	if err != nil {
+		return false, fmt.Errorf("Invalid %s %s, expected a boolean", clientOptChecksums, val)
+	}
+
+	return b, nil
+}
+
+// artifactDigest returns the sha256 digest of a file of the packed image.
+func artifactDigest(ctx context.Context, ref client.Reference, p string) (digest.Digest, error) {
+	size, err := artifactSize(ctx, ref, p)
+	if err != nil {
+		return "", err
+	}
+
+	digester := digest.SHA256.Digester()
+	for offset := 0; offset < int(size); offset += checksumChunkSize {
+		dt, err := ref.ReadFile(ctx, client.ReadRequest{
+			Filename: p,
+			Range: &client.FileRange{
+				Offset: offset,
+				Length: checksumChunkSize,
+			},
+		})
+		if err != nil {
+			return "", fmt.Errorf("Failed to read %s: %w", p, err)
+		}
+		digester.Hash().Write(dt)
+	}
+
+	return digester.Digest(), nil
+}
+
+// addChecksums records the sha256 digests of the kernel, the initrd and the
+// block image of the packed image in the annotations of the target and in
+// urunc.json, returning the reference of the image with the new urunc.json.
+func addChecksums(ctx context.Context, c client.Client, instr *PackInstructions,
+		ref client.Reference, opts LLBOpts) (client.Reference, error) {
+	found := false
+	for annot, digestAnnot := range checksumAnnots {
+		p, ok := instr.Annots[annot]
+		if !ok {
+			continue
+		}
+		dgst, err := artifactDigest(ctx, ref, p)
+		if err != nil {
+			return nil, err
+		}
+		instr.Annots[digestAnnot] = dgst.String()
+		found = true
+	}
+	if !found {
+		return ref, nil
+	}
+
+	// Replace urunc.json, which was created before the digests were known
+	ref, err := replaceUruncJSON(ctx, c, instr, ref, opts, "the digests of the artifacts")
+	if err != nil {
+		return nil, err
+	}
+	instr.addHistory("pun: add the digests in " + opts.UruncJSONPath)
+
+	return ref, nil
+}
+
+// replaceUruncJSON writes the urunc.json of the annotations of the target in
+// the image of ref, after a step that added annotations. what describes the
+// new annotations.
+func replaceUruncJSON(ctx context.Context, c client.Client, instr *PackInstructions,
+		ref client.Reference, opts LLBOpts, what string) (client.Reference, error) {
+	uruncJSONBytes, err := uruncJSON(instr)
+	if err != nil {
+		return nil, err
+	}
+	base, err := ref.ToState()
+	if err != nil {
+		return nil, err
+	}
+	base = base.File(llb.Mkfile(opts.UruncJSONPath, 0644, uruncJSONBytes, uruncJSONOpts(opts)...),
+			llb.WithCustomName("Add "+what+" in urunc.json"))
+	dt, err := base.Marshal(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to marshal LLB state: %w", err)
+	}
+	res, err := c.Solve(ctx, client.SolveRequest{
+		Definition: dt.ToPB(),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("Failed to add %s in urunc.json: %w", what, err)
+	}
+
+	return res.SingleRef()
+}
@@ -0,0 +1,95 @@
+// Copyright (c) 2023-2024, Nubificus LTD
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+// Config is the configuration file of pun
+type Config struct {
+	// Registries (or repository prefixes) of unikernel images mapped to
+	// the platform we should use to pull them (e.g. "qemu" or "qemu/arm64")
+	Hubs map[string]string `json:"hubs"`
+	// Shortnames of registries (or repository prefixes) mapped to the
+	// repository prefixes that their images get pulled from
+	Aliases map[string]string `json:"aliases"`
+	// The experimental features to enable, or all of them with "all"
+	Features []string `json:"features"`
+	// The lint rules mapped to their severities, or off to disable them
+	Lint map[string]string `json:"lint"`
+	// The lint plugins mapped to their command lines
+	LintPlugins map[string][]string `json:"lintPlugins"`
+}
+
+// loadConfig reads the JSON configuration file of pun
+func loadConfig(path string) (*Config, error) {
+	var config Config
+
+	content, err := readLocalFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to read config %s: %w", path, err)
+	}
+	err = json.Unmarshal(content, &config)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to parse config %s: %w", path, err)
+	}
+
+	return &config, nil
+}
+
+// apply overrides the LLB options with the ones in the configuration.
+func (config *Config) apply(opts *LLBOpts) error {
+	for hub, platform := range config.Hubs {
+		_, err := hubPlatform(platform, opts.Platform)
+		if err != nil {
+			return fmt.Errorf("Invalid platform for %s: %w", hub, err)
+		}
+		opts.Hubs[hub] = platform
+	}
+	for alias, target := range config.Aliases {
+		err := validateAlias(alias, target)
+		if err != nil {
+			return err
+		}
+		opts.Aliases[alias] = target
+	}
+	err := parseFeatures(opts.Features, config.Features)
+	if err != nil {
+		return fmt.Errorf("Invalid features: %w", err)
+	}
+
+	return nil
+}
+
+// buildOpts returns the build options of the frontend that carry the
+// configuration, for the builds that pun sends to buildkit.
+func (config *Config) buildOpts() map[string]string {
+	opts := make(map[string]string)
+
+	for hub, platform := range config.Hubs {
+		opts[clientOptHub+hub] = platform
+	}
+	for alias, target := range config.Aliases {
+		opts[clientOptAlias+alias] = target
+	}
+	if len(config.Features) > 0 {
+		opts[clientOptExperimental] = strings.Join(config.Features, ",")
+	}
+
+	return opts
+}
@@ -0,0 +1,100 @@
+// Copyright (c) 2023-2024, Nubificus LTD
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	bkclient "github.com/moby/buildkit/client"
+	"github.com/moby/buildkit/worker/label"
+)
+
+const (
+	containerdNamespaceEnv     string = "CONTAINERD_NAMESPACE"
+	defaultContainerdNamespace string = "default"
+	// The output that stores the image in the image store of containerd
+	exporterContainerd         string = "containerd"
+	buildkitdSocket            string = "buildkitd.sock"
+)
+
+// containerdNamespace returns the namespace of containerd, as nerdctl does.
+func containerdNamespace() string {
+	if ns := os.Getenv(containerdNamespaceEnv); ns != "" {
+		return ns
+	}
+
+	return defaultContainerdNamespace
+}
+
+// nerdctlBuildkitAddr returns the address of the buildkitd of nerdctl for a
+// namespace of containerd, or an empty string if there is none. As in
+// nerdctl, the buildkitd of the namespace is preferred to the one of the
+// default namespace and to the plain one, while rootless users have their
+// sockets in $XDG_RUNTIME_DIR.
+func nerdctlBuildkitAddr(namespace string) string {
+	runDir := "/run"
+	if os.Geteuid() != 0 {
+		runDir = os.Getenv("XDG_RUNTIME_DIR")
+		if runDir == "" {
+			return ""
+		}
+	}
+	dirs := []string{"buildkit-" + namespace, "buildkit-" + defaultContainerdNamespace, "buildkit"}
+	for _, dir := range dirs {
+		socket := filepath.Join(runDir, dir, buildkitdSocket)
+		if _, err := os.Stat(socket); err == nil {
+			return "unix://" + socket
+		}
+	}
+
+	return ""
+}
+
+// hasContainerdOutput returns true if the build stores the image in the
+// image store of containerd.
+func hasContainerdOutput(outputs []string) bool {
+	for _, output := range outputs {
+		attrs, err := parseCSVAttrs("output", output)
+		if err == nil && attrs["type"] == exporterContainerd {
+			return true
+		}
+	}
+
+	return false
+}
+
+// checkContainerdWorker checks that buildkitd stores its images in the
+// given namespace of containerd, since the image output of buildkitd stores
+// the images in the namespace of its containerd worker, if it has one.
+func checkContainerdWorker(ctx context.Context, c *bkclient.Client, namespace string) error {
+	workers, err := c.ListWorkers(ctx)
+	if err != nil {
+		return fmt.Errorf("Failed to list the workers of buildkitd: %w", err)
+	}
+	for _, w := range workers {
+		if w.Labels[label.Executor] != "containerd" {
+			continue
+		}
+		if ns := w.Labels[label.ContainerdNamespace]; ns != namespace {
+			return fmt.Errorf("buildkitd stores the images in the containerd namespace %s, instead of %s", ns, namespace)
+		}
+		return nil
+	}
+
+	return fmt.Errorf("buildkitd has no containerd worker, use an oci or docker output and load it with nerdctl")
+}
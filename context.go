@@ -0,0 +1,255 @@
+// Copyright (c) 2023-2024, Nubificus LTD
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"path"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+
+	"github.com/moby/buildkit/client/llb"
+	"github.com/moby/buildkit/frontend/dockerfile/instructions"
+	"github.com/moby/buildkit/frontend/gateway/client"
+	"github.com/moby/buildkit/util/gitutil"
+)
+
+// contextState returns the LLB state of the build context. If ref is empty,
+// the context is the local directory that the client sends. Otherwise, ref
+// should be a git URL (e.g. https://github.com/org/repo.git#branch:subdir)
+// and the context will get fetched from that repository.
+//
+// If paths is not empty, only these paths will get transferred from the
+// local context, instead of the whole directory.
+func contextState(ref string, opts LLBOpts, paths []string) (llb.State, error) {
+	if ref == "" {
+		var localOpts []llb.LocalOption
+		if len(paths) > 0 {
+			localOpts = append(localOpts, llb.FollowPaths(paths))
+		}
+		localOpts = append(localOpts, llb.SharedKeyHint(opts.ContextName))
+		return llb.Local(opts.ContextName, localOpts...), nil
+	}
+
+	gitRef, err := gitutil.ParseGitRef(ref)
+	if err != nil {
+		return llb.Scratch(), fmt.Errorf("Unsupported build context %s: %w", ref, err)
+	}
+	commit := gitRef.Commit
+	if gitRef.SubDir != "" {
+		commit += ":" + gitRef.SubDir
+	}
+
+	return llb.Git(gitRef.Remote, commit,
+			llb.WithCustomName("[internal] load git source " + ref)), nil
+}
+
+// ContextSource is a source of an instruction in the build context.
+type ContextSource struct {
+	Cmd  string // The instruction, e.g. COPY
+	Path string // The path of the source, as written in the file
+}
+
+// contextSources returns the sources of the COPY, ADD and SEED instructions
+// of the images in the build context.
+func contextSources(images []*PackInstructions) []ContextSource {
+	var sources []ContextSource
+	for _, instr := range images {
+		for _, cmd := range instr.Copies {
+			switch c := cmd.(type) {
+			case *instructions.CopyCommand:
+				if c.From != "" {
+					continue
+				}
+				for _, src := range c.SourcePaths {
+					sources = append(sources, ContextSource{Cmd: "COPY", Path: src})
+				}
+			case *instructions.AddCommand:
+				for _, src := range c.SourcePaths {
+					if isRemoteSrc(src) {
+						continue
+					}
+					sources = append(sources, ContextSource{Cmd: "ADD", Path: src})
+				}
+			case *SeedCommand:
+				for _, src := range c.sources() {
+					sources = append(sources, ContextSource{Cmd: "SEED", Path: src})
+				}
+			}
+		}
+	}
+
+	return sources
+}
+
+// contextPaths returns the paths of the build context that the images use
+// in COPY, ADD and SEED instructions. If any image needs the whole context,
+// no paths are returned.
+func contextPaths(images []*PackInstructions) []string {
+	seen := make(map[string]bool)
+	var paths []string
+
+	for _, src := range contextSources(images) {
+		p := path.Join("/", filepath.ToSlash(src.Path))
+		if p == "/" {
+			return nil
+		}
+		if !seen[p] {
+			seen[p] = true
+			paths = append(paths, path.Join(".", p))
+		}
+	}
+	sort.Strings(paths)
+
+	return paths
+}
+
+// fromPaths returns the paths that the COPY instructions of the image copy
+// from the same image or stage as c, with the same handling of symlinks, or
+// nil if one of them needs all of its files.
+func fromPaths(c *instructions.CopyCommand, instr *PackInstructions, images []*PackInstructions) []string {
+	dep := findImage(images, instr, c.From)
+	follow := instr.CopyFlags[c].FollowSymlinks
+	var paths []string
+
+	for _, cmd := range instr.Copies {
+		other, ok := cmd.(*instructions.CopyCommand)
+		// The TLS material only gets copied in the target
+		if !ok || other.From == "" || instr.CopyFlags[other].TLS || instr.CopyFlags[other].FollowSymlinks != follow {
+			continue
+		}
+		if dep != nil && findImage(images, instr, other.From) != dep {
+			continue
+		} else if dep == nil && other.From != c.From {
+			continue
+		}
+		p := path.Join("/", other.SourcePaths[0])
+		if p == "/" || hasWildcards(path.Dir(p)) {
+			return nil
+		}
+		if !slices.Contains(paths, p) {
+			paths = append(paths, p)
+		}
+	}
+	sort.Strings(paths)
+
+	// A copied directory already has all of its paths
+	var pruned []string
+	for _, p := range paths {
+		covered := false
+		for _, dir := range pruned {
+			covered = covered || (!hasWildcards(dir) && strings.HasPrefix(p, dir+"/"))
+		}
+		if !covered {
+			pruned = append(pruned, p)
+		}
+	}
+
+	return pruned
+}
+
+// prunedFrom returns a scratch state with only the given paths of from, in
+// the same places, so that the copies of an image from another image or
+// stage depend on the files that they copy and not on all of its files,
+// e.g. a kernel of a toolchain image. The state is the same for all the
+// copies of the image from the same source, so it only gets created once.
+func prunedFrom(from llb.State, paths []string, follow bool) llb.State {
+	var action *llb.FileAction
+
+	for _, p := range paths {
+		// Copy into the parent, so that the copies never nest
+		dir := path.Dir(p)
+		if dir != "/" {
+			dir += "/"
+		}
+		info := &llb.CopyInfo{
+			CreateDestPath:     true,
+			FollowSymlinks:     follow,
+			AllowWildcard:      hasWildcards(p),
+			// The copy of the image reports the sources that match nothing
+			AllowEmptyWildcard: true,
+		}
+		if action == nil {
+			action = llb.Copy(from, p, dir, info)
+		} else {
+			action = action.Copy(from, p, dir, info)
+		}
+	}
+
+	return llb.Scratch().File(action, llb.WithCustomName("[internal] select "+strings.Join(paths, " ")))
+}
+
+// checkContextSources fails if a source of the images is missing from the
+// build context, so that the build fails before the main solve with the
+// path of the source, instead of a cryptic error of the file op. It returns
+// the matches of the sources with wildcards, which can not match nothing
+// either.
+func checkContextSources(ctx context.Context, ref client.Reference, images []*PackInstructions) ([]ReportGlob, error) {
+	var globs []ReportGlob
+	for _, src := range contextSources(images) {
+		p := path.Join("/", filepath.ToSlash(src.Path))
+		if p == "/" {
+			continue
+		}
+		found := false
+		if hasWildcards(p) {
+			matches, err := expandGlob(ctx, ref, p)
+			if err != nil {
+				return nil, err
+			}
+			globs = append(globs, ReportGlob{Cmd: src.Cmd, Pattern: src.Path, Matches: matches})
+			found = len(matches) > 0
+		} else {
+			var err error
+			found, err = fileExists(ctx, ref, p)
+			if err != nil {
+				return nil, err
+			}
+		}
+		if !found {
+			return nil, fmt.Errorf("%s source %s not found in context", src.Cmd, src.Path)
+		}
+	}
+
+	return globs, nil
+}
+
+// prefetchContext solves the state of the build context on its own, so the
+// transfer of the context can start before the main solve. The main solve
+// will then reuse the result of the transfer. The sources of the images get
+// checked against the transferred context, returning the matches of their
+// wildcards.
+func prefetchContext(ctx context.Context, c client.Client, buildCtx llb.State, images []*PackInstructions) ([]ReportGlob, error) {
+	def, err := buildCtx.Marshal(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to marshal state of build context: %w", err)
+	}
+	res, err := c.Solve(ctx, client.SolveRequest{
+		Definition: def.ToPB(),
+		Evaluate:   true,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("Failed to transfer build context: %w", err)
+	}
+	ref, err := res.SingleRef()
+	if err != nil {
+		return nil, err
+	}
+
+	return checkContextSources(ctx, ref, images)
+}
@@ -0,0 +1,182 @@
+// Copyright (c) 2023-2024, Nubificus LTD
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/moby/buildkit/client/llb"
+	"github.com/moby/buildkit/frontend/dockerfile/parser"
+)
+
+const (
+	normalizeFlag  string = "normalize"
+	symlinksFlag   string = "symlinks"
+	symlinksKeep   string = "preserve"
+	symlinksFollow string = "follow"
+)
+
+// CopyFlags are the flags of pun for COPY, which the dockerfile parser does
+// not know about. By default, COPY preserves the extended attributes, the
+// ownership and the modification times of the files.
+type CopyFlags struct {
+	// Reset the ownership to 0:0 and the timestamps to SOURCE_DATE_EPOCH
+	Normalize bool
+	// Copy the targets of the sources which are symlinks, instead of
+	// the symlinks themselves
+	FollowSymlinks bool
+	// Encrypt the layers with the copied files, in pun build
+	Encrypt        bool
+	// Copy only the members of the source archive that match the patterns
+	Extract        []string
+	// Copy the source directory as an ext4 image of that size
+	Ext4Size       int64
+	// Copy TLS material in a layer after urunc.json
+	TLS            bool
+}
+
+// popFlag removes the flag --name from an instruction and returns its
+// value, which is empty if the flag has no value.
+func popFlag(node *parser.Node, name string) (string, bool) {
+	var val string
+	var found bool
+	var flags []string
+
+	for _, f := range node.Flags {
+		if f == "--"+name {
+			found = true
+			continue
+		}
+		if v, ok := strings.CutPrefix(f, "--"+name+"="); ok {
+			val = v
+			found = true
+			continue
+		}
+		flags = append(flags, f)
+	}
+	node.Flags = flags
+
+	return val, found
+}
+
+// popBoolFlag removes a boolean flag from an instruction. A flag without a
+// value is true.
+func popBoolFlag(node *parser.Node, name string) (bool, error) {
+	val, found := popFlag(node, name)
+	if !found {
+		return false, nil
+	}
+	if val == "" {
+		return true, nil
+	}
+	b, err := strconv.ParseBool(val)
+	if err != nil {
+		return false, fmt.Errorf("Invalid value %s for --%s, expected a boolean", val, name)
+	}
+
+	return b, nil
+}
+
+// popCopyFlags removes the flags of pun from a COPY or an ADD instruction,
+// before it reaches the dockerfile parser. ADD only has --extract.
+func popCopyFlags(node *parser.Node) (CopyFlags, error) {
+	var flags CopyFlags
+	var err error
+
+	isCopy := strings.EqualFold(node.Value, "copy")
+	if !isCopy && !strings.EqualFold(node.Value, "add") {
+		return flags, nil
+	}
+	if val, ok := popFlag(node, extractFlag); ok {
+		flags.Extract = splitList(val)
+		if len(flags.Extract) == 0 {
+			return flags, fmt.Errorf("The --%s flag needs the members to extract", extractFlag)
+		}
+		for _, pattern := range flags.Extract {
+			if _, err := path.Match(pattern, ""); err != nil {
+				return flags, fmt.Errorf("Invalid pattern %s for --%s: %w", pattern, extractFlag, err)
+			}
+		}
+	}
+	if !isCopy {
+		return flags, nil
+	}
+	flags.Normalize, err = popBoolFlag(node, normalizeFlag)
+	if err != nil {
+		return flags, err
+	}
+	flags.Encrypt, err = popBoolFlag(node, encryptFlag)
+	if err != nil {
+		return flags, err
+	}
+	flags.TLS, err = popBoolFlag(node, tlsFlag)
+	if err != nil {
+		return flags, err
+	}
+	if val, ok := popFlag(node, ext4Flag); ok {
+		flags.Ext4Size, err = parseExt4Size(val)
+		if err != nil {
+			return flags, err
+		}
+		if len(flags.Extract) > 0 {
+			return flags, fmt.Errorf("The --%s and --%s flags can not be used together", ext4Flag, extractFlag)
+		}
+	}
+	if val, ok := popFlag(node, symlinksFlag); ok {
+		switch val {
+		case symlinksKeep:
+		case symlinksFollow:
+			flags.FollowSymlinks = true
+		default:
+			return flags, fmt.Errorf("Invalid value %s for --%s, expected %s or %s",
+					val, symlinksFlag, symlinksKeep, symlinksFollow)
+		}
+	}
+
+	return flags, nil
+}
+
+// normalizedTime returns the timestamp of normalized files, which is
+// SOURCE_DATE_EPOCH if it was given, else the Unix epoch.
+func normalizedTime(opts LLBOpts) time.Time {
+	if opts.Epoch != nil {
+		return *opts.Epoch
+	}
+
+	return time.Unix(0, 0).UTC()
+}
+
+// copyInfo returns the options of the LLB copy for the flags. Files get
+// normalized if either the flags or the options of the build say so.
+func (f CopyFlags) copyInfo(opts LLBOpts) *llb.CopyInfo {
+	info := &llb.CopyInfo{
+		CreateDestPath: true,
+		FollowSymlinks: f.FollowSymlinks,
+	}
+	if f.Normalize || opts.Normalize {
+		epoch := normalizedTime(opts)
+		info.ChownOpt = &llb.ChownOpt{
+			User:  &llb.UserOpt{UID: 0},
+			Group: &llb.UserOpt{UID: 0},
+		}
+		info.CreatedTime = &epoch
+	}
+
+	return info
+}
@@ -0,0 +1,143 @@
+// Copyright (c) 2023-2024, Nubificus LTD
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/containerd/console"
+	"github.com/moby/buildkit/client/llb"
+	"github.com/moby/buildkit/frontend/gateway/client"
+	"github.com/moby/buildkit/solver/errdefs"
+	"github.com/moby/buildkit/solver/pb"
+)
+
+const (
+	// The inputs of the failed step get mounted under this directory
+	debugInputsDir string = "/inputs"
+	debugShellPath string = "/bin/sh"
+)
+
+// nopWriteCloser prevents the process of the container from closing the
+// stdout and stderr of pun.
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error {
+	return nil
+}
+
+// debugShell starts an interactive shell in a container with the snapshots
+// of the inputs of the step that failed, mounted in /inputs/<N> in the order
+// of the inputs of the step. Since unikernel images do not have a shell, the
+// root of the container is the debug image. Errors which do not come from a
+// step (e.g. a wrong Containerfile) have nothing to inspect.
+func debugShell(ctx context.Context, c client.Client, buildErr error, debugImage string) {
+	var solveErr *errdefs.SolveError
+
+	if !errors.As(buildErr, &solveErr) || len(solveErr.InputIDs) == 0 {
+		fmt.Fprintf(os.Stderr, "No snapshot of a failed step to debug: %v\n", buildErr)
+		return
+	}
+	err := runDebugShell(ctx, c, solveErr, debugImage)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to start debug shell: %v\n", err)
+	}
+}
+
+func runDebugShell(ctx context.Context, c client.Client, solveErr *errdefs.SolveError, debugImage string) error {
+	platform := solveErr.Op.GetPlatform()
+
+	// Get the shell from the debug image, for the platform of the step
+	shellState := llb.Image(debugImage)
+	if platform != nil {
+		shellState = llb.Image(debugImage, llb.Platform(platform.Spec()))
+	}
+	dt, err := shellState.Marshal(ctx)
+	if err != nil {
+		return err
+	}
+	shellRes, err := c.Solve(ctx, client.SolveRequest{
+		Definition: dt.ToPB(),
+	})
+	if err != nil {
+		return fmt.Errorf("Failed to get debug image %s: %w", debugImage, err)
+	}
+	shellRef, err := shellRes.SingleRef()
+	if err != nil {
+		return err
+	}
+
+	mounts := []client.Mount{{
+		Dest:      "/",
+		Ref:       shellRef,
+		MountType: pb.MountType_BIND,
+	}}
+	for i, id := range solveErr.InputIDs {
+		mounts = append(mounts, client.Mount{
+			Dest:      fmt.Sprintf("%s/%d", debugInputsDir, i),
+			ResultID:  id,
+			MountType: pb.MountType_BIND,
+		})
+	}
+	ctr, err := c.NewContainer(ctx, client.NewContainerRequest{
+		Mounts:   mounts,
+		Platform: platform,
+	})
+	if err != nil {
+		return err
+	}
+	defer ctr.Release(context.WithoutCancel(ctx))
+
+	fmt.Fprintf(os.Stderr, "\nThe build failed, starting a shell with the inputs of the step in %s/<N>\n", debugInputsDir)
+	req := client.StartRequest{
+		Args:   []string{debugShellPath},
+		Cwd:    debugInputsDir,
+		Stdin:  io.NopCloser(os.Stdin),
+		Stdout: nopWriteCloser{os.Stdout},
+		Stderr: nopWriteCloser{os.Stderr},
+	}
+
+	// Use a raw terminal if we have one, as in docker run -it
+	con, err := console.ConsoleFromFile(os.Stdin)
+	if err == nil {
+		req.Tty = true
+		err = con.SetRaw()
+		if err != nil {
+			return err
+		}
+		defer con.Reset()
+	}
+	proc, err := ctr.Start(ctx, req)
+	if err != nil {
+		return err
+	}
+	if req.Tty {
+		size, err := con.Size()
+		if err == nil {
+			proc.Resize(ctx, client.WinSize{
+				Rows: uint32(size.Height),
+				Cols: uint32(size.Width),
+			})
+		}
+	}
+
+	return proc.Wait()
+}
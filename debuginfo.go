@@ -0,0 +1,178 @@
+// Copyright (c) 2023-2024, Nubificus LTD
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	bkclient "github.com/moby/buildkit/client"
+	"github.com/moby/buildkit/exporter/containerimage/exptypes"
+	"github.com/moby/buildkit/frontend/gateway/client"
+	digest "github.com/opencontainers/go-digest"
+	ocispecs "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+const (
+	// Build the debug artifact of the image with this digest, instead of
+	// the image itself
+	clientOptDebugArtifact string = "debug-artifact"
+	debugImageDesc         string = "Debug symbols of a unikernel packed with pun"
+	// The digest of the image that the debug symbols belong to
+	annotDebugSubject      string = "com.nubificus.pun.debug.subject"
+	// The path of the debug file in the artifact
+	annotDebugFile         string = "com.nubificus.pun.debug.file"
+	// As in the tags of cosign, the debug artifact of an image gets tagged
+	// with sha256-<digest of the image>.debug
+	debugTagSuffix         string = ".debug"
+)
+
+// debugSubjectFromBuildOpts returns the digest of the image whose debug
+// artifact gets built, or an empty digest if the image itself gets built.
+func debugSubjectFromBuildOpts(opts map[string]string, s *Strip) (digest.Digest, error) {
+	val := opts[clientOptDebugArtifact]
+	if val == "" {
+		return "", nil
+	}
+	if s == nil || !s.SplitDebug {
+		return "", fmt.Errorf("The %s option requires %s", clientOptDebugArtifact, clientOptSplitDebug)
+	}
+	subject, err := digest.Parse(val)
+	if err != nil {
+		return "", fmt.Errorf("Invalid %s %s: %w", clientOptDebugArtifact, val, err)
+	}
+
+	return subject, nil
+}
+
+// addDebugMeta adds the config and the annotations of the debug artifact of
+// a build in the result.
+func addDebugMeta(res *client.Result, b *platformBuild, subject digest.Digest) error {
+	debugPath := "/" + debugFile(b.Target.Annots[uruncBinaryAnnot])
+	annots := map[string]string{
+		annotImageDesc:    debugImageDesc,
+		annotDebugSubject: subject.String(),
+		annotDebugFile:    debugPath,
+	}
+	platform := b.LLBOpts.Platform
+	config := ocispecs.Image{
+		Platform: ocispecs.Platform{
+			Architecture: platform.Architecture,
+			Variant:      platform.Variant,
+			OS:           "linux",
+		},
+		RootFS: ocispecs.RootFS{
+			Type: "layers",
+		},
+		Config: ocispecs.ImageConfig{
+			Labels: annots,
+		},
+	}
+	configKey := exptypes.ExporterImageConfigKey
+	if b.Platform != nil {
+		configKey = fmt.Sprintf("%s/%s", exptypes.ExporterImageConfigKey, b.id())
+	}
+
+	dt, err := json.Marshal(config)
+	if err != nil {
+		return fmt.Errorf("Failed to marshal debug config: %w", err)
+	}
+	res.AddMeta(configKey, dt)
+	for annot, val := range annots {
+		res.AddMeta(exptypes.AnnotationManifestKey(b.Platform, annot), []byte(val))
+		res.AddMeta(exptypes.AnnotationManifestDescriptorKey(b.Platform, annot), []byte(val))
+	}
+
+	return nil
+}
+
+// debugResult returns the debug artifact of the builds, which only contains
+// the debug symbols of the kernel of every platform.
+func debugResult(builds []*platformBuild, subject digest.Digest) (*client.Result, error) {
+	res := client.NewResult()
+
+	if builds[0].Platform == nil {
+		res.SetRef(builds[0].Debug)
+		err := addDebugMeta(res, builds[0], subject)
+		if err != nil {
+			return nil, err
+		}
+
+		return res, nil
+	}
+
+	var exp exptypes.Platforms
+	for _, b := range builds {
+		res.AddRef(b.id(), b.Debug)
+		err := addDebugMeta(res, b, subject)
+		if err != nil {
+			return nil, err
+		}
+		exp.Platforms = append(exp.Platforms, exptypes.Platform{
+			ID:       b.id(),
+			Platform: *b.Platform,
+		})
+	}
+	dt, err := json.Marshal(exp)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to marshal platforms: %w", err)
+	}
+	res.AddMeta(exptypes.ExporterPlatformsKey, dt)
+
+	return res, nil
+}
+
+// debugTag returns the name of the debug artifact of the image with the
+// given name and digest, in the same repository as the image.
+func debugTag(name string, subject digest.Digest) string {
+	// Drop the digest and the tag of the image, but not the port of the
+	// registry
+	name, _, _ = strings.Cut(name, "@")
+	if i := strings.LastIndex(name, ":"); i > strings.LastIndex(name, "/") {
+		name = name[:i]
+	}
+
+	return fmt.Sprintf("%s:%s-%s%s", name, subject.Algorithm(), subject.Encoded(), debugTagSuffix)
+}
+
+// debugExports returns the outputs of the debug artifact of an image, which
+// are the image outputs of the image with the tag of the debug artifact.
+func debugExports(exports []bkclient.ExportEntry, subject digest.Digest) ([]bkclient.ExportEntry, error) {
+	var debugExports []bkclient.ExportEntry
+	for _, entry := range exports {
+		if entry.Type != bkclient.ExporterImage || entry.Attrs["name"] == "" {
+			continue
+		}
+		attrs := make(map[string]string)
+		for k, v := range entry.Attrs {
+			attrs[k] = v
+		}
+		var names []string
+		for _, name := range strings.Split(entry.Attrs["name"], ",") {
+			names = append(names, debugTag(strings.TrimSpace(name), subject))
+		}
+		attrs["name"] = strings.Join(names, ",")
+		debugExports = append(debugExports, bkclient.ExportEntry{
+			Type:  entry.Type,
+			Attrs: attrs,
+		})
+	}
+	if len(debugExports) == 0 {
+		return nil, fmt.Errorf("The debug symbols need an image output with a name, or a --debug-output")
+	}
+
+	return debugExports, nil
+}
@@ -0,0 +1,135 @@
+// Copyright (c) 2023-2024, Nubificus LTD
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"maps"
+	"slices"
+	"strconv"
+	"strings"
+
+	units "github.com/docker/go-units"
+	bkclient "github.com/moby/buildkit/client"
+)
+
+const (
+	clientOptDeviceProfile string = "device-profile"
+	uruncMemoryAnnot       string = "com.urunc.unikernel.memoryLimit"
+	// The compression of the layers of the exported images
+	exportCompression      string = "compression"
+)
+
+// DeviceProfile adjusts the defaults of the build for a device that the
+// unikernels run on, e.g. a small edge board.
+type DeviceProfile struct {
+	Platform      string // The default platform of the unikernel
+	MemoryLimit   int64  // The memory that the unikernel can use, in bytes
+	StorageBudget int64  // The maximum size of the image, in bytes
+	Compression   string // The compression of the layers of the image
+}
+
+// deviceProfiles are the device profiles that pun knows. The storage budget
+// is the part of the storage of the device that a single unikernel gets.
+var deviceProfiles = map[string]DeviceProfile{
+	"jetson": {
+		Platform:      "qemu/arm64",
+		MemoryLimit:   1 << 30,
+		StorageBudget: 256 << 20,
+		Compression:   "zstd",
+	},
+	"rpi4": {
+		Platform:      "qemu/arm64",
+		MemoryLimit:   512 << 20,
+		StorageBudget: 128 << 20,
+		Compression:   "gzip",
+	},
+}
+
+// deviceProfileFromBuildOpts returns the device profile of the build, or
+// nil if it has none.
+func deviceProfileFromBuildOpts(opts map[string]string) (*DeviceProfile, error) {
+	name := opts[clientOptDeviceProfile]
+	if name == "" {
+		return nil, nil
+	}
+	profile, ok := deviceProfiles[name]
+	if !ok {
+		var names []string
+		for name := range deviceProfiles {
+			names = append(names, name)
+		}
+		slices.Sort(names)
+		return nil, fmt.Errorf("Unknown %s %s, expected one of: %s", clientOptDeviceProfile, name,
+				strings.Join(names, ", "))
+	}
+
+	return &profile, nil
+}
+
+// buildOpts returns the build options with the defaults of the profile:
+// its platform and the stripping of the artifacts, since the storage of
+// devices is small. The options that the build sets explicitly win.
+func (p *DeviceProfile) buildOpts(opts map[string]string) map[string]string {
+	opts = maps.Clone(opts)
+	defaults := map[string]string{
+		clientOptPlatform:       p.Platform,
+		clientOptStripKernel:    "true",
+		clientOptCompressInitrd: "true",
+	}
+	for key, val := range defaults {
+		if _, ok := opts[key]; !ok {
+			opts[key] = val
+		}
+	}
+
+	return opts
+}
+
+// policy returns the policy of the build with the storage budget of the
+// profile as the maximum size of the image, unless the policy sets a
+// smaller one.
+func (p *DeviceProfile) policy(policy *Policy) *Policy {
+	if policy == nil {
+		policy = new(Policy)
+	}
+	if policy.maxImageSize == 0 || policy.maxImageSize > p.StorageBudget {
+		policy.maxImageSize = p.StorageBudget
+		policy.MaxImageSize = units.HumanSize(float64(p.StorageBudget))
+	}
+
+	return policy
+}
+
+// annotate sets the memory limit of the profile in the annotations of the
+// image, unless a label sets it.
+func (p *DeviceProfile) annotate(instr *PackInstructions) {
+	if _, ok := instr.Annots[uruncMemoryAnnot]; !ok {
+		instr.Annots[uruncMemoryAnnot] = strconv.FormatInt(p.MemoryLimit, 10)
+	}
+}
+
+// setCompression sets the compression of the profile in the image outputs
+// of a standalone build, which do not set one.
+func (p *DeviceProfile) setCompression(exports []bkclient.ExportEntry) {
+	for _, entry := range exports {
+		switch entry.Type {
+		case bkclient.ExporterImage, bkclient.ExporterOCI, bkclient.ExporterDocker:
+			if _, ok := entry.Attrs[exportCompression]; !ok {
+				entry.Attrs[exportCompression] = p.Compression
+			}
+		}
+	}
+}
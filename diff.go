@@ -0,0 +1,199 @@
+// Copyright (c) 2023-2024, Nubificus LTD
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+
+	"github.com/moby/buildkit/util/appcontext"
+	"golang.org/x/sync/errgroup"
+)
+
+const diffCmd string = "diff"
+
+// ImageSummary contains the parts of a packed image that pun diff compares.
+type ImageSummary struct {
+	Digest      string
+	Annotations map[string]string
+	Labels      map[string]string
+	UruncJSON   map[string]string
+	KernelPath  string
+	KernelHash  string
+	Layers      []string
+}
+
+func diffUsage() {
+	fmt.Println("Usage of pun diff")
+	fmt.Printf("%s %s [<args>] <imageA> <imageB>\n\n", os.Args[0], diffCmd)
+	fmt.Println("Supported command line arguments")
+	fmt.Println("\t--urunc-json-path path \t\tThe path of urunc.json in the rootfs (default " + uruncJSONPath + ")")
+}
+
+// summarizeImage fetches an image and the files of its layers that matter
+// for urunc.
+func summarizeImage(ctx context.Context, ref string, jsonPath string) (*ImageSummary, error) {
+	img, err := fetchImage(ctx, registryResolver(), ref)
+	if err != nil {
+		return nil, err
+	}
+
+	sum := &ImageSummary{
+		Digest:      img.Digest.String(),
+		Annotations: img.Manifest.Annotations,
+		Labels:      img.Config.Config.Labels,
+		KernelPath:  defaultKernelPath,
+	}
+	if kernelPath, ok := sum.Labels[uruncBinaryAnnot]; ok {
+		sum.KernelPath = kernelPath
+	}
+	for _, layer := range img.Manifest.Layers {
+		sum.Layers = append(sum.Layers, layer.Digest.String())
+	}
+
+	files, err := img.readImageFiles(ctx, jsonPath, sum.KernelPath)
+	if err != nil {
+		return nil, err
+	}
+	sum.UruncJSON = files.UruncJSON
+	sum.KernelHash = files.KernelHash.String()
+
+	return sum, nil
+}
+
+// diffMaps returns the differences of two maps, sorted by key, in the form
+// of a unified diff.
+func diffMaps(a map[string]string, b map[string]string) []string {
+	var keys []string
+	var lines []string
+
+	for key := range a {
+		keys = append(keys, key)
+	}
+	for key := range b {
+		if _, ok := a[key]; !ok {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		valA, inA := a[key]
+		valB, inB := b[key]
+		if inA && inB && valA == valB {
+			continue
+		}
+		if inA {
+			lines = append(lines, fmt.Sprintf("- %s=%s", key, valA))
+		}
+		if inB {
+			lines = append(lines, fmt.Sprintf("+ %s=%s", key, valB))
+		}
+	}
+
+	return lines
+}
+
+// diffLists returns the differences of two lists, position by position,
+// since the order of the layers matters.
+func diffLists(a []string, b []string) []string {
+	var lines []string
+
+	for i := 0; i < len(a) || i < len(b); i++ {
+		if i < len(a) && i < len(b) && a[i] == b[i] {
+			continue
+		}
+		if i < len(a) {
+			lines = append(lines, fmt.Sprintf("- %d: %s", i, a[i]))
+		}
+		if i < len(b) {
+			lines = append(lines, fmt.Sprintf("+ %d: %s", i, b[i]))
+		}
+	}
+
+	return lines
+}
+
+// diffImages returns the differences of two images, grouped in sections.
+// It returns nothing, if the images do not differ.
+func diffImages(a *ImageSummary, b *ImageSummary) []string {
+	var out []string
+
+	section := func(title string, lines []string) {
+		if len(lines) == 0 {
+			return
+		}
+		out = append(out, title+":")
+		for _, line := range lines {
+			out = append(out, "  "+line)
+		}
+	}
+	if a.Digest == b.Digest {
+		return nil
+	}
+
+	section("Digest", diffLists([]string{a.Digest}, []string{b.Digest}))
+	section("urunc.json", diffMaps(a.UruncJSON, b.UruncJSON))
+	section("Annotations", diffMaps(a.Annotations, b.Annotations))
+	section("Labels", diffMaps(a.Labels, b.Labels))
+	section("Kernel", diffMaps(
+		map[string]string{a.KernelPath: a.KernelHash},
+		map[string]string{b.KernelPath: b.KernelHash}))
+	section("Layers", diffLists(a.Layers, b.Layers))
+
+	return out
+}
+
+// diffMain compares two packed images and, as diff does, exits with 1 if
+// they differ.
+func diffMain(args []string) {
+	var jsonPath string
+
+	fs := flag.NewFlagSet(diffCmd, flag.ExitOnError)
+	fs.StringVar(&jsonPath, "urunc-json-path", uruncJSONPath, "The path of urunc.json in the rootfs")
+	fs.Usage = diffUsage
+	fs.Parse(args)
+	if fs.NArg() != 2 {
+		diffUsage()
+		os.Exit(2)
+	}
+
+	var sums [2]*ImageSummary
+	eg, ctx := errgroup.WithContext(appcontext.Context())
+	for i := range sums {
+		eg.Go(func() error {
+			sum, err := summarizeImage(ctx, fs.Arg(i), jsonPath)
+			sums[i] = sum
+			return err
+		})
+	}
+	err := eg.Wait()
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(2)
+	}
+
+	lines := diffImages(sums[0], sums[1])
+	if len(lines) == 0 {
+		fmt.Println("The images are identical")
+		return
+	}
+	for _, line := range lines {
+		fmt.Println(line)
+	}
+	os.Exit(1)
+}
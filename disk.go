@@ -0,0 +1,161 @@
+// Copyright (c) 2023-2024, Nubificus LTD
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"path"
+	"slices"
+
+	"github.com/moby/buildkit/client/llb"
+	"github.com/moby/buildkit/frontend/gateway/client"
+	ocispecs "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+const (
+	clientOptDiskFormat   string = "disk-format"
+	clientOptDiskImage    string = "disk-image"
+	defaultDiskImage      string = "docker.io/library/alpine:3.20"
+	diskFormatAuto        string = "auto"
+	diskFormatRaw         string = "raw"
+	diskFormatQcow2       string = "qcow2"
+	uruncBlockFormatAnnot string = "com.urunc.unikernel.blockFormat"
+	// The packed image gets mounted there in the conversion container
+	diskRootfs            string = "/unikernel"
+)
+
+// hypervisorDiskFormats are the formats of the block images that every
+// hypervisor gets with disk-format=auto. Only qemu understands qcow2.
+var hypervisorDiskFormats = map[string]string{
+	"qemu":        diskFormatQcow2,
+	"firecracker": diskFormatRaw,
+	"hvt":         diskFormatRaw,
+	"spt":         diskFormatRaw,
+	"xen":         diskFormatRaw,
+}
+
+// defaultDiskCmd converts the block image to PUN_FORMAT with qemu-img,
+// unless it is already in that format. qemu-img gets installed if the image
+// does not have it.
+const defaultDiskCmd string = `
+set -e
+if ! command -v qemu-img > /dev/null; then
+	apk add --no-cache qemu-img > /dev/null
+fi
+format=$(qemu-img info --output=json "$PUN_DISK" | sed -n 's/.*"format": *"\([^"]*\)".*/\1/p' | head -n 1)
+if [ "$format" = "$PUN_FORMAT" ]; then
+	echo "The block image is already $PUN_FORMAT"
+	exit 0
+fi
+qemu-img convert -f "$format" -O "$PUN_FORMAT" "$PUN_DISK" /tmp/disk
+cat /tmp/disk > "$PUN_DISK"
+echo "Converted the block image from $format to $PUN_FORMAT"
+`
+
+// DiskConversion describes the conversion of the block image of the packed
+// image to the format of its hypervisor, in a container of Image.
+type DiskConversion struct {
+	Format string // raw, qcow2 or auto, for the format of the hypervisor
+	Image  string // The image with qemu-img
+}
+
+// diskConversionFromBuildOpts returns the conversion of the build options,
+// or nil if the block images are packed as they are.
+func diskConversionFromBuildOpts(opts map[string]string) (*DiskConversion, error) {
+	format := opts[clientOptDiskFormat]
+	if format == "" {
+		return nil, nil
+	}
+	formats := []string{diskFormatAuto, diskFormatRaw, diskFormatQcow2}
+	if !slices.Contains(formats, format) {
+		return nil, fmt.Errorf("Invalid %s %s, expected one of: %s, %s, %s", clientOptDiskFormat, format,
+				diskFormatAuto, diskFormatRaw, diskFormatQcow2)
+	}
+
+	d := &DiskConversion{
+		Format: format,
+		Image:  defaultDiskImage,
+	}
+	if val := opts[clientOptDiskImage]; val != "" {
+		d.Image = val
+	}
+
+	return d, nil
+}
+
+// format returns the format of the block image for a hypervisor.
+func (d *DiskConversion) format(hypervisor string) (string, error) {
+	if d.Format != diskFormatAuto {
+		return d.Format, nil
+	}
+	format, ok := hypervisorDiskFormats[hypervisor]
+	if !ok {
+		return "", fmt.Errorf("There is no block image format for %s, please set %s", hypervisor, clientOptDiskFormat)
+	}
+
+	return format, nil
+}
+
+// runDiskConversion converts the block image of the packed image to the
+// format of its hypervisor and records the format in the annotations of the
+// target and in urunc.json. Images without a block image are returned as
+// they are.
+func runDiskConversion(ctx context.Context, c client.Client, d *DiskConversion, instr *PackInstructions,
+		ref client.Reference, platform ocispecs.Platform, opts LLBOpts) (client.Reference, error) {
+	blockPath, ok := instr.Annots[uruncBlockAnnot]
+	if !ok {
+		return ref, nil
+	}
+	format, err := d.format(platformHypervisor(instr, platform))
+	if err != nil {
+		return nil, err
+	}
+
+	rootfs, err := ref.ToState()
+	if err != nil {
+		return nil, err
+	}
+	converted := llb.Image(d.Image).Run(
+		llb.Args([]string{"/bin/sh", "-c", defaultDiskCmd}),
+		llb.AddEnv("PUN_DISK", path.Join(diskRootfs, blockPath)),
+		llb.AddEnv("PUN_FORMAT", format),
+		llb.WithCustomName("Convert " + blockPath + " to " + format),
+	).AddMount(diskRootfs, rootfs)
+	dt, err := converted.Marshal(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to marshal the conversion of %s: %w", blockPath, err)
+	}
+	res, err := c.Solve(ctx, client.SolveRequest{
+		Definition: dt.ToPB(),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("Failed to convert %s to %s: %w", blockPath, format, err)
+	}
+	ref, err = res.SingleRef()
+	if err != nil {
+		return nil, err
+	}
+	instr.addHistory("pun: convert " + blockPath + " to " + format)
+
+	instr.Annots[uruncBlockFormatAnnot] = format
+	ref, err = replaceUruncJSON(ctx, c, instr, ref, opts, "the format of the block image")
+	if err != nil {
+		return nil, err
+	}
+	instr.addHistory("pun: add the format of the block image in " + opts.UruncJSONPath)
+
+	return ref, nil
+}
@@ -0,0 +1,122 @@
+// Copyright (c) 2023-2024, Nubificus LTD
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"path"
+	"strings"
+
+	units "github.com/docker/go-units"
+	"github.com/moby/buildkit/frontend/dockerfile/parser"
+)
+
+const (
+	diskCmd                string = "disk"
+	diskSwapFlag           string = "swap"
+	diskMountFlag          string = "mount"
+	uruncScratchDisksAnnot string = "com.urunc.unikernel.scratchDisks"
+)
+
+// ScratchDisk is an empty disk that urunc creates when the unikernel starts,
+// either for swap or for scratch space.
+type ScratchDisk struct {
+	Size       int64  `json:"size"`                 // The size in bytes
+	Swap       bool   `json:"swap,omitempty"`       // Use the disk as swap
+	MountPoint string `json:"mountPoint,omitempty"` // Where the unikernel mounts it
+}
+
+// DiskCommand is the DISK instruction of pun, which declares an empty disk
+// that urunc creates at runtime, so that stateful unikernels do not need
+// volumes that get set up out of band.
+//
+//	DISK [--swap] [--mount=<path>] <size>
+type DiskCommand struct {
+	Disk ScratchDisk
+	args string // The arguments of the instruction, before the expansion
+	loc  []parser.Range
+}
+
+func (c *DiskCommand) Name() string {
+	return diskCmd
+}
+
+func (c *DiskCommand) Location() []parser.Range {
+	return c.loc
+}
+
+func isDisk(node *parser.Node) bool {
+	return strings.EqualFold(node.Value, diskCmd)
+}
+
+// parseDisk parses a DISK instruction. The dockerfile parser does not know
+// about it, so it only gives us its flags and the original line.
+func parseDisk(node *parser.Node) (*DiskCommand, error) {
+	c := &DiskCommand{
+		loc: nodeLocation(node),
+	}
+
+	var err error
+	c.Disk.Swap, err = popBoolFlag(node, diskSwapFlag)
+	if err != nil {
+		return nil, err
+	}
+	if val, ok := popFlag(node, diskMountFlag); ok {
+		if !path.IsAbs(val) {
+			return nil, fmt.Errorf("The --%s flag of DISK requires an absolute path, got %s", diskMountFlag, val)
+		}
+		c.Disk.MountPoint = val
+	}
+	if c.Disk.Swap && c.Disk.MountPoint != "" {
+		return nil, fmt.Errorf("A swap disk can not be mounted")
+	}
+	if len(node.Flags) > 0 {
+		return nil, fmt.Errorf("Unknown flag %s in DISK", node.Flags[0])
+	}
+
+	c.args = rawArgs(node)
+	if c.args == "" {
+		return nil, fmt.Errorf("DISK requires the size of the disk")
+	}
+
+	return c, nil
+}
+
+// expand expands any args in the size of the disk.
+func (c *DiskCommand) expand(scope *argScope) error {
+	words, err := scope.expandWords(c.args)
+	if err != nil {
+		return err
+	}
+	if len(words) != 1 {
+		return fmt.Errorf("DISK requires exactly one size, got %s", c.args)
+	}
+	size, err := units.RAMInBytes(words[0])
+	if err != nil || size <= 0 {
+		return fmt.Errorf("Invalid size %s in DISK, expected e.g. 512M", words[0])
+	}
+	c.Disk.Size = size
+
+	return nil
+}
+
+// scratchDisksAnnot returns the value of the annotation with the disks that
+// urunc creates, a JSON array.
+func scratchDisksAnnot(disks []ScratchDisk) string {
+	dt, _ := json.Marshal(disks)
+
+	return string(dt)
+}
@@ -0,0 +1,240 @@
+// Copyright (c) 2023-2024, Nubificus LTD
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/moby/buildkit/client/llb"
+	"github.com/moby/buildkit/frontend/dockerfile/parser"
+)
+
+const (
+	dnsCmd         string = "dns"
+	dnsSearchFlag  string = "search"
+	dnsOptionFlag  string = "option"
+	hostCmd        string = "host"
+	resolvConfPath string = "/etc/resolv.conf"
+	hostsPath      string = "/etc/hosts"
+)
+
+// DNSCommand is the DNS instruction of pun, which adds nameservers, search
+// domains and resolver options in the resolv.conf of the image, since
+// unikernels have no runtime hooks that could add them later.
+//
+//	DNS [--search=<domain>,...] [--option=<option>,...] <nameserver>...
+type DNSCommand struct {
+	Nameservers []string
+	Search      []string
+	Options     []string
+	args        string // The arguments of the instruction, before the expansion
+	loc         []parser.Range
+}
+
+func (c *DNSCommand) Name() string {
+	return dnsCmd
+}
+
+func (c *DNSCommand) Location() []parser.Range {
+	return c.loc
+}
+
+func isDNS(node *parser.Node) bool {
+	return strings.EqualFold(node.Value, dnsCmd)
+}
+
+// parseDNS parses a DNS instruction, which the dockerfile parser does not
+// know about.
+func parseDNS(node *parser.Node) (*DNSCommand, error) {
+	c := &DNSCommand{
+		loc: nodeLocation(node),
+	}
+	if val, ok := popFlag(node, dnsSearchFlag); ok {
+		c.Search = splitList(val)
+	}
+	if val, ok := popFlag(node, dnsOptionFlag); ok {
+		c.Options = splitList(val)
+	}
+	if len(node.Flags) > 0 {
+		return nil, fmt.Errorf("Unknown flag %s in DNS", node.Flags[0])
+	}
+	c.args = rawArgs(node)
+	if c.args == "" && len(c.Search) == 0 && len(c.Options) == 0 {
+		return nil, fmt.Errorf("DNS requires at least one nameserver, search domain or option")
+	}
+
+	return c, nil
+}
+
+// expand expands any args in the nameservers of the instruction.
+func (c *DNSCommand) expand(scope *argScope) error {
+	var err error
+
+	c.Nameservers, err = scope.expandWords(c.args)
+	if err != nil {
+		return err
+	}
+	for _, ns := range c.Nameservers {
+		if net.ParseIP(ns) == nil {
+			return fmt.Errorf("Invalid nameserver %s in DNS, expected an IP address", ns)
+		}
+	}
+
+	return nil
+}
+
+// HostCommand is the HOST instruction of pun, which adds an entry in the
+// hosts file of the image.
+//
+//	HOST <ip> <hostname>...
+type HostCommand struct {
+	IP        string
+	Hostnames []string
+	args      string // The arguments of the instruction, before the expansion
+	loc       []parser.Range
+}
+
+func (c *HostCommand) Name() string {
+	return hostCmd
+}
+
+func (c *HostCommand) Location() []parser.Range {
+	return c.loc
+}
+
+func isHost(node *parser.Node) bool {
+	return strings.EqualFold(node.Value, hostCmd)
+}
+
+// parseHost parses a HOST instruction, which the dockerfile parser does not
+// know about.
+func parseHost(node *parser.Node) (*HostCommand, error) {
+	c := &HostCommand{
+		loc: nodeLocation(node),
+	}
+	if len(node.Flags) > 0 {
+		return nil, fmt.Errorf("Unknown flag %s in HOST", node.Flags[0])
+	}
+	c.args = rawArgs(node)
+	if c.args == "" {
+		return nil, fmt.Errorf("HOST requires an IP address and at least one hostname")
+	}
+
+	return c, nil
+}
+
+// expand expands any args in the address and the hostnames of the
+// instruction.
+func (c *HostCommand) expand(scope *argScope) error {
+	words, err := scope.expandWords(c.args)
+	if err != nil {
+		return err
+	}
+	if len(words) < 2 {
+		return fmt.Errorf("HOST requires an IP address and at least one hostname")
+	}
+	if net.ParseIP(words[0]) == nil {
+		return fmt.Errorf("Invalid address %s in HOST, expected an IP address", words[0])
+	}
+	c.IP, c.Hostnames = words[0], words[1:]
+
+	return nil
+}
+
+// NetworkFiles are the entries of the resolv.conf and the hosts file that
+// the DNS and HOST instructions of an image declare.
+type NetworkFiles struct {
+	Nameservers []string
+	Search      []string
+	Options     []string
+	Hosts       []*HostCommand
+}
+
+// resolvConf returns the contents of the resolv.conf of the image, or nil if
+// it declares no DNS.
+func (n *NetworkFiles) resolvConf() []byte {
+	if len(n.Nameservers) == 0 && len(n.Search) == 0 && len(n.Options) == 0 {
+		return nil
+	}
+	var b strings.Builder
+	for _, ns := range n.Nameservers {
+		fmt.Fprintf(&b, "nameserver %s\n", ns)
+	}
+	if len(n.Search) > 0 {
+		fmt.Fprintf(&b, "search %s\n", strings.Join(n.Search, " "))
+	}
+	if len(n.Options) > 0 {
+		fmt.Fprintf(&b, "options %s\n", strings.Join(n.Options, " "))
+	}
+
+	return []byte(b.String())
+}
+
+// hosts returns the contents of the hosts file of the image, with the
+// entries of localhost, or nil if it declares no hosts.
+func (n *NetworkFiles) hosts() []byte {
+	if len(n.Hosts) == 0 {
+		return nil
+	}
+	var b strings.Builder
+	b.WriteString("127.0.0.1\tlocalhost\n::1\tlocalhost\n")
+	for _, h := range n.Hosts {
+		fmt.Fprintf(&b, "%s\t%s\n", h.IP, strings.Join(h.Hostnames, " "))
+	}
+
+	return []byte(b.String())
+}
+
+// networkFilesIn writes the resolv.conf and the hosts file of the image in
+// base, in a single layer, replacing the ones of the base image.
+func networkFilesIn(base llb.State, n *NetworkFiles, opts LLBOpts) llb.State {
+	var action *llb.FileAction
+	mkfileOpts := uruncJSONOpts(opts)
+	for _, f := range []struct {
+		path string
+		dt   []byte
+	}{{resolvConfPath, n.resolvConf()}, {hostsPath, n.hosts()}} {
+		if f.dt == nil {
+			continue
+		}
+		if action == nil {
+			action = llb.Mkdir("/etc", 0755, llb.WithParents(true))
+		}
+		action = action.Mkfile(f.path, 0644, f.dt, mkfileOpts...)
+	}
+	if action == nil {
+		return base
+	}
+
+	return base.File(action, llb.WithCustomName("Write the DNS configuration of the image"))
+}
+
+// historyEntry returns the history entry of the layer of the files.
+func (n *NetworkFiles) historyEntry() string {
+	var paths []string
+	if n.resolvConf() != nil {
+		paths = append(paths, resolvConfPath)
+	}
+	if n.hosts() != nil {
+		paths = append(paths, hostsPath)
+	}
+	if len(paths) == 0 {
+		return ""
+	}
+
+	return "DNS: write " + strings.Join(paths, " ")
+}
@@ -0,0 +1,207 @@
+// Copyright (c) 2023-2024, Nubificus LTD
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/containerd/platforms"
+	"github.com/distribution/reference"
+	bkclient "github.com/moby/buildkit/client"
+	"github.com/moby/buildkit/exporter/containerimage/exptypes"
+	"github.com/moby/buildkit/frontend/gateway/client"
+	digest "github.com/opencontainers/go-digest"
+	ocispecs "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// PushPrediction has the digests that an image output would push, which
+// pun build --dry-run prints as a JSON line per output.
+type PushPrediction struct {
+	// The tags of the output
+	Tags      []string            `json:"tags"`
+	// The tags pinned to the digest, for deployment manifests
+	Refs      []string            `json:"refs"`
+	// The digest of the index or the manifest that the tags point to
+	Digest    digest.Digest       `json:"digest"`
+	MediaType string              `json:"mediaType"`
+	Manifests []PredictedManifest `json:"manifests"`
+}
+
+// PredictedManifest is the manifest of a platform of a PushPrediction.
+type PredictedManifest struct {
+	Platform string        `json:"platform"`
+	Digest   digest.Digest `json:"digest"`
+	Config   digest.Digest `json:"config"`
+}
+
+// dryRunExport returns the export that replaces a pushing image output in
+// a dry run, which writes the same image to an OCI archive. The image
+// exporter defaults to docker media types and inline attestations, so the
+// oci exporter gets them explicitly, in order to produce the same digests.
+func dryRunExport(entry bkclient.ExportEntry, archive string) bkclient.ExportEntry {
+	attrs := make(map[string]string)
+	for k, v := range entry.Attrs {
+		switch k {
+		case "name", "push", "push-by-digest", "unpack", "store", "registry.insecure":
+			continue
+		}
+		attrs[k] = v
+	}
+	if _, ok := attrs[exportOCIMediaTypes]; !ok {
+		attrs[exportOCIMediaTypes] = "false"
+	}
+	if _, ok := attrs[string(exptypes.OptKeyForceInlineAttestations)]; !ok {
+		attrs[string(exptypes.OptKeyForceInlineAttestations)] = "true"
+	}
+
+	return bkclient.ExportEntry{
+		Type:  bkclient.ExporterOCI,
+		Attrs: attrs,
+		Output: func(map[string]string) (io.WriteCloser, error) {
+			return os.Create(archive)
+		},
+	}
+}
+
+// predictArchive returns the digests of the image of an OCI archive.
+func predictArchive(archive string, tags []string) (*PushPrediction, error) {
+	index, fetch, err := archiveFetcher(archive)
+	if err != nil {
+		return nil, err
+	}
+	if len(index.Manifests) != 1 {
+		return nil, fmt.Errorf("Expected a single image in %s, got %d", archive, len(index.Manifests))
+	}
+	root := index.Manifests[0]
+
+	p := &PushPrediction{
+		Tags:      tags,
+		Digest:    root.Digest,
+		MediaType: root.MediaType,
+	}
+	for _, tag := range tags {
+		named, err := reference.ParseNormalizedNamed(tag)
+		if err != nil {
+			return nil, err
+		}
+		pinned, err := reference.WithDigest(reference.TagNameOnly(named), root.Digest)
+		if err != nil {
+			return nil, err
+		}
+		p.Refs = append(p.Refs, reference.FamiliarString(pinned))
+	}
+
+	manifests := []ocispecs.Descriptor{root}
+	switch root.MediaType {
+	case ocispecs.MediaTypeImageIndex, mediaTypeDockerList:
+		var sub ocispecs.Index
+		err = fetch(root, &sub)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to read index %s: %w", root.Digest, err)
+		}
+		manifests = sub.Manifests
+	}
+	for _, m := range manifests {
+		// The attestations are not images of the platforms
+		if m.Platform != nil && m.Platform.OS == "unknown" {
+			continue
+		}
+		var manifest ocispecs.Manifest
+		err = fetch(m, &manifest)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to read manifest %s: %w", m.Digest, err)
+		}
+		var config ocispecs.Image
+		err = fetch(manifest.Config, &config)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to read config %s: %w", manifest.Config.Digest, err)
+		}
+		p.Manifests = append(p.Manifests, PredictedManifest{
+			Platform: platforms.Format(config.Platform),
+			Digest:   m.Digest,
+			Config:   manifest.Config.Digest,
+		})
+	}
+
+	return p, nil
+}
+
+// dryRunBuild builds the image like clientBuild, but the image outputs that
+// push get written to temporary OCI archives instead, without contacting the
+// registries. It prints the digests that the pushes would have and returns
+// the digest of the first one. The rest of the outputs are skipped, as well
+// as the steps that follow the export, such as the debug artifact.
+func dryRunBuild(ctx context.Context, c *bkclient.Client, solveOpt bkclient.SolveOpt, opts BuildCLIOpts) (string, error) {
+	dir, err := os.MkdirTemp("", "pun-dry-run-")
+	if err != nil {
+		return "", err
+	}
+	defer os.RemoveAll(dir)
+
+	archives := make(map[string][]string)
+	dryOpt := solveOpt
+	dryOpt.Exports = nil
+	for i, entry := range solveOpt.Exports {
+		tags, err := pushedTags(entry)
+		if err != nil {
+			return "", err
+		}
+		if entry.Type != bkclient.ExporterImage || entry.Attrs["push"] != "true" {
+			continue
+		}
+		archive := filepath.Join(dir, fmt.Sprintf("output-%d.tar", i))
+		archives[archive] = tags
+		dryOpt.Exports = append(dryOpt.Exports, dryRunExport(entry, archive))
+	}
+	if len(archives) == 0 {
+		return "", fmt.Errorf("--dry-run requires an image output that pushes, e.g. type=image,name=<name>,push=true")
+	}
+
+	buildFunc := func(ctx context.Context, c client.Client) (*client.Result, error) {
+		return buildImage(ctx, c, newBuildReport(), nil)
+	}
+	_, err = runBuild(ctx, c, dryOpt, buildFunc, opts)
+	if err != nil {
+		return "", err
+	}
+
+	var first string
+	enc := json.NewEncoder(os.Stdout)
+	for i := range solveOpt.Exports {
+		archive := filepath.Join(dir, fmt.Sprintf("output-%d.tar", i))
+		tags, ok := archives[archive]
+		if !ok {
+			continue
+		}
+		p, err := predictArchive(archive, tags)
+		if err != nil {
+			return "", fmt.Errorf("Failed to predict the digests of %v: %w", tags, err)
+		}
+		if first == "" {
+			first = p.Digest.String()
+		}
+		err = enc.Encode(p)
+		if err != nil {
+			return "", err
+		}
+	}
+
+	return first, nil
+}
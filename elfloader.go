@@ -0,0 +1,205 @@
+// Copyright (c) 2023-2024, Nubificus LTD
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"debug/elf"
+	"fmt"
+	"io"
+	"path"
+	"strings"
+
+	"github.com/containerd/continuity/fs"
+)
+
+// elfLibTriplets are the multiarch directories of the libraries, per
+// architecture.
+var elfLibTriplets = map[string]string{
+	"amd64":   "x86_64-linux-gnu",
+	"arm64":   "aarch64-linux-gnu",
+	"riscv64": "riscv64-linux-gnu",
+}
+
+// elfLoaderCheck checks that the ELF loader of Unikraft can run a binary of
+// a rootfs, which it loads from the paths of the guest, without the
+// ld.so.cache of Linux.
+type elfLoaderCheck struct {
+	root     string
+	machine  elf.Machine
+	arch     string
+	problems []string
+	// The libraries that were already checked, or found missing
+	seen     map[string]bool
+}
+
+// open opens an ELF file of the rootfs, with the symlinks resolved in the
+// rootfs, as the guest sees them.
+func (c *elfLoaderCheck) open(guestPath string) (*elf.File, error) {
+	p, err := fs.RootPath(c.root, guestPath)
+	if err != nil {
+		return nil, err
+	}
+
+	return elf.Open(p)
+}
+
+func (c *elfLoaderCheck) report(format string, args ...interface{}) {
+	c.problems = append(c.problems, fmt.Sprintf(format, args...))
+}
+
+// searchPaths returns the directories where the dynamic loader looks for
+// the libraries of an object: its runpath, or its rpath if it has no
+// runpath, and then the default directories.
+func (c *elfLoaderCheck) searchPaths(f *elf.File, guestPath string) []string {
+	var dirs []string
+
+	paths, _ := f.DynString(elf.DT_RUNPATH)
+	if len(paths) == 0 {
+		paths, _ = f.DynString(elf.DT_RPATH)
+	}
+	for _, p := range paths {
+		for _, dir := range strings.Split(p, ":") {
+			dir = strings.ReplaceAll(dir, "${ORIGIN}", path.Dir(guestPath))
+			dir = strings.ReplaceAll(dir, "$ORIGIN", path.Dir(guestPath))
+			if dir != "" {
+				dirs = append(dirs, dir)
+			}
+		}
+	}
+	if triplet, ok := elfLibTriplets[c.arch]; ok {
+		dirs = append(dirs, "/lib/"+triplet, "/usr/lib/"+triplet)
+	}
+
+	return append(dirs, "/lib64", "/usr/lib64", "/lib", "/usr/lib")
+}
+
+// checkLibs checks that the libraries that an object needs are in the
+// rootfs, for the architecture of the binary, along with their own.
+func (c *elfLoaderCheck) checkLibs(f *elf.File, guestPath string) {
+	needed, err := f.DynString(elf.DT_NEEDED)
+	if err != nil {
+		c.report("Failed to read the libraries that %s needs: %v", guestPath, err)
+		return
+	}
+	dirs := c.searchPaths(f, guestPath)
+	for _, lib := range needed {
+		if c.seen[lib] {
+			continue
+		}
+		c.seen[lib] = true
+
+		candidates := []string{lib}
+		if !strings.Contains(lib, "/") {
+			candidates = nil
+			for _, dir := range dirs {
+				candidates = append(candidates, path.Join(dir, lib))
+			}
+		}
+		found := false
+		for _, p := range candidates {
+			libFile, err := c.open(p)
+			if err != nil {
+				continue
+			}
+			if libFile.Machine != c.machine {
+				libFile.Close()
+				continue
+			}
+			found = true
+			c.checkLibs(libFile, p)
+			libFile.Close()
+			break
+		}
+		if !found {
+			c.report("The library %s, which %s needs, is not in the rootfs for %s, copy it to one of %s",
+					lib, guestPath, c.arch, strings.Join(dirs, ", "))
+		}
+	}
+}
+
+// elfInterpreter returns the dynamic loader of a binary, if it has one.
+func elfInterpreter(f *elf.File) (string, error) {
+	for _, prog := range f.Progs {
+		if prog.Type != elf.PT_INTERP {
+			continue
+		}
+		dt, err := io.ReadAll(prog.Open())
+		if err != nil {
+			return "", err
+		}
+		return strings.TrimRight(string(dt), "\x00"), nil
+	}
+
+	return "", nil
+}
+
+// checkELFLoader checks that the ELF loader of Unikraft can run a binary of
+// a rootfs: the binary must be a position independent executable, either
+// static, or dynamic with its loader and its libraries in the rootfs. It
+// returns an error with all the problems that it finds, which would
+// otherwise crash the guest.
+func checkELFLoader(root string, binary string) error {
+	c := &elfLoaderCheck{
+		root: root,
+		seen: make(map[string]bool),
+	}
+
+	f, err := c.open(binary)
+	if err != nil {
+		return fmt.Errorf("Failed to read the binary %s: %w", binary, err)
+	}
+	defer f.Close()
+	c.machine = f.Machine
+	arch, ok := elfArchs[f.Machine]
+	if !ok || f.Class != elf.ELFCLASS64 {
+		return fmt.Errorf("The binary %s is for %s %s, which the ELF loader does not support", binary, f.Class, f.Machine)
+	}
+	c.arch = arch
+
+	interp, err := elfInterpreter(f)
+	if err != nil {
+		return fmt.Errorf("Failed to read the interpreter of %s: %w", binary, err)
+	}
+	switch f.Type {
+	case elf.ET_DYN:
+	case elf.ET_EXEC:
+		if interp == "" {
+			c.report("The binary %s is static but not position independent, link it with -static-pie", binary)
+		} else {
+			c.report("The binary %s is not position independent, link it with -fPIE -pie, or with -static-pie", binary)
+		}
+	default:
+		return fmt.Errorf("The binary %s is not an executable, but %s", binary, f.Type)
+	}
+	if interp != "" {
+		interpFile, err := c.open(interp)
+		if err != nil {
+			c.report("The dynamic loader %s of %s is not in the rootfs, copy it from the toolchain, or link the binary with -static-pie",
+					interp, binary)
+		} else {
+			if interpFile.Machine != c.machine {
+				c.report("The dynamic loader %s of %s is for %s, not %s", interp, binary, interpFile.Machine, c.machine)
+			}
+			interpFile.Close()
+		}
+	}
+	c.checkLibs(f, binary)
+
+	if len(c.problems) == 0 {
+		return nil
+	}
+
+	return fmt.Errorf("The ELF loader of Unikraft can not run %s:\n\t%s", binary, strings.Join(c.problems, "\n\t"))
+}
@@ -0,0 +1,543 @@
+// Copyright (c) 2023-2024, Nubificus LTD
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"archive/tar"
+	"context"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/containerd/containerd/archive/compression"
+	"github.com/containers/ocicrypt"
+	encconfig "github.com/containers/ocicrypt/config"
+	bkclient "github.com/moby/buildkit/client"
+	"github.com/moby/buildkit/frontend/dockerfile/instructions"
+	"github.com/moby/buildkit/session/secrets"
+	digest "github.com/opencontainers/go-digest"
+	ocispecs "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+const (
+	encryptFlag          string = "encrypt"
+	// The paths of the image whose layers need to get encrypted, in JSON
+	annotEncryptPaths    string = "com.nubificus.pun.encrypt.paths"
+	// The build secrets with this prefix are the keys of the recipients
+	encryptionKeySecret  string = "encryption-key"
+	encryptedSuffix      string = "+encrypted"
+)
+
+// encryptedPaths returns the destinations of the COPY instructions of the
+// image with --encrypt.
+func encryptedPaths(instr *PackInstructions) []string {
+	var paths []string
+	for _, cmd := range instr.Copies {
+		c, ok := cmd.(*instructions.CopyCommand)
+		if !ok || !instr.CopyFlags[c].Encrypt {
+			continue
+		}
+		paths = append(paths, copyDest(c))
+	}
+
+	return paths
+}
+
+// checkEncrypt fails the build of an image with encrypted paths, unless pun
+// build runs the frontend and encrypts all of its outputs after the export,
+// since buildkit can not encrypt them itself.
+func checkEncrypt(instr *PackInstructions, encryption *archiveEncryption) error {
+	if len(encryptedPaths(instr)) == 0 || encryption != nil {
+		return nil
+	}
+
+	return fmt.Errorf("COPY --%s requires pun build --encrypt with recipient keys and oci outputs", encryptFlag)
+}
+
+// cryptoConfigFromSecrets returns the configuration of ocicrypt for the
+// keys of the recipients, which are build secrets. Certificates get used
+// with pkcs7 and public keys with jwe.
+func cryptoConfigFromSecrets(ctx context.Context, store secrets.SecretStore, ids []string) (*encconfig.CryptoConfig, error) {
+	var pubKeys, certs [][]byte
+	for _, id := range ids {
+		dt, err := store.GetSecret(ctx, id)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to read secret %s: %w", id, err)
+		}
+		block, _ := pem.Decode(dt)
+		if block != nil && block.Type == "CERTIFICATE" {
+			certs = append(certs, dt)
+		} else {
+			pubKeys = append(pubKeys, dt)
+		}
+	}
+
+	var ccs []encconfig.CryptoConfig
+	if len(pubKeys) > 0 {
+		cc, err := encconfig.EncryptWithJwe(pubKeys)
+		if err != nil {
+			return nil, err
+		}
+		ccs = append(ccs, cc)
+	}
+	if len(certs) > 0 {
+		cc, err := encconfig.EncryptWithPkcs7(certs)
+		if err != nil {
+			return nil, err
+		}
+		ccs = append(ccs, cc)
+	}
+	cc := encconfig.CombineCryptoConfigs(ccs)
+
+	return &cc, nil
+}
+
+// encryptionKeys returns the ids of the secrets which are keys of the
+// recipients of the encrypted layers.
+func encryptionKeys(ids []string) []string {
+	var keys []string
+	for _, id := range ids {
+		if strings.HasPrefix(id, encryptionKeySecret) {
+			keys = append(keys, id)
+		}
+	}
+
+	return keys
+}
+
+// archiveEncryption is the encryption of the oci outputs of pun build.
+type archiveEncryption struct {
+	cc       *encconfig.CryptoConfig
+	archives []string
+}
+
+// encryptionFromCLI returns the encryption of the outputs of pun build.
+// Only the images of oci outputs can get encrypted, since the other
+// exporters push or load the images themselves.
+func encryptionFromCLI(ctx context.Context, opts BuildCLIOpts) (*archiveEncryption, error) {
+	store, ids, err := secretStore(opts.Secrets)
+	if err != nil {
+		return nil, err
+	}
+	keys := encryptionKeys(ids)
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("--encrypt requires the keys of the recipients as secrets with ids that start with %s",
+				encryptionKeySecret)
+	}
+	e := &archiveEncryption{}
+	e.cc, err = cryptoConfigFromSecrets(ctx, store, keys)
+	if err != nil {
+		return nil, err
+	}
+	for _, output := range opts.Outputs {
+		attrs, err := parseCSVAttrs("output", output)
+		if err != nil {
+			return nil, err
+		}
+		if attrs["type"] != bkclient.ExporterOCI || attrs["dest"] == "" || attrs["dest"] == "-" {
+			return nil, fmt.Errorf("Encrypted layers require oci outputs with a file as dest, got %s", output)
+		}
+		e.archives = append(e.archives, attrs["dest"])
+	}
+
+	return e, nil
+}
+
+// encrypt encrypts the layers of the oci outputs.
+func (e *archiveEncryption) encrypt() error {
+	for _, archive := range e.archives {
+		err := encryptArchive(archive, e.cc)
+		if err != nil {
+			// Do not leave the plain layers behind
+			os.Remove(archive)
+			return fmt.Errorf("Failed to encrypt %s: %w", archive, err)
+		}
+	}
+
+	return nil
+}
+
+// ociLayout is an extracted OCI archive, whose layers get encrypted.
+type ociLayout struct {
+	dir       string
+	cc        *encconfig.CryptoConfig
+	encrypted map[digest.Digest]ocispecs.Descriptor // Plain layers to encrypted ones
+	stale     map[digest.Digest]bool                // Replaced manifests and indexes
+}
+
+func (l *ociLayout) blobPath(d digest.Digest) string {
+	return filepath.Join(l.dir, "blobs", d.Algorithm().String(), d.Encoded())
+}
+
+func (l *ociLayout) readJSON(desc ocispecs.Descriptor, v any) error {
+	dt, err := os.ReadFile(l.blobPath(desc.Digest))
+	if err != nil {
+		return err
+	}
+
+	return json.Unmarshal(dt, v)
+}
+
+// writeJSON writes v as a blob, which replaces the blob of desc, and returns
+// desc with its new digest and size.
+func (l *ociLayout) writeJSON(desc ocispecs.Descriptor, v any) (ocispecs.Descriptor, error) {
+	dt, err := json.Marshal(v)
+	if err != nil {
+		return desc, err
+	}
+	if digest.FromBytes(dt) == desc.Digest {
+		return desc, nil
+	}
+	l.stale[desc.Digest] = true
+	desc.Digest = digest.FromBytes(dt)
+	desc.Size = int64(len(dt))
+
+	return desc, os.WriteFile(l.blobPath(desc.Digest), dt, 0644)
+}
+
+// layerContains returns the paths of the layer, out of the given ones.
+func (l *ociLayout) layerContains(layer ocispecs.Descriptor, paths []string) ([]string, error) {
+	f, err := os.Open(l.blobPath(layer.Digest))
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	dr, err := compression.DecompressStream(f)
+	if err != nil {
+		return nil, err
+	}
+	defer dr.Close()
+
+	found := make(map[string]bool)
+	tr := tar.NewReader(dr)
+	for {
+		hdr, err := tr.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		name := path.Clean("/" + hdr.Name)
+		for _, p := range paths {
+			if name == p || strings.HasPrefix(name, p+"/") {
+				found[p] = true
+			}
+		}
+	}
+
+	var contained []string
+	for _, p := range paths {
+		if found[p] {
+			contained = append(contained, p)
+		}
+	}
+
+	return contained, nil
+}
+
+// encryptLayer encrypts a layer with ocicrypt and returns its descriptor.
+func (l *ociLayout) encryptLayer(layer ocispecs.Descriptor) (ocispecs.Descriptor, error) {
+	if desc, ok := l.encrypted[layer.Digest]; ok {
+		return desc, nil
+	}
+	if !strings.HasPrefix(layer.MediaType, ocispecs.MediaTypeImageLayer) {
+		return layer, fmt.Errorf("Layers of type %s can not get encrypted, use an oci output", layer.MediaType)
+	}
+
+	in, err := os.Open(l.blobPath(layer.Digest))
+	if err != nil {
+		return layer, err
+	}
+	defer in.Close()
+	r, finalizer, err := ocicrypt.EncryptLayer(l.cc.EncryptConfig, in, layer)
+	if err != nil {
+		return layer, err
+	}
+	tmp, err := os.CreateTemp(l.dir, "layer")
+	if err != nil {
+		return layer, err
+	}
+	defer os.Remove(tmp.Name())
+	digester := digest.SHA256.Digester()
+	size, err := io.Copy(io.MultiWriter(tmp, digester.Hash()), r)
+	if err == nil {
+		err = tmp.Close()
+	}
+	if err != nil {
+		return layer, err
+	}
+	annots, err := finalizer()
+	if err != nil {
+		return layer, err
+	}
+
+	desc := ocispecs.Descriptor{
+		MediaType:   layer.MediaType + encryptedSuffix,
+		Digest:      digester.Digest(),
+		Size:        size,
+		Annotations: make(map[string]string),
+	}
+	for k, v := range layer.Annotations {
+		desc.Annotations[k] = v
+	}
+	for k, v := range annots {
+		desc.Annotations[k] = v
+	}
+	err = os.Rename(tmp.Name(), l.blobPath(desc.Digest))
+	if err != nil {
+		return layer, err
+	}
+	l.encrypted[layer.Digest] = desc
+
+	return desc, nil
+}
+
+// encryptManifest encrypts the layers of an image which contain any of the
+// paths that the image marks for encryption, returning the descriptor of
+// the new manifest.
+func (l *ociLayout) encryptManifest(desc ocispecs.Descriptor) (ocispecs.Descriptor, error) {
+	var manifest ocispecs.Manifest
+	err := l.readJSON(desc, &manifest)
+	if err != nil {
+		return desc, err
+	}
+	var paths []string
+	if val, ok := manifest.Annotations[annotEncryptPaths]; ok {
+		err = json.Unmarshal([]byte(val), &paths)
+		if err != nil {
+			return desc, fmt.Errorf("Invalid %s annotation: %w", annotEncryptPaths, err)
+		}
+	}
+	if len(paths) == 0 {
+		return desc, nil
+	}
+
+	found := make(map[string]bool)
+	for i, layer := range manifest.Layers {
+		contained, err := l.layerContains(layer, paths)
+		if err != nil {
+			return desc, fmt.Errorf("Failed to read layer %s: %w", layer.Digest, err)
+		}
+		if len(contained) == 0 {
+			continue
+		}
+		manifest.Layers[i], err = l.encryptLayer(layer)
+		if err != nil {
+			return desc, fmt.Errorf("Failed to encrypt layer %s: %w", layer.Digest, err)
+		}
+		for _, p := range contained {
+			found[p] = true
+		}
+	}
+	// Never export a path in plain text, if we could not find its layer
+	for _, p := range paths {
+		if !found[p] {
+			return desc, fmt.Errorf("Found no layer with %s, which needs to get encrypted", p)
+		}
+	}
+
+	return l.writeJSON(desc, manifest)
+}
+
+// encryptDesc encrypts the images of an index or a manifest.
+func (l *ociLayout) encryptDesc(desc ocispecs.Descriptor) (ocispecs.Descriptor, error) {
+	switch desc.MediaType {
+	case ocispecs.MediaTypeImageManifest:
+		return l.encryptManifest(desc)
+	case ocispecs.MediaTypeImageIndex:
+		var index ocispecs.Index
+		err := l.readJSON(desc, &index)
+		if err != nil {
+			return desc, err
+		}
+		for i, m := range index.Manifests {
+			index.Manifests[i], err = l.encryptDesc(m)
+			if err != nil {
+				return desc, err
+			}
+		}
+		return l.writeJSON(desc, index)
+	}
+
+	return desc, nil
+}
+
+// extractArchive extracts an OCI archive in dir.
+func extractArchive(archive string, dir string) error {
+	f, err := os.Open(archive)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	tr := tar.NewReader(f)
+	for {
+		hdr, err := tr.Next()
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		name := filepath.Join(dir, filepath.FromSlash(path.Clean("/"+hdr.Name)))
+		switch hdr.Typeflag {
+		case tar.TypeDir:
+			err = os.MkdirAll(name, 0755)
+		case tar.TypeReg:
+			err = os.MkdirAll(filepath.Dir(name), 0755)
+			if err == nil {
+				err = writeFileFrom(name, tr)
+			}
+		default:
+			err = fmt.Errorf("Unexpected entry %s in the OCI archive", hdr.Name)
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+func writeFileFrom(name string, r io.Reader) error {
+	f, err := os.Create(name)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(f, r)
+	if err != nil {
+		f.Close()
+		return err
+	}
+
+	return f.Close()
+}
+
+// createArchive writes the files of dir in an OCI archive, skipping the
+// blobs which are not referenced anymore.
+func createArchive(archive string, dir string, skip map[string]bool) error {
+	f, err := os.Create(archive)
+	if err != nil {
+		return err
+	}
+	tw := tar.NewWriter(f)
+	err = filepath.Walk(dir, func(p string, info os.FileInfo, err error) error {
+		if err != nil || p == dir || skip[p] {
+			return err
+		}
+		rel, err := filepath.Rel(dir, p)
+		if err != nil {
+			return err
+		}
+		hdr, err := tar.FileInfoHeader(info, "")
+		if err != nil {
+			return err
+		}
+		hdr.Name = filepath.ToSlash(rel)
+		err = tw.WriteHeader(hdr)
+		if err != nil || info.IsDir() {
+			return err
+		}
+		in, err := os.Open(p)
+		if err != nil {
+			return err
+		}
+		defer in.Close()
+		_, err = io.Copy(tw, in)
+		return err
+	})
+	if err == nil {
+		err = tw.Close()
+	}
+	if err != nil {
+		f.Close()
+		return err
+	}
+
+	return f.Close()
+}
+
+// encryptArchive encrypts the layers of the images of an OCI archive that
+// contain paths which the images mark for encryption. The plain layers get
+// removed from the archive.
+func encryptArchive(archive string, cc *encconfig.CryptoConfig) error {
+	dir, err := os.MkdirTemp(filepath.Dir(archive), ".pun-encrypt")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+	layoutDir := filepath.Join(dir, "layout")
+	err = extractArchive(archive, layoutDir)
+	if err != nil {
+		return fmt.Errorf("Failed to extract %s: %w", archive, err)
+	}
+
+	l := &ociLayout{
+		dir:       layoutDir,
+		cc:        cc,
+		encrypted: make(map[digest.Digest]ocispecs.Descriptor),
+		stale:     make(map[digest.Digest]bool),
+	}
+	indexPath := filepath.Join(layoutDir, ocispecs.ImageIndexFile)
+	dt, err := os.ReadFile(indexPath)
+	if err != nil {
+		return err
+	}
+	var index ocispecs.Index
+	err = json.Unmarshal(dt, &index)
+	if err != nil {
+		return fmt.Errorf("Invalid %s in %s: %w", ocispecs.ImageIndexFile, archive, err)
+	}
+	for i, m := range index.Manifests {
+		index.Manifests[i], err = l.encryptDesc(m)
+		if err != nil {
+			return err
+		}
+	}
+	if len(l.encrypted) == 0 {
+		return nil
+	}
+	dt, err = json.Marshal(index)
+	if err != nil {
+		return err
+	}
+	err = os.WriteFile(indexPath, dt, 0644)
+	if err != nil {
+		return err
+	}
+
+	// The plain layers must not end up in the archive, neither the old
+	// manifests, which reference them
+	skip := make(map[string]bool)
+	for d := range l.encrypted {
+		skip[l.blobPath(d)] = true
+	}
+	for d := range l.stale {
+		skip[l.blobPath(d)] = true
+	}
+	tmp := filepath.Join(dir, "archive.tar")
+	err = createArchive(tmp, layoutDir, skip)
+	if err != nil {
+		return fmt.Errorf("Failed to write %s: %w", archive, err)
+	}
+	fmt.Fprintf(os.Stderr, "Encrypted %d layers of %s\n", len(l.encrypted), archive)
+
+	return os.Rename(tmp, archive)
+}
@@ -0,0 +1,89 @@
+// Copyright (c) 2023-2024, Nubificus LTD
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"path"
+	"strings"
+
+	units "github.com/docker/go-units"
+	"github.com/moby/buildkit/client/llb"
+	"github.com/moby/buildkit/frontend/dockerfile/instructions"
+)
+
+const (
+	ext4Flag           string = "ext4"
+	clientOptExt4Image string = "ext4-image"
+	defaultExt4Image   string = "docker.io/library/alpine:3.20"
+	ext4SrcDir         string = "/src"
+	ext4OutDir         string = "/out"
+)
+
+// defaultExt4Cmd creates an ext4 image of PUN_SIZE bytes with the contents
+// of PUN_SRC, with mkfs.ext4 -d, which needs no loop devices. e2fsprogs get
+// installed if the image does not have them.
+const defaultExt4Cmd string = `
+set -e
+if ! command -v mkfs.ext4 > /dev/null; then
+	apk add --no-cache e2fsprogs > /dev/null
+fi
+truncate -s "$PUN_SIZE" "$PUN_OUT"
+mkfs.ext4 -q -F -E root_owner=0:0 -d "$PUN_SRC" "$PUN_OUT"
+`
+
+// parseExt4Size parses the value of the --ext4 flag, the size of the ext4
+// image in binary units, e.g. 256M.
+func parseExt4Size(val string) (int64, error) {
+	size, err := units.RAMInBytes(val)
+	if err != nil || size <= 0 {
+		return 0, fmt.Errorf("Invalid value %s for --%s, expected the size of the image, e.g. 256M", val, ext4Flag)
+	}
+
+	return size, nil
+}
+
+// checkExt4Copy validates a COPY --ext4, whose destination is the path of
+// the image, rather than a directory.
+func checkExt4Copy(c *instructions.CopyCommand) error {
+	if strings.HasSuffix(c.DestPath, "/") {
+		return fmt.Errorf("The destination of COPY --%s is the path of the image, got %s", ext4Flag, c.DestPath)
+	}
+
+	return nil
+}
+
+// ext4In copies src of from to dst as an ext4 image of the size of the
+// --ext4 flag, instead of as a directory, e.g. for the block device of
+// Firecracker. The image gets created in a container of the ext4 image.
+func ext4In(base llb.State, from llb.State, src string, dst string, flags CopyFlags, opts LLBOpts) llb.State {
+	name := path.Base(dst)
+	runOpts := []llb.RunOption{
+		llb.Args([]string{"/bin/sh", "-c", defaultExt4Cmd}),
+		llb.AddEnv("PUN_SRC", ext4SrcDir),
+		llb.AddEnv("PUN_OUT", path.Join(ext4OutDir, name)),
+		llb.AddEnv("PUN_SIZE", fmt.Sprint(flags.Ext4Size)),
+		llb.AddMount(ext4SrcDir, from, llb.SourcePath(path.Join("/", src)), llb.Readonly),
+		llb.WithCustomName("Create the ext4 image " + dst + " from " + src),
+	}
+	if flags.Normalize || opts.Normalize {
+		// The timestamps of the filesystem come from the fake time
+		runOpts = append(runOpts, llb.AddEnv("E2FSPROGS_FAKE_TIME", fmt.Sprint(normalizedTime(opts).Unix())))
+	}
+	run := llb.Image(opts.Ext4Image).Run(runOpts...)
+	out := run.AddMount(ext4OutDir, llb.Scratch())
+
+	return base.File(llb.Copy(out, name, dst, flags.copyInfo(opts)))
+}
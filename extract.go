@@ -0,0 +1,73 @@
+// Copyright (c) 2023-2024, Nubificus LTD
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"path"
+	"strings"
+
+	"github.com/moby/buildkit/client/llb"
+)
+
+const (
+	extractFlag           string = "extract"
+	clientOptExtractImage string = "extract-image"
+	// Buildkit can not unpack zip archives, so unzip runs in this image
+	defaultExtractImage   string = "docker.io/library/alpine:3.20"
+	extractArchiveDir     string = "/archive"
+	extractOutDir         string = "/out"
+)
+
+// isZip returns true if an archive is a zip file, which buildkit does not
+// unpack by itself.
+func isZip(src string) bool {
+	return strings.EqualFold(path.Ext(src), ".zip")
+}
+
+// unpackState returns a state with the members of the archive src of from
+// that match the patterns, with their paths in the archive. Tarballs, either
+// plain or compressed, get unpacked by buildkit, while zip files get
+// extracted with unzip, in a container of the extraction image. The state
+// is not part of the image, so the archive does not end up in a layer.
+func unpackState(from llb.State, src string, patterns []string, opts LLBOpts) llb.State {
+	if !isZip(src) {
+		return llb.Scratch().File(llb.Copy(from, src, "/", &llb.CopyInfo{
+			AttemptUnpack:  true,
+			CreateDestPath: true,
+		}), llb.WithCustomName("Unpack "+src))
+	}
+
+	archive := path.Join(extractArchiveDir, path.Base(src))
+	args := append([]string{"unzip", "-o", "-q", archive}, patterns...)
+	args = append(args, "-d", extractOutDir)
+	run := llb.Image(opts.ExtractImage).Run(
+		llb.Args(args),
+		llb.AddMount(extractArchiveDir, from, llb.SourcePath(path.Dir(src)), llb.Readonly),
+		llb.WithCustomName("Extract "+strings.Join(patterns, ", ")+" from "+src),
+	)
+
+	return run.AddMount(extractOutDir, llb.Scratch())
+}
+
+// extractIn copies the members of the archive src that match the patterns
+// of the --extract flag to dst, keeping their paths in the archive.
+func extractIn(base llb.State, from llb.State, src string, dst string, flags CopyFlags, opts LLBOpts) llb.State {
+	info := flags.copyInfo(opts)
+	info.CopyDirContentsOnly = true
+	info.IncludePatterns = flags.Extract
+
+	return base.File(llb.Copy(unpackState(from, src, flags.Extract, opts), "/", dst, info),
+			llb.WithCustomName("Extract "+strings.Join(flags.Extract, ", ")+" from "+src))
+}
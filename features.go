@@ -0,0 +1,74 @@
+// Copyright (c) 2023-2024, Nubificus LTD
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+)
+
+const (
+	clientOptExperimental string = "experimental"
+	// Enables all the experimental features
+	allFeatures           string = "all"
+	featureBuilderStages  string = "builder-stages"
+)
+
+// experimentalFeatures are the features that pun ships behind a flag, until
+// they become stable, mapped to their description. Features that become
+// stable get removed from here, along with their checks, while the names of
+// the removed features are still accepted, so that builds which enable them
+// keep working.
+var experimentalFeatures = map[string]string{
+	featureBuilderStages: "Build the stages with RUN with the dockerfile frontend",
+}
+
+// stableFeatures are the features that were experimental in the past.
+var stableFeatures = []string{}
+
+// parseFeatures adds the features of a comma separated list to the enabled
+// ones. The list can also be all, for all the experimental features.
+func parseFeatures(enabled map[string]bool, names []string) error {
+	for _, name := range names {
+		name = strings.TrimSpace(name)
+		if name == "" || slices.Contains(stableFeatures, name) {
+			continue
+		}
+		if name == allFeatures {
+			for feature := range experimentalFeatures {
+				enabled[feature] = true
+			}
+			continue
+		}
+		if _, ok := experimentalFeatures[name]; !ok {
+			return fmt.Errorf("Unknown experimental feature %s", name)
+		}
+		enabled[name] = true
+	}
+
+	return nil
+}
+
+// checkFeature returns an error if the experimental feature that something
+// needs is not enabled.
+func (opts LLBOpts) checkFeature(name string, what string) error {
+	if opts.Features[name] {
+		return nil
+	}
+
+	return fmt.Errorf("%s needs the experimental feature %s, which gets enabled with %s=%s",
+		what, name, clientOptExperimental, name)
+}
@@ -0,0 +1,140 @@
+// Copyright (c) 2023-2024, Nubificus LTD
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/moby/buildkit/client/llb"
+	"github.com/moby/buildkit/frontend/gateway/client"
+)
+
+const (
+	clientOptGlobReport string = "glob-report"
+	// How many matches of a pattern the progress output lists
+	maxProgressMatches  int    = 10
+)
+
+// ReportGlob is a wildcard source of an instruction and the files of the
+// build context that it matched.
+type ReportGlob struct {
+	Cmd     string   `json:"cmd"`
+	Pattern string   `json:"pattern"`
+	Matches []string `json:"matches"`
+}
+
+// globReportFromBuildOpts returns true if the matches of the wildcards in
+// the sources need to be reported.
+func globReportFromBuildOpts(opts map[string]string) (bool, error) {
+	val := opts[clientOptGlobReport]
+	if val == "" {
+		return false, nil
+	}
+	b, err := strconv.ParseBool(val)
+	if err != nil {
+		return false, fmt.Errorf("Invalid %s %s, expected a boolean", clientOptGlobReport, val)
+	}
+
+	return b, nil
+}
+
+// hasWildcards returns true if a source is a pattern.
+func hasWildcards(src string) bool {
+	return strings.ContainsAny(src, "*?[")
+}
+
+// expandGlob returns the files of the image of ref that match the pattern,
+// which is an absolute path, with wildcards in any of its elements.
+func expandGlob(ctx context.Context, ref client.Reference, pattern string) ([]string, error) {
+	elems := strings.Split(strings.Trim(path.Clean(pattern), "/"), "/")
+	matches := []string{"/"}
+	for i, elem := range elems {
+		last := i == len(elems)-1
+		var next []string
+		for _, dir := range matches {
+			entries, err := ref.ReadDir(ctx, client.ReadDirRequest{
+				Path:           dir,
+				IncludePattern: elem,
+			})
+			if err != nil {
+				return nil, fmt.Errorf("Failed to read %s: %w", dir, err)
+			}
+			for _, e := range entries {
+				if ok, _ := path.Match(elem, e.Path); !ok {
+					continue
+				}
+				if !last && !os.FileMode(e.Mode).IsDir() {
+					continue
+				}
+				next = append(next, path.Join(dir, e.Path))
+			}
+		}
+		matches = next
+	}
+	slices.Sort(matches)
+
+	return matches, nil
+}
+
+// addGlobs records the matches of the wildcards in the report. The matches
+// are the same in every platform, so they are only recorded once.
+func (r *BuildReport) addGlobs(globs []ReportGlob) {
+	for _, g := range globs {
+		seen := slices.ContainsFunc(r.Globs, func(other ReportGlob) bool {
+			return other.Cmd == g.Cmd && other.Pattern == g.Pattern
+		})
+		if !seen {
+			r.Globs = append(r.Globs, g)
+		}
+	}
+}
+
+// progressGlobs shows the matches of the wildcards in the progress output,
+// as vertices named after them, since frontends have no other way to print
+// there.
+func progressGlobs(ctx context.Context, c client.Client, globs []ReportGlob) error {
+	for _, g := range globs {
+		shown := g.Matches
+		if len(shown) > maxProgressMatches {
+			shown = shown[:maxProgressMatches]
+		}
+		name := fmt.Sprintf("[glob] %s %s matched %d files: %s", g.Cmd, g.Pattern, len(g.Matches),
+				strings.Join(shown, ", "))
+		if len(shown) < len(g.Matches) {
+			name += ", ..."
+		}
+		st := llb.Scratch().File(llb.Mkfile("matches", 0644, []byte(strings.Join(g.Matches, "\n"))),
+				llb.WithCustomName(name))
+		def, err := st.Marshal(ctx)
+		if err != nil {
+			return fmt.Errorf("Failed to marshal the matches of %s: %w", g.Pattern, err)
+		}
+		_, err = c.Solve(ctx, client.SolveRequest{
+			Definition: def.ToPB(),
+			Evaluate:   true,
+		})
+		if err != nil {
+			return fmt.Errorf("Failed to report the matches of %s: %w", g.Pattern, err)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,318 @@
+// Copyright (c) 2023-2024, Nubificus LTD
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/moby/buildkit/client/llb"
+	"github.com/moby/buildkit/frontend/dockerfile/instructions"
+	"github.com/moby/buildkit/solver/pb"
+	digest "github.com/opencontainers/go-digest"
+)
+
+const (
+	graphCmd     string = "graph"
+	graphDOT     string = "dot"
+	graphMermaid string = "mermaid"
+	graphCtxID   string = "context"
+)
+
+type graphNode struct {
+	ID    string
+	Label string
+	Ext   bool // Outside of the file, e.g. a base image
+}
+
+type graphEdge struct {
+	From  string
+	To    string
+	Label string
+}
+
+// Graph is a directed graph of a build, which gets rendered as DOT or as a
+// mermaid flowchart.
+type Graph struct {
+	Nodes []graphNode
+	Edges []graphEdge
+	seen  map[string]bool
+}
+
+func newGraph() *Graph {
+	return &Graph{
+		seen: make(map[string]bool),
+	}
+}
+
+func (g *Graph) addNode(id string, label string, ext bool) {
+	if g.seen[id] {
+		return
+	}
+	g.seen[id] = true
+	g.Nodes = append(g.Nodes, graphNode{ID: id, Label: label, Ext: ext})
+}
+
+func (g *Graph) addEdge(from string, to string, label string) {
+	g.Edges = append(g.Edges, graphEdge{From: from, To: to, Label: label})
+}
+
+func stageID(images []*PackInstructions, instr *PackInstructions) string {
+	for i, image := range images {
+		if image == instr {
+			return fmt.Sprintf("stage%d", i)
+		}
+	}
+
+	return ""
+}
+
+func stageLabel(images []*PackInstructions, instr *PackInstructions) string {
+	if instr.Name != "" {
+		return instr.Name
+	}
+
+	return strings.Replace(stageID(images, instr), "stage", "stage ", 1)
+}
+
+// stageGraph returns the graph of the images of the file, with edges from
+// the bases and the sources of the copies to the images. If target is set,
+// only the images that the target needs are included.
+func stageGraph(images []*PackInstructions, target *PackInstructions) *Graph {
+	g := newGraph()
+
+	stages := images
+	if target != nil {
+		stages = reachableImages(images, target)
+	}
+	for _, instr := range stages {
+		id := stageID(images, instr)
+		g.addNode(id, stageLabel(images, instr), false)
+
+		if dep := findImage(images, instr, instr.Base); dep != nil {
+			g.addEdge(stageID(images, dep), id, "FROM")
+		} else if instr.Base != "scratch" {
+			g.addNode("base:"+instr.Base, instr.Base, true)
+			g.addEdge("base:"+instr.Base, id, "FROM")
+		}
+
+		for _, cmd := range instr.Copies {
+			switch c := cmd.(type) {
+			case *instructions.CopyCommand:
+				label := fmt.Sprintf("COPY %s %s", strings.Join(c.SourcePaths, " "), c.DestPath)
+				if dep := findImage(images, instr, c.From); dep != nil {
+					g.addEdge(stageID(images, dep), id, label)
+				} else if c.From != "" {
+					g.addNode("base:"+c.From, c.From, true)
+					g.addEdge("base:"+c.From, id, label)
+				} else {
+					g.addNode(graphCtxID, "build context", true)
+					g.addEdge(graphCtxID, id, label)
+				}
+			case *instructions.AddCommand:
+				for _, src := range c.SourcePaths {
+					label := fmt.Sprintf("ADD %s %s", src, c.DestPath)
+					if isRemoteSrc(src) {
+						g.addNode("url:"+src, src, true)
+						g.addEdge("url:"+src, id, label)
+						continue
+					}
+					g.addNode(graphCtxID, "build context", true)
+					g.addEdge(graphCtxID, id, label)
+				}
+			case *SeedCommand:
+				g.addNode(graphCtxID, "build context", true)
+				g.addEdge(graphCtxID, id, "SEED "+c.Dest)
+			}
+		}
+	}
+
+	return g
+}
+
+// opLabel describes an LLB operation in a single line.
+func opLabel(op *pb.Op) string {
+	switch o := op.Op.(type) {
+	case *pb.Op_Source:
+		return o.Source.Identifier
+	case *pb.Op_File:
+		var actions []string
+		for _, action := range o.File.Actions {
+			switch a := action.Action.(type) {
+			case *pb.FileAction_Copy:
+				actions = append(actions, fmt.Sprintf("copy %s %s", a.Copy.Src, a.Copy.Dest))
+			case *pb.FileAction_Mkfile:
+				actions = append(actions, "mkfile "+a.Mkfile.Path)
+			case *pb.FileAction_Mkdir:
+				actions = append(actions, "mkdir "+a.Mkdir.Path)
+			case *pb.FileAction_Rm:
+				actions = append(actions, "rm "+a.Rm.Path)
+			}
+		}
+		return strings.Join(actions, "; ")
+	case *pb.Op_Exec:
+		return strings.Join(o.Exec.Meta.Args, " ")
+	case *pb.Op_Merge:
+		return "merge"
+	case *pb.Op_Diff:
+		return "diff"
+	}
+
+	return "unknown"
+}
+
+// llbGraph returns the graph of the operations of an LLB definition, with
+// edges from the inputs of every operation to it.
+func llbGraph(def *llb.Definition) (*Graph, error) {
+	g := newGraph()
+
+	for _, dt := range def.Def {
+		var op pb.Op
+		err := op.Unmarshal(dt)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to parse LLB operation: %w", err)
+		}
+		id := digest.FromBytes(dt).String()
+		// The last operation only points to the result
+		if op.Op == nil {
+			continue
+		}
+		g.addNode(id, opLabel(&op), false)
+		for _, input := range op.Inputs {
+			g.addEdge(string(input.Digest), id, "")
+		}
+	}
+
+	return g, nil
+}
+
+// writeDOT renders the graph in the DOT language of Graphviz.
+func (g *Graph) writeDOT(w io.Writer) {
+	fmt.Fprintln(w, "digraph pun {")
+	fmt.Fprintln(w, "\trankdir=LR;")
+	for _, n := range g.Nodes {
+		shape := "box"
+		if n.Ext {
+			shape = "ellipse"
+		}
+		fmt.Fprintf(w, "\t%q [label=%q, shape=%s];\n", n.ID, n.Label, shape)
+	}
+	for _, e := range g.Edges {
+		if e.Label == "" {
+			fmt.Fprintf(w, "\t%q -> %q;\n", e.From, e.To)
+			continue
+		}
+		fmt.Fprintf(w, "\t%q -> %q [label=%q];\n", e.From, e.To, e.Label)
+	}
+	fmt.Fprintln(w, "}")
+}
+
+// writeMermaid renders the graph as a mermaid flowchart. Mermaid does not
+// allow arbitrary node ids, so the nodes get numbered.
+func (g *Graph) writeMermaid(w io.Writer) {
+	ids := make(map[string]string)
+	escape := func(s string) string {
+		return strings.ReplaceAll(s, "\"", "#quot;")
+	}
+
+	fmt.Fprintln(w, "flowchart LR")
+	for i, n := range g.Nodes {
+		ids[n.ID] = fmt.Sprintf("n%d", i)
+		if n.Ext {
+			fmt.Fprintf(w, "\t%s([\"%s\"])\n", ids[n.ID], escape(n.Label))
+			continue
+		}
+		fmt.Fprintf(w, "\t%s[\"%s\"]\n", ids[n.ID], escape(n.Label))
+	}
+	for _, e := range g.Edges {
+		if e.Label == "" {
+			fmt.Fprintf(w, "\t%s --> %s\n", ids[e.From], ids[e.To])
+			continue
+		}
+		fmt.Fprintf(w, "\t%s -->|\"%s\"| %s\n", ids[e.From], escape(e.Label), ids[e.To])
+	}
+}
+
+func graphUsage() {
+	fmt.Println("Usage of pun graph")
+	fmt.Printf("%s %s [<args>]\n\n", os.Args[0], graphCmd)
+	fmt.Println("Supported command line arguments")
+	fmt.Println("\t-f, --file filename \t\tPath to the Containerfile (default " + defaultContainerFile + ")")
+	fmt.Println("\t--target name \t\t\tOnly show the images that the target needs")
+	fmt.Println("\t--build-arg KEY=VALUE \t\tSet a build arg (can be used multiple times)")
+	fmt.Println("\t--config filename \t\tPath to the configuration file of pun")
+	fmt.Println("\t--format format \t\tThe format of the graph (dot, mermaid)")
+	fmt.Println("\t--llb bool \t\t\tShow the LLB operations of the target instead")
+}
+
+func graphMain(args []string) {
+	var file, target, configFile, format string
+	var buildArgs stringList
+	var showLLB bool
+
+	fs := flag.NewFlagSet(graphCmd, flag.ExitOnError)
+	fs.StringVar(&file, "file", defaultContainerFile, "Path to the Containerfile")
+	fs.StringVar(&file, "f", defaultContainerFile, "Path to the Containerfile")
+	fs.StringVar(&target, "target", "", "Only show the images that the target needs")
+	fs.Var(&buildArgs, "build-arg", "Set a build arg (can be used multiple times)")
+	fs.StringVar(&configFile, "config", "", "Path to the configuration file of pun")
+	fs.StringVar(&format, "format", graphDOT, "The format of the graph (dot, mermaid)")
+	fs.BoolVar(&showLLB, "llb", false, "Show the LLB operations of the target instead")
+	fs.Usage = graphUsage
+	fs.Parse(args)
+
+	if format != graphDOT && format != graphMermaid {
+		fmt.Printf("Unknown graph format %s\n", format)
+		os.Exit(1)
+	}
+	local, err := loadLocalBuild(file, buildArgs, configFile, target)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+
+	var g *Graph
+	if showLLB {
+		buildCtx, err := contextState("", local.LLBOpts,
+				contextPaths(reachableImages(local.Images, local.Target)))
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		def, err := constructLLB(local.Target, local.Images, buildCtx, local.LLBOpts)
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		g, err = llbGraph(def)
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+	} else if target != "" {
+		g = stageGraph(local.Images, local.Target)
+	} else {
+		g = stageGraph(local.Images, nil)
+	}
+
+	if format == graphMermaid {
+		g.writeMermaid(os.Stdout)
+		return
+	}
+	g.writeDOT(os.Stdout)
+}
@@ -0,0 +1,180 @@
+// Copyright (c) 2023-2024, Nubificus LTD
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"path"
+	"strings"
+
+	"github.com/moby/buildkit/client/llb"
+	"github.com/moby/buildkit/frontend/dockerfile/parser"
+	"github.com/moby/buildkit/frontend/gateway/client"
+)
+
+const (
+	clientOptPreSolveHook  string = "pre-solve-hook"
+	clientOptPostSolveHook string = "post-solve-hook"
+	hookCmd                string = "hook"
+	hookImageFlag          string = "image"
+	// The rootfs of the image gets mounted there in the hook container
+	hookRootfs             string = "/unikernel"
+)
+
+// Hook is a command that runs against the files of the image in a
+// container of Image, e.g. a proprietary tool that signs the kernel. The
+// changes of the command in the mounted rootfs end up in the image.
+type Hook struct {
+	Name  string // The option of the hook, e.g. pre-solve-hook
+	Image string // The image with the tools of the command
+	Cmd   string // The shell command of the hook
+}
+
+// HookCommand is the HOOK instruction of pun, which declares a hook of the
+// image in the file, next to the instructions that it runs against.
+//
+//	HOOK --image=<image> pre-solve|post-solve <command>
+//
+// The command is a shell command, so it is not expanded with the build
+// args, but with the variables of the hook.
+type HookCommand struct {
+	Hook Hook
+	args string // The image, before the expansion
+	loc  []parser.Range
+}
+
+func (c *HookCommand) Name() string {
+	return hookCmd
+}
+
+func (c *HookCommand) Location() []parser.Range {
+	return c.loc
+}
+
+func isHook(node *parser.Node) bool {
+	return strings.EqualFold(node.Value, hookCmd)
+}
+
+// parseHook parses a HOOK instruction, which the dockerfile parser does not
+// know about.
+func parseHook(node *parser.Node) (*HookCommand, error) {
+	c := &HookCommand{
+		loc: nodeLocation(node),
+	}
+	image, ok := popFlag(node, hookImageFlag)
+	if !ok || image == "" {
+		return nil, fmt.Errorf("HOOK requires the image of the hook with --%s", hookImageFlag)
+	}
+	c.args = image
+	if len(node.Flags) > 0 {
+		return nil, fmt.Errorf("Unknown flag %s in HOOK", node.Flags[0])
+	}
+	point, cmd, _ := strings.Cut(rawArgs(node), " ")
+	switch point {
+	case "pre-solve":
+		c.Hook.Name = clientOptPreSolveHook
+	case "post-solve":
+		c.Hook.Name = clientOptPostSolveHook
+	default:
+		return nil, fmt.Errorf("Invalid HOOK %s, expected pre-solve or post-solve", point)
+	}
+	c.Hook.Cmd = strings.TrimSpace(cmd)
+	if c.Hook.Cmd == "" {
+		return nil, fmt.Errorf("HOOK requires the command of the hook")
+	}
+
+	return c, nil
+}
+
+// expand expands any args in the image of the hook.
+func (c *HookCommand) expand(scope *argScope) error {
+	image, err := scope.expand(c.args)
+	if err != nil {
+		return err
+	}
+	c.Hook.Image = image
+
+	return nil
+}
+
+// hook returns the hook name of the image. The hook of the build options, if
+// any, overrides the one of the HOOK instruction.
+func (instr *PackInstructions) hook(name string, opt *Hook) *Hook {
+	if opt != nil {
+		return opt
+	}
+
+	return instr.Hooks[name]
+}
+
+// hookFromBuildOpts returns the hook of the build option name, with the
+// image in name and the command in name-cmd, or nil if it is not set.
+func hookFromBuildOpts(opts map[string]string, name string) (*Hook, error) {
+	image := opts[name]
+	cmd := opts[name+"-cmd"]
+	if image == "" && cmd == "" {
+		return nil, nil
+	}
+	if image == "" || cmd == "" {
+		return nil, fmt.Errorf("The %s needs both %s and %s-cmd", name, name, name)
+	}
+
+	return &Hook{
+		Name:  name,
+		Image: image,
+		Cmd:   cmd,
+	}, nil
+}
+
+// state returns the rootfs after the hook runs against it. The command
+// gets the details of the unikernel through the PUN_* environment variables.
+func (h *Hook) state(rootfs llb.State, instr *PackInstructions) llb.State {
+	var kernel string
+	if kernelPath, ok := instr.Annots[uruncBinaryAnnot]; ok {
+		kernel = path.Join(hookRootfs, kernelPath)
+	}
+	run := llb.Image(h.Image).Run(
+		llb.Args([]string{"/bin/sh", "-c", h.Cmd}),
+		llb.AddEnv("PUN_HOOK", h.Name),
+		llb.AddEnv("PUN_ROOTFS", hookRootfs),
+		llb.AddEnv("PUN_KERNEL", kernel),
+		llb.AddEnv("PUN_UNIKERNEL_TYPE", instr.Annots[uruncUnikernelType]),
+		llb.WithCustomName("Run the " + h.Name),
+	)
+
+	return run.AddMount(hookRootfs, rootfs)
+}
+
+// runHook runs the hook against the solved image of ref and returns the
+// reference of the image that the hook left behind.
+func runHook(ctx context.Context, c client.Client, h *Hook, instr *PackInstructions, ref client.Reference) (client.Reference, error) {
+	rootfs, err := ref.ToState()
+	if err != nil {
+		return nil, err
+	}
+	dt, err := h.state(rootfs, instr).Marshal(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to marshal the %s: %w", h.Name, err)
+	}
+	res, err := c.Solve(ctx, client.SolveRequest{
+		Definition: dt.ToPB(),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("The %s failed: %w", h.Name, err)
+	}
+
+	return res.SingleRef()
+}
@@ -0,0 +1,85 @@
+// Copyright (c) 2023-2024, Nubificus LTD
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"strconv"
+)
+
+const (
+	clientOptHypervisorDefaults string = "hypervisor-defaults"
+	uruncConsoleAnnot           string = "com.urunc.unikernel.consoleDevice"
+	uruncNetModelAnnot          string = "com.urunc.unikernel.netModel"
+	uruncBlockModelAnnot        string = "com.urunc.unikernel.blockModel"
+)
+
+// hypervisorDefaults are the annotations that every hypervisor gets, unless
+// the file sets them, so that the same labels do not get copied between
+// files.
+var hypervisorDefaults = map[string]map[string]string{
+	"qemu": {
+		uruncConsoleAnnot:    "serial",
+		uruncNetModelAnnot:   "virtio-net",
+		uruncBlockModelAnnot: "virtio-blk",
+	},
+	"firecracker": {
+		uruncConsoleAnnot:    "serial",
+		uruncNetModelAnnot:   "virtio-net",
+		uruncBlockModelAnnot: "virtio-blk",
+	},
+	"hvt": {
+		uruncConsoleAnnot:    "solo5",
+		uruncNetModelAnnot:   "solo5-net",
+		uruncBlockModelAnnot: "solo5-block",
+	},
+	"spt": {
+		uruncConsoleAnnot:    "solo5",
+		uruncNetModelAnnot:   "solo5-net",
+		uruncBlockModelAnnot: "solo5-block",
+	},
+	"xen": {
+		uruncConsoleAnnot:    "xen-console",
+		uruncNetModelAnnot:   "xen-netfront",
+		uruncBlockModelAnnot: "xen-blkfront",
+	},
+}
+
+// hypervisorDefaultsFromBuildOpts returns false if the defaults of the
+// hypervisors are disabled.
+func hypervisorDefaultsFromBuildOpts(opts map[string]string) (bool, error) {
+	val := opts[clientOptHypervisorDefaults]
+	if val == "" {
+		return true, nil
+	}
+	b, err := strconv.ParseBool(val)
+	if err != nil {
+		return false, fmt.Errorf("Invalid %s %s, expected a boolean", clientOptHypervisorDefaults, val)
+	}
+
+	return b, nil
+}
+
+// setHypervisorDefaults adds the defaults of the hypervisor of the target to
+// its annotations. Targets without a hypervisor label get none, since they
+// might run on any hypervisor.
+func setHypervisorDefaults(instr *PackInstructions) {
+	defaults := hypervisorDefaults[instr.Annots[uruncHypervisorAnnot]]
+	for key, val := range defaults {
+		if _, ok := instr.Annots[key]; !ok {
+			instr.Annots[key] = val
+		}
+	}
+}
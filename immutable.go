@@ -0,0 +1,144 @@
+// Copyright (c) 2023-2024, Nubificus LTD
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/containerd/containerd/errdefs"
+	"github.com/distribution/reference"
+	bkclient "github.com/moby/buildkit/client"
+	"github.com/moby/buildkit/exporter/containerimage/exptypes"
+	"github.com/moby/buildkit/frontend/gateway/client"
+	digest "github.com/opencontainers/go-digest"
+)
+
+// pushedTags returns the tags that an image output pushes, if any.
+func pushedTags(entry bkclient.ExportEntry) ([]string, error) {
+	var tags []string
+
+	if entry.Type != bkclient.ExporterImage || entry.Attrs["push"] != "true" || entry.Attrs["name"] == "" {
+		return nil, nil
+	}
+	for _, name := range strings.Split(entry.Attrs["name"], ",") {
+		named, err := reference.ParseNormalizedNamed(strings.TrimSpace(name))
+		if err != nil {
+			return nil, fmt.Errorf("Invalid name %s: %w", name, err)
+		}
+		// Pushes by digest can not overwrite anything
+		if _, ok := named.(reference.Digested); ok {
+			continue
+		}
+		tags = append(tags, reference.TagNameOnly(named).String())
+	}
+
+	return tags, nil
+}
+
+// existingTags returns the tags that already exist in their registries,
+// mapped to the digests that they point to.
+func existingTags(ctx context.Context, tags []string) (map[string]digest.Digest, error) {
+	existing := make(map[string]digest.Digest)
+
+	resolver := registryResolver()
+	for _, tag := range tags {
+		_, desc, err := resolver.Resolve(ctx, tag)
+		if errdefs.IsNotFound(err) {
+			continue
+		} else if err != nil {
+			return nil, fmt.Errorf("Failed to resolve %s: %w", tag, err)
+		}
+		existing[tag] = desc.Digest
+	}
+
+	return existing, nil
+}
+
+// predictDigest builds the image of an image output without pushing it and
+// returns its digest, which is the digest that the push would have. The
+// build is the same as the one that pushes, so the latter comes from the
+// cache.
+func predictDigest(ctx context.Context, c *bkclient.Client, solveOpt bkclient.SolveOpt,
+		entry bkclient.ExportEntry, opts BuildCLIOpts) (digest.Digest, error) {
+	attrs := make(map[string]string)
+	for k, v := range entry.Attrs {
+		attrs[k] = v
+	}
+	attrs["push"] = "false"
+	delete(attrs, "unpack")
+
+	dryOpt := solveOpt
+	dryOpt.CacheExports = nil
+	dryOpt.Exports = []bkclient.ExportEntry{{
+		Type:  entry.Type,
+		Attrs: attrs,
+	}}
+	buildFunc := func(ctx context.Context, c client.Client) (*client.Result, error) {
+		return buildImage(ctx, c, newBuildReport(), nil)
+	}
+	resp, err := runBuild(ctx, c, dryOpt, buildFunc, opts)
+	if err != nil {
+		return "", err
+	}
+	imageDigest, err := digest.Parse(resp.ExporterResponse[exptypes.ExporterImageDigestKey])
+	if err != nil {
+		return "", fmt.Errorf("The digest of the image is unknown: %w", err)
+	}
+
+	return imageDigest, nil
+}
+
+// checkImmutableTags fails if an image output would overwrite a tag that
+// already points to a different image, e.g. a released unikernel image. The
+// tags that point to the same image, such as the ones of a reproducible
+// rebuild, are fine.
+func checkImmutableTags(ctx context.Context, c *bkclient.Client, solveOpt bkclient.SolveOpt, opts BuildCLIOpts) error {
+	for _, entry := range solveOpt.Exports {
+		tags, err := pushedTags(entry)
+		if err != nil {
+			return err
+		}
+		existing, err := existingTags(ctx, tags)
+		if err != nil {
+			return err
+		}
+		if len(existing) == 0 {
+			continue
+		}
+
+		imageDigest, err := predictDigest(ctx, c, solveOpt, entry, opts)
+		if err != nil {
+			return fmt.Errorf("Failed to build the image to check the existing tags: %w", err)
+		}
+		for _, tag := range tags {
+			d, ok := existing[tag]
+			if !ok {
+				continue
+			}
+			if d != imageDigest {
+				return fmt.Errorf("The tag %s already exists with digest %s, but the image has digest %s, use --force to overwrite it",
+						tag, d, imageDigest)
+			}
+			if !quietProgress(opts.Progress) {
+				fmt.Fprintf(os.Stderr, "The tag %s already points to the image %s\n", tag, imageDigest)
+			}
+		}
+	}
+
+	return nil
+}
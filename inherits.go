@@ -0,0 +1,180 @@
+// Copyright (c) 2023-2024, Nubificus LTD
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"path"
+	"strings"
+
+	"github.com/moby/buildkit/client/llb"
+	"github.com/moby/buildkit/client/llb/sourceresolver"
+	"github.com/moby/buildkit/frontend/dockerfile/parser"
+	"github.com/moby/buildkit/frontend/gateway/client"
+	ocispecs "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+const (
+	inheritsCmd             string = "inherits"
+	// A comma separated list of patterns of the labels to inherit
+	clientOptLabelAllowlist string = "label-allowlist"
+	punAnnotPrefix          string = "com.nubificus.pun."
+)
+
+// InheritsCommand is the INHERITS instruction of pun, which makes the image
+// inherit the annotations of a published base spec, so that the packaging
+// standards of an organization live in one image and update centrally.
+//
+//	INHERITS <image>
+//
+// The base spec is an image (or an OCI artifact with an image config),
+// whose labels are the annotations to inherit, e.g. an image that pun
+// built from a file with only FROM scratch and LABEL instructions.
+type InheritsCommand struct {
+	Ref  string
+	args string // The arguments of the instruction, before the expansion
+	loc  []parser.Range
+}
+
+func (c *InheritsCommand) Name() string {
+	return inheritsCmd
+}
+
+func (c *InheritsCommand) Location() []parser.Range {
+	return c.loc
+}
+
+func isInherits(node *parser.Node) bool {
+	return strings.EqualFold(node.Value, inheritsCmd)
+}
+
+// parseInherits parses an INHERITS instruction, which the dockerfile parser
+// does not know about.
+func parseInherits(node *parser.Node) (*InheritsCommand, error) {
+	c := &InheritsCommand{
+		loc: nodeLocation(node),
+	}
+	if len(node.Flags) > 0 {
+		return nil, fmt.Errorf("Unknown flag %s in INHERITS", node.Flags[0])
+	}
+	c.args = rawArgs(node)
+	if c.args == "" {
+		return nil, fmt.Errorf("INHERITS requires the reference of a base spec")
+	}
+
+	return c, nil
+}
+
+// expand expands any args in the reference of the base spec.
+func (c *InheritsCommand) expand(scope *argScope) error {
+	words, err := scope.expandWords(c.args)
+	if err != nil {
+		return err
+	}
+	if len(words) != 1 {
+		return fmt.Errorf("INHERITS requires exactly one base spec, got %d", len(words))
+	}
+	c.Ref = words[0]
+
+	return nil
+}
+
+// labelAllowlistFromBuildOpts returns the patterns of the labels that the
+// image may inherit, e.g. org.opencontainers.image.*, or nil if it inherits
+// all of them.
+func labelAllowlistFromBuildOpts(opts map[string]string) ([]string, error) {
+	var allowlist []string
+
+	val := opts[clientOptLabelAllowlist]
+	if val == "" {
+		return nil, nil
+	}
+	for _, pattern := range strings.Split(val, ",") {
+		pattern = strings.TrimSpace(pattern)
+		_, err := path.Match(pattern, "")
+		if err != nil {
+			return nil, fmt.Errorf("Invalid %s pattern %s: %w", clientOptLabelAllowlist, pattern, err)
+		}
+		allowlist = append(allowlist, pattern)
+	}
+
+	return allowlist, nil
+}
+
+// labelAllowed returns true if the image may inherit the label. The labels of
+// urunc and pun are always allowed, since the image needs them to run.
+func labelAllowed(key string, allowlist []string) bool {
+	if allowlist == nil || strings.HasPrefix(key, uruncAnnotPrefix) || strings.HasPrefix(key, punAnnotPrefix) {
+		return true
+	}
+	for _, pattern := range allowlist {
+		if ok, _ := path.Match(pattern, key); ok {
+			return true
+		}
+	}
+
+	return false
+}
+
+// inheritSpec fetches the base spec of the image, if it has one, and adds
+// its labels to the annotations that the file does not set. Only the config
+// of the base spec gets fetched. With an allowlist, the labels that it does
+// not allow, such as the metadata of the CI that built the base spec, are
+// left out of the config and the manifest of the image.
+func inheritSpec(ctx context.Context, c client.Client, instr *PackInstructions, opts LLBOpts,
+		mode llb.ResolveMode, allowlist []string) error {
+	if instr.Inherits == "" {
+		return nil
+	}
+	if opts.Offline {
+		return offlineError("The base spec " + instr.Inherits)
+	}
+
+	var config []byte
+	err := opts.Retry.retry(ctx, "resolve "+instr.Inherits, func() error {
+		var err error
+		_, _, config, err = c.ResolveImageConfig(ctx, instr.Inherits, sourceresolver.Opt{
+			LogName:  "[internal] load base spec " + instr.Inherits,
+			Platform: &opts.Platform,
+			ImageOpt: &sourceresolver.ResolveImageOpt{
+				ResolveMode: mode.String(),
+			},
+		})
+		return err
+	})
+	if err != nil {
+		return fmt.Errorf("Failed to resolve the base spec %s: %w", instr.Inherits, err)
+	}
+	var img ocispecs.Image
+	err = json.Unmarshal(config, &img)
+	if err != nil {
+		return fmt.Errorf("Failed to parse the config of the base spec %s: %w", instr.Inherits, err)
+	}
+
+	for key, val := range img.Config.Labels {
+		if _, ok := instr.Annots[key]; ok || !labelAllowed(key, allowlist) {
+			continue
+		}
+		err = validateAnnot(key, val)
+		if err != nil {
+			return fmt.Errorf("Invalid annotation in the base spec %s: %w", instr.Inherits, err)
+		}
+		instr.Annots[key] = val
+	}
+
+	return nil
+}
@@ -0,0 +1,86 @@
+// Copyright (c) 2023-2024, Nubificus LTD
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	bkclient "github.com/moby/buildkit/client"
+	"github.com/moby/buildkit/frontend/gateway/client"
+)
+
+// The intermediate states of the target that can be built instead of it
+const (
+	clientOptIntermediate   string = "intermediate"
+	intermediatePostBase    string = "post-base"
+	intermediatePostCopies  string = "post-copies"
+	intermediatePreAnnotate string = "pre-annotate"
+)
+
+// intermediateStates are the intermediate states of the target, in the
+// order that they get created.
+var intermediateStates = []string{
+	intermediatePostBase,
+	intermediatePostCopies,
+	intermediatePreAnnotate,
+}
+
+// intermediateFromBuildOpts returns the intermediate state to build instead
+// of the target, if any.
+func intermediateFromBuildOpts(opts map[string]string) (string, error) {
+	val := opts[clientOptIntermediate]
+	if val == "" || slices.Contains(intermediateStates, val) {
+		return val, nil
+	}
+
+	return "", fmt.Errorf("Invalid %s %s, expected one of: %s", clientOptIntermediate, val,
+			strings.Join(intermediateStates, ", "))
+}
+
+// exportIntermediates exports every intermediate state of the target in an
+// OCI layout under dir, e.g. dir/post-copies. The builds are the same as the
+// one of the image up to the intermediate state, so they come from the
+// cache.
+func exportIntermediates(ctx context.Context, c *bkclient.Client, solveOpt bkclient.SolveOpt,
+		dir string, opts BuildCLIOpts) error {
+	for _, name := range intermediateStates {
+		intOpt := solveOpt
+		intOpt.CacheExports = nil
+		intOpt.FrontendAttrs = maps.Clone(solveOpt.FrontendAttrs)
+		intOpt.FrontendAttrs[clientOptIntermediate] = name
+		intOpt.Exports = []bkclient.ExportEntry{{
+			Type:      bkclient.ExporterOCI,
+			Attrs:     map[string]string{"tar": "false"},
+			OutputDir: filepath.Join(dir, name),
+		}}
+
+		buildFunc := func(ctx context.Context, c client.Client) (*client.Result, error) {
+			return buildImage(ctx, c, newBuildReport(), nil)
+		}
+		_, err := runBuild(ctx, c, intOpt, buildFunc, opts)
+		if err != nil {
+			return fmt.Errorf("Failed to export the %s state: %w", name, err)
+		}
+		fmt.Fprintf(os.Stderr, "Exported the %s state to %s\n", name, intOpt.Exports[0].OutputDir)
+	}
+
+	return nil
+}
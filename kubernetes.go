@@ -0,0 +1,248 @@
+// Copyright (c) 2023-2024, Nubificus LTD
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+
+	// Registers kube-pod:// addresses, which connect to buildkitd through
+	// kubectl exec
+	_ "github.com/moby/buildkit/client/connhelper/kubepod"
+)
+
+const (
+	driverRemote       string        = "remote"
+	driverKubernetes   string        = "kubernetes"
+	defaultKubeImage   string        = "docker.io/moby/buildkit:v0.16.0"
+	kubeContainer      string        = "buildkitd"
+	defaultKubeTimeout time.Duration = 2 * time.Minute
+)
+
+// KubeDriver describes where the buildkitd of --driver=kubernetes runs: in
+// an existing pod or service of the cluster, or in a pod that pun creates
+// for the build and deletes afterwards.
+type KubeDriver struct {
+	Context   string        // The context of kubectl, if not the current one
+	Namespace string        // The namespace of the pod, if not the default one
+	Pod       string        // An existing pod with buildkitd
+	Service   string        // The address of an existing buildkitd service
+	Image     string        // The image of buildkitd in the created pod
+	Rootless  bool          // Run the created pod without privileges
+	Timeout   time.Duration // How long to wait for the created pod
+}
+
+// kubeDriverFromCLI parses the --driver-opt arguments of the kubernetes
+// driver, in the form of <key>=<value>.
+func kubeDriverFromCLI(driverOpts []string) (*KubeDriver, error) {
+	driver := &KubeDriver{
+		Image:   defaultKubeImage,
+		Timeout: defaultKubeTimeout,
+	}
+	for _, opt := range driverOpts {
+		key, val, ok := strings.Cut(opt, "=")
+		if !ok {
+			return nil, fmt.Errorf("Invalid driver option %s, expected <key>=<value>", opt)
+		}
+		var err error
+		switch key {
+		case "context":
+			driver.Context = val
+		case "namespace":
+			driver.Namespace = val
+		case "pod":
+			driver.Pod = val
+		case "service":
+			driver.Service = val
+		case "image":
+			driver.Image = val
+		case "rootless":
+			driver.Rootless, err = strconv.ParseBool(val)
+		case "timeout":
+			driver.Timeout, err = time.ParseDuration(val)
+		default:
+			return nil, fmt.Errorf("Unknown driver option %s", key)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("Invalid driver option %s: %w", opt, err)
+		}
+	}
+	if driver.Pod != "" && driver.Service != "" {
+		return nil, fmt.Errorf("The pod and service driver options can not be used together")
+	}
+
+	return driver, nil
+}
+
+// kubectl runs kubectl in the context and the namespace of the driver and
+// returns its output.
+func (d *KubeDriver) kubectl(ctx context.Context, stdin []byte, args ...string) ([]byte, error) {
+	if d.Context != "" {
+		args = append([]string{"--context=" + d.Context}, args...)
+	}
+	if d.Namespace != "" {
+		args = append([]string{"--namespace=" + d.Namespace}, args...)
+	}
+	cmd := exec.CommandContext(ctx, "kubectl", args...)
+	if stdin != nil {
+		cmd.Stdin = bytes.NewReader(stdin)
+	}
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("kubectl %s failed: %w: %s", args[len(args)-1], err, strings.TrimSpace(stderr.String()))
+	}
+
+	return out, nil
+}
+
+// podManifest returns the manifest of the pod of buildkitd. Rootless pods
+// use the rootless image of buildkit, which needs no privileges, but no
+// seccomp and AppArmor profiles.
+func (d *KubeDriver) podManifest(name string) ([]byte, error) {
+	container := map[string]any{
+		"name":  kubeContainer,
+		"image": d.Image,
+		"readinessProbe": map[string]any{
+			"exec": map[string]any{
+				"command": []string{"buildctl", "debug", "workers"},
+			},
+			"periodSeconds": 2,
+		},
+		"securityContext": map[string]any{
+			"privileged": true,
+		},
+	}
+	annotations := map[string]string{}
+	if d.Rootless {
+		if !strings.HasSuffix(d.Image, "-rootless") {
+			container["image"] = d.Image + "-rootless"
+		}
+		container["args"] = []string{"--oci-worker-no-process-sandbox"}
+		container["securityContext"] = map[string]any{
+			"runAsUser":  1000,
+			"runAsGroup": 1000,
+			"seccompProfile": map[string]any{
+				"type": "Unconfined",
+			},
+		}
+		annotations["container.apparmor.security.beta.kubernetes.io/"+kubeContainer] = "unconfined"
+	}
+
+	return json.Marshal(map[string]any{
+		"apiVersion": "v1",
+		"kind":       "Pod",
+		"metadata": map[string]any{
+			"name":        name,
+			"labels":      map[string]string{"app.kubernetes.io/managed-by": "pun"},
+			"annotations": annotations,
+		},
+		"spec": map[string]any{
+			"restartPolicy": "Never",
+			"containers":    []any{container},
+		},
+	})
+}
+
+// podAddr returns the address of buildkitd in a pod, which connects
+// through kubectl exec.
+func (d *KubeDriver) podAddr(pod string) string {
+	q := url.Values{}
+	q.Set("container", kubeContainer)
+	if d.Context != "" {
+		q.Set("context", d.Context)
+	}
+	if d.Namespace != "" {
+		q.Set("namespace", d.Namespace)
+	}
+
+	return (&url.URL{Scheme: "kube-pod", Host: pod, RawQuery: q.Encode()}).String()
+}
+
+// start returns the address of buildkitd in the cluster and a function that
+// cleans up afterwards. Unless the driver uses an existing pod or service,
+// it creates a pod with buildkitd and waits for it to get ready.
+func (d *KubeDriver) start(ctx context.Context) (string, func(), error) {
+	if d.Service != "" {
+		return d.Service, func() {}, nil
+	}
+	if d.Pod != "" {
+		return d.podAddr(d.Pod), func() {}, nil
+	}
+
+	suffix := make([]byte, 4)
+	_, err := rand.Read(suffix)
+	if err != nil {
+		return "", nil, err
+	}
+	name := "pun-buildkitd-" + hex.EncodeToString(suffix)
+	manifest, err := d.podManifest(name)
+	if err != nil {
+		return "", nil, err
+	}
+	cleanup := func() {
+		// The pod gets deleted even if the build got canceled
+		_, err := d.kubectl(context.WithoutCancel(ctx), nil, "delete", "pod", name, "--wait=false")
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to delete the pod %s: %v\n", name, err)
+		}
+	}
+	fmt.Fprintf(os.Stderr, "Creating the pod %s with buildkitd\n", name)
+	_, err = d.kubectl(ctx, manifest, "create", "-f", "-")
+	if err != nil {
+		return "", nil, err
+	}
+	_, err = d.kubectl(ctx, nil, "wait", "--for=condition=Ready",
+			"--timeout="+d.Timeout.String(), "pod/"+name)
+	if err != nil {
+		cleanup()
+		return "", nil, err
+	}
+
+	return d.podAddr(name), cleanup, nil
+}
+
+// driverAddr returns the address of buildkitd for the driver of the build
+// and a function that cleans up after the build.
+func driverAddr(ctx context.Context, opts BuildCLIOpts) (string, func(), error) {
+	switch opts.Driver {
+	case "", driverRemote:
+		if opts.Addr == "" {
+			// Fall back to the buildkitd of nerdctl, on hosts with
+			// containerd, but no docker
+			return nerdctlBuildkitAddr(opts.Namespace), func() {}, nil
+		}
+		return opts.Addr, func() {}, nil
+	case driverKubernetes:
+		driver, err := kubeDriverFromCLI(opts.DriverOpts)
+		if err != nil {
+			return "", nil, err
+		}
+		return driver.start(ctx)
+	}
+
+	return "", nil, fmt.Errorf("Unknown driver %s, expected %s or %s", opts.Driver, driverRemote, driverKubernetes)
+}
@@ -0,0 +1,340 @@
+// Copyright (c) 2023-2024, Nubificus LTD
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"archive/tar"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/containerd/containerd/remotes"
+	"github.com/containerd/platforms"
+	"github.com/distribution/reference"
+	units "github.com/docker/go-units"
+	bkclient "github.com/moby/buildkit/client"
+	"github.com/moby/buildkit/frontend/dockerfile/instructions"
+	ocispecs "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// The comment of the history entries of the layers that pun creates
+const historyComment string = "pun"
+
+// stateHistory returns the history of the layers of the state of an image,
+// as imageState creates them, with an entry for every layer and the
+// instruction that created it. It returns nil if the layers of the base are
+// unknown, e.g. when the base was not resolved.
+func stateHistory(instr *PackInstructions, images []*PackInstructions) []ocispecs.History {
+	var history []ocispecs.History
+	if instr.Dockerfile != nil {
+		// The dockerfile frontend does not return the history of builders
+		return nil
+	} else if instr.Base == "scratch" {
+		history = []ocispecs.History{}
+	} else if dep := findImage(images, instr, instr.Base); dep != nil {
+		history = stateHistory(dep, images)
+	} else if isHTTPBase(instr.Base) {
+		history = []ocispecs.History{{CreatedBy: "FROM " + instr.Base, Comment: historyComment}}
+	} else if instr.Resolved != nil {
+		var config ocispecs.Image
+		if json.Unmarshal(instr.Resolved.Config, &config) == nil {
+			history = config.History
+			if len(history) == 0 {
+				for range config.RootFS.DiffIDs {
+					history = append(history, ocispecs.History{CreatedBy: "FROM " + instr.Base})
+				}
+			}
+		}
+	}
+	if history == nil {
+		return nil
+	}
+	history = append([]ocispecs.History{}, history...)
+
+	add := func(createdBy string) {
+		history = append(history, ocispecs.History{CreatedBy: createdBy, Comment: historyComment})
+	}
+	for _, cmd := range instr.Copies {
+		switch c := cmd.(type) {
+		case *instructions.CopyCommand:
+			if instr.CopyFlags[c].TLS {
+				// See tlsHistory
+				continue
+			}
+			createdBy := fmt.Sprintf("COPY %s %s", c.SourcePaths[0], c.DestPath)
+			if c.From != "" {
+				createdBy = fmt.Sprintf("COPY --from=%s %s %s", c.From, c.SourcePaths[0], c.DestPath)
+			}
+			add(createdBy)
+		case *instructions.AddCommand:
+			for _, src := range c.SourcePaths {
+				add(fmt.Sprintf("ADD %s %s", src, c.DestPath))
+			}
+		case *MkdirCommand:
+			for _, p := range c.Paths {
+				add("MKDIR " + p)
+			}
+		case *RmCommand:
+			for _, p := range c.Paths {
+				add("RM " + p)
+			}
+		case *MvCommand:
+			add(fmt.Sprintf("MV %s %s", c.Src, c.Dest))
+		case *SeedCommand:
+			add(fmt.Sprintf("SEED %s %s", strings.Join(c.sources(), " "), c.Dest))
+		}
+	}
+	if createdBy := instr.Network.historyEntry(); createdBy != "" {
+		add(createdBy)
+	}
+	if hasRm(instr) {
+		// flatten squashes all the layers in one
+		for i := range history {
+			history[i].EmptyLayer = true
+		}
+		add("RM: flatten the image")
+	}
+
+	return history
+}
+
+// tlsHistory records the layers of the TLS material, which come after
+// urunc.json.
+func (instr *PackInstructions) tlsHistory() {
+	for _, c := range tlsCopies(instr) {
+		instr.addHistory(fmt.Sprintf("COPY --%s %s %s", tlsFlag, c.SourcePaths[0], c.DestPath))
+	}
+}
+
+// addHistory records a layer that a step after the solve created, if the
+// history of the image is known.
+func (instr *PackInstructions) addHistory(createdBy string) {
+	if instr.History == nil {
+		return
+	}
+	instr.History = append(instr.History, ocispecs.History{CreatedBy: createdBy, Comment: historyComment})
+}
+
+// imageLayers returns the layers of the images of a manifest or an index,
+// with the instructions that created them, which fetch reads. Attestations
+// are skipped.
+func imageLayers(desc ocispecs.Descriptor, fetch func(ocispecs.Descriptor, any) error) ([]ReportImage, error) {
+	switch desc.MediaType {
+	case ocispecs.MediaTypeImageIndex, mediaTypeDockerList:
+		var index ocispecs.Index
+		err := fetch(desc, &index)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to read index %s: %w", desc.Digest, err)
+		}
+		var images []ReportImage
+		for _, m := range index.Manifests {
+			if m.Platform != nil && m.Platform.OS == "unknown" {
+				continue
+			}
+			if m.Platform == nil && desc.Platform != nil {
+				m.Platform = desc.Platform
+			}
+			sub, err := imageLayers(m, fetch)
+			if err != nil {
+				return nil, err
+			}
+			images = append(images, sub...)
+		}
+		return images, nil
+	case ocispecs.MediaTypeImageManifest, mediaTypeDockerManifest:
+	default:
+		return nil, nil
+	}
+
+	var manifest ocispecs.Manifest
+	err := fetch(desc, &manifest)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to read manifest %s: %w", desc.Digest, err)
+	}
+	var config ocispecs.Image
+	err = fetch(manifest.Config, &config)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to read config %s: %w", manifest.Config.Digest, err)
+	}
+
+	img := ReportImage{
+		Platform: platforms.Format(config.Platform),
+		Digest:   desc.Digest,
+	}
+	var history []ocispecs.History
+	for _, h := range config.History {
+		if !h.EmptyLayer {
+			history = append(history, h)
+		}
+	}
+	for i, layer := range manifest.Layers {
+		l := ReportLayer{
+			Digest: layer.Digest,
+			Size:   layer.Size,
+		}
+		if i < len(history) {
+			l.CreatedBy = history[i].CreatedBy
+		}
+		img.Layers = append(img.Layers, l)
+		img.Size += layer.Size
+	}
+
+	return []ReportImage{img}, nil
+}
+
+// archiveLayers returns the layers of the images of an OCI archive, as the
+// oci and docker exporters write it.
+func archiveLayers(archive string) ([]ReportImage, error) {
+	index, fetch, err := archiveFetcher(archive)
+	if err != nil {
+		return nil, err
+	}
+	var images []ReportImage
+	for _, m := range index.Manifests {
+		sub, err := imageLayers(m, fetch)
+		if err != nil {
+			return nil, err
+		}
+		images = append(images, sub...)
+	}
+
+	return images, nil
+}
+
+// archiveFetcher reads the index of an OCI archive and returns it with a
+// function that reads the manifests and the configs of the archive. Only
+// the small blobs of the archive, such as the manifests and the configs, are
+// kept in memory.
+func archiveFetcher(archive string) (*ocispecs.Index, func(ocispecs.Descriptor, any) error, error) {
+	f, err := os.Open(archive)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer f.Close()
+
+	blobs := make(map[string][]byte)
+	tr := tar.NewReader(f)
+	for {
+		hdr, err := tr.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return nil, nil, fmt.Errorf("Failed to read %s: %w", archive, err)
+		}
+		if hdr.Typeflag != tar.TypeReg || hdr.Size > maxManifestSize {
+			continue
+		}
+		dt, err := io.ReadAll(tr)
+		if err != nil {
+			return nil, nil, fmt.Errorf("Failed to read %s: %w", archive, err)
+		}
+		blobs[path.Clean(hdr.Name)] = dt
+	}
+
+	fetch := func(desc ocispecs.Descriptor, v any) error {
+		dt, ok := blobs[path.Join("blobs", desc.Digest.Algorithm().String(), desc.Digest.Encoded())]
+		if !ok {
+			return fmt.Errorf("%s is not in %s", desc.Digest, archive)
+		}
+		return json.Unmarshal(dt, v)
+	}
+	var index ocispecs.Index
+	dt, ok := blobs[ocispecs.ImageIndexFile]
+	if !ok {
+		return nil, nil, fmt.Errorf("%s has no %s", archive, ocispecs.ImageIndexFile)
+	}
+	err = json.Unmarshal(dt, &index)
+	if err != nil {
+		return nil, nil, fmt.Errorf("Invalid %s in %s: %w", ocispecs.ImageIndexFile, archive, err)
+	}
+
+	return &index, fetch, nil
+}
+
+// registryLayers returns the layers of the images of a pushed image.
+func registryLayers(ctx context.Context, ref string) ([]ReportImage, error) {
+	named, err := reference.ParseNormalizedNamed(ref)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid image reference %s: %w", ref, err)
+	}
+	named = reference.TagNameOnly(named)
+	resolver := registryResolver()
+	name, desc, err := resolver.Resolve(ctx, named.String())
+	if err != nil {
+		return nil, fmt.Errorf("Failed to resolve %s: %w", ref, err)
+	}
+	var fetcher remotes.Fetcher
+	fetcher, err = resolver.Fetcher(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+
+	return imageLayers(desc, func(desc ocispecs.Descriptor, v any) error {
+		return fetchJSON(ctx, fetcher, desc, v)
+	})
+}
+
+// outputLayers returns the layers of the images of the first output that
+// can be read back: an oci or docker archive, or a pushed image. It returns
+// nil if there is no such output.
+func outputLayers(ctx context.Context, exports []bkclient.ExportEntry, outputs []string) ([]ReportImage, error) {
+	for i, entry := range exports {
+		switch entry.Type {
+		case bkclient.ExporterOCI, bkclient.ExporterDocker:
+			attrs, err := parseCSVAttrs("output", outputs[i])
+			if err != nil || attrs["dest"] == "-" {
+				continue
+			}
+			return archiveLayers(attrs["dest"])
+		case bkclient.ExporterImage:
+			if entry.Attrs["push"] != "true" || entry.Attrs["name"] == "" {
+				continue
+			}
+			name, _, _ := strings.Cut(entry.Attrs["name"], ",")
+			return registryLayers(ctx, name)
+		}
+	}
+
+	return nil, nil
+}
+
+// printLayers prints the layers of the images with their sizes and the
+// instructions that created them, followed by the total size.
+func printLayers(w io.Writer, images []ReportImage) {
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	for i, img := range images {
+		if i > 0 {
+			fmt.Fprintln(tw)
+		}
+		fmt.Fprintf(tw, "Layers of %s (%s)\n", img.Platform, img.Digest)
+		fmt.Fprintln(tw, "SIZE\tCREATED BY")
+		for _, l := range img.Layers {
+			createdBy := l.CreatedBy
+			if createdBy == "" {
+				createdBy = "-"
+			}
+			fmt.Fprintf(tw, "%s\t%s\n", units.HumanSize(float64(l.Size)), createdBy)
+		}
+		fmt.Fprintf(tw, "%s\tTotal\n", units.HumanSize(float64(img.Size)))
+	}
+	tw.Flush()
+}
@@ -0,0 +1,340 @@
+// Copyright (c) 2023-2024, Nubificus LTD
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"slices"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/containerd/platforms"
+	"github.com/moby/buildkit/util/appcontext"
+	ocispecs "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+const (
+	lintCmd        string = "lint"
+	lintFormatText string = "text"
+	lintFormatJSON string = "json"
+)
+
+// The severities of the lint rules, in increasing order
+const (
+	lintOff     string = "off"
+	lintInfo    string = "info"
+	lintWarning string = "warning"
+	lintError   string = "error"
+)
+
+var lintSeverities = []string{lintOff, lintInfo, lintWarning, lintError}
+
+// LintCLIOpts are the options of pun lint.
+type LintCLIOpts struct {
+	// The Containerfile to lint
+	ContainerFile string
+	// The name of the image to lint, if the file defines more than one
+	Target        string
+	// Build args in the form of KEY=VALUE
+	BuildArgs     stringList
+	// The configuration file of pun, with the severities of the rules
+	ConfigFile    string
+	// The platforms of the build, which provide the hypervisor
+	Platform      string
+	// The format of the findings, text or json
+	Format        string
+	// Print the rules and their severities instead of linting
+	Rules         bool
+}
+
+// LintFinding is a problem that a lint rule found in the target.
+type LintFinding struct {
+	Rule     string `json:"rule"`
+	Severity string `json:"severity"`
+	Message  string `json:"message"`
+	// The name of the image, if it has one
+	Image    string `json:"image,omitempty"`
+}
+
+// lintContext is what the lint rules check: the target, as parsed, and
+// the platforms of the build.
+type lintContext struct {
+	Local     *LocalBuild
+	Platforms []*ocispecs.Platform
+}
+
+// LintRule is a check of every image that the target needs, which returns
+// the messages of its findings.
+type LintRule struct {
+	Name        string
+	Severity    string // The severity, unless the config file sets one
+	Description string
+	check       func(lc *lintContext, image *PackInstructions) []string
+}
+
+// lintRules are the rules of pun lint.
+var lintRules = []LintRule{
+	{
+		Name:        "kernel-binary",
+		Severity:    lintError,
+		Description: "Every image sets " + uruncBinaryAnnot + ", or its base implies it",
+		check:       requireAnnot(uruncBinaryAnnot),
+	},
+	{
+		Name:        "unikernel-type",
+		Severity:    lintError,
+		Description: "Every image sets " + uruncUnikernelType + ", or its base implies it",
+		check:       requireAnnot(uruncUnikernelType),
+	},
+	{
+		Name:        "hypervisor",
+		Severity:    lintError,
+		Description: "Every image sets " + uruncHypervisorAnnot + ", or the build is for hypervisor platforms",
+		check:       requireHypervisor,
+	},
+}
+
+// requireAnnot returns a check that an image sets an annotation, unless
+// the build detects it from the base of the image. Images with a base spec
+// pass, since the annotation might come from it, which only the build
+// fetches.
+func requireAnnot(key string) func(lc *lintContext, image *PackInstructions) []string {
+	return func(lc *lintContext, image *PackInstructions) []string {
+		if _, ok := image.Annots[key]; ok || image.Inherits != "" {
+			return nil
+		}
+		if _, ok := kernelAnnots(image.Base)[key]; ok {
+			return nil
+		}
+		return []string{fmt.Sprintf("The image does not set %s", key)}
+	}
+}
+
+// requireHypervisor checks that an image sets its hypervisor, unless the
+// platforms of the build provide it, as the OS of every platform.
+func requireHypervisor(lc *lintContext, image *PackInstructions) []string {
+	messages := requireAnnot(uruncHypervisorAnnot)(lc, image)
+	if messages == nil || lc.Platforms[0] == nil {
+		return messages
+	}
+	spec := findAnnotSpec(uruncHypervisorAnnot)
+	for _, p := range lc.Platforms {
+		if !slices.Contains(spec.Values, p.OS) {
+			return []string{fmt.Sprintf("The image does not set %s, and the OS of platform %s is not a hypervisor",
+					uruncHypervisorAnnot, platforms.Format(*p))}
+		}
+	}
+
+	return nil
+}
+
+// lintSeveritiesFromConfig returns the severities of the rules, with the
+// overrides of the config file, which maps the names of the rules to their
+// severities, or off to disable them. The rules of the plugins are named
+// after the plugin, e.g. naming/repository-prefix.
+func lintSeveritiesFromConfig(config *Config) (map[string]string, error) {
+	severities := make(map[string]string)
+
+	for _, rule := range lintRules {
+		severities[rule.Name] = rule.Severity
+	}
+	if config == nil {
+		return severities, nil
+	}
+	err := validateLintPlugins(config.LintPlugins)
+	if err != nil {
+		return nil, err
+	}
+	for name, severity := range config.Lint {
+		plugin, _, isPlugin := strings.Cut(name, "/")
+		if _, ok := config.LintPlugins[plugin]; !ok && isPlugin {
+			return nil, fmt.Errorf("Unknown lint plugin %s of rule %s", plugin, name)
+		}
+		if _, ok := severities[name]; !ok && !isPlugin {
+			return nil, fmt.Errorf("Unknown lint rule %s", name)
+		}
+		if !slices.Contains(lintSeverities, severity) {
+			return nil, fmt.Errorf("Invalid severity %s of lint rule %s, expected one of: off, info, warning, error",
+					severity, name)
+		}
+		severities[name] = severity
+	}
+
+	return severities, nil
+}
+
+// lint runs the enabled rules against every image that the target needs,
+// except for the plain Dockerfiles, which build containers.
+func lint(lc *lintContext, severities map[string]string) []LintFinding {
+	var findings []LintFinding
+
+	for _, image := range reachableImages(lc.Local.Images, lc.Local.Target) {
+		if image.Dockerfile != nil {
+			continue
+		}
+		for _, rule := range lintRules {
+			severity := severities[rule.Name]
+			if severity == lintOff {
+				continue
+			}
+			for _, msg := range rule.check(lc, image) {
+				findings = append(findings, LintFinding{
+					Rule:     rule.Name,
+					Severity: severity,
+					Message:  msg,
+					Image:    image.Name,
+				})
+			}
+		}
+	}
+
+	return findings
+}
+
+// printLintFindings prints the findings as file: severity: message [rule],
+// or as a JSON array.
+func printLintFindings(w io.Writer, file string, findings []LintFinding, format string) error {
+	if format == lintFormatJSON {
+		if findings == nil {
+			findings = []LintFinding{}
+		}
+		return json.NewEncoder(w).Encode(findings)
+	}
+	for _, f := range findings {
+		if f.Image != "" {
+			fmt.Fprintf(w, "%s: %s: %s: %s [%s]\n", file, f.Severity, f.Image, f.Message, f.Rule)
+			continue
+		}
+		fmt.Fprintf(w, "%s: %s: %s [%s]\n", file, f.Severity, f.Message, f.Rule)
+	}
+
+	return nil
+}
+
+func lintUsage() {
+	fmt.Println("Usage of pun lint")
+	fmt.Printf("%s %s [<args>]\n\n", os.Args[0], lintCmd)
+	fmt.Println("Supported command line arguments")
+	fmt.Println("\t-f, --file filename \t\tPath to the Containerfile (default " + defaultContainerFile + ")")
+	fmt.Println("\t--target name \t\t\tThe image to lint, if the file defines many")
+	fmt.Println("\t--build-arg KEY=VALUE \t\tSet a build arg (can be used multiple times)")
+	fmt.Println("\t--config filename \t\tPath to the configuration file of pun, with the severities of the rules")
+	fmt.Println("\t--platform platforms \t\tThe comma separated platforms of the build, e.g. qemu/amd64")
+	fmt.Println("\t--format type \t\t\tThe format of the findings, text or json (default text)")
+	fmt.Println("\t--rules bool \t\t\tPrint the rules and their severities")
+}
+
+func parseLintCLIOpts(args []string) LintCLIOpts {
+	var opts LintCLIOpts
+
+	fs := flag.NewFlagSet(lintCmd, flag.ExitOnError)
+	fs.StringVar(&opts.ContainerFile, "file", defaultContainerFile, "Path to the Containerfile")
+	fs.StringVar(&opts.ContainerFile, "f", defaultContainerFile, "Path to the Containerfile")
+	fs.StringVar(&opts.Target, "target", "", "The image to lint, if the file defines many")
+	fs.Var(&opts.BuildArgs, "build-arg", "Set a build arg (can be used multiple times)")
+	fs.StringVar(&opts.ConfigFile, "config", "", "Path to the configuration file of pun")
+	fs.StringVar(&opts.Platform, "platform", "", "The comma separated platforms of the build")
+	fs.StringVar(&opts.Format, "format", lintFormatText, "The format of the findings, text or json")
+	fs.BoolVar(&opts.Rules, "rules", false, "Print the rules and their severities")
+	fs.Usage = lintUsage
+	fs.Parse(args)
+
+	return opts
+}
+
+// lintLocalBuild lints a local Containerfile with the rules of pun and the
+// plugins of the config file, and returns the findings.
+func lintLocalBuild(ctx context.Context, opts LintCLIOpts) ([]LintFinding, error) {
+	if opts.Format != lintFormatText && opts.Format != lintFormatJSON {
+		return nil, fmt.Errorf("Invalid format %s, expected %s or %s", opts.Format, lintFormatText, lintFormatJSON)
+	}
+	local, err := loadLocalBuild(opts.ContainerFile, opts.BuildArgs, opts.ConfigFile, opts.Target)
+	if err != nil {
+		return nil, err
+	}
+	severities, err := lintSeveritiesFromConfig(local.Config)
+	if err != nil {
+		return nil, err
+	}
+	targetPlatforms, err := platformsFromBuildOpts(map[string]string{clientOptPlatforms: opts.Platform})
+	if err != nil {
+		return nil, err
+	}
+
+	lc := &lintContext{Local: local, Platforms: targetPlatforms}
+	findings := lint(lc, severities)
+	if local.Config == nil {
+		return findings, nil
+	}
+	pluginFindings, err := lintPlugins(ctx, opts.ContainerFile, lc, local.Config.LintPlugins, severities)
+	if err != nil {
+		return nil, err
+	}
+
+	return append(findings, pluginFindings...), nil
+}
+
+// printLintRules prints the rules with their severities, as the config file
+// sets them.
+func printLintRules(w io.Writer, severities map[string]string) {
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "RULE\tSEVERITY\tDESCRIPTION")
+	for _, rule := range lintRules {
+		fmt.Fprintf(tw, "%s\t%s\t%s\n", rule.Name, severities[rule.Name], rule.Description)
+	}
+	tw.Flush()
+}
+
+func lintMain(args []string) {
+	opts := parseLintCLIOpts(args)
+
+	if opts.Rules {
+		var config *Config
+		var err error
+		if opts.ConfigFile != "" {
+			config, err = loadConfig(opts.ConfigFile)
+		}
+		var severities map[string]string
+		if err == nil {
+			severities, err = lintSeveritiesFromConfig(config)
+		}
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		printLintRules(os.Stdout, severities)
+		return
+	}
+	findings, err := lintLocalBuild(appcontext.Context(), opts)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	err = printLintFindings(os.Stdout, opts.ContainerFile, findings, opts.Format)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	for _, f := range findings {
+		if f.Severity == lintError {
+			os.Exit(1)
+		}
+	}
+}
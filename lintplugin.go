@@ -0,0 +1,191 @@
+// Copyright (c) 2023-2024, Nubificus LTD
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os/exec"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/containerd/platforms"
+)
+
+const (
+	// How long a lint plugin may run
+	lintPluginTimeout time.Duration = 30 * time.Second
+)
+
+// LintSpec is the parsed Containerfile that the lint plugins get in their
+// standard input.
+type LintSpec struct {
+	File      string      `json:"file"`
+	// The image to lint
+	Target    LintImage   `json:"target"`
+	// All the images of the file, including the target
+	Images    []LintImage `json:"images"`
+	// The platforms of the build, if given
+	Platforms []string    `json:"platforms,omitempty"`
+}
+
+// LintImage is an image of a LintSpec.
+type LintImage struct {
+	Name        string            `json:"name,omitempty"`
+	Base        string            `json:"base"`
+	Description string            `json:"description,omitempty"`
+	Annotations map[string]string `json:"annotations"`
+	Inherits    string            `json:"inherits,omitempty"`
+	// The names of the args that the image sees
+	Args        []string          `json:"args,omitempty"`
+}
+
+// LintPluginOutput is what the lint plugins write in their standard output.
+// The findings name their rule, which pun prefixes with the name of the
+// plugin, e.g. naming/repository-prefix, and their severity, which the
+// config file can override. Findings without a severity are errors.
+type LintPluginOutput struct {
+	Findings []LintFinding `json:"findings"`
+}
+
+func lintImage(instr *PackInstructions) LintImage {
+	img := LintImage{
+		Name:        instr.Name,
+		Base:        instr.Base,
+		Description: instr.Description,
+		Annotations: instr.Annots,
+		Inherits:    instr.Inherits,
+	}
+	for _, arg := range instr.Args {
+		img.Args = append(img.Args, arg.Name)
+	}
+
+	return img
+}
+
+// lintSpec returns the input of the lint plugins.
+func lintSpec(file string, lc *lintContext) LintSpec {
+	spec := LintSpec{
+		File:   file,
+		Target: lintImage(lc.Local.Target),
+	}
+	for _, instr := range lc.Local.Images {
+		spec.Images = append(spec.Images, lintImage(instr))
+	}
+	for _, p := range lc.Platforms {
+		if p != nil {
+			spec.Platforms = append(spec.Platforms, platforms.Format(*p))
+		}
+	}
+
+	return spec
+}
+
+// validateLintPlugins checks the plugins of the config file, which maps
+// their names to their command lines.
+func validateLintPlugins(plugins map[string][]string) error {
+	for name, cmd := range plugins {
+		if name == "" || strings.Contains(name, "/") {
+			return fmt.Errorf("Invalid name of lint plugin %q", name)
+		}
+		if len(cmd) == 0 {
+			return fmt.Errorf("The lint plugin %s has no command", name)
+		}
+	}
+
+	return nil
+}
+
+// runLintPlugin runs a plugin with the spec in its standard input and
+// returns its findings, with their rules prefixed with the name of the
+// plugin.
+func runLintPlugin(ctx context.Context, name string, cmdline []string, spec []byte) ([]LintFinding, error) {
+	ctx, cancel := context.WithTimeout(ctx, lintPluginTimeout)
+	defer cancel()
+
+	cmd := exec.CommandContext(ctx, cmdline[0], cmdline[1:]...)
+	cmd.Stdin = bytes.NewReader(spec)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("Lint plugin %s failed: %w: %s", name, err, strings.TrimSpace(stderr.String()))
+	}
+	var output LintPluginOutput
+	err = json.Unmarshal(out, &output)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid output of lint plugin %s: %w", name, err)
+	}
+
+	for i, f := range output.Findings {
+		if f.Rule == "" || f.Message == "" {
+			return nil, fmt.Errorf("Lint plugin %s returned a finding without a rule or a message", name)
+		}
+		if f.Severity == "" {
+			f.Severity = lintError
+		}
+		if f.Severity == lintOff || !slices.Contains(lintSeverities, f.Severity) {
+			return nil, fmt.Errorf("Lint plugin %s returned the invalid severity %s for rule %s", name, f.Severity, f.Rule)
+		}
+		f.Rule = name + "/" + f.Rule
+		output.Findings[i] = f
+	}
+
+	return output.Findings, nil
+}
+
+// lintPlugins runs the plugins of the config file and returns their
+// findings, with the severities of the config file. The plugins run in the
+// order of their names, so that the output is the same in every run.
+func lintPlugins(ctx context.Context, file string, lc *lintContext, plugins map[string][]string,
+		severities map[string]string) ([]LintFinding, error) {
+	var findings []LintFinding
+
+	if len(plugins) == 0 {
+		return nil, nil
+	}
+	spec, err := json.Marshal(lintSpec(file, lc))
+	if err != nil {
+		return nil, err
+	}
+	var names []string
+	for name := range plugins {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+	for _, name := range names {
+		pluginFindings, err := runLintPlugin(ctx, name, plugins[name], spec)
+		if err != nil {
+			return nil, err
+		}
+		for _, f := range pluginFindings {
+			if severity, ok := severities[f.Rule]; ok {
+				f.Severity = severity
+			}
+			if f.Severity == lintOff {
+				continue
+			}
+			if f.Image == "" {
+				f.Image = lc.Local.Target.Name
+			}
+			findings = append(findings, f)
+		}
+	}
+
+	return findings, nil
+}
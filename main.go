@@ -23,16 +23,22 @@ import (
 	"fmt"
 	"bytes"
 	"strings"
-	"io/ioutil"
+	"path"
+	"io"
+	"slices"
+	"unicode/utf8"
 
+	"github.com/containerd/platforms"
 	"github.com/moby/buildkit/exporter/containerimage/exptypes"
 	"github.com/moby/buildkit/frontend/gateway/grpcclient"
 	"github.com/moby/buildkit/util/appcontext"
 	"github.com/moby/buildkit/client/llb"
 	"github.com/moby/buildkit/frontend/gateway/client"
+	digest "github.com/opencontainers/go-digest"
 	ocispecs "github.com/opencontainers/image-spec/specs-go/v1"
 	"github.com/moby/buildkit/frontend/dockerfile/instructions"
-	"github.com/moby/buildkit/frontend/dockerfile/parser"
+	"github.com/moby/buildkit/frontend/subrequests"
+	"github.com/moby/buildkit/frontend/subrequests/outline"
 )
 
 const (
@@ -40,7 +46,26 @@ const (
 	unikraftHub        string = "unikraft.org"
 	packContextName    string = "context"
 	clientOptFilename  string = "filename"
+	clientOptBuildCtx  string = "context"
+	clientOptTarget    string = "target"
 	uruncJSONPath      string = "/urunc.json"
+	// The key of urunc.json in the metadata of the result
+	uruncJSONMetaKey   string = "frontend.pun.urunc-json"
+	// Containerfiles are small. Anything larger than that is most probably
+	// a wrong file and we should not read it in memory.
+	maxFileSize        int64  = 1 << 20
+)
+
+// Annotations which registries like Harbor understand, in order to
+// distinguish unikernel artifacts from the usual container images. pun build
+// also sets the artifact type of the manifests of oci outputs.
+const (
+	annotImageTitle     string = "org.opencontainers.image.title"
+	annotImageDesc      string = "org.opencontainers.image.description"
+	annotImageBaseName  string = "org.opencontainers.image.base.name"
+	unikernelArtifact   string = "application/vnd.urunc.unikernel.v1"
+	unikernelImageDesc  string = "Unikernel image packed with pun for urunc"
+	uruncUnikernelType  string = "com.urunc.unikernel.unikernelType"
 )
 
 type CLIOpts struct {
@@ -51,12 +76,42 @@ type CLIOpts struct {
 	// Choose the execution mode. If set, then pun will not act as a
 	// buidlkit frontend. Instead it will just print the LLB.
 	PrintLLB       bool
+	// A git URL to use as the build context, instead of the local one
+	GitContext     string
+	// The name of the image to build, if the file defines more than one
+	Target         string
+	// Build args in the form of KEY=VALUE
+	BuildArgs      stringList
+	// The configuration file of pun
+	ConfigFile     string
+	// Forbid anything that needs the network
+	Offline        bool
+	// The policy that the image must follow
+	PolicyFile     string
+	// Reset the ownership and the timestamps of all the copied files
+	Normalize      bool
 }
 
 type PackInstructions struct {
+	Name   string			  // The name of the image, if any
 	Base   string			  // The Base image to use
-	Copies []instructions.CopyCommand // Copy commands
+	Copies []instructions.Command	  // Copy, Add, Mkdir, Rm and Mv commands, in order
+	CopyFlags map[instructions.Command]CopyFlags // The flags of pun in the copies
 	Annots map[string]string	  // Annotations
+	Platform *ocispecs.Platform	  // The platform of the base, if set in FROM
+	Resolved *BaseImage		  // The resolved base image, if any
+	Description string		  // The comment of FROM, if any
+	Args   []ArgDecl		  // The ARG declarations that the image sees
+	Libraries []UnikraftLib		  // The libraries of the unikraft kernel, if known
+	History []ocispecs.History	  // The history of the layers, if known
+	Disks  []ScratchDisk		  // The disks that urunc creates at runtime
+	Network NetworkFiles		  // The entries of resolv.conf and the hosts file
+	Configs []*ConfigCommand	  // The configuration files of the application
+	Profiles []Profile		  // The variants of the unikernel that urunc picks
+	Dockerfile []byte		  // The Dockerfile of builder stages, see builderStages
+	BuilderState *llb.State		  // The state of the builder stage, once solved
+	Inherits string			  // The base spec whose labels the image inherits
+	Hooks  map[string]*Hook		  // The hooks of HOOK, by the name of their option
 }
 
 var version string
@@ -64,11 +119,32 @@ var version string
 func usage() {
 
 	fmt.Println("Usage of pun")
-	fmt.Printf("%s [<args>]\n\n", os.Args[0])
+	fmt.Printf("%s [<args>]\n", os.Args[0])
+	fmt.Printf("%s %s [<args>] [<context>]\n", os.Args[0], buildCmd)
+	fmt.Printf("%s %s [<args>] [<context>] [-- <nerdctl run args>]\n", os.Args[0], runCmd)
+	fmt.Printf("%s %s [<args>] <imageA> <imageB>\n", os.Args[0], diffCmd)
+	fmt.Printf("%s %s [<args>]\n", os.Args[0], annotationsCmd)
+	fmt.Printf("%s %s [<args>]\n", os.Args[0], validateCmd)
+	fmt.Printf("%s %s [<args>]\n", os.Args[0], lintCmd)
+	fmt.Printf("%s %s [<args>]\n", os.Args[0], graphCmd)
+	fmt.Printf("%s %s %s|%s [<args>]\n", os.Args[0], cacheCmd, cacheDuCmd, cachePruneCmd)
+	fmt.Printf("%s %s [<args>]\n", os.Args[0], selftestCmd)
+	fmt.Printf("%s %s [<args>]\n", os.Args[0], serveCmd)
+	fmt.Printf("%s %s %s <app>:<tag> [<args>]\n", os.Args[0], catalogCmd, catalogBuildCmd)
+	fmt.Printf("%s %s [<args>] [<context>]\n", os.Args[0], s2iCmd)
+	fmt.Printf("%s %s %s|%s [<args>]\n", os.Args[0], bundleCmd, bundleExportCmd, bundleImportCmd)
+	fmt.Printf("%s %s [<args>] [<target>...]\n\n", os.Args[0], bakeCmd)
 	fmt.Println("Supported command line arguments")
 	fmt.Println("\t-v, --version bool \t\tPrint the version and exit")
 	fmt.Println("\t-f, --file filename \t\tPath to the Containerfile")
 	fmt.Println("\t--LLB bool \t\t\tPrint the LLB instead of acting as a frontend")
+	fmt.Println("\t--git-context url \t\tUse a git repository as the build context")
+	fmt.Println("\t--target name \t\t\tThe image to build, if the file defines many")
+	fmt.Println("\t--build-arg KEY=VALUE \t\tSet a build arg (can be used multiple times)")
+	fmt.Println("\t--config filename \t\tPath to the configuration file of pun")
+	fmt.Println("\t--offline bool \t\t\tFail if the build needs network access")
+	fmt.Println("\t--policy filename \t\tThe policy that the image must follow (default $PUN_POLICY)")
+	fmt.Println("\t--normalize bool \t\tReset the owner and the timestamps of all the copied files")
 }
 
 func parseCLIOpts() CLIOpts {
@@ -79,6 +155,13 @@ func parseCLIOpts() CLIOpts {
 	flag.StringVar(&opts.ContainerFile, "file", "", "Path to the Containerfile")
 	flag.StringVar(&opts.ContainerFile, "f", "", "Path to the Containerfile")
 	flag.BoolVar(&opts.PrintLLB, "LLB", false, "Print the LLB, instead of acting as a frontend")
+	flag.StringVar(&opts.GitContext, "git-context", "", "Use a git repository as the build context")
+	flag.StringVar(&opts.Target, "target", "", "The image to build, if the file defines many")
+	flag.Var(&opts.BuildArgs, "build-arg", "Set a build arg (can be used multiple times)")
+	flag.StringVar(&opts.ConfigFile, "config", "", "Path to the configuration file of pun")
+	flag.BoolVar(&opts.Offline, "offline", false, "Fail if the build needs network access")
+	flag.StringVar(&opts.PolicyFile, "policy", "", "The policy that the image must follow")
+	flag.BoolVar(&opts.Normalize, "normalize", false, "Reset the owner and the timestamps of all the copied files")
 
 	flag.Usage = usage
 	flag.Parse()
@@ -86,15 +169,51 @@ func parseCLIOpts() CLIOpts {
 	return opts
 }
 
-func parseFile(fileBytes []byte) (*PackInstructions, error) {
+// normalizeFile removes the UTF-8 byte order mark and converts CRLF line
+// endings to LF, which files edited in Windows usually have. Furthermore,
+// it checks that the file is valid UTF-8, reporting where it is not.
+func normalizeFile(fileBytes []byte) ([]byte, error) {
+	fileBytes = bytes.TrimPrefix(fileBytes, []byte("\xef\xbb\xbf"))
+	fileBytes = bytes.ReplaceAll(fileBytes, []byte("\r\n"), []byte("\n"))
+
+	line := 1
+	lineStart := 0
+	for offset := 0; offset < len(fileBytes); {
+		r, size := utf8.DecodeRune(fileBytes[offset:])
+		if r == utf8.RuneError && size <= 1 {
+			return nil, fmt.Errorf("Invalid UTF-8 at line %d, column %d (byte offset %d)", line, offset-lineStart+1, offset)
+		}
+		if r == '\n' {
+			line++
+			lineStart = offset + size
+		}
+		offset += size
+	}
+
+	return fileBytes, nil
+}
+
+// parseFile parses the packing instructions of all the images that the file
+// defines. Every FROM instruction starts the definition of a new image
+// (e.g. qemu and firecracker variants of the same application), which can
+// get named with FROM ... AS <name>.
+//
+// The args contain the build args which can be used in the instructions.
+func parseFile(fileBytes []byte, args map[string]string) ([]*PackInstructions, error) {
+	var images []*PackInstructions
 	var instr *PackInstructions
-	instr = new(PackInstructions)
-	instr.Annots = make(map[string]string)
+	var globalDecls []ArgDecl
 
-	r := bytes.NewReader(fileBytes)
+	// Args declared before the first FROM can only be used in FROM
+	globalScope := newArgScope(args, nil)
+	scope := globalScope
 
+	fileBytes, err := normalizeFile(fileBytes)
+	if err != nil {
+		return nil, err
+	}
 	// Parse the Dockerfile
-	parseRes, err := parser.Parse(r)
+	parseRes, err := parsedSpecs.parse(fileBytes)
 	if err != nil {
 		fmt.Printf("Failed to parse file: %v\n", err)
 		return nil, err
@@ -102,55 +221,474 @@ func parseFile(fileBytes []byte) (*PackInstructions, error) {
 
 	// Traverse Dockerfile commands
 	for _, child := range parseRes.AST.Children {
-		cmd, err := instructions.ParseInstruction(child)
+		cond, hasCond := popCondition(child)
+		copyFlags, err := popCopyFlags(child)
+		if err != nil {
+			return nil, err
+		}
+		var cmd interface{}
+		if isMkdir(child) {
+			cmd, err = parseMkdir(child)
+		} else if isRm(child) {
+			cmd, err = parseRm(child)
+		} else if isMv(child) {
+			cmd, err = parseMv(child)
+		} else if isDisk(child) {
+			cmd, err = parseDisk(child)
+		} else if isSeed(child) {
+			cmd, err = parseSeed(child)
+		} else if isProfile(child) {
+			cmd, err = parseProfile(child)
+		} else if isConfig(child) {
+			cmd, err = parseConfig(child)
+		} else if isDNS(child) {
+			cmd, err = parseDNS(child)
+		} else if isHost(child) {
+			cmd, err = parseHost(child)
+		} else if isInherits(child) {
+			cmd, err = parseInherits(child)
+		} else if isHook(child) {
+			cmd, err = parseHook(child)
+		} else {
+			cmd, err = instructions.ParseInstruction(child)
+		}
 		if err != nil {
 			fmt.Printf("Failed to parse instruction %s: %v\n", child.Value, err)
 			return nil, err
 		}
+		if hasCond {
+			// Handle --if conditions
+			if _, ok := cmd.(*instructions.Stage); ok {
+				return nil, fmt.Errorf("The --if flag can not be used in FROM")
+			}
+			include, err := scope.evalCondition(cond)
+			if err != nil {
+				return nil, err
+			}
+			if !include {
+				continue
+			}
+		}
+		if c, ok := cmd.(*instructions.ArgCommand); ok {
+			// Handle ARG
+			err = scope.declare(c, args)
+			if err != nil {
+				return nil, err
+			}
+			decls := argDecls(c, child.StartLine, instr == nil)
+			if instr == nil {
+				globalDecls = append(globalDecls, decls...)
+			} else {
+				instr.Args = append(instr.Args, decls...)
+			}
+			continue
+		}
+		if _, ok := cmd.(*instructions.Stage); !ok && instr == nil {
+			fmt.Printf("Ignoring %s instruction before FROM\n", child.Value)
+			continue
+		}
 		switch c := cmd.(type) {
 		case *instructions.Stage:
 			// Handle FROM
-			if instr.Base != "" {
-				return nil, fmt.Errorf("Multi-stage builds are not supported")
+			instr = new(PackInstructions)
+			instr.Name = c.Name
+			instr.Description = c.Comment
+			instr.Annots = make(map[string]string)
+			instr.CopyFlags = make(map[instructions.Command]CopyFlags)
+			instr.Args = slices.Clone(globalDecls)
+			instr.Base, err = globalScope.expand(c.BaseName)
+			if err != nil {
+				return nil, err
+			}
+			instr.Platform, err = parseStagePlatform(c.Platform, globalScope)
+			if err != nil {
+				return nil, err
 			}
-			instr.Base = c.BaseName
+			images = append(images, instr)
+			scope = newArgScope(args, globalScope)
 		case *instructions.CopyCommand:
 			// Handle COPY
-			instr.Copies = append(instr.Copies, *c)
+			err = c.Expand(scope.expand)
+			if err != nil {
+				return nil, err
+			}
+			c.From, err = scope.expand(c.From)
+			if err != nil {
+				return nil, err
+			}
+			if copyFlags.Ext4Size > 0 {
+				err = checkExt4Copy(c)
+				if err != nil {
+					return nil, err
+				}
+				// The ext4 image is the block device, unless a
+				// label says otherwise
+				if _, ok := instr.Annots[uruncBlockAnnot]; !ok {
+					instr.Annots[uruncBlockAnnot] = c.DestPath
+				}
+			}
+			instr.Copies = append(instr.Copies, c)
+			instr.CopyFlags[c] = copyFlags
+			if copyFlags.TLS {
+				// urunc finds the TLS material through the annotation
+				instr.Annots[uruncTLSAnnot] = tlsPathsAnnot(tlsCopies(instr))
+			}
+		case *instructions.AddCommand:
+			// Handle ADD
+			err = c.Expand(scope.expand)
+			if err != nil {
+				return nil, err
+			}
+			err = checkAdd(c)
+			if err != nil {
+				return nil, err
+			}
+			instr.Copies = append(instr.Copies, c)
+			instr.CopyFlags[c] = copyFlags
 		case *instructions.LabelCommand:
-			// Handle LABLE annotations
+			// Handle LABLE annotations, expanding any build args
+			// before they reach urunc.json
+			err = c.Expand(scope.expand)
+			if err != nil {
+				return nil, err
+			}
 			for _, kvp := range c.Labels {
 				annotKey := strings.Trim(kvp.Key, "\"")
-				instr.Annots[annotKey] = strings.Trim(kvp.Value, "\"")
+				annotVal := strings.Trim(kvp.Value, "\"")
+				err = validateAnnot(annotKey, annotVal)
+				if err != nil {
+					return nil, err
+				}
+				instr.Annots[annotKey] = annotVal
+			}
+		case *MkdirCommand:
+			// Handle MKDIR
+			err = c.expand(scope)
+			if err != nil {
+				return nil, err
+			}
+			instr.Copies = append(instr.Copies, c)
+		case *RmCommand:
+			// Handle RM
+			err = c.expand(scope)
+			if err != nil {
+				return nil, err
+			}
+			instr.Copies = append(instr.Copies, c)
+		case *MvCommand:
+			// Handle MV
+			err = c.expand(scope)
+			if err != nil {
+				return nil, err
+			}
+			instr.Copies = append(instr.Copies, c)
+		case *SeedCommand:
+			// Handle SEED, which urunc finds through its annotation,
+			// unless a label says otherwise
+			err = c.expand(scope)
+			if err != nil {
+				return nil, err
+			}
+			if _, ok := instr.Annots[uruncSeedAnnot]; !ok {
+				instr.Annots[uruncSeedAnnot] = c.Dest
+			}
+			instr.Copies = append(instr.Copies, c)
+		case *ProfileCommand:
+			// Handle PROFILE, which only reaches urunc.json
+			err = c.expand(scope)
+			if err != nil {
+				return nil, err
+			}
+			err = instr.addProfile(c.Profile)
+			if err != nil {
+				return nil, err
+			}
+			instr.Annots[uruncProfilesAnnot] = profilesAnnot(instr.Profiles)
+		case *ConfigCommand:
+			// Handle CONFIG, whose files get written after urunc.json
+			err = c.expand(scope)
+			if err != nil {
+				return nil, err
+			}
+			instr.Configs = append(instr.Configs, c)
+		case *DNSCommand:
+			// Handle DNS, whose entries get written after the copies
+			err = c.expand(scope)
+			if err != nil {
+				return nil, err
 			}
+			instr.Network.Nameservers = append(instr.Network.Nameservers, c.Nameservers...)
+			instr.Network.Search = append(instr.Network.Search, c.Search...)
+			instr.Network.Options = append(instr.Network.Options, c.Options...)
+		case *HostCommand:
+			// Handle HOST, whose entries get written after the copies
+			err = c.expand(scope)
+			if err != nil {
+				return nil, err
+			}
+			instr.Network.Hosts = append(instr.Network.Hosts, c)
+		case *InheritsCommand:
+			// Handle INHERITS, whose base spec gets fetched before the
+			// build
+			if instr.Inherits != "" {
+				return nil, fmt.Errorf("INHERITS can only be used once in an image")
+			}
+			err = c.expand(scope)
+			if err != nil {
+				return nil, err
+			}
+			instr.Inherits = c.Ref
+		case *HookCommand:
+			// Handle HOOK, which the build options can override
+			if _, ok := instr.Hooks[c.Hook.Name]; ok {
+				return nil, fmt.Errorf("HOOK %s can only be used once in an image", c.Hook.Name)
+			}
+			err = c.expand(scope)
+			if err != nil {
+				return nil, err
+			}
+			if instr.Hooks == nil {
+				instr.Hooks = make(map[string]*Hook)
+			}
+			instr.Hooks[c.Hook.Name] = &c.Hook
+		case *DiskCommand:
+			// Handle DISK, which only reaches urunc.json
+			err = c.expand(scope)
+			if err != nil {
+				return nil, err
+			}
+			instr.Disks = append(instr.Disks, c.Disk)
+			instr.Annots[uruncScratchDisksAnnot] = scratchDisksAnnot(instr.Disks)
 		case instructions.Command:
-			// Catch all other commands
-			fmt.Printf("UNsupported command%s\n", c.Name())
+			// Catch all other commands. The ones of containers make the
+			// image a builder stage
+			if !slices.Contains(dockerfileOnlyCmds, strings.ToLower(c.Name())) {
+				fmt.Printf("UNsupported command%s\n", c.Name())
+			}
 		default:
 			fmt.Printf("%f is not a command type\n", c)
 		}
 
 	}
+	if len(images) == 0 {
+		return nil, fmt.Errorf("No FROM instruction was found")
+	}
+	err = builderStages(fileBytes, images)
+	if err != nil {
+		return nil, err
+	}
+
+	return images, nil
+}
+
+// selectImage returns the image with the given name. If no name is
+// specified, the last image of the file gets selected, as in docker build.
+func selectImage(images []*PackInstructions, target string) (*PackInstructions, error) {
+	if target == "" {
+		return images[len(images)-1], nil
+	}
+	for _, image := range images {
+		if strings.EqualFold(image.Name, target) {
+			return image, nil
+		}
+	}
 
-	return instr, nil
+	return nil, fmt.Errorf("Target %s was not found", target)
 }
 
-func copyIn(base llb.State, from string, src string, dst string) llb.State {
+func copyIn(base llb.State, from llb.State, src string, dst string, flags CopyFlags, opts LLBOpts) llb.State {
 	var copyState llb.State
-	var localSrc llb.State
 
-	localSrc = llb.Local(packContextName)
-	copyState = base.File(llb.Copy(localSrc, src, dst, &llb.CopyInfo{
-				CreateDestPath: true,}))
+	if len(flags.Extract) > 0 {
+		return extractIn(base, from, src, dst, flags, opts)
+	}
+	if flags.Ext4Size > 0 {
+		return ext4In(base, from, src, dst, flags, opts)
+	}
+	info := flags.copyInfo(opts)
+	info.AllowWildcard = hasWildcards(src)
+	copyState = base.File(llb.Copy(from, src, dst, info))
 
 	return copyState
 }
 
-func constructLLB(instr PackInstructions) (*llb.Definition, error) {
-	var base llb.State
+// linkIn merges a layer on top of base, for COPY --link and ADD --link. The
+// files get copied in a layer of their own, which does not depend on the
+// layers below it, so buildkit caches it by the content of its sources
+// alone and a change in the base or in a previous copy does not invalidate
+// it.
+func linkIn(base llb.State, layer llb.State) llb.State {
+	return llb.Merge([]llb.State{base, layer}, llb.WithCustomName("Merge the linked files"))
+}
+
+// isRemoteSrc returns true if the source of an ADD is a HTTP(S) URL.
+func isRemoteSrc(src string) bool {
+	return strings.HasPrefix(src, "http://") || strings.HasPrefix(src, "https://")
+}
+
+// checkAdd validates the sources and the checksum of an ADD instruction.
+// A checksum can only be used for HTTP(S) sources.
+func checkAdd(c *instructions.AddCommand) error {
+	if c.Checksum == "" {
+		return nil
+	}
+	_, err := digest.Parse(c.Checksum)
+	if err != nil {
+		return fmt.Errorf("Invalid checksum %s in ADD: %w", c.Checksum, err)
+	}
+	for _, src := range c.SourcePaths {
+		if !isRemoteSrc(src) {
+			return fmt.Errorf("Checksum can only be used with HTTP(S) sources in ADD, got %s", src)
+		}
+	}
+
+	return nil
+}
+
+// addIn handles an ADD instruction. Remote sources get downloaded, verifying
+// their checksum if it was specified and local archives get extracted. With
+// --extract, only the matching members of the archives get extracted.
+func addIn(base llb.State, from llb.State, c *instructions.AddCommand, flags CopyFlags, opts LLBOpts) llb.State {
+	for _, src := range c.SourcePaths {
+		info := flags.copyInfo(opts)
+		if !isRemoteSrc(src) {
+			if len(flags.Extract) > 0 {
+				base = extractIn(base, from, src, c.DestPath, flags, opts)
+				continue
+			}
+			info.AttemptUnpack = true
+			base = base.File(llb.Copy(from, src, c.DestPath, info))
+			continue
+		}
+
+		filename := path.Base(src)
+		httpOpts := []llb.HTTPOption{llb.Filename(filename)}
+		if c.Checksum != "" {
+			httpOpts = append(httpOpts, llb.Checksum(digest.Digest(c.Checksum)))
+		}
+		remote := llb.HTTP(src, httpOpts...)
+		if len(flags.Extract) > 0 {
+			base = extractIn(base, remote, filename, c.DestPath, flags, opts)
+			continue
+		}
+		base = base.File(llb.Copy(remote, filename, c.DestPath, info))
+	}
+
+	return base
+}
+
+// imageState returns the LLB state of an image, after performing all of its
+// copies. Images might depend on previously defined images, either using
+// them as a base or copying files from them.
+func imageState(instr *PackInstructions, images []*PackInstructions, buildCtx llb.State, opts LLBOpts) (llb.State, error) {
+	if instr.Dockerfile != nil {
+		if instr.BuilderState == nil {
+			return llb.State{}, fmt.Errorf("The builder stage %s needs the dockerfile frontend of buildkit", instr.Name)
+		}
+		return *instr.BuilderState, nil
+	}
+	base, err := baseState(instr, images, buildCtx, opts)
+	if err != nil {
+		return base, err
+	}
+
+	// Perform any copies inside the image. The TLS material gets copied
+	// after urunc.json, in the target only
+	for _, cmd := range instr.Copies {
+		if c, ok := cmd.(*instructions.CopyCommand); ok && instr.CopyFlags[c].TLS {
+			continue
+		}
+		base, err = commandState(base, cmd, instr, images, buildCtx, opts)
+		if err != nil {
+			return base, err
+		}
+	}
+	base = networkFilesIn(base, &instr.Network, opts)
+	if hasRm(instr) {
+		base = flatten(base)
+	}
+
+	return base, nil
+}
+
+// copyCommandState returns the LLB state of base after a COPY of the image.
+// The copies from other images or stages only get the paths that the image
+// copies from them.
+func copyCommandState(base llb.State, c *instructions.CopyCommand, instr *PackInstructions,
+		images []*PackInstructions, buildCtx llb.State, opts LLBOpts) (llb.State, error) {
+	from := buildCtx
+	if dep := findImage(images, instr, c.From); dep != nil {
+		var err error
+		from, err = imageState(dep, images, buildCtx, opts)
+		if err != nil {
+			return base, err
+		}
+	} else if c.From != "" {
+		from = llb.Image(c.From, llb.Platform(imagePlatform(instr, opts)))
+	}
+	if c.From != "" && !instr.CopyFlags[c].TLS {
+		if paths := fromPaths(c, instr, images); len(paths) > 0 {
+			from = prunedFrom(from, paths, instr.CopyFlags[c].FollowSymlinks)
+		}
+	}
+
+	if c.Link {
+		return linkIn(base, copyIn(llb.Scratch(), from, c.SourcePaths[0], c.DestPath, instr.CopyFlags[c], opts)), nil
+	}
+
+	return copyIn(base, from, c.SourcePaths[0], c.DestPath, instr.CopyFlags[c], opts), nil
+}
+
+// baseState returns the LLB state of the base of an image.
+func baseState(instr *PackInstructions, images []*PackInstructions, buildCtx llb.State, opts LLBOpts) (llb.State, error) {
+	if instr.Base == "scratch" {
+		return llb.Scratch(), nil
+	} else if dep := findImage(images, instr, instr.Base); dep != nil {
+		return imageState(dep, images, buildCtx, opts)
+	} else if isHTTPBase(instr.Base) {
+		// Wrap the raw artifact in an empty image
+		kernelPath, ok := instr.Annots[uruncBinaryAnnot]
+		if !ok {
+			kernelPath = defaultKernelPath
+		}
+		return httpBase(instr.Base, kernelPath)
+	} else if instr.Resolved != nil {
+		return instr.Resolved.State, nil
+	}
+
+	return unresolvedBase(instr.Base, imagePlatform(instr, opts), opts.Aliases)
+}
+
+// commandState returns the LLB state of base after a Copy, Add, Mkdir, Rm,
+// Mv or Seed command of the image.
+func commandState(base llb.State, cmd instructions.Command, instr *PackInstructions,
+		images []*PackInstructions, buildCtx llb.State, opts LLBOpts) (llb.State, error) {
+	switch c := cmd.(type) {
+	case *instructions.CopyCommand:
+		return copyCommandState(base, c, instr, images, buildCtx, opts)
+	case *instructions.AddCommand:
+		if c.Link {
+			return linkIn(base, addIn(llb.Scratch(), buildCtx, c, instr.CopyFlags[c], opts)), nil
+		}
+		return addIn(base, buildCtx, c, instr.CopyFlags[c], opts), nil
+	case *MkdirCommand:
+		return mkdirIn(base, c, opts), nil
+	case *RmCommand:
+		return rmIn(base, c), nil
+	case *MvCommand:
+		return mvIn(base, c), nil
+	case *SeedCommand:
+		return seedIn(base, buildCtx, c, opts), nil
+	}
+
+	return base, nil
+}
+
+// uruncJSON returns the contents of urunc.json, with the base64 encoded
+// values of the annotations of the image.
+func uruncJSON(instr *PackInstructions) ([]byte, error) {
 	uruncJSON := make(map[string]string)
 
-	// Create urunc.json file, since annotations do not reach urunc
 	for annot, val := range instr.Annots {
 		encoded := base64.StdEncoding.EncodeToString([]byte(val))
 		uruncJSON[annot] = string(encoded)
@@ -160,27 +698,72 @@ func constructLLB(instr PackInstructions) (*llb.Definition, error) {
 		return nil, fmt.Errorf("Failed to marshal urunc json: %v", err)
 	}
 
-	// Set the base image where we will pack the unikernel
-	if instr.Base == "scratch" {
-		base = llb.Scratch()
-	} else {
-		// Define the platform to qemu/amd64 so we cna pull unikraft images
-		platform := ocispecs.Platform{
-			OS:           "qemu",
-			Architecture: "amd64",
+	return uruncJSONBytes, nil
+}
+
+// uruncJSONOpts returns the options of the creation of urunc.json. Its
+// timestamp would be the time of the build, unless the files get
+// normalized.
+func uruncJSONOpts(opts LLBOpts) []llb.MkfileOption {
+	var mkfileOpts []llb.MkfileOption
+	if opts.Normalize {
+		mkfileOpts = append(mkfileOpts, llb.WithCreatedTime(normalizedTime(opts)))
+	}
+
+	return mkfileOpts
+}
+
+// constructLLB creates the LLB definition of the target image. If the base
+// images were resolved beforehand, the LLB will use the resolved digests.
+func constructLLB(instr *PackInstructions, images []*PackInstructions, buildCtx llb.State, opts LLBOpts) (*llb.Definition, error) {
+	// Create urunc.json file, since annotations do not reach urunc
+	uruncJSONBytes, err := uruncJSON(instr)
+	if err != nil {
+		return nil, err
+	}
+
+	if opts.Intermediate == intermediatePostBase {
+		base, err := baseState(instr, images, buildCtx, opts)
+		if err != nil {
+			return nil, err
 		}
-		base = llb.Image(instr.Base, llb.Platform(platform),)
+		return marshalLLB(base, opts)
+	}
+	base, err := imageState(instr, images, buildCtx, opts)
+	if err != nil {
+		return nil, err
+	}
+	if opts.Intermediate == intermediatePostCopies {
+		return marshalLLB(base, opts)
+	}
+	if hook := instr.hook(clientOptPreSolveHook, opts.PreSolveHook); hook != nil {
+		base = hook.state(base, instr)
+	}
+	if opts.Intermediate == intermediatePreAnnotate {
+		return marshalLLB(base, opts)
 	}
 
-	// Perform any copies inside the image
-	for _, aCopy := range instr.Copies {
-		base = copyIn(base, packContextName, aCopy.SourcePaths[0], aCopy.DestPath)
+	base = base.File(llb.Mkfile(opts.UruncJSONPath, 0644, uruncJSONBytes, uruncJSONOpts(opts)...))
+	base, err = configsIn(base, instr, opts)
+	if err != nil {
+		return nil, err
+	}
+	base, err = tlsIn(base, instr, images, buildCtx, opts)
+	if err != nil {
+		return nil, err
 	}
 
-	// Create the urunc.json file in the rootfs
-	base = base.File(llb.Mkfile(uruncJSONPath, 0644, uruncJSONBytes))
+	return marshalLLB(base, opts)
+}
 
-	dt, err := base.Marshal(context.TODO(), llb.LinuxAmd64)
+// marshalLLB marshals the state of the image. Ops without a platform, such
+// as the ones of the helper images, get the architecture of the unikernel.
+func marshalLLB(base llb.State, opts LLBOpts) (*llb.Definition, error) {
+	dt, err := base.Marshal(context.TODO(), llb.Platform(ocispecs.Platform{
+		OS:           "linux",
+		Architecture: opts.Platform.Architecture,
+		Variant:      opts.Platform.Variant,
+	}))
 	if err != nil {
 		return nil, fmt.Errorf("Failed to marshal LLB state: %v", err)
 	}
@@ -188,10 +771,13 @@ func constructLLB(instr PackInstructions) (*llb.Definition, error) {
 	return dt, nil
 }
 
-func readFileFromLLB(ctx context.Context, c client.Client, filename string) ([]byte, error) {
+func readFileFromLLB(ctx context.Context, c client.Client, buildCtx llb.State, filename string, opts LLBOpts, isLocal bool) ([]byte, error) {
 	// Get the file from client's context
-	fileSrc := llb.Local(packContextName, llb.IncludePatterns([]string {filename}),
+	fileSrc := buildCtx
+	if isLocal {
+		fileSrc = llb.Local(opts.ContextName, llb.IncludePatterns([]string {filename}),
 				llb.WithCustomName("Internal:Read-" + filename))
+	}
 	fileDef, err := fileSrc.Marshal(ctx)
 	if err != nil {
 		return nil, fmt.Errorf("Failed to marshal state for fetching %s: %w", clientOptFilename, err)
@@ -207,9 +793,23 @@ func readFileFromLLB(ctx context.Context, c client.Client, filename string) ([]b
 		return nil, fmt.Errorf("Failed to get ref from solve resutl for fetching %s: %w", clientOptFilename, err)
 	}
 
+	// Check the size of the file before reading it
+	fileStat, err := fileRef.StatFile(ctx, client.StatRequest{
+		Path: filename,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("Failed to stat %s: %w", clientOptFilename, err)
+	}
+	if fileStat.Size_ > maxFileSize {
+		return nil, fmt.Errorf("%s is too large (%d bytes), the maximum size is %d bytes", filename, fileStat.Size_, maxFileSize)
+	}
+
 	// Read the content of the file
 	fileBytes, err := fileRef.ReadFile(ctx, client.ReadRequest{
 		Filename: filename,
+		Range: &client.FileRange{
+			Length: int(maxFileSize),
+		},
 	})
 	if err != nil {
 		return nil, fmt.Errorf("Failed to read %s: %w", clientOptFilename, err)
@@ -218,15 +818,56 @@ func readFileFromLLB(ctx context.Context, c client.Client, filename string) ([]b
 	return fileBytes, nil
 }
 
-func annotateRes(annots map[string]string, res *client.Result) (*client.Result, error) {
+// artifactAnnots returns the annotations that mark the produced image as a
+// unikernel artifact. User-defined annotations with the same key take
+// precedence over the ones we generate.
+func artifactAnnots(instr PackInstructions) map[string]string {
+	annots := make(map[string]string)
+
+	annots[annotImageDesc] = unikernelImageDesc
+	if ukType, ok := instr.Annots[uruncUnikernelType]; ok {
+		annots[annotImageTitle] = ukType + " unikernel"
+	}
+	if instr.Base != "scratch" {
+		annots[annotImageBaseName] = instr.Base
+	}
+	for annot, val := range instr.Annots {
+		annots[annot] = val
+	}
+	if paths := encryptedPaths(&instr); len(paths) > 0 {
+		dt, _ := json.Marshal(paths)
+		annots[annotEncryptPaths] = string(dt)
+	}
+	if len(instr.Libraries) > 0 {
+		annots[annotUnikraftLibs] = unikraftLibsAnnot(instr.Libraries)
+	}
+
+	return annots
+}
+
+func annotateRes(instr PackInstructions, res *client.Result, def ocispecs.Platform) (*client.Result, error) {
 	ref, err := res.SingleRef()
 	if err != nil {
 		return nil, fmt.Errorf("Failed te get reference of LLB solve result : %v",err)
 	}
+	err = addImageMeta(res, instr, nil, def)
+	if err != nil {
+		return nil, err
+	}
+	res.SetRef(ref)
 
+	return res, nil
+}
+
+// addImageMeta adds the image config and the annotations of an image in
+// the result. In multi-platform builds, platform is the platform of the
+// image, otherwise it is nil and the architecture of the image is the one
+// of the default platform.
+func addImageMeta(res *client.Result, instr PackInstructions, platform *ocispecs.Platform, def ocispecs.Platform) error {
 	config := ocispecs.Image{
 		Platform: ocispecs.Platform{
-			Architecture: "amd64",
+			Architecture: def.Architecture,
+			Variant:      def.Variant,
 			OS:           "linux",
 		},
 		RootFS: ocispecs.RootFS{
@@ -235,26 +876,85 @@ func annotateRes(annots map[string]string, res *client.Result) (*client.Result,
 		Config: ocispecs.ImageConfig{
 			WorkingDir: "/",
 			Entrypoint: []string{"/hello2"},
-			Labels:     annots,
+			Labels:     instr.Annots,
 		},
+		History: instr.History,
+	}
+	configKey := exptypes.ExporterImageConfigKey
+	if platform != nil {
+		// The OS of the platform is the hypervisor, while the image
+		// itself is always for linux hosts
+		config.Platform.Architecture = platform.Architecture
+		config.Platform.Variant = platform.Variant
+		configKey = fmt.Sprintf("%s/%s", exptypes.ExporterImageConfigKey, platforms.FormatAll(*platform))
 	}
 
 	uruncJSONBytes, err := json.Marshal(config)
 	if err != nil {
-		return nil, fmt.Errorf("Failed to marshal urunc json: %v", err)
+		return fmt.Errorf("Failed to marshal urunc json: %v", err)
 	}
-	res.AddMeta(exptypes.ExporterImageConfigKey, uruncJSONBytes)
-	for annot, val := range annots {
-		res.AddMeta(exptypes.AnnotationManifestKey(nil, annot), []byte(val))
+	res.AddMeta(configKey, uruncJSONBytes)
+	// Set the annotations both in the manifest and in its descriptor
+	// inside the index, since registry UIs might read either of them.
+	for annot, val := range artifactAnnots(instr) {
+		res.AddMeta(exptypes.AnnotationManifestKey(platform, annot), []byte(val))
+		res.AddMeta(exptypes.AnnotationManifestDescriptorKey(platform, annot), []byte(val))
 	}
-	res.SetRef(ref)
 
-	return res, nil
+	return nil
+}
+
+// readLocalFile reads a file from the local filesystem, rejecting files
+// larger than maxFileSize.
+func readLocalFile(filename string) ([]byte, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	content, err := io.ReadAll(io.LimitReader(f, maxFileSize+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(content)) > maxFileSize {
+		return nil, fmt.Errorf("%s is too large, the maximum size is %d bytes", filename, maxFileSize)
+	}
+
+	return content, nil
 }
 
 func punBuilder(ctx context.Context, c client.Client) (*client.Result, error) {
+	return buildImage(ctx, c, newBuildReport(), nil)
+}
+
+// buildImage builds the target of the file and fills in the report of the
+// build, which also gets added in the metadata of the result. encryption is
+// the encryption of the outputs, when pun build runs the frontend and
+// encrypts them after the export.
+func buildImage(ctx context.Context, c client.Client, report *BuildReport,
+		encryption *archiveEncryption) (*client.Result, error) {
 	// Get the Build options from buildkit
 	packOpts := c.BuildOpts().Opts
+	deviceProfile, err := deviceProfileFromBuildOpts(packOpts)
+	if err != nil {
+		return nil, err
+	}
+	if deviceProfile != nil {
+		packOpts = deviceProfile.buildOpts(packOpts)
+	}
+
+	// Answer the subrequests which do not need the file
+	requestID := packOpts[clientOptRequestID]
+	if requestID != "" {
+		err := checkSubrequest(requestID)
+		if err != nil {
+			return nil, err
+		}
+		if requestID == subrequests.RequestSubrequestsDescribe {
+			return describeResult()
+		}
+	}
 
 	// Get the file that contains the instructions
 	packFile := packOpts[clientOptFilename]
@@ -262,45 +962,342 @@ func punBuilder(ctx context.Context, c client.Client) (*client.Result, error) {
 		return nil, fmt.Errorf("%s: was not provided", clientOptFilename)
 	}
 
+	llbOpts, err := llbOptsFromBuildOpts(packOpts)
+	if err != nil {
+		return nil, err
+	}
+	var steps postSteps
+	steps.BootTest, err = bootTestFromBuildOpts(packOpts)
+	if err != nil {
+		return nil, err
+	}
+	steps.Strip, err = stripFromBuildOpts(packOpts)
+	if err != nil {
+		return nil, err
+	}
+	steps.Checksums, err = checksumsFromBuildOpts(packOpts)
+	if err != nil {
+		return nil, err
+	}
+	steps.Scrub, err = scrubFromBuildOpts(packOpts)
+	if err != nil {
+		return nil, err
+	}
+	steps.Scan, err = scanFromBuildOpts(packOpts)
+	if err != nil {
+		return nil, err
+	}
+	steps.PostSolveHook, err = hookFromBuildOpts(packOpts, clientOptPostSolveHook)
+	if err != nil {
+		return nil, err
+	}
+	steps.Disk, err = diskConversionFromBuildOpts(packOpts)
+	if err != nil {
+		return nil, err
+	}
+	steps.Sign, err = signFromBuildOpts(packOpts)
+	if err != nil {
+		return nil, err
+	}
+	steps.UruncJSONSign, err = uruncJSONSignFromBuildOpts(packOpts)
+	if err != nil {
+		return nil, err
+	}
+	hvDefaults, err := hypervisorDefaultsFromBuildOpts(packOpts)
+	if err != nil {
+		return nil, err
+	}
+	labelAllowlist, err := labelAllowlistFromBuildOpts(packOpts)
+	if err != nil {
+		return nil, err
+	}
+	steps.UnikraftConfig = unikraftConfigFromBuildOpts(packOpts)
+	steps.GlobReport, err = globReportFromBuildOpts(packOpts)
+	if err != nil {
+		return nil, err
+	}
+	sbom := sbomFromBuildOpts(packOpts)
+	debugSubject, err := debugSubjectFromBuildOpts(packOpts, steps.Strip)
+	if err != nil {
+		return nil, err
+	}
+	cacheImports, err := cacheImportsFromOpts(packOpts)
+	if err != nil {
+		return nil, err
+	}
+	policy, err := policyFromBuildOpts(packOpts)
+	if err != nil {
+		return nil, err
+	}
+	if deviceProfile != nil {
+		policy = deviceProfile.policy(policy)
+	}
+	if policy != nil && policy.hasSizes() {
+		steps.Sizes = policy
+	}
+
+	// Get the build context, which might be a git repository
+	gitContext := packOpts[clientOptBuildCtx]
+	if llbOpts.Offline && gitContext != "" {
+		return nil, offlineError("The git context " + gitContext)
+	}
+	fileCtx, err := contextState(gitContext, llbOpts, nil)
+	if err != nil {
+		return nil, err
+	}
+
 	// Fetch and read contents of user-specified file in build context
-	fileBytes, err := readFileFromLLB(ctx, c, packFile)
+	fileBytes, err := readFileFromLLB(ctx, c, fileCtx, packFile, llbOpts, gitContext == "")
 	if err != nil {
 		return nil, fmt.Errorf("Failed to fetch and read %s: %w", clientOptFilename, err)
 	}
+	report.File = packFile
+	report.FileDigest = digest.FromBytes(fileBytes)
+	report.Context = gitContext
+	report.phase("read-file")
 
-	// Parse packing instructions
-	packInst, err := parseFile(fileBytes)
+	// Plain Dockerfiles of containers get built as usual, so that one
+	// syntax line works for both containers and unikernels
+	passthrough, err := passthroughFromBuildOpts(packOpts, fileBytes)
 	if err != nil {
-		return nil, fmt.Errorf("Error parsing packing instructions", err)
+		return nil, err
+	}
+	if passthrough {
+		return solveDockerfile(ctx, c, packOpts, nil)
 	}
 
-	// Create the LLB definiton
-	dt, err := constructLLB(*packInst)
+	// Parse packing instructions, once for every platform that we build,
+	// since the platform args might change the images
+	targetPlatforms, err := platformsFromBuildOpts(packOpts)
 	if err != nil {
-		return nil, fmt.Errorf("Failed to create LLB definition : %v\n", err)
+		return nil, err
 	}
-
-	// Pass LLB to buildkit
-	result, err := c.Solve(ctx, client.SolveRequest{
-		Definition: dt.ToPB(),
-	})
+	var builds []*platformBuild
+	for _, platform := range targetPlatforms {
+		build := &platformBuild{
+			Platform: platform,
+			LLBOpts:  llbOpts,
+		}
+		if platform != nil {
+			build.LLBOpts.Platform = *platform
+		}
+		args := mergeArgs(platformArgs(workersPlatform(c.BuildOpts().Workers), build.LLBOpts.Platform),
+				buildArgsFromOpts(packOpts))
+		build.Images, err = parseFile(fileBytes, args)
+		if err != nil {
+			return nil, fmt.Errorf("Error parsing packing instructions: %v", err)
+		}
+		build.Target, err = selectImage(build.Images, packOpts[clientOptTarget])
+		if err != nil {
+			return nil, err
+		}
+		if deviceProfile != nil {
+			deviceProfile.annotate(build.Target)
+		}
+		builds = append(builds, build)
+	}
+	if requestID == outline.RequestSubrequestsOutline {
+		return targetOutline(fileBytes, builds[0].Images, builds[0].Target).ToResult()
+	}
+	resolveMode, err := parseResolveMode(packOpts[clientOptResolveMode])
 	if err != nil {
-		return nil, fmt.Errorf("Failed to resolve LLB: %v",err)
+		return nil, err
+	}
+	for _, build := range builds {
+		err = inheritSpec(ctx, c, build.Target, build.LLBOpts, resolveMode, labelAllowlist)
+		if err != nil {
+			return nil, err
+		}
+		if policy != nil {
+			err = policy.check(ctx, build.Images, build.Target, policyBaseExpander(packOpts, build.LLBOpts.Aliases))
+			if err != nil {
+				return nil, err
+			}
+		}
+		err = checkEncrypt(build.Target, encryption)
+		if err != nil {
+			return nil, err
+		}
+		if llbOpts.Offline {
+			err = checkOffline(build.Images, reachableImages(build.Images, build.Target), packOpts)
+			if err != nil {
+				return nil, err
+			}
+		}
+		build.setPlatformHypervisor()
+		detectKernelAnnots(build.Target)
+		if hvDefaults {
+			setHypervisorDefaults(build.Target)
+		}
+		build.LLBOpts.Hubs = xenHubs(build.Target, build.LLBOpts)
+		err = checkPlatformArch(build.Target, build.LLBOpts.Platform)
+		if err != nil {
+			return nil, err
+		}
+	}
+	report.phase("parse")
+
+	// Resolve the base images that the target needs and solve it
+	for _, build := range builds {
+		err = build.solve(ctx, c, gitContext, resolveMode, cacheImports, steps, report)
+		if err != nil {
+			return nil, err
+		}
 	}
 
 	// Add annotations and Labels in output image
-	result, err = annotateRes(packInst.Annots, result)
+	var result *client.Result
+	indexAnnots := indexAnnotsFromOpts(packOpts)
+	if debugSubject != "" {
+		result, err = debugResult(builds, debugSubject)
+	} else if builds[0].Platform == nil && len(indexAnnots) == 0 && steps.Scan == nil && !sbom {
+		result = client.NewResult()
+		result.SetRef(builds[0].Ref)
+		result, err = annotateRes(*builds[0].Target, result, builds[0].LLBOpts.Platform)
+	} else {
+		// buildkit only creates an index for results with platforms,
+		// so single platform builds with index annotations or
+		// attestations need one
+		if builds[0].Platform == nil {
+			platform := builds[0].LLBOpts.Platform
+			builds[0].Platform = &platform
+		}
+		result, err = platformsResult(builds)
+		if err == nil {
+			err = addIndexAnnots(result, indexAnnots, builds[0].Target)
+		}
+		for _, build := range builds {
+			if err == nil && steps.Scan != nil {
+				addScanAttestation(result, build, steps.Scan)
+			}
+			if err == nil && sbom {
+				err = addSBOMAttestation(ctx, c, result, build)
+			}
+		}
+	}
 	if err != nil {
 		return nil, fmt.Errorf("Failed to annotate final image: %v",err)
 	}
+	if debugSubject == "" {
+		addUruncJSONMeta(result, builds)
+	}
+	err = report.addToResult(result)
+	if err != nil {
+		return nil, err
+	}
 
 	return result, nil
 }
 
+// LocalBuild is a Containerfile parsed in the client side, when pun prints
+// the LLB or validates the file.
+type LocalBuild struct {
+	FileBytes []byte
+	Images    []*PackInstructions
+	Target    *PackInstructions
+	LLBOpts   LLBOpts
+	Config    *Config // The configuration file, if any
+}
+
+// loadLocalBuild reads and parses a local Containerfile, using the build
+// args of the command line and the configuration file, if any.
+func loadLocalBuild(file string, buildArgs []string, configFile string, target string) (*LocalBuild, error) {
+	var err error
+
+	local := &LocalBuild{
+		LLBOpts: defaultLLBOpts(),
+	}
+	local.FileBytes, err = readLocalFile(file)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to read %s: %w", file, err)
+	}
+
+	userArgs, err := buildArgsFromCLI(buildArgs)
+	if err != nil {
+		return nil, err
+	}
+	local.LLBOpts.Epoch, err = parseEpoch(userArgs[argSourceDateEpoch])
+	if err != nil {
+		return nil, err
+	}
+	if configFile != "" {
+		config, err := loadConfig(configFile)
+		if err != nil {
+			return nil, err
+		}
+		err = config.apply(&local.LLBOpts)
+		if err != nil {
+			return nil, err
+		}
+		local.Config = config
+	}
+
+	// Parse file with packing instructions
+	args := mergeArgs(platformArgs(platforms.DefaultSpec(), local.LLBOpts.Platform), userArgs)
+	local.Images, err = parseFile(local.FileBytes, args)
+	if err != nil {
+		return nil, fmt.Errorf("Error parsing packing instructions: %w", err)
+	}
+	local.Target, err = selectImage(local.Images, target)
+	if err != nil {
+		return nil, err
+	}
+
+	return local, nil
+}
+
 func main() {
 	var cliOpts CLIOpts
 	var packInst *PackInstructions
 
+	// Standalone mode, where pun builds the image itself
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case buildCmd:
+			buildMain(os.Args[2:])
+			return
+		case runCmd:
+			runMain(os.Args[2:])
+			return
+		case diffCmd:
+			diffMain(os.Args[2:])
+			return
+		case annotationsCmd:
+			annotationsMain(os.Args[2:])
+			return
+		case validateCmd:
+			validateMain(os.Args[2:])
+			return
+		case lintCmd:
+			lintMain(os.Args[2:])
+			return
+		case graphCmd:
+			graphMain(os.Args[2:])
+			return
+		case cacheCmd:
+			cacheMain(os.Args[2:])
+			return
+		case selftestCmd:
+			selftestMain(os.Args[2:])
+			return
+		case serveCmd:
+			serveMain(os.Args[2:])
+			return
+		case catalogCmd:
+			catalogMain(os.Args[2:])
+			return
+		case s2iCmd:
+			s2iMain(os.Args[2:])
+			return
+		case bundleCmd:
+			bundleMain(os.Args[2:])
+			return
+		case bakeCmd:
+			bakeMain(os.Args[2:])
+			return
+		}
+	}
+
 	cliOpts = parseCLIOpts()
 
 	if cliOpts.Version {
@@ -324,21 +1321,49 @@ func main() {
 		os.Exit(1)
 	}
 
-	CntrFileContent, err := ioutil.ReadFile(cliOpts.ContainerFile)
+	local, err := loadLocalBuild(cliOpts.ContainerFile, cliOpts.BuildArgs,
+			cliOpts.ConfigFile, cliOpts.Target)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	images := local.Images
+	packInst = local.Target
+	llbOpts := local.LLBOpts
+	llbOpts.Normalize = cliOpts.Normalize
+	policy, err := loadPolicy(cliOpts.PolicyFile)
 	if err != nil {
-		fmt.Printf("Failed to read %s: %v\n", cliOpts.ContainerFile, err)
+		fmt.Println(err)
 		os.Exit(1)
 	}
+	if policy != nil {
+		err = policy.check(appcontext.Context(), images, packInst, policyBaseExpander(nil, llbOpts.Aliases))
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+	}
+	if cliOpts.Offline {
+		if cliOpts.GitContext != "" {
+			fmt.Println(offlineError("The git context " + cliOpts.GitContext))
+			os.Exit(1)
+		}
+		err = checkOffline(images, reachableImages(images, packInst), nil)
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+	}
 
-	// Parse file with packaging instructions
-	packInst, err = parseFile(CntrFileContent)
+	buildCtx, err := contextState(cliOpts.GitContext, llbOpts,
+			contextPaths(reachableImages(images, packInst)))
 	if err != nil {
-		fmt.Println("Error parsing packing instructions", err)
+		fmt.Println(err)
 		os.Exit(1)
 	}
 
 	// Create the LLB definition
-	dt, err := constructLLB(*packInst)
+	dt, err := constructLLB(packInst, images, buildCtx, llbOpts)
 	if err != nil {
 		fmt.Printf("Failed to create LLB definition : %v\n", err)
 		os.Exit(1)
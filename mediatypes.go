@@ -0,0 +1,289 @@
+// Copyright (c) 2023-2024, Nubificus LTD
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	bkclient "github.com/moby/buildkit/client"
+	digest "github.com/opencontainers/go-digest"
+	ocispecs "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+const (
+	mediaTypesOCI          string = "oci"
+	mediaTypesDocker       string = "docker"
+	exportOCIMediaTypes    string = "oci-mediatypes"
+	// The shorthand of --config-media-type for the config type of urunc
+	configMediaTypeUrunc   string = "urunc"
+	uruncConfigMediaType   string = "application/vnd.urunc.config.v1+json"
+	// The shorthand of --artifact-type for the artifact type of unikernels
+	artifactTypeUrunc      string = "urunc"
+	// The layers that Harbor shows as the icon and the readme of an artifact
+	harborIconAnnot        string = "io.goharbor.artifact.v1alpha1.icon"
+	harborReadmeAnnot      string = "io.goharbor.artifact.v1alpha1.readme"
+	readmeMediaType        string = "text/markdown"
+)
+
+// iconMediaTypes are the media types of the icons, by their extension.
+var iconMediaTypes = map[string]string{
+	".png":  "image/png",
+	".jpg":  "image/jpeg",
+	".jpeg": "image/jpeg",
+	".gif":  "image/gif",
+}
+
+// setMediaTypes sets the media types of the manifests of the image outputs,
+// unless an output sets them itself with oci-mediatypes.
+func setMediaTypes(exports []bkclient.ExportEntry, mediaTypes string) error {
+	var oci string
+	switch mediaTypes {
+	case "":
+		return nil
+	case mediaTypesOCI:
+		oci = "true"
+	case mediaTypesDocker:
+		oci = "false"
+	default:
+		return fmt.Errorf("Invalid media types %s, expected %s or %s", mediaTypes, mediaTypesOCI, mediaTypesDocker)
+	}
+	for _, entry := range exports {
+		switch entry.Type {
+		case bkclient.ExporterImage, bkclient.ExporterOCI, bkclient.ExporterDocker:
+			if _, ok := entry.Attrs[exportOCIMediaTypes]; !ok {
+				entry.Attrs[exportOCIMediaTypes] = oci
+			}
+		}
+	}
+
+	return nil
+}
+
+// manifestEdit is what pun build changes in the manifests of the images of
+// the oci outputs, since buildkit can not set it itself: the media type of
+// the configs, the artifact type and the layers that registries show, e.g.
+// the icon and the readme of Harbor.
+type manifestEdit struct {
+	configMediaType string
+	artifactType    string
+	layers          []ocispecs.Descriptor
+	blobs           [][]byte // The contents of the layers
+	archives        []string
+}
+
+// addLayer adds a layer with the content of a local file to the manifests,
+// with an annotation that tells registries what it is.
+func (e *manifestEdit) addLayer(filename string, mediaType string, annot string) error {
+	dt, err := readLocalFile(filename)
+	if err != nil {
+		return err
+	}
+	e.layers = append(e.layers, ocispecs.Descriptor{
+		MediaType: mediaType,
+		Digest:    digest.FromBytes(dt),
+		Size:      int64(len(dt)),
+		Annotations: map[string]string{
+			annot:                    "true",
+			ocispecs.AnnotationTitle: filepath.Base(filename),
+		},
+	})
+	e.blobs = append(e.blobs, dt)
+
+	return nil
+}
+
+// manifestEditFromCLI returns the changes of the manifests of the oci
+// outputs of pun build, or nil if there are none. As with the encryption,
+// only oci outputs with OCI media types support them.
+func manifestEditFromCLI(opts BuildCLIOpts) (*manifestEdit, error) {
+	e := &manifestEdit{
+		configMediaType: configMediaType(opts.ConfigMediaType),
+		artifactType:    artifactType(opts.ArtifactType),
+	}
+	if opts.Icon != "" {
+		mediaType, ok := iconMediaTypes[strings.ToLower(filepath.Ext(opts.Icon))]
+		if !ok {
+			return nil, fmt.Errorf("The icon %s is not a PNG, JPEG or GIF image", opts.Icon)
+		}
+		err := e.addLayer(opts.Icon, mediaType, harborIconAnnot)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if opts.Readme != "" {
+		err := e.addLayer(opts.Readme, readmeMediaType, harborReadmeAnnot)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if e.configMediaType == "" && e.artifactType == "" && len(e.layers) == 0 {
+		return nil, nil
+	}
+
+	if opts.MediaTypes == mediaTypesDocker {
+		return nil, fmt.Errorf("The config media type, the artifact type and the artifact layers require OCI media types")
+	}
+	for _, output := range opts.Outputs {
+		attrs, err := parseCSVAttrs("output", output)
+		if err != nil {
+			return nil, err
+		}
+		if attrs["type"] != bkclient.ExporterOCI || attrs["dest"] == "" || attrs["dest"] == "-" ||
+				attrs[exportOCIMediaTypes] == "false" {
+			return nil, fmt.Errorf("The config media type, the artifact type and the artifact layers require oci outputs with a file as dest, got %s",
+					output)
+		}
+		e.archives = append(e.archives, attrs["dest"])
+	}
+
+	return e, nil
+}
+
+// outputs returns the archives whose manifests get changed, if any.
+func (e *manifestEdit) outputs() []string {
+	if e == nil {
+		return nil
+	}
+
+	return e.archives
+}
+
+// artifactType returns the artifact type of --artifact-type.
+func artifactType(val string) string {
+	if val == artifactTypeUrunc {
+		return unikernelArtifact
+	}
+
+	return val
+}
+
+// configMediaType returns the media type of --config-media-type.
+func configMediaType(val string) string {
+	if val == configMediaTypeUrunc {
+		return uruncConfigMediaType
+	}
+
+	return val
+}
+
+// editManifests changes the manifests of the images of an index or a
+// manifest.
+func (l *ociLayout) editManifests(desc ocispecs.Descriptor, e *manifestEdit) (ocispecs.Descriptor, error) {
+	switch desc.MediaType {
+	case ocispecs.MediaTypeImageManifest:
+		var manifest ocispecs.Manifest
+		err := l.readJSON(desc, &manifest)
+		if err != nil {
+			return desc, err
+		}
+		if e.configMediaType != "" {
+			manifest.Config.MediaType = e.configMediaType
+		}
+		if e.artifactType != "" {
+			manifest.ArtifactType = e.artifactType
+			desc.ArtifactType = e.artifactType
+		}
+		// Runtimes do not unpack the layers that are not filesystems
+		manifest.Layers = append(manifest.Layers, e.layers...)
+		return l.writeJSON(desc, manifest)
+	case ocispecs.MediaTypeImageIndex:
+		var index ocispecs.Index
+		err := l.readJSON(desc, &index)
+		if err != nil {
+			return desc, err
+		}
+		for i, m := range index.Manifests {
+			// The attestations keep the config type of in-toto
+			if m.Platform != nil && m.Platform.OS == "unknown" {
+				continue
+			}
+			index.Manifests[i], err = l.editManifests(m, e)
+			if err != nil {
+				return desc, err
+			}
+		}
+		return l.writeJSON(desc, index)
+	}
+
+	return desc, nil
+}
+
+// editArchive changes the manifests of the images of an OCI archive, e.g.
+// for registries that tell unikernel images apart by the media type of
+// their config or by their artifact type.
+func editArchive(archive string, e *manifestEdit) error {
+	dir, err := os.MkdirTemp(filepath.Dir(archive), ".pun-manifests")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+	layoutDir := filepath.Join(dir, "layout")
+	err = extractArchive(archive, layoutDir)
+	if err != nil {
+		return fmt.Errorf("Failed to extract %s: %w", archive, err)
+	}
+
+	l := &ociLayout{
+		dir:   layoutDir,
+		stale: make(map[digest.Digest]bool),
+	}
+	indexPath := filepath.Join(layoutDir, ocispecs.ImageIndexFile)
+	dt, err := os.ReadFile(indexPath)
+	if err != nil {
+		return err
+	}
+	var index ocispecs.Index
+	err = json.Unmarshal(dt, &index)
+	if err != nil {
+		return fmt.Errorf("Invalid %s in %s: %w", ocispecs.ImageIndexFile, archive, err)
+	}
+	for i, blob := range e.blobs {
+		err = os.WriteFile(l.blobPath(e.layers[i].Digest), blob, 0644)
+		if err != nil {
+			return err
+		}
+	}
+	for i, m := range index.Manifests {
+		index.Manifests[i], err = l.editManifests(m, e)
+		if err != nil {
+			return err
+		}
+	}
+	dt, err = json.Marshal(index)
+	if err != nil {
+		return err
+	}
+	err = os.WriteFile(indexPath, dt, 0644)
+	if err != nil {
+		return err
+	}
+
+	// The old manifests must not end up in the archive
+	skip := make(map[string]bool)
+	for d := range l.stale {
+		skip[l.blobPath(d)] = true
+	}
+	tmp := filepath.Join(dir, "archive.tar")
+	err = createArchive(tmp, layoutDir, skip)
+	if err != nil {
+		return fmt.Errorf("Failed to write %s: %w", archive, err)
+	}
+
+	return os.Rename(tmp, archive)
+}
@@ -0,0 +1,144 @@
+// Copyright (c) 2023-2024, Nubificus LTD
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"unicode"
+
+	"github.com/moby/buildkit/client/llb"
+	"github.com/moby/buildkit/frontend/dockerfile/parser"
+)
+
+const (
+	mkdirCmd         string      = "mkdir"
+	mkdirModeFlag    string      = "mode"
+	defaultMkdirMode os.FileMode = 0755
+)
+
+// MkdirCommand is the MKDIR instruction of pun, which creates empty
+// directories in the rootfs, e.g. the mount points that the unikernel
+// expects, along with any missing parents.
+//
+//	MKDIR [--mode=<octal>] <path>...
+type MkdirCommand struct {
+	Paths []string
+	Mode  os.FileMode
+	args  string // The arguments of the instruction, before the expansion
+	loc   []parser.Range
+}
+
+func (c *MkdirCommand) Name() string {
+	return mkdirCmd
+}
+
+func (c *MkdirCommand) Location() []parser.Range {
+	return c.loc
+}
+
+func isMkdir(node *parser.Node) bool {
+	return strings.EqualFold(node.Value, mkdirCmd)
+}
+
+// cutFirstWord returns line without its first word.
+func cutFirstWord(line string) string {
+	line = strings.TrimLeftFunc(line, unicode.IsSpace)
+	if i := strings.IndexFunc(line, unicode.IsSpace); i >= 0 {
+		return line[i:]
+	}
+
+	return ""
+}
+
+// rawArgs returns the arguments of an instruction that the dockerfile
+// parser does not know about, which only keeps the original line.
+func rawArgs(node *parser.Node) string {
+	// Skip the instruction and its flags
+	args := cutFirstWord(node.Original)
+	for strings.HasPrefix(strings.TrimSpace(args), "--") {
+		args = cutFirstWord(args)
+	}
+
+	return strings.TrimSpace(args)
+}
+
+// nodeLocation returns the lines of an instruction in the file.
+func nodeLocation(node *parser.Node) []parser.Range {
+	return []parser.Range{{
+		Start: parser.Position{Line: node.StartLine},
+		End:   parser.Position{Line: node.EndLine},
+	}}
+}
+
+// parseMkdir parses a MKDIR instruction. The dockerfile parser does not know
+// about it, so it only gives us its flags and the original line.
+func parseMkdir(node *parser.Node) (*MkdirCommand, error) {
+	c := &MkdirCommand{
+		Mode: defaultMkdirMode,
+		loc:  nodeLocation(node),
+	}
+
+	if val, ok := popFlag(node, mkdirModeFlag); ok {
+		if val == "" {
+			return nil, fmt.Errorf("The --%s flag of MKDIR requires a value, e.g. --%s=0755", mkdirModeFlag, mkdirModeFlag)
+		}
+		mode, err := strconv.ParseUint(val, 8, 32)
+		if err != nil || mode > 07777 {
+			return nil, fmt.Errorf("Invalid mode %s in MKDIR, expected an octal number", val)
+		}
+		c.Mode = os.FileMode(mode)
+	}
+	if len(node.Flags) > 0 {
+		return nil, fmt.Errorf("Unknown flag %s in MKDIR", node.Flags[0])
+	}
+
+	c.args = rawArgs(node)
+	if c.args == "" {
+		return nil, fmt.Errorf("MKDIR requires at least one path")
+	}
+
+	return c, nil
+}
+
+// expand expands any args in the paths of the instruction.
+func (c *MkdirCommand) expand(scope *argScope) error {
+	var err error
+
+	c.Paths, err = scope.expandWords(c.args)
+	if err != nil {
+		return err
+	}
+	if len(c.Paths) == 0 {
+		return fmt.Errorf("MKDIR requires at least one path")
+	}
+
+	return nil
+}
+
+// mkdirIn creates the directories of a MKDIR instruction in base.
+func mkdirIn(base llb.State, c *MkdirCommand, opts LLBOpts) llb.State {
+	mkdirOpts := []llb.MkdirOption{llb.WithParents(true)}
+	if opts.Normalize {
+		mkdirOpts = append(mkdirOpts, llb.WithCreatedTime(normalizedTime(opts)))
+	}
+	for _, p := range c.Paths {
+		base = base.File(llb.Mkdir(p, c.Mode, mkdirOpts...))
+	}
+
+	return base
+}
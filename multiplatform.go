@@ -0,0 +1,412 @@
+// Copyright (c) 2023-2024, Nubificus LTD
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"slices"
+	"strings"
+
+	"github.com/containerd/platforms"
+	"github.com/moby/buildkit/client/llb"
+	"github.com/moby/buildkit/exporter/containerimage/exptypes"
+	"github.com/moby/buildkit/frontend/gateway/client"
+	ocispecs "github.com/opencontainers/image-spec/specs-go/v1"
+	"golang.org/x/sync/errgroup"
+)
+
+// The platforms to build, as in docker buildx build --platform
+const clientOptPlatforms string = "platform"
+
+// platformBuild is the build of the target for one of the platforms of the
+// build. In single platform builds, Platform is nil.
+type platformBuild struct {
+	Platform *ocispecs.Platform
+	LLBOpts  LLBOpts
+	Images   []*PackInstructions
+	Target   *PackInstructions
+	Ref      client.Reference
+	Debug    client.Reference // The debug symbols, if they got split
+	Scan     client.Reference // The results of the vulnerability scan
+	UruncJSON []byte          // The final urunc.json of the image
+}
+
+// platformsFromBuildOpts returns the platforms of a multi-platform build,
+// given as a comma separated list. If there is no list, it returns a
+// single nil platform, for the single platform build.
+func platformsFromBuildOpts(opts map[string]string) ([]*ocispecs.Platform, error) {
+	val := opts[clientOptPlatforms]
+	if val == "" {
+		return []*ocispecs.Platform{nil}, nil
+	}
+
+	var targets []*ocispecs.Platform
+	var ids []string
+	for _, s := range strings.Split(val, ",") {
+		platform, err := platforms.Parse(strings.TrimSpace(s))
+		if err != nil {
+			return nil, fmt.Errorf("Invalid %s %s: %w", clientOptPlatforms, s, err)
+		}
+		platform = platforms.Normalize(platform)
+		id := platforms.FormatAll(platform)
+		if slices.Contains(ids, id) {
+			return nil, fmt.Errorf("The platform %s is given more than once", id)
+		}
+		ids = append(ids, id)
+		targets = append(targets, &platform)
+	}
+
+	return targets, nil
+}
+
+func (b *platformBuild) id() string {
+	if b.Platform == nil {
+		return ""
+	}
+
+	return platforms.FormatAll(*b.Platform)
+}
+
+// phase returns the name of a phase of the build in the report, which
+// contains the platform in multi-platform builds.
+func (b *platformBuild) phase(name string) string {
+	if b.Platform == nil {
+		return name
+	}
+
+	return name + " " + b.id()
+}
+
+// setPlatformHypervisor sets the hypervisor of the target to the OS of its
+// platform, e.g. qemu for qemu/arm64, unless the file sets it, so that
+// every platform gets its own urunc.json.
+func (b *platformBuild) setPlatformHypervisor() {
+	if b.Platform == nil {
+		return
+	}
+	if _, ok := b.Target.Annots[uruncHypervisorAnnot]; ok {
+		return
+	}
+	spec := findAnnotSpec(uruncHypervisorAnnot)
+	if spec == nil || !slices.Contains(spec.Values, b.Platform.OS) {
+		return
+	}
+	if b.Target.Annots == nil {
+		b.Target.Annots = make(map[string]string)
+	}
+	b.Target.Annots[uruncHypervisorAnnot] = b.Platform.OS
+}
+
+// hypervisorArchs are the architectures that every hypervisor supports.
+var hypervisorArchs = map[string][]string{
+	"qemu":        {"amd64", "arm64", "riscv64"},
+	"firecracker": {"amd64", "arm64"},
+	"hvt":         {"amd64", "arm64"},
+	"spt":         {"amd64", "arm64"},
+	"xen":         {"amd64", "arm64"},
+}
+
+// checkPlatformArch checks that the hypervisor of the target supports the
+// architecture of its platform, e.g. that riscv64 unikernels do not target
+// firecracker.
+func checkPlatformArch(instr *PackInstructions, platform ocispecs.Platform) error {
+	hypervisor := instr.Annots[uruncHypervisorAnnot]
+	archs, ok := hypervisorArchs[hypervisor]
+	if !ok || slices.Contains(archs, platform.Architecture) {
+		return nil
+	}
+
+	return fmt.Errorf("The hypervisor %s does not support %s, only %s", hypervisor,
+			platform.Architecture, strings.Join(archs, ", "))
+}
+
+// postSteps are the optional steps that run after the solve of the image,
+// before it gets exported.
+type postSteps struct {
+	Strip     *Strip
+	// The hook that runs against the solved image, after stripping
+	PostSolveHook *Hook
+	// Convert the block image to the format of the hypervisor
+	Disk      *DiskConversion
+	Sign      *Sign
+	Checksums bool // Record the digests of the artifacts
+	// Sign urunc.json, after everything that changes it
+	UruncJSONSign *UruncJSONSign
+	Scrub     *Scrub
+	Scan      *Scan
+	BootTest  *BootTest
+	// The policy, if it limits the sizes of the image
+	Sizes     *Policy
+	// The kconfig of unikraft kernels, whose libraries get recorded
+	UnikraftConfig string
+	// Report the matches of the wildcards in the sources of the context
+	GlobReport bool
+}
+
+// solve resolves the bases of the target and solves its LLB, running the
+// steps after the solve.
+func (b *platformBuild) solve(ctx context.Context, c client.Client, gitContext string,
+		resolveMode llb.ResolveMode, cacheImports []client.CacheOptionsEntry,
+		steps postSteps, report *BuildReport) error {
+	reachable := reachableImages(b.Images, b.Target)
+
+	// Transfer only the paths of the local context that we need
+	buildCtx, err := contextState(gitContext, b.LLBOpts, contextPaths(reachable))
+	if err != nil {
+		return err
+	}
+
+	// Start the transfer of the context, while resolving the base images
+	eg, egCtx := errgroup.WithContext(ctx)
+	var globs []ReportGlob
+	eg.Go(func() error {
+		var err error
+		globs, err = prefetchContext(egCtx, c, buildCtx, reachable)
+		return err
+	})
+	resolveImages(egCtx, eg, c, b.Images, reachable, b.LLBOpts, resolveMode)
+	err = eg.Wait()
+	if err != nil {
+		return err
+	}
+	report.addImages(b.Images, reachable, b.Target, b.LLBOpts)
+	report.phase(b.phase("resolve"))
+	err = checkUnikraftTarget(b, reachable)
+	if err != nil {
+		return err
+	}
+	if steps.GlobReport && len(globs) > 0 {
+		report.addGlobs(globs)
+		err = progressGlobs(ctx, c, globs)
+		if err != nil {
+			return err
+		}
+	}
+
+	err = solveBuilders(ctx, c, b, reachable)
+	if err != nil {
+		return err
+	}
+
+	// Create the LLB definiton
+	dt, err := constructLLB(b.Target, b.Images, buildCtx, b.LLBOpts)
+	if err != nil {
+		return fmt.Errorf("Failed to create LLB definition : %v\n", err)
+	}
+	b.Target.History = stateHistory(b.Target, b.Images)
+	if b.Target.hook(clientOptPreSolveHook, b.LLBOpts.PreSolveHook) != nil {
+		b.Target.addHistory("pun: run the " + clientOptPreSolveHook)
+	}
+	b.Target.addHistory("pun: create " + b.LLBOpts.UruncJSONPath)
+	b.Target.configHistory()
+	b.Target.tlsHistory()
+
+	// Pass LLB to buildkit
+	result, err := c.Solve(ctx, client.SolveRequest{
+		Definition:   dt.ToPB(),
+		CacheImports: cacheImports,
+	})
+	if err != nil {
+		return fmt.Errorf("Failed to resolve LLB: %v", err)
+	}
+	b.Ref, err = result.SingleRef()
+	if err != nil {
+		return err
+	}
+	report.phase(b.phase("solve"))
+
+	// The intermediate states are exported as they are, for debugging
+	if b.LLBOpts.Intermediate != "" {
+		return nil
+	}
+
+	if b.Target.Annots[uruncUnikernelType] == "unikraft" {
+		b.Target.Libraries, err = unikraftLibs(ctx, b.Ref, steps.UnikraftConfig)
+		if err != nil {
+			return err
+		}
+	}
+
+	// Make the artifacts smaller, before we boot them
+	if steps.Strip != nil {
+		b.Ref, b.Debug, err = runStrip(ctx, c, steps.Strip, b.Target, b.Ref, report)
+		if err != nil {
+			return err
+		}
+		b.Target.addHistory("pun: strip the artifacts")
+		report.phase(b.phase("strip"))
+	}
+
+	if hook := b.Target.hook(clientOptPostSolveHook, steps.PostSolveHook); hook != nil {
+		b.Ref, err = runHook(ctx, c, hook, b.Target, b.Ref)
+		if err != nil {
+			return err
+		}
+		b.Target.addHistory("pun: run the " + clientOptPostSolveHook)
+		report.phase(b.phase("post-solve-hook"))
+	}
+
+	if platformHypervisor(b.Target, imagePlatform(b.Target, b.LLBOpts)) == xenHypervisor {
+		err = checkXenKernel(ctx, b.Target, b.Ref)
+		if err != nil {
+			return err
+		}
+		report.phase(b.phase("xen"))
+	}
+
+	if steps.Disk != nil {
+		b.Ref, err = runDiskConversion(ctx, c, steps.Disk, b.Target, b.Ref,
+				imagePlatform(b.Target, b.LLBOpts), b.LLBOpts)
+		if err != nil {
+			return err
+		}
+		report.phase(b.phase("disk-format"))
+	}
+
+	// The kernel gets signed as it will get exported
+	if steps.Sign != nil {
+		b.Ref, err = runSign(ctx, c, steps.Sign, b.Target, b.Ref, b.LLBOpts)
+		if err != nil {
+			return err
+		}
+		report.phase(b.phase("sign"))
+	}
+
+	// The digests are computed after the steps that change the artifacts
+	if steps.Checksums {
+		b.Ref, err = addChecksums(ctx, c, b.Target, b.Ref, b.LLBOpts)
+		if err != nil {
+			return err
+		}
+		report.phase(b.phase("checksums"))
+	}
+
+	if steps.UruncJSONSign != nil {
+		b.Ref, err = runUruncJSONSign(ctx, c, steps.UruncJSONSign, b.Target, b.Ref, b.LLBOpts)
+		if err != nil {
+			return err
+		}
+		report.phase(b.phase("sign-urunc-json"))
+	}
+
+	// Nothing changes the files of the image after that
+	if steps.Sizes != nil {
+		err = steps.Sizes.checkSizes(ctx, c, b, buildCtx)
+		if err != nil {
+			return err
+		}
+		report.phase(b.phase("sizes"))
+	}
+
+	if steps.Scrub != nil {
+		err = runScrub(ctx, c, steps.Scrub, b.Target, b.Ref)
+		if err != nil {
+			return err
+		}
+		report.phase(b.phase("scrub"))
+	}
+
+	if steps.Scan != nil {
+		b.Scan, err = runScan(ctx, c, steps.Scan, b.Ref)
+		if err != nil {
+			return err
+		}
+		report.phase(b.phase("scan"))
+	}
+
+	// Boot the packed unikernel, before it gets exported
+	if steps.BootTest != nil {
+		err = runBootTest(ctx, c, steps.BootTest, b.Target, b.Ref, imagePlatform(b.Target, b.LLBOpts))
+		if err != nil {
+			return err
+		}
+		report.phase(b.phase("boot-test"))
+	}
+
+	b.UruncJSON, err = b.Ref.ReadFile(ctx, client.ReadRequest{
+		Filename: b.LLBOpts.UruncJSONPath,
+	})
+	if err != nil {
+		return fmt.Errorf("Failed to read %s: %w", b.LLBOpts.UruncJSONPath, err)
+	}
+
+	return nil
+}
+
+// addUruncJSONMeta adds the urunc.json of every platform in the metadata of
+// the result, which buildkit passes to the response of the solve, since its
+// key has the frontend. prefix. In that way, the clients of buildkit get the
+// packaging metadata without pulling the image.
+func addUruncJSONMeta(res *client.Result, builds []*platformBuild) {
+	for _, b := range builds {
+		// The intermediate states have no urunc.json
+		if b.UruncJSON == nil {
+			continue
+		}
+		key := uruncJSONMetaKey
+		if id := b.id(); id != "" {
+			key += "/" + id
+		}
+		res.AddMeta(key, b.UruncJSON)
+	}
+}
+
+// platformsResult returns the result of a multi-platform build, with a
+// reference, an image config and annotations for every platform.
+func platformsResult(builds []*platformBuild) (*client.Result, error) {
+	res := client.NewResult()
+
+	var exp exptypes.Platforms
+	for _, b := range builds {
+		res.AddRef(b.id(), b.Ref)
+		err := addImageMeta(res, *b.Target, b.Platform, b.LLBOpts.Platform)
+		if err != nil {
+			return nil, err
+		}
+		exp.Platforms = append(exp.Platforms, exptypes.Platform{
+			ID:       b.id(),
+			Platform: *b.Platform,
+		})
+	}
+	dt, err := json.Marshal(exp)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to marshal platforms: %w", err)
+	}
+	res.AddMeta(exptypes.ExporterPlatformsKey, dt)
+
+	return res, nil
+}
+
+// addIndexAnnots adds the annotations of the index in the result, both in
+// the index and in its descriptor. Annotations without a value get the
+// value of the annotation of the target.
+func addIndexAnnots(res *client.Result, annots map[string]string, target *PackInstructions) error {
+	targetAnnots := artifactAnnots(*target)
+	for annot, val := range annots {
+		if val == "" {
+			var ok bool
+			val, ok = targetAnnots[annot]
+			if !ok {
+				return fmt.Errorf("The index annotation %s has no value and the image does not set it", annot)
+			}
+		}
+		res.AddMeta(exptypes.AnnotationIndexKey(annot), []byte(val))
+		res.AddMeta(exptypes.AnnotationIndexDescriptorKey(annot), []byte(val))
+	}
+
+	return nil
+}
@@ -0,0 +1,92 @@
+// Copyright (c) 2023-2024, Nubificus LTD
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/moby/buildkit/client/llb"
+	"github.com/moby/buildkit/frontend/dockerfile/parser"
+)
+
+const mvCmd string = "mv"
+
+// MvCommand is the MV instruction of pun, which moves a path inside the
+// image, e.g. the kernel of a base with a different layout to the path that
+// the rest of the images use.
+//
+//	MV <src> <dest>
+type MvCommand struct {
+	Src  string
+	Dest string
+	args string // The arguments of the instruction, before the expansion
+	loc  []parser.Range
+}
+
+func (c *MvCommand) Name() string {
+	return mvCmd
+}
+
+func (c *MvCommand) Location() []parser.Range {
+	return c.loc
+}
+
+func isMv(node *parser.Node) bool {
+	return strings.EqualFold(node.Value, mvCmd)
+}
+
+// parseMv parses a MV instruction, which the dockerfile parser does not know
+// about.
+func parseMv(node *parser.Node) (*MvCommand, error) {
+	c := &MvCommand{
+		loc: nodeLocation(node),
+	}
+	if len(node.Flags) > 0 {
+		return nil, fmt.Errorf("Unknown flag %s in MV", node.Flags[0])
+	}
+	c.args = rawArgs(node)
+	if c.args == "" {
+		return nil, fmt.Errorf("MV requires a source and a destination")
+	}
+
+	return c, nil
+}
+
+// expand expands any args in the paths of the instruction.
+func (c *MvCommand) expand(scope *argScope) error {
+	paths, err := scope.expandWords(c.args)
+	if err != nil {
+		return err
+	}
+	if len(paths) != 2 {
+		return fmt.Errorf("MV requires a source and a destination, got %d paths", len(paths))
+	}
+	c.Src, c.Dest = paths[0], paths[1]
+	if strings.Trim(c.Src, "/") == "" {
+		return fmt.Errorf("MV can not move the root of the image")
+	}
+
+	return nil
+}
+
+// mvIn moves the source of a MV instruction to its destination in base,
+// copying it and removing the original in the same layer. The files keep
+// their metadata, as with mv.
+func mvIn(base llb.State, c *MvCommand) llb.State {
+	return base.File(llb.Copy(base, c.Src, c.Dest, &llb.CopyInfo{
+		CreateDestPath: true,
+	}).Rm(c.Src))
+}
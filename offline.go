@@ -0,0 +1,75 @@
+// Copyright (c) 2023-2024, Nubificus LTD
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/moby/buildkit/frontend/dockerfile/instructions"
+)
+
+const clientOptOffline string = "offline"
+
+// offlineError is the error for anything that needs the network in offline
+// builds.
+func offlineError(what string) error {
+	return fmt.Errorf("%s requires network access, which is not allowed in offline mode", what)
+}
+
+// checkOffline checks that the images we will build do not need the
+// network. The bases need to come from local OCI layouts, either directly
+// or through named contexts, and there can be no HTTP sources. The
+// buildOpts contain the named contexts, if any.
+func checkOffline(images []*PackInstructions, reachable []*PackInstructions, buildOpts map[string]string) error {
+	for _, instr := range reachable {
+		base := instr.Base
+		if namedCtx, ok := buildOpts[clientOptContext+base]; ok {
+			base = namedCtx
+		}
+		if base != "scratch" && findImage(images, instr, instr.Base) == nil &&
+		   !strings.HasPrefix(base, ociLayoutPrefix) {
+			return offlineError("The base image " + instr.Base)
+		}
+
+		for _, cmd := range instr.Copies {
+			switch c := cmd.(type) {
+			case *instructions.CopyCommand:
+				if c.From != "" && findImage(images, instr, c.From) == nil {
+					return offlineError("COPY --from=" + c.From)
+				}
+				if len(instr.CopyFlags[c].Extract) > 0 && isZip(c.SourcePaths[0]) {
+					return offlineError("Extracting from " + c.SourcePaths[0])
+				}
+				if instr.CopyFlags[c].Ext4Size > 0 {
+					return offlineError("COPY --" + ext4Flag)
+				}
+			case *instructions.AddCommand:
+				for _, src := range c.SourcePaths {
+					if isRemoteSrc(src) {
+						return offlineError("ADD " + src)
+					}
+					if len(instr.CopyFlags[c].Extract) > 0 && isZip(src) {
+						return offlineError("Extracting from " + src)
+					}
+				}
+			case *SeedCommand:
+				return offlineError("SEED " + c.Dest)
+			}
+		}
+	}
+
+	return nil
+}
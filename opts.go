@@ -0,0 +1,278 @@
+// Copyright (c) 2023-2024, Nubificus LTD
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/containerd/platforms"
+	"github.com/moby/buildkit/frontend/gateway/client"
+	ocispecs "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+const (
+	clientOptContextName string = "contextkey"
+	clientOptUruncJSON   string = "urunc-json-path"
+	clientOptPlatform    string = "default-platform"
+	clientOptUnikraftHub string = "unikraft-hub"
+	clientOptHub         string = "hub:"
+	clientOptCacheImport string = "cache-imports"
+	clientOptMaxResolves string = "max-parallel-resolves"
+	clientOptRetries     string = "registry-retries"
+	clientOptRetryDelay  string = "registry-retry-delay"
+	clientOptIndexAnnot  string = "index-annotation:"
+	clientOptNormalize   string = "normalize"
+)
+
+// LLBOpts contains the options for the construction of the LLB, so that
+// pun can get adapted in different layouts.
+type LLBOpts struct {
+	ContextName   string            // The name of the local build context
+	UruncJSONPath string            // The path of urunc.json in the rootfs
+	Platform      ocispecs.Platform // The default platform of the unikernel
+	// Registries (or repository prefixes) of unikernel images mapped to the
+	// platform of their images. The platform can be just an OS (e.g. qemu),
+	// in which case the architecture of the default platform is used.
+	Hubs          map[string]string
+	// Shortnames of registries (or repository prefixes) mapped to the
+	// repository prefixes that their images get pulled from
+	Aliases       map[string]string
+	// The maximum number of base images to resolve concurrently, so that
+	// builds in small runners do not open too many connections. Zero means
+	// no limit.
+	MaxResolves   int
+	// How to retry the resolution of base images on transient errors
+	Retry         RetryPolicy
+	// Forbid anything that needs the network, for hermetic builds
+	Offline       bool
+	// Reset the ownership and the timestamps of all the copied files
+	Normalize     bool
+	// The timestamp of the normalized files, from SOURCE_DATE_EPOCH. If it
+	// is not set, the Unix epoch is used.
+	Epoch         *time.Time
+	// The image that extracts the members of zip archives
+	ExtractImage  string
+	// The image that creates the ext4 images of COPY --ext4
+	Ext4Image     string
+	// The image that creates the cloud-init seeds of SEED
+	SeedImage     string
+	// The hook that runs against the files of the image, before urunc.json
+	// gets created
+	PreSolveHook  *Hook
+	// The experimental features that the build enables
+	Features      map[string]bool
+	// The intermediate state of the target to build instead of it, for
+	// debugging
+	Intermediate  string
+}
+
+// defaultLLBOpts returns the options that pun uses by default.
+func defaultLLBOpts() LLBOpts {
+	return LLBOpts{
+		ContextName:   packContextName,
+		UruncJSONPath: uruncJSONPath,
+		Platform: ocispecs.Platform{
+			OS:           "qemu",
+			Architecture: "amd64",
+		},
+		Hubs: map[string]string{
+			unikraftHub:          "qemu",
+			unikraftCommunityHub: "qemu",
+			unikraftIndex:        "qemu",
+		},
+		Aliases:      defaultAliases(),
+		Retry:        defaultRetryPolicy(),
+		ExtractImage: defaultExtractImage,
+		Ext4Image:    defaultExt4Image,
+		SeedImage:    defaultSeedImage,
+		Features:     make(map[string]bool),
+	}
+}
+
+// llbOptsFromBuildOpts overrides the default options with the ones given
+// in the build options of buildkit (e.g. buildctl --opt urunc-json-path=).
+func llbOptsFromBuildOpts(opts map[string]string) (LLBOpts, error) {
+	llbOpts := defaultLLBOpts()
+
+	if val, ok := opts[clientOptContextName]; ok && val != "" {
+		llbOpts.ContextName = val
+	}
+	if val, ok := opts[clientOptUruncJSON]; ok && val != "" {
+		llbOpts.UruncJSONPath = val
+	}
+	if val, ok := opts[clientOptPlatform]; ok && val != "" {
+		platform, err := platforms.Parse(val)
+		if err != nil {
+			return llbOpts, fmt.Errorf("Invalid %s %s: %w", clientOptPlatform, val, err)
+		}
+		llbOpts.Platform = platform
+	}
+	if val, ok := opts[clientOptUnikraftHub]; ok && val != "" {
+		// A mirror of the Unikraft registry
+		llbOpts.Hubs[val] = llbOpts.Hubs[unikraftHub]
+	}
+	if val, ok := opts[clientOptMaxResolves]; ok && val != "" {
+		limit, err := strconv.Atoi(val)
+		if err != nil || limit < 0 {
+			return llbOpts, fmt.Errorf("Invalid %s %s, expected a non-negative number", clientOptMaxResolves, val)
+		}
+		llbOpts.MaxResolves = limit
+	}
+	if val, ok := opts[clientOptRetries]; ok && val != "" {
+		retries, err := strconv.Atoi(val)
+		if err != nil || retries < 0 {
+			return llbOpts, fmt.Errorf("Invalid %s %s, expected a non-negative number", clientOptRetries, val)
+		}
+		llbOpts.Retry.Attempts = retries + 1
+	}
+	if val, ok := opts[clientOptRetryDelay]; ok && val != "" {
+		delay, err := time.ParseDuration(val)
+		if err != nil {
+			return llbOpts, fmt.Errorf("Invalid %s %s: %w", clientOptRetryDelay, val, err)
+		}
+		llbOpts.Retry.Delay = delay
+	}
+	if val, ok := opts[clientOptOffline]; ok && val != "" {
+		offline, err := strconv.ParseBool(val)
+		if err != nil {
+			return llbOpts, fmt.Errorf("Invalid %s %s, expected a boolean", clientOptOffline, val)
+		}
+		llbOpts.Offline = offline
+	}
+	if val, ok := opts[clientOptExtractImage]; ok && val != "" {
+		llbOpts.ExtractImage = val
+	}
+	if val, ok := opts[clientOptExt4Image]; ok && val != "" {
+		llbOpts.Ext4Image = val
+	}
+	if val, ok := opts[clientOptSeedImage]; ok && val != "" {
+		llbOpts.SeedImage = val
+	}
+	if val, ok := opts[clientOptExperimental]; ok && val != "" {
+		err := parseFeatures(llbOpts.Features, strings.Split(val, ","))
+		if err != nil {
+			return llbOpts, fmt.Errorf("Invalid %s %s: %w", clientOptExperimental, val, err)
+		}
+	}
+	hook, err := hookFromBuildOpts(opts, clientOptPreSolveHook)
+	if err != nil {
+		return llbOpts, err
+	}
+	llbOpts.PreSolveHook = hook
+	if val, ok := opts[clientOptNormalize]; ok && val != "" {
+		normalize, err := strconv.ParseBool(val)
+		if err != nil {
+			return llbOpts, fmt.Errorf("Invalid %s %s, expected a boolean", clientOptNormalize, val)
+		}
+		llbOpts.Normalize = normalize
+	}
+	llbOpts.Intermediate, err = intermediateFromBuildOpts(opts)
+	if err != nil {
+		return llbOpts, err
+	}
+	epoch, err := parseEpoch(opts[clientOptBuildArg+argSourceDateEpoch])
+	if err != nil {
+		return llbOpts, err
+	}
+	llbOpts.Epoch = epoch
+	for key, val := range opts {
+		if hub, ok := strings.CutPrefix(key, clientOptHub); ok {
+			llbOpts.Hubs[hub] = val
+		}
+	}
+	for hub, val := range llbOpts.Hubs {
+		_, err := hubPlatform(val, llbOpts.Platform)
+		if err != nil {
+			return llbOpts, fmt.Errorf("Invalid platform for %s: %w", hub, err)
+		}
+	}
+	for key, val := range opts {
+		if alias, ok := strings.CutPrefix(key, clientOptAlias); ok {
+			err := validateAlias(alias, val)
+			if err != nil {
+				return llbOpts, err
+			}
+			llbOpts.Aliases[alias] = val
+		}
+	}
+
+	return llbOpts, nil
+}
+
+// hubPlatform parses the platform of the images of a hub. If the platform
+// is just an OS, the architecture of the default platform gets used.
+func hubPlatform(val string, def ocispecs.Platform) (ocispecs.Platform, error) {
+	if !strings.Contains(val, "/") {
+		return ocispecs.Platform{
+			OS:           val,
+			Architecture: def.Architecture,
+			Variant:      def.Variant,
+		}, nil
+	}
+
+	return platforms.Parse(val)
+}
+
+// cacheImportsFromOpts returns the caches to import in the solve of the
+// image (e.g. buildctl --import-cache), which buildkit passes to frontends
+// as a build option.
+func cacheImportsFromOpts(opts map[string]string) ([]client.CacheOptionsEntry, error) {
+	var imports []client.CacheOptionsEntry
+
+	val, ok := opts[clientOptCacheImport]
+	if !ok || val == "" {
+		return nil, nil
+	}
+	err := json.Unmarshal([]byte(val), &imports)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid %s %s: %w", clientOptCacheImport, val, err)
+	}
+
+	return imports, nil
+}
+
+// indexAnnotsFromOpts returns the annotations of the index of the image
+// (e.g. buildctl --opt index-annotation:<key>=<value>). An empty value means
+// that the annotation of the target image should be used.
+func indexAnnotsFromOpts(opts map[string]string) map[string]string {
+	annots := make(map[string]string)
+
+	for key, val := range opts {
+		if annot, ok := strings.CutPrefix(key, clientOptIndexAnnot); ok && annot != "" {
+			annots[annot] = val
+		}
+	}
+
+	return annots
+}
+
+// parseEpoch parses the value of SOURCE_DATE_EPOCH, which is the number of
+// seconds since the Unix epoch. It returns nil for an empty value.
+func parseEpoch(val string) (*time.Time, error) {
+	if val == "" {
+		return nil, nil
+	}
+	sec, err := strconv.ParseInt(val, 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid %s %s, expected seconds since the epoch", argSourceDateEpoch, val)
+	}
+	epoch := time.Unix(sec, 0).UTC()
+
+	return &epoch, nil
+}
@@ -0,0 +1,112 @@
+// Copyright (c) 2023-2024, Nubificus LTD
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+
+	"github.com/moby/buildkit/frontend/gateway/client"
+	"github.com/moby/buildkit/frontend/subrequests"
+	"github.com/moby/buildkit/frontend/subrequests/outline"
+	"github.com/moby/buildkit/solver/pb"
+)
+
+// The subrequests (e.g. docker buildx build --print=outline) are passed to
+// the frontend with this build option.
+const clientOptRequestID string = "requestid"
+
+// supportedSubrequests are the subrequests that pun answers.
+var supportedSubrequests = []subrequests.Request{
+	outline.SubrequestsOutlineDefinition,
+	subrequests.SubrequestsDescribeDefinition,
+}
+
+// targetOutline returns the outline of the target image, with the args
+// that it and the images it depends on declare, in the order of the file.
+func targetOutline(fileBytes []byte, images []*PackInstructions, target *PackInstructions) outline.Outline {
+	type declKey struct {
+		name string
+		line int
+	}
+	seen := make(map[declKey]bool)
+
+	o := outline.Outline{
+		Name:        target.Name,
+		Description: target.Description,
+		Sources:     [][]byte{fileBytes},
+	}
+	for _, image := range reachableImages(images, target) {
+		for _, decl := range image.Args {
+			key := declKey{decl.Name, decl.Line}
+			if seen[key] {
+				continue
+			}
+			seen[key] = true
+			arg := outline.Arg{
+				Name:        decl.Name,
+				Description: decl.Description,
+				Location: &pb.Location{
+					SourceIndex: 0,
+					Ranges: []*pb.Range{{
+						Start: pb.Position{Line: int32(decl.Line)},
+						End:   pb.Position{Line: int32(decl.Line)},
+					}},
+				},
+			}
+			if decl.Default != nil {
+				arg.Value = *decl.Default
+			}
+			o.Args = append(o.Args, arg)
+		}
+	}
+
+	return o
+}
+
+// describeResult answers the describe subrequest, with the subrequests
+// that pun supports.
+func describeResult() (*client.Result, error) {
+	dt, err := json.MarshalIndent(supportedSubrequests, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	b := bytes.NewBuffer(nil)
+	err = subrequests.PrintDescribe(dt, b)
+	if err != nil {
+		return nil, err
+	}
+
+	res := client.NewResult()
+	res.Metadata = map[string][]byte{
+		"result.json": dt,
+		"result.txt":  b.Bytes(),
+		"version":     []byte(subrequests.SubrequestsDescribeDefinition.Version),
+	}
+
+	return res, nil
+}
+
+// checkSubrequest returns an error for subrequests that pun does not know.
+func checkSubrequest(req string) error {
+	for _, r := range supportedSubrequests {
+		if r.Name == req {
+			return nil
+		}
+	}
+
+	return fmt.Errorf("Unsupported subrequest %s", req)
+}
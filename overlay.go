@@ -0,0 +1,178 @@
+// Copyright (c) 2023-2024, Nubificus LTD
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"path"
+	"strings"
+
+	"github.com/moby/buildkit/client/llb"
+	"github.com/moby/buildkit/frontend/dockerfile/parser"
+)
+
+const (
+	configCmd        string = "config"
+	configFormatFlag string = "format"
+	configFormatEnv  string = "env"
+	configFormatJSON string = "json"
+)
+
+// ConfigValue is a key and its value in a CONFIG instruction.
+type ConfigValue struct {
+	Key   string
+	Value string
+}
+
+// ConfigCommand is the CONFIG instruction of pun, which writes a small
+// configuration file of the application from key/value pairs, which can use
+// build args. The files of all the CONFIG instructions of the target get
+// written in a layer after urunc.json, so that repacking the image for
+// another environment reuses the rest of the layers from the cache.
+//
+//	CONFIG [--format=env|json] <dest> <key>=<value>...
+type ConfigCommand struct {
+	Dest   string
+	Format string
+	Values []ConfigValue
+	args   string // The arguments of the instruction, before the expansion
+	loc    []parser.Range
+}
+
+func (c *ConfigCommand) Name() string {
+	return configCmd
+}
+
+func (c *ConfigCommand) Location() []parser.Range {
+	return c.loc
+}
+
+func isConfig(node *parser.Node) bool {
+	return strings.EqualFold(node.Value, configCmd)
+}
+
+// parseConfig parses a CONFIG instruction, which the dockerfile parser does
+// not know about.
+func parseConfig(node *parser.Node) (*ConfigCommand, error) {
+	c := &ConfigCommand{
+		Format: configFormatEnv,
+		loc:    nodeLocation(node),
+	}
+	if val, ok := popFlag(node, configFormatFlag); ok {
+		if val != configFormatEnv && val != configFormatJSON {
+			return nil, fmt.Errorf("Invalid format %s in CONFIG, expected %s or %s", val, configFormatEnv, configFormatJSON)
+		}
+		c.Format = val
+	}
+	if len(node.Flags) > 0 {
+		return nil, fmt.Errorf("Unknown flag %s in CONFIG", node.Flags[0])
+	}
+	c.args = rawArgs(node)
+	if c.args == "" {
+		return nil, fmt.Errorf("CONFIG requires a destination and at least one key=value")
+	}
+
+	return c, nil
+}
+
+// expand expands any args in the destination and the values of the
+// instruction.
+func (c *ConfigCommand) expand(scope *argScope) error {
+	words, err := scope.expandWords(c.args)
+	if err != nil {
+		return err
+	}
+	if len(words) < 2 {
+		return fmt.Errorf("CONFIG requires a destination and at least one key=value")
+	}
+	c.Dest = words[0]
+	if strings.HasSuffix(c.Dest, "/") {
+		return fmt.Errorf("The destination of CONFIG is the path of the file, got %s", c.Dest)
+	}
+	c.Values = nil
+	for _, word := range words[1:] {
+		key, val, ok := strings.Cut(word, "=")
+		if !ok || key == "" {
+			return fmt.Errorf("Invalid value %s in CONFIG, expected key=value", word)
+		}
+		c.Values = append(c.Values, ConfigValue{Key: key, Value: val})
+	}
+
+	return nil
+}
+
+// content returns the contents of the configuration file. Later values of a
+// key override the earlier ones in JSON.
+func (c *ConfigCommand) content() ([]byte, error) {
+	if c.Format == configFormatJSON {
+		values := make(map[string]string)
+		for _, v := range c.Values {
+			values[v.Key] = v.Value
+		}
+		dt, err := json.MarshalIndent(values, "", "  ")
+		if err != nil {
+			return nil, fmt.Errorf("Failed to marshal %s: %w", c.Dest, err)
+		}
+		return append(dt, '\n'), nil
+	}
+
+	var b strings.Builder
+	for _, v := range c.Values {
+		fmt.Fprintf(&b, "%s=%s\n", v.Key, v.Value)
+	}
+
+	return []byte(b.String()), nil
+}
+
+// configsIn writes the files of the CONFIG instructions of the image in
+// base, in a single layer.
+func configsIn(base llb.State, instr *PackInstructions, opts LLBOpts) (llb.State, error) {
+	if len(instr.Configs) == 0 {
+		return base, nil
+	}
+
+	var action *llb.FileAction
+	mkdir := func(p string) {
+		if action == nil {
+			action = llb.Mkdir(p, 0755, llb.WithParents(true))
+		} else {
+			action = action.Mkdir(p, 0755, llb.WithParents(true))
+		}
+	}
+	for _, c := range instr.Configs {
+		dt, err := c.content()
+		if err != nil {
+			return base, err
+		}
+		mkdir(path.Dir(path.Join("/", c.Dest)))
+		action = action.Mkfile(c.Dest, 0644, dt, uruncJSONOpts(opts)...)
+	}
+
+	return base.File(action, llb.WithCustomName("Write the configuration of the application")), nil
+}
+
+// configHistory records the layer of the configuration files, which comes
+// after urunc.json.
+func (instr *PackInstructions) configHistory() {
+	if len(instr.Configs) == 0 {
+		return
+	}
+	var paths []string
+	for _, c := range instr.Configs {
+		paths = append(paths, c.Dest)
+	}
+	instr.addHistory("CONFIG: write " + strings.Join(paths, " "))
+}
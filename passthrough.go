@@ -0,0 +1,123 @@
+// Copyright (c) 2023-2024, Nubificus LTD
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/moby/buildkit/client/llb"
+	"github.com/moby/buildkit/frontend/dockerfile/parser"
+	"github.com/moby/buildkit/frontend/gateway/client"
+	"github.com/moby/buildkit/solver/pb"
+)
+
+const (
+	clientOptPassthrough string = "passthrough"
+	// The dockerfile frontend that is built in buildkit
+	dockerfileFrontend   string = "dockerfile.v0"
+	// The input of the dockerfile frontend with the Dockerfile
+	dockerfileInput      string = "dockerfile"
+)
+
+// dockerfileOnlyCmds are the instructions that only make sense in container
+// images, which pun does not support.
+var dockerfileOnlyCmds = []string{
+	"run", "cmd", "entrypoint", "env", "workdir", "user", "expose", "volume",
+	"shell", "healthcheck", "stopsignal", "onbuild",
+}
+
+// passthroughFromBuildOpts returns whether the file gets passed to the
+// dockerfile frontend: always with passthrough=true, never with
+// passthrough=false and, by default, if it is a plain Dockerfile.
+func passthroughFromBuildOpts(opts map[string]string, fileBytes []byte) (bool, error) {
+	val := opts[clientOptPassthrough]
+	if val == "" || val == "auto" {
+		return isPlainDockerfile(fileBytes), nil
+	}
+	b, err := strconv.ParseBool(val)
+	if err != nil {
+		return false, fmt.Errorf("Invalid %s %s, expected auto or a boolean", clientOptPassthrough, val)
+	}
+
+	return b, nil
+}
+
+// isPlainDockerfile returns true if the file is the Dockerfile of a
+// container, rather than the packing instructions of a unikernel: it has
+// instructions that only containers use, e.g. RUN, and no urunc labels.
+func isPlainDockerfile(fileBytes []byte) bool {
+	res, err := parser.Parse(bytes.NewReader(fileBytes))
+	if err != nil {
+		// Let the parser of pun report the error
+		return false
+	}
+
+	plain := false
+	for _, child := range res.AST.Children {
+		cmd := strings.ToLower(child.Value)
+		if cmd == "label" && strings.Contains(child.Original, uruncAnnotPrefix) {
+			return false
+		}
+		for _, other := range dockerfileOnlyCmds {
+			if cmd == other {
+				plain = true
+			}
+		}
+	}
+
+	return plain
+}
+
+// solveDockerfile solves a Dockerfile with the dockerfile frontend of
+// buildkit, with the given build options and the inputs of the build, e.g.
+// the named contexts. If dockerfile is set, it replaces the Dockerfile of
+// the build.
+func solveDockerfile(ctx context.Context, c client.Client, opts map[string]string, dockerfile []byte) (*client.Result, error) {
+	inputs, err := c.Inputs(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to get the inputs of the build: %w", err)
+	}
+	frontendInputs := make(map[string]*pb.Definition)
+	for name, st := range inputs {
+		def, err := st.Marshal(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to marshal the input %s: %w", name, err)
+		}
+		frontendInputs[name] = def.ToPB()
+	}
+	if dockerfile != nil {
+		st := llb.Scratch().File(llb.Mkfile(builderDockerfile, 0644, dockerfile))
+		def, err := st.Marshal(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to marshal the Dockerfile: %w", err)
+		}
+		frontendInputs[dockerfileInput] = def.ToPB()
+	}
+
+	res, err := c.Solve(ctx, client.SolveRequest{
+		Frontend:       dockerfileFrontend,
+		FrontendOpt:    opts,
+		FrontendInputs: frontendInputs,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("Failed to build with the dockerfile frontend: %w", err)
+	}
+
+	return res, nil
+}
@@ -0,0 +1,90 @@
+// Copyright (c) 2023-2024, Nubificus LTD
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+
+	// Registers podman-container:// addresses, which connect to a
+	// buildkitd that runs in a podman container
+	_ "github.com/moby/buildkit/client/connhelper/podmancontainer"
+)
+
+const (
+	// The output that loads the image in podman
+	exporterPodman    string = "podman"
+	defaultPodmanBin  string = "podman"
+)
+
+// podmanOutput is an output of the build that gets loaded in podman.
+type podmanOutput struct {
+	Bin     string // The podman binary
+	Tarball string // The docker archive of the image
+}
+
+// podmanOutputs replaces the podman outputs of the build with docker
+// archives in temporary files, which podman loads after the build. Docker
+// archives keep the full names of the images, so that podman load tags the
+// loaded images with them.
+func podmanOutputs(outputs []string) ([]string, []podmanOutput, error) {
+	var replaced []string
+	var loads []podmanOutput
+	for _, output := range outputs {
+		attrs, err := parseCSVAttrs("output", output)
+		if err != nil {
+			return nil, nil, err
+		}
+		if attrs["type"] != exporterPodman {
+			replaced = append(replaced, output)
+			continue
+		}
+		if attrs["name"] == "" {
+			return nil, nil, fmt.Errorf("The %s output requires name", exporterPodman)
+		}
+		bin := attrs[exporterPodman]
+		if bin == "" {
+			bin = defaultPodmanBin
+		}
+		tarball, err := os.CreateTemp("", "pun-podman-*.tar")
+		if err != nil {
+			return nil, nil, err
+		}
+		tarball.Close()
+		loads = append(loads, podmanOutput{
+			Bin:     bin,
+			Tarball: tarball.Name(),
+		})
+		replaced = append(replaced, fmt.Sprintf("type=docker,\"name=%s\",dest=%s",
+				attrs["name"], tarball.Name()))
+	}
+
+	return replaced, loads, nil
+}
+
+// load loads the image of the output in podman.
+func (o podmanOutput) load(ctx context.Context) error {
+	cmd := exec.CommandContext(ctx, o.Bin, "load", "-i", o.Tarball)
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("Failed to load the image in podman: %w: %s", err, strings.TrimSpace(string(out)))
+	}
+	fmt.Fprint(os.Stderr, string(out))
+
+	return nil
+}
@@ -0,0 +1,379 @@
+// Copyright (c) 2023-2024, Nubificus LTD
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"slices"
+	"sort"
+	"strings"
+
+	units "github.com/docker/go-units"
+	"github.com/moby/buildkit/frontend/dockerfile/instructions"
+	"github.com/open-policy-agent/opa/rego"
+)
+
+const (
+	clientOptPolicy string = "policy"
+	// The policy can also be given in the environment, e.g. from a ConfigMap
+	policyEnv       string = "PUN_POLICY"
+	// The rules of Rego policies that return the violations
+	policyRegoQuery string = "data.pun.deny"
+)
+
+// Policy contains the packaging standards that the images must follow.
+// Bases and annotations are matched with shell patterns, as in path.Match,
+// where a trailing ** matches anything, including slashes. Rules that the
+// fields can not express go in a Rego module, whose deny set returns the
+// violations.
+type Policy struct {
+	// The bases that images can use. Images of the file and scratch are
+	// always allowed. If empty, any base is allowed.
+	AllowedBases         []string            `json:"allowedBases"`
+	// The labels that the target image must have
+	RequiredLabels       []string            `json:"requiredLabels"`
+	// The annotations that the target image must not have
+	ForbiddenAnnotations []string            `json:"forbiddenAnnotations"`
+	// The values that some labels of the target image are allowed to have
+	AllowedValues        map[string][]string `json:"allowedValues"`
+	// The maximum size of the files of the image, e.g. 64MB
+	MaxImageSize         string              `json:"maxImageSize"`
+	// The maximum size of the files that an instruction adds
+	MaxLayerSize         string              `json:"maxLayerSize"`
+	// A Rego module of package pun
+	Rego                 string              `json:"rego"`
+
+	maxImageSize int64
+	maxLayerSize int64
+	query        *rego.PreparedEvalQuery
+	// The policies that the images must also follow, e.g. the one of the
+	// client next to the central one
+	also         []*Policy
+}
+
+// PolicyInput is the input of the Rego policies: the target and all the
+// images that it needs, as parsed, and the external images that the build
+// pulls for them.
+type PolicyInput struct {
+	Target  LintImage   `json:"target"`
+	Images  []LintImage `json:"images"`
+	// The bases, as named contexts and aliases expand them, and the images
+	// of COPY --from
+	Sources []string    `json:"sources"`
+}
+
+// parsePolicy parses a policy in JSON, or a Rego module, which is the
+// same as a JSON policy with just the module.
+func parsePolicy(content []byte) (*Policy, error) {
+	var policy Policy
+	var err error
+
+	if bytes.HasPrefix(bytes.TrimSpace(content), []byte("{")) {
+		err = json.Unmarshal(content, &policy)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to parse policy: %w", err)
+		}
+	} else {
+		policy.Rego = string(content)
+	}
+	if policy.Rego != "" {
+		query, err := rego.New(
+			rego.Query(policyRegoQuery),
+			rego.Module("policy.rego", policy.Rego),
+		).PrepareForEval(context.TODO())
+		if err != nil {
+			return nil, fmt.Errorf("Failed to parse the Rego module of the policy: %w", err)
+		}
+		policy.query = &query
+	}
+	for _, patterns := range [][]string{policy.AllowedBases, policy.ForbiddenAnnotations} {
+		for _, pattern := range patterns {
+			if _, err := path.Match(pattern, ""); err != nil {
+				return nil, fmt.Errorf("Invalid pattern %s in policy: %w", pattern, err)
+			}
+		}
+	}
+	if policy.MaxImageSize != "" {
+		policy.maxImageSize, err = units.FromHumanSize(policy.MaxImageSize)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid maxImageSize in policy: %w", err)
+		}
+	}
+	if policy.MaxLayerSize != "" {
+		policy.maxLayerSize, err = units.FromHumanSize(policy.MaxLayerSize)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid maxLayerSize in policy: %w", err)
+		}
+	}
+
+	return &policy, nil
+}
+
+// centralPolicy returns the policy in the environment, e.g. from a
+// ConfigMap, which every build must follow. It returns nil if there is none.
+func centralPolicy() (*Policy, error) {
+	val := os.Getenv(policyEnv)
+	if val == "" {
+		return nil, nil
+	}
+	policy, err := parsePolicy([]byte(val))
+	if err != nil {
+		return nil, fmt.Errorf("Invalid %s: %w", policyEnv, err)
+	}
+
+	return policy, nil
+}
+
+// loadPolicy returns the policy of a local file, if given, along with the
+// central one. It returns nil if there is no policy.
+func loadPolicy(filename string) (*Policy, error) {
+	central, err := centralPolicy()
+	if err != nil || filename == "" {
+		return central, err
+	}
+	content, err := readLocalFile(filename)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to read policy %s: %w", filename, err)
+	}
+	policy, err := parsePolicy(content)
+	if err != nil {
+		return nil, err
+	}
+
+	return andPolicy(central, policy), nil
+}
+
+// policyFromBuildOpts returns the policy of the build options, if any,
+// along with the central one in the environment of the frontend. The
+// policy of the client can only add rules, it never replaces the central
+// one.
+func policyFromBuildOpts(opts map[string]string) (*Policy, error) {
+	central, err := centralPolicy()
+	if err != nil {
+		return nil, err
+	}
+	val := opts[clientOptPolicy]
+	if val == "" {
+		return central, nil
+	}
+	policy, err := parsePolicy([]byte(val))
+	if err != nil {
+		return nil, err
+	}
+
+	return andPolicy(central, policy), nil
+}
+
+// minSize returns the smaller of two limits of sizes, where zero means no
+// limit.
+func minSize(a int64, b int64) int64 {
+	if a == 0 || (b != 0 && b < a) {
+		return b
+	}
+
+	return a
+}
+
+// andPolicy returns a policy that the images follow only if they follow
+// both policy and other. The limits of the sizes are the smaller ones.
+func andPolicy(policy *Policy, other *Policy) *Policy {
+	if policy == nil {
+		return other
+	} else if other == nil {
+		return policy
+	}
+	combined := *policy
+	combined.also = append(slices.Clone(policy.also), other)
+	combined.maxImageSize = minSize(policy.maxImageSize, other.maxImageSize)
+	combined.maxLayerSize = minSize(policy.maxLayerSize, other.maxLayerSize)
+	if combined.maxImageSize != policy.maxImageSize {
+		combined.MaxImageSize = other.MaxImageSize
+	}
+	if combined.maxLayerSize != policy.maxLayerSize {
+		combined.MaxLayerSize = other.MaxLayerSize
+	}
+
+	return &combined
+}
+
+// policyBaseExpander returns the function that expands the bases of the
+// images to the images that the build pulls, through the named contexts of
+// the build options and the aliases, so that the policies check the latter.
+func policyBaseExpander(opts map[string]string, aliases map[string]string) func(string) string {
+	return func(base string) string {
+		if namedCtx, ok := opts[clientOptContext+base]; ok {
+			base = namedCtx
+		}
+		if strings.HasPrefix(base, ociLayoutPrefix) || isHTTPBase(base) {
+			return base
+		}
+		return aliasBase(base, aliases)
+	}
+}
+
+// policySources returns the external images that the build of the target
+// pulls: the bases, as expand expands them, and the images of COPY --from.
+func policySources(images []*PackInstructions, target *PackInstructions, expand func(string) string) []string {
+	var sources []string
+
+	for _, instr := range reachableImages(images, target) {
+		if instr.Base != "scratch" && findImage(images, instr, instr.Base) == nil {
+			sources = append(sources, expand(instr.Base))
+		}
+		for _, cmd := range instr.Copies {
+			c, ok := cmd.(*instructions.CopyCommand)
+			if !ok || c.From == "" || findImage(images, instr, c.From) != nil {
+				continue
+			}
+			sources = append(sources, expand(c.From))
+		}
+	}
+
+	return sources
+}
+
+// hasSizes returns true if the policy limits the sizes of the image, which
+// are only known after the solve.
+func (policy *Policy) hasSizes() bool {
+	return policy.maxImageSize > 0 || policy.maxLayerSize > 0
+}
+
+func matchAny(patterns []string, name string) bool {
+	for _, pattern := range patterns {
+		if prefix, ok := strings.CutSuffix(pattern, "**"); ok && strings.HasPrefix(name, prefix) {
+			return true
+		}
+		if ok, _ := path.Match(pattern, name); ok {
+			return true
+		}
+	}
+
+	return false
+}
+
+// regoViolations evaluates the Rego module of the policy against the parsed
+// images and returns the messages of its deny set.
+func (policy *Policy) regoViolations(ctx context.Context, images []*PackInstructions, target *PackInstructions,
+		sources []string) ([]string, error) {
+	policyInput := PolicyInput{Target: lintImage(target), Sources: sources}
+	for _, instr := range reachableImages(images, target) {
+		policyInput.Images = append(policyInput.Images, lintImage(instr))
+	}
+	// Rego gets the input as plain JSON values
+	dt, err := json.Marshal(policyInput)
+	if err != nil {
+		return nil, err
+	}
+	var input interface{}
+	err = json.Unmarshal(dt, &input)
+	if err != nil {
+		return nil, err
+	}
+
+	rs, err := policy.query.Eval(ctx, rego.EvalInput(input))
+	if err != nil {
+		return nil, fmt.Errorf("Failed to evaluate the policy: %w", err)
+	}
+	var messages []string
+	for _, result := range rs {
+		for _, expr := range result.Expressions {
+			violations, ok := expr.Value.([]interface{})
+			if !ok {
+				return nil, fmt.Errorf("The deny rule of the policy must be a set, not %T", expr.Value)
+			}
+			for _, v := range violations {
+				if msg, ok := v.(string); ok {
+					messages = append(messages, msg)
+				} else {
+					messages = append(messages, fmt.Sprint(v))
+				}
+			}
+		}
+	}
+	sort.Strings(messages)
+
+	return messages, nil
+}
+
+// check evaluates the policy, and the ones that it is combined with,
+// against the parsed images, before anything gets solved. The allowed bases
+// apply to the images that the build pulls, as expand expands them. It
+// reports all the violations at once.
+func (policy *Policy) check(ctx context.Context, images []*PackInstructions, target *PackInstructions,
+		expand func(string) string) error {
+	sources := policySources(images, target, expand)
+	var errs []error
+
+	for _, p := range append([]*Policy{policy}, policy.also...) {
+		violations, err := p.violations(ctx, images, target, sources)
+		if err != nil {
+			return err
+		}
+		errs = append(errs, violations...)
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("The image violates the policy: %w", errors.Join(errs...))
+	}
+
+	return nil
+}
+
+// violations returns the violations of the rules of the policy itself.
+func (policy *Policy) violations(ctx context.Context, images []*PackInstructions, target *PackInstructions,
+		sources []string) ([]error, error) {
+	var errs []error
+
+	for _, source := range sources {
+		if len(policy.AllowedBases) > 0 && !matchAny(policy.AllowedBases, source) {
+			errs = append(errs, fmt.Errorf("The base %s is not allowed", source))
+		}
+	}
+	for _, label := range policy.RequiredLabels {
+		if _, ok := target.Annots[label]; !ok {
+			errs = append(errs, fmt.Errorf("The label %s is required", label))
+		}
+	}
+	var annots []string
+	for annot := range target.Annots {
+		annots = append(annots, annot)
+	}
+	sort.Strings(annots)
+	for _, annot := range annots {
+		val := target.Annots[annot]
+		if matchAny(policy.ForbiddenAnnotations, annot) {
+			errs = append(errs, fmt.Errorf("The annotation %s is forbidden", annot))
+		}
+		if allowed, ok := policy.AllowedValues[annot]; ok && !slices.Contains(allowed, val) {
+			errs = append(errs, fmt.Errorf("The value %s of %s is not allowed", val, annot))
+		}
+	}
+	if policy.query != nil {
+		messages, err := policy.regoViolations(ctx, images, target, sources)
+		if err != nil {
+			return nil, err
+		}
+		for _, msg := range messages {
+			errs = append(errs, errors.New(msg))
+		}
+	}
+
+	return errs, nil
+}
@@ -0,0 +1,127 @@
+// Copyright (c) 2023-2024, Nubificus LTD
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"slices"
+	"strings"
+
+	"github.com/moby/buildkit/frontend/dockerfile/parser"
+)
+
+const (
+	profileCmd         string = "profile"
+	uruncProfilesAnnot string = "com.urunc.unikernel.profiles"
+	profileKeyCmdline  string = "cmdline"
+	profileKeyInitrd   string = "initrd"
+)
+
+// Profile is a named variant of the unikernel of the image, with its own
+// command line and initrd, which urunc picks at runtime with the
+// com.urunc.unikernel.profile annotation of the container.
+type Profile struct {
+	Name    string `json:"name"`
+	Cmdline string `json:"cmdline,omitempty"`
+	Initrd  string `json:"initrd,omitempty"`
+}
+
+// ProfileCommand is the PROFILE instruction of pun, which declares a
+// profile of the image, so that variants of an application that only
+// differ in their flags do not need images of their own.
+//
+//	PROFILE <name> [cmdline=<cmdline>] [initrd=<path>]
+type ProfileCommand struct {
+	Profile Profile
+	args    string // The arguments of the instruction, before the expansion
+	loc     []parser.Range
+}
+
+func (c *ProfileCommand) Name() string {
+	return profileCmd
+}
+
+func (c *ProfileCommand) Location() []parser.Range {
+	return c.loc
+}
+
+func isProfile(node *parser.Node) bool {
+	return strings.EqualFold(node.Value, profileCmd)
+}
+
+// parseProfile parses a PROFILE instruction, which the dockerfile parser
+// does not know about.
+func parseProfile(node *parser.Node) (*ProfileCommand, error) {
+	c := &ProfileCommand{
+		loc: nodeLocation(node),
+	}
+	if len(node.Flags) > 0 {
+		return nil, fmt.Errorf("Unknown flag %s in PROFILE", node.Flags[0])
+	}
+	c.args = rawArgs(node)
+	if c.args == "" {
+		return nil, fmt.Errorf("PROFILE requires a name")
+	}
+
+	return c, nil
+}
+
+// expand expands any args in the name and the values of the profile.
+func (c *ProfileCommand) expand(scope *argScope) error {
+	words, err := scope.expandWords(c.args)
+	if err != nil {
+		return err
+	}
+	if len(words) == 0 || strings.Contains(words[0], "=") {
+		return fmt.Errorf("PROFILE requires a name before its values")
+	}
+	c.Profile = Profile{Name: words[0]}
+	for _, word := range words[1:] {
+		key, val, _ := strings.Cut(word, "=")
+		switch key {
+		case profileKeyCmdline:
+			c.Profile.Cmdline = val
+		case profileKeyInitrd:
+			if val == "" {
+				return fmt.Errorf("The initrd of the profile %s can not be empty", c.Profile.Name)
+			}
+			c.Profile.Initrd = val
+		default:
+			return fmt.Errorf("Unknown value %s in PROFILE, expected %s or %s", word, profileKeyCmdline, profileKeyInitrd)
+		}
+	}
+
+	return nil
+}
+
+// addProfile adds a profile in the image, failing if the image already has
+// a profile with the same name.
+func (instr *PackInstructions) addProfile(p Profile) error {
+	if slices.ContainsFunc(instr.Profiles, func(other Profile) bool { return other.Name == p.Name }) {
+		return fmt.Errorf("The profile %s is declared more than once", p.Name)
+	}
+	instr.Profiles = append(instr.Profiles, p)
+
+	return nil
+}
+
+// profilesAnnot returns the value of the annotation with the profiles, a
+// JSON array.
+func profilesAnnot(profiles []Profile) string {
+	dt, _ := json.Marshal(profiles)
+
+	return string(dt)
+}
@@ -0,0 +1,234 @@
+// Copyright (c) 2023-2024, Nubificus LTD
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	bkclient "github.com/moby/buildkit/client"
+	"github.com/moby/buildkit/util/progress/progressui"
+	digest "github.com/opencontainers/go-digest"
+)
+
+const (
+	// Structured events of the steps, one JSON object per line
+	progressJSON string = "json"
+)
+
+// progressDisplay shows the progress of builds, as progressui.Display does.
+type progressDisplay interface {
+	UpdateFrom(ctx context.Context, ch chan *bkclient.SolveStatus) ([]bkclient.VertexWarning, error)
+}
+
+// ProgressEvent is an event of the json progress output, for log processors.
+type ProgressEvent struct {
+	// vertex, status, log or warning
+	Type      string        `json:"type"`
+	Time      time.Time     `json:"time"`
+	Vertex    digest.Digest `json:"vertex,omitempty"`
+	// The name of the vertex, e.g. the instruction of the Containerfile
+	Name      string        `json:"name,omitempty"`
+	Started   *time.Time    `json:"started,omitempty"`
+	Completed *time.Time    `json:"completed,omitempty"`
+	Cached    bool          `json:"cached,omitempty"`
+	Error     string        `json:"error,omitempty"`
+	// The progress of a status of the vertex, e.g. of a pull
+	ID        string        `json:"id,omitempty"`
+	Current   int64         `json:"current,omitempty"`
+	Total     int64         `json:"total,omitempty"`
+	// The output of the vertex (stream 1 or 2) or the message of a warning
+	Stream    int           `json:"stream,omitempty"`
+	Data      string        `json:"data,omitempty"`
+}
+
+// jsonDisplay writes the progress as a ProgressEvent per line.
+type jsonDisplay struct {
+	enc *json.Encoder
+}
+
+func (d *jsonDisplay) UpdateFrom(ctx context.Context, ch chan *bkclient.SolveStatus) ([]bkclient.VertexWarning, error) {
+	var warnings []bkclient.VertexWarning
+
+	for s := range ch {
+		var events []ProgressEvent
+		now := time.Now().UTC()
+		for _, v := range s.Vertexes {
+			events = append(events, ProgressEvent{
+				Type:      "vertex",
+				Time:      now,
+				Vertex:    v.Digest,
+				Name:      v.Name,
+				Started:   v.Started,
+				Completed: v.Completed,
+				Cached:    v.Cached,
+				Error:     v.Error,
+			})
+		}
+		for _, st := range s.Statuses {
+			events = append(events, ProgressEvent{
+				Type:      "status",
+				Time:      st.Timestamp,
+				Vertex:    st.Vertex,
+				Name:      st.Name,
+				Started:   st.Started,
+				Completed: st.Completed,
+				ID:        st.ID,
+				Current:   st.Current,
+				Total:     st.Total,
+			})
+		}
+		for _, l := range s.Logs {
+			events = append(events, ProgressEvent{
+				Type:   "log",
+				Time:   l.Timestamp,
+				Vertex: l.Vertex,
+				Stream: l.Stream,
+				Data:   string(l.Data),
+			})
+		}
+		for _, w := range s.Warnings {
+			warnings = append(warnings, *w)
+			events = append(events, ProgressEvent{
+				Type:   "warning",
+				Time:   now,
+				Vertex: w.Vertex,
+				Data:   string(w.Short),
+			})
+		}
+		for _, e := range events {
+			err := d.enc.Encode(e)
+			if err != nil {
+				return warnings, err
+			}
+		}
+	}
+
+	return warnings, nil
+}
+
+// newDisplay returns the display of a progress mode, which is one of the
+// modes of buildx (auto, plain, tty, quiet, rawjson) or json.
+func newDisplay(out io.Writer, mode string) (progressDisplay, error) {
+	switch mode {
+	case progressJSON:
+		return &jsonDisplay{enc: json.NewEncoder(out)}, nil
+	case string(progressui.AutoMode), string(progressui.PlainMode), string(progressui.TtyMode),
+			string(progressui.QuietMode), string(progressui.RawJSONMode):
+		return progressui.NewDisplay(out, progressui.DisplayMode(mode))
+	}
+
+	return nil, fmt.Errorf("Invalid progress %s, expected one of: auto, plain, tty, quiet, json, rawjson", mode)
+}
+
+// quietProgress returns true if pun should not print anything besides the
+// progress, such as the layers of the image.
+func quietProgress(mode string) bool {
+	return mode == string(progressui.QuietMode) || mode == progressJSON || mode == string(progressui.RawJSONMode)
+}
+
+// progressMux merges the progress of concurrent builds, e.g. the targets of
+// pun bake, in a single display, so that the tty display shows all of them
+// at once and the plain output prefixes the steps with their build, instead
+// of garbling the output of many displays.
+type progressMux struct {
+	ch   chan *bkclient.SolveStatus
+	wg   sync.WaitGroup
+	done chan error
+}
+
+// newProgressMux starts the display of the progress of concurrent builds.
+func newProgressMux(ctx context.Context, mode string) (*progressMux, error) {
+	display, err := newDisplay(os.Stderr, mode)
+	if err != nil {
+		return nil, err
+	}
+
+	m := &progressMux{
+		ch:   make(chan *bkclient.SolveStatus),
+		done: make(chan error, 1),
+	}
+	go func() {
+		_, err := display.UpdateFrom(context.WithoutCancel(ctx), m.ch)
+		m.done <- err
+	}()
+
+	return m, nil
+}
+
+// add returns the channel of the progress of a build, whose steps get the
+// prefix. The build closes the channel when it finishes.
+func (m *progressMux) add(prefix string) chan *bkclient.SolveStatus {
+	ch := make(chan *bkclient.SolveStatus)
+
+	m.wg.Add(1)
+	go func() {
+		defer m.wg.Done()
+		for s := range ch {
+			m.ch <- prefixStatus(prefix, s)
+		}
+	}()
+
+	return ch
+}
+
+// wait waits for the display to show the progress of all the builds, once
+// they finish.
+func (m *progressMux) wait() error {
+	m.wg.Wait()
+	close(m.ch)
+
+	return <-m.done
+}
+
+// prefixStatus prefixes the steps of the progress of a build. The digests
+// of the steps are scoped to the build as well, since the builds share the
+// steps that they have in common, which the display would otherwise merge.
+func prefixStatus(prefix string, s *bkclient.SolveStatus) *bkclient.SolveStatus {
+	scope := func(d digest.Digest) digest.Digest {
+		if d == "" {
+			return d
+		}
+		return digest.FromString(prefix + d.String())
+	}
+
+	for _, v := range s.Vertexes {
+		v.Digest = scope(v.Digest)
+		for i, in := range v.Inputs {
+			v.Inputs[i] = scope(in)
+		}
+		v.Name = "[" + prefix + "] " + v.Name
+		if v.ProgressGroup != nil {
+			v.ProgressGroup.Id = prefix + "/" + v.ProgressGroup.Id
+			v.ProgressGroup.Name = "[" + prefix + "] " + v.ProgressGroup.Name
+		}
+	}
+	for _, st := range s.Statuses {
+		st.Vertex = scope(st.Vertex)
+	}
+	for _, l := range s.Logs {
+		l.Vertex = scope(l.Vertex)
+	}
+	for _, w := range s.Warnings {
+		w.Vertex = scope(w.Vertex)
+	}
+
+	return s
+}
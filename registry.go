@@ -0,0 +1,224 @@
+// Copyright (c) 2023-2024, Nubificus LTD
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"archive/tar"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/containerd/containerd/archive/compression"
+	"github.com/containerd/containerd/remotes"
+	"github.com/containerd/containerd/remotes/docker"
+	"github.com/distribution/reference"
+	"github.com/docker/cli/cli/config"
+	digest "github.com/opencontainers/go-digest"
+	ocispecs "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+const (
+	dockerHubHost       string = "registry-1.docker.io"
+	dockerHubConfigKey  string = "https://index.docker.io/v1/"
+	mediaTypeDockerList string = "application/vnd.docker.distribution.manifest.list.v2+json"
+	// Image manifests are small, as Containerfiles are
+	maxManifestSize     int64  = 4 << 20
+)
+
+// RemoteImage is an image in a registry, as the commands of pun which
+// inspect images (e.g. pun diff) see it.
+type RemoteImage struct {
+	Ref      string
+	Digest   digest.Digest
+	Manifest ocispecs.Manifest
+	Config   ocispecs.Image
+	fetcher  remotes.Fetcher
+}
+
+// registryResolver returns a resolver for the registries, which uses the
+// credentials of the docker configuration.
+func registryResolver() remotes.Resolver {
+	cfg := config.LoadDefaultConfigFile(os.Stderr)
+	creds := func(host string) (string, string, error) {
+		if host == dockerHubHost {
+			host = dockerHubConfigKey
+		}
+		auth, err := cfg.GetAuthConfig(host)
+		if err != nil {
+			return "", "", err
+		}
+		if auth.IdentityToken != "" {
+			return "", auth.IdentityToken, nil
+		}
+		return auth.Username, auth.Password, nil
+	}
+
+	return docker.NewResolver(docker.ResolverOptions{
+		Hosts: docker.ConfigureDefaultRegistries(
+			docker.WithAuthorizer(docker.NewDockerAuthorizer(docker.WithAuthCreds(creds))),
+		),
+	})
+}
+
+// fetchJSON fetches a small blob and unmarshals it in v.
+func fetchJSON(ctx context.Context, fetcher remotes.Fetcher, desc ocispecs.Descriptor, v any) error {
+	if desc.Size > maxManifestSize {
+		return fmt.Errorf("%s is too large (%d bytes)", desc.Digest, desc.Size)
+	}
+	rc, err := fetcher.Fetch(ctx, desc)
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+
+	dt, err := io.ReadAll(io.LimitReader(rc, maxManifestSize))
+	if err != nil {
+		return err
+	}
+
+	return json.Unmarshal(dt, v)
+}
+
+// fetchImage fetches the manifest and the config of an image. If the
+// reference points to an index, the first manifest which is not an
+// attestation gets used, since pun produces single-platform images.
+func fetchImage(ctx context.Context, resolver remotes.Resolver, ref string) (*RemoteImage, error) {
+	named, err := reference.ParseNormalizedNamed(ref)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid image reference %s: %w", ref, err)
+	}
+	named = reference.TagNameOnly(named)
+
+	name, desc, err := resolver.Resolve(ctx, named.String())
+	if err != nil {
+		return nil, fmt.Errorf("Failed to resolve %s: %w", ref, err)
+	}
+	fetcher, err := resolver.Fetcher(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+
+	img := &RemoteImage{
+		Ref:     ref,
+		Digest:  desc.Digest,
+		fetcher: fetcher,
+	}
+	if desc.MediaType == ocispecs.MediaTypeImageIndex || desc.MediaType == mediaTypeDockerList {
+		var index ocispecs.Index
+		err = fetchJSON(ctx, fetcher, desc, &index)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to fetch index of %s: %w", ref, err)
+		}
+		found := false
+		for _, m := range index.Manifests {
+			if m.Platform != nil && m.Platform.OS == "unknown" {
+				continue
+			}
+			desc = m
+			found = true
+			break
+		}
+		if !found {
+			return nil, fmt.Errorf("No image manifest in the index of %s", ref)
+		}
+	}
+
+	err = fetchJSON(ctx, fetcher, desc, &img.Manifest)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to fetch manifest of %s: %w", ref, err)
+	}
+	err = fetchJSON(ctx, fetcher, img.Manifest.Config, &img.Config)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to fetch config of %s: %w", ref, err)
+	}
+
+	return img, nil
+}
+
+// ImageFiles contains what the commands of pun look for in the layers of
+// an image.
+type ImageFiles struct {
+	UruncJSON  map[string]string // The decoded contents of urunc.json
+	KernelHash digest.Digest     // The digest of the unikernel binary
+}
+
+// readImageFiles reads urunc.json and hashes the unikernel binary, going
+// through the layers in order, so that the topmost layer wins.
+func (img *RemoteImage) readImageFiles(ctx context.Context, jsonPath string, kernelPath string) (*ImageFiles, error) {
+	files := &ImageFiles{}
+	jsonPath = strings.TrimPrefix(path.Clean("/"+jsonPath), "/")
+	kernelPath = strings.TrimPrefix(path.Clean("/"+kernelPath), "/")
+
+	for _, layer := range img.Manifest.Layers {
+		rc, err := img.fetcher.Fetch(ctx, layer)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to fetch layer %s: %w", layer.Digest, err)
+		}
+		err = readLayerFiles(rc, files, jsonPath, kernelPath)
+		rc.Close()
+		if err != nil {
+			return nil, fmt.Errorf("Failed to read layer %s: %w", layer.Digest, err)
+		}
+	}
+
+	return files, nil
+}
+
+func readLayerFiles(r io.Reader, files *ImageFiles, jsonPath string, kernelPath string) error {
+	dr, err := compression.DecompressStream(r)
+	if err != nil {
+		return err
+	}
+	defer dr.Close()
+
+	tr := tar.NewReader(dr)
+	for {
+		hdr, err := tr.Next()
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		name := strings.TrimPrefix(path.Clean("/"+hdr.Name), "/")
+		switch name {
+		case jsonPath:
+			var encoded map[string]string
+			err = json.NewDecoder(io.LimitReader(tr, maxFileSize)).Decode(&encoded)
+			if err != nil {
+				return fmt.Errorf("Failed to decode %s: %w", jsonPath, err)
+			}
+			files.UruncJSON = make(map[string]string)
+			for key, val := range encoded {
+				decoded, err := base64.StdEncoding.DecodeString(val)
+				if err != nil {
+					return fmt.Errorf("Failed to decode %s in %s: %w", key, jsonPath, err)
+				}
+				files.UruncJSON[key] = string(decoded)
+			}
+		case kernelPath:
+			files.KernelHash, err = digest.SHA256.FromReader(tr)
+			if err != nil {
+				return err
+			}
+		}
+	}
+}
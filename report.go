@@ -0,0 +1,182 @@
+// Copyright (c) 2023-2024, Nubificus LTD
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/containerd/platforms"
+	"github.com/moby/buildkit/frontend/dockerfile/instructions"
+	"github.com/moby/buildkit/frontend/gateway/client"
+	digest "github.com/opencontainers/go-digest"
+)
+
+// The key of the result metadata that contains the build report
+const reportMetaKey string = "pun.report"
+
+// ReportInput is an input of the build, such as a base image or a remote
+// file of ADD.
+type ReportInput struct {
+	Type     string        `json:"type"`
+	Name     string        `json:"name"`
+	Ref      string        `json:"ref,omitempty"`
+	Digest   digest.Digest `json:"digest,omitempty"`
+	Platform string        `json:"platform,omitempty"`
+}
+
+// ReportPhase is the time that a phase of the build took.
+type ReportPhase struct {
+	Name    string  `json:"name"`
+	Seconds float64 `json:"seconds"`
+}
+
+// ReportSize is the size of an artifact of the unikernel, before and after
+// its post-processing.
+type ReportSize struct {
+	Path   string `json:"path"`
+	Before int64  `json:"before"`
+	After  int64  `json:"after"`
+}
+
+// ReportLayer is a layer of the output image and the instruction that
+// created it.
+type ReportLayer struct {
+	Digest    digest.Digest `json:"digest"`
+	Size      int64         `json:"size"`
+	CreatedBy string        `json:"createdBy,omitempty"`
+}
+
+// ReportImage is an output image, for every platform of the build, with
+// the compressed size of its layers.
+type ReportImage struct {
+	Platform string        `json:"platform"`
+	Digest   digest.Digest `json:"digest"`
+	Size     int64         `json:"size"`
+	Layers   []ReportLayer `json:"layers"`
+}
+
+// BuildReport is a machine-readable summary of a build, which pun adds in
+// the result metadata and writes to a file in standalone builds.
+type BuildReport struct {
+	File         string            `json:"file"`
+	FileDigest   digest.Digest     `json:"fileDigest,omitempty"`
+	Context      string            `json:"context,omitempty"`
+	Target       string            `json:"target,omitempty"`
+	Platforms    []string          `json:"platforms"`
+	Inputs       []ReportInput     `json:"inputs"`
+	Annotations  map[string]string `json:"annotations,omitempty"`
+	OutputDigest string            `json:"outputDigest,omitempty"`
+	Started      time.Time         `json:"started"`
+	Finished     time.Time         `json:"finished"`
+	Phases       []ReportPhase     `json:"phases"`
+	Sizes        []ReportSize      `json:"sizes,omitempty"`
+	Images       []ReportImage     `json:"images,omitempty"`
+	Globs        []ReportGlob      `json:"globs,omitempty"`
+	last         time.Time
+}
+
+func newBuildReport() *BuildReport {
+	now := time.Now()
+
+	return &BuildReport{
+		Started: now,
+		last:    now,
+	}
+}
+
+// phase records that a phase of the build ended now. Every phase starts
+// when the previous one ended.
+func (r *BuildReport) phase(name string) {
+	now := time.Now()
+	r.Phases = append(r.Phases, ReportPhase{
+		Name:    name,
+		Seconds: now.Sub(r.last).Seconds(),
+	})
+	r.last = now
+}
+
+// addImages records the target and the inputs of the images that we
+// build, after their bases got resolved. In multi-platform builds, it gets
+// called for every platform and the annotations are the ones of the first.
+func (r *BuildReport) addImages(images []*PackInstructions, reachable []*PackInstructions,
+		target *PackInstructions, opts LLBOpts) {
+	r.Target = target.Name
+	r.Platforms = append(r.Platforms, platforms.Format(imagePlatform(target, opts)))
+	if r.Annotations == nil {
+		r.Annotations = artifactAnnots(*target)
+	}
+
+	for _, instr := range reachable {
+		if instr.Resolved != nil {
+			r.Inputs = append(r.Inputs, ReportInput{
+				Type:     "image",
+				Name:     instr.Base,
+				Ref:      instr.Resolved.Ref,
+				Digest:   instr.Resolved.Digest,
+				Platform: platforms.Format(instr.Resolved.Platform),
+			})
+		}
+		for _, cmd := range instr.Copies {
+			switch c := cmd.(type) {
+			case *instructions.CopyCommand:
+				if c.From != "" && findImage(images, instr, c.From) == nil {
+					r.Inputs = append(r.Inputs, ReportInput{
+						Type: "image",
+						Name: c.From,
+					})
+				}
+			case *instructions.AddCommand:
+				for _, src := range c.SourcePaths {
+					if isRemoteSrc(src) {
+						r.Inputs = append(r.Inputs, ReportInput{
+							Type:   "url",
+							Name:   src,
+							Digest: digest.Digest(c.Checksum),
+						})
+					}
+				}
+			}
+		}
+	}
+}
+
+// addToResult adds the report in the metadata of the result.
+func (r *BuildReport) addToResult(res *client.Result) error {
+	r.Finished = time.Now()
+	dt, err := json.Marshal(r)
+	if err != nil {
+		return fmt.Errorf("Failed to marshal build report: %w", err)
+	}
+	res.AddMeta(reportMetaKey, dt)
+
+	return nil
+}
+
+// write writes the report to a file in JSON.
+func (r *BuildReport) write(filename string) error {
+	dt, err := json.MarshalIndent(r, "", "  ")
+	if err != nil {
+		return fmt.Errorf("Failed to marshal build report: %w", err)
+	}
+	err = os.WriteFile(filename, append(dt, '\n'), 0644)
+	if err != nil {
+		return fmt.Errorf("Failed to write build report %s: %w", filename, err)
+	}
+
+	return nil
+}
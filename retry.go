@@ -0,0 +1,140 @@
+// Copyright (c) 2023-2024, Nubificus LTD
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"regexp"
+	"strings"
+	"time"
+
+	remoteserrors "github.com/containerd/containerd/remotes/errors"
+	"github.com/moby/buildkit/util/grpcerrors"
+	"google.golang.org/grpc/codes"
+)
+
+const (
+	defaultRetryAttempts int           = 3
+	defaultRetryDelay    time.Duration = time.Second
+	maxRetryDelay        time.Duration = 30 * time.Second
+)
+
+// Errors of registries which go away if we try again, for the errors that
+// lost their types on their way through buildkit
+var transientErrors = []string{
+	"i/o timeout",
+	"tls handshake timeout",
+	"timeout awaiting response headers",
+	"connection reset",
+	"connection refused",
+	"broken pipe",
+	"unexpected eof",
+	"too many requests",
+	"service unavailable",
+	"bad gateway",
+	"gateway timeout",
+	"internal server error",
+}
+
+// Status codes of registries in HTTP errors, e.g. "unexpected status: 503"
+// or "unexpected status code 502"
+var statusCodeRE = regexp.MustCompile(`\bstatus(?: code)?:? (5\d\d|429)\b`)
+
+// RetryPolicy describes how many times and how often to retry registry
+// operations which failed with a transient error.
+type RetryPolicy struct {
+	Attempts int           // The number of attempts, including the first one
+	Delay    time.Duration // The delay before the first retry, which doubles
+}
+
+func defaultRetryPolicy() RetryPolicy {
+	return RetryPolicy{
+		Attempts: defaultRetryAttempts,
+		Delay:    defaultRetryDelay,
+	}
+}
+
+// transientStatus returns true for the HTTP status codes of registries
+// that might go away if we try again.
+func transientStatus(code int) bool {
+	return code == http.StatusTooManyRequests || code >= 500 && code <= 599
+}
+
+// isTransient returns true for errors of registries that might go away if
+// we try again, such as timeouts and 5xx responses. The typed errors of the
+// registry clients and the gRPC codes of buildkit decide first, and the
+// messages of the errors only when there are neither.
+func isTransient(err error) bool {
+	if errors.Is(err, context.Canceled) {
+		return false
+	}
+	var statusErr remoteserrors.ErrUnexpectedStatus
+	if errors.As(err, &statusErr) {
+		return transientStatus(statusErr.StatusCode)
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return true
+	}
+	switch grpcerrors.Code(err) {
+	case codes.Unavailable:
+		return true
+	case codes.Canceled, codes.InvalidArgument, codes.NotFound, codes.PermissionDenied,
+			codes.Unauthenticated, codes.Unimplemented:
+		return false
+	}
+	msg := strings.ToLower(err.Error())
+	for _, transient := range transientErrors {
+		if strings.Contains(msg, transient) {
+			return true
+		}
+	}
+
+	return statusCodeRE.MatchString(msg)
+}
+
+// retry runs fn until it succeeds, it fails with an error that is not
+// transient, or the attempts of the policy run out. The delay between the
+// attempts doubles every time, up to maxRetryDelay. If all the attempts
+// fail, the error contains the errors of all of them.
+func (p RetryPolicy) retry(ctx context.Context, what string, fn func() error) error {
+	var errs []error
+
+	delay := p.Delay
+	for attempt := 1; ; attempt++ {
+		err := fn()
+		if err == nil {
+			return nil
+		}
+		if attempt == 1 && (p.Attempts <= 1 || !isTransient(err)) {
+			return err
+		}
+		errs = append(errs, fmt.Errorf("attempt %d: %w", attempt, err))
+		if attempt >= p.Attempts || !isTransient(err) {
+			return fmt.Errorf("Failed to %s after %d attempts: %w", what, attempt, errors.Join(errs...))
+		}
+
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			return fmt.Errorf("Failed to %s: %w", what, errors.Join(append(errs, ctx.Err())...))
+		}
+		delay = min(2*delay, maxRetryDelay)
+	}
+}
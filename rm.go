@@ -0,0 +1,126 @@
+// Copyright (c) 2023-2024, Nubificus LTD
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/moby/buildkit/client/llb"
+	"github.com/moby/buildkit/frontend/dockerfile/parser"
+)
+
+const (
+	rmCmd       string = "rm"
+	rmForceFlag string = "force"
+)
+
+// RmCommand is the RM instruction of pun, which removes paths from the
+// image, e.g. the sources of the application or debug files of a kraft
+// base. The paths can contain wildcards.
+//
+//	RM [--force] <path>...
+type RmCommand struct {
+	Paths []string
+	Force bool   // Do not fail if a path does not exist
+	args  string // The arguments of the instruction, before the expansion
+	loc   []parser.Range
+}
+
+func (c *RmCommand) Name() string {
+	return rmCmd
+}
+
+func (c *RmCommand) Location() []parser.Range {
+	return c.loc
+}
+
+func isRm(node *parser.Node) bool {
+	return strings.EqualFold(node.Value, rmCmd)
+}
+
+// parseRm parses a RM instruction, which the dockerfile parser does not know
+// about.
+func parseRm(node *parser.Node) (*RmCommand, error) {
+	var err error
+
+	c := &RmCommand{
+		loc: nodeLocation(node),
+	}
+	c.Force, err = popBoolFlag(node, rmForceFlag)
+	if err != nil {
+		return nil, err
+	}
+	if len(node.Flags) > 0 {
+		return nil, fmt.Errorf("Unknown flag %s in RM", node.Flags[0])
+	}
+	c.args = rawArgs(node)
+	if c.args == "" {
+		return nil, fmt.Errorf("RM requires at least one path")
+	}
+
+	return c, nil
+}
+
+// expand expands any args in the paths of the instruction.
+func (c *RmCommand) expand(scope *argScope) error {
+	var err error
+
+	c.Paths, err = scope.expandWords(c.args)
+	if err != nil {
+		return err
+	}
+	if len(c.Paths) == 0 {
+		return fmt.Errorf("RM requires at least one path")
+	}
+	for _, p := range c.Paths {
+		if strings.Trim(p, "/") == "" {
+			return fmt.Errorf("RM can not remove the root of the image")
+		}
+	}
+
+	return nil
+}
+
+// rmIn removes the paths of a RM instruction from base.
+func rmIn(base llb.State, c *RmCommand) llb.State {
+	for _, p := range c.Paths {
+		base = base.File(llb.Rm(p, llb.WithAllowWildcard(true), llb.WithAllowNotFound(c.Force)))
+	}
+
+	return base
+}
+
+// hasRm returns true if the image removes any paths, including the sources
+// of MV.
+func hasRm(instr *PackInstructions) bool {
+	for _, cmd := range instr.Copies {
+		switch cmd.(type) {
+		case *RmCommand, *MvCommand:
+			return true
+		}
+	}
+
+	return false
+}
+
+// flatten squashes the layers of an image in a single one. Removing a path
+// from the base only adds a whiteout on top of its layers, so the images
+// that remove paths get flattened in order to actually get smaller.
+func flatten(base llb.State) llb.State {
+	return llb.Scratch().File(llb.Copy(base, "/", "/", &llb.CopyInfo{
+		CopyDirContentsOnly: true,
+	}))
+}
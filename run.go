@@ -0,0 +1,159 @@
+// Copyright (c) 2023-2024, Nubificus LTD
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"os/exec"
+
+	"github.com/moby/buildkit/util/appcontext"
+)
+
+const (
+	runCmd         string = "run"
+	defaultRuntime string = "io.containerd.urunc.v2"
+	defaultRunTag  string = "pun.local/run:latest"
+)
+
+// RunCLIOpts are the options of pun run, which builds an image in standalone
+// mode (unless an existing one is given) and runs it with urunc.
+type RunCLIOpts struct {
+	Build    BuildCLIOpts
+	// An existing image to run, instead of building one
+	Image    string
+	// The name of the built image in containerd
+	Tag      string
+	// The containerd runtime of urunc
+	Runtime  string
+	// The nerdctl binary
+	Nerdctl  string
+	// Extra arguments for nerdctl run, given after --
+	RunArgs  []string
+}
+
+func runUsage() {
+	fmt.Println("Usage of pun run")
+	fmt.Printf("%s %s [<args>] [<context>] [-- <nerdctl run args>]\n\n", os.Args[0], runCmd)
+	fmt.Println("Supported command line arguments")
+	fmt.Println("\t--image name \t\t\tRun an existing image, instead of building one")
+	fmt.Println("\t--tag name \t\t\tThe name of the built image (default " + defaultRunTag + ")")
+	fmt.Println("\t--runtime name \t\t\tThe containerd runtime of urunc (default " + defaultRuntime + ")")
+	fmt.Println("\t--nerdctl path \t\t\tThe nerdctl binary (default nerdctl)")
+	buildFlagsUsage()
+}
+
+func parseRunCLIOpts(args []string) (RunCLIOpts, error) {
+	var opts RunCLIOpts
+
+	// Everything after -- goes to nerdctl run
+	for i, arg := range args {
+		if arg == "--" {
+			opts.RunArgs = args[i+1:]
+			args = args[:i]
+			break
+		}
+	}
+
+	fs := flag.NewFlagSet(runCmd, flag.ExitOnError)
+	addBuildFlags(fs, &opts.Build)
+	fs.StringVar(&opts.Image, "image", "", "Run an existing image, instead of building one")
+	fs.StringVar(&opts.Tag, "tag", defaultRunTag, "The name of the built image")
+	fs.StringVar(&opts.Runtime, "runtime", defaultRuntime, "The containerd runtime of urunc")
+	fs.StringVar(&opts.Nerdctl, "nerdctl", "nerdctl", "The nerdctl binary")
+	fs.Usage = runUsage
+	fs.Parse(args)
+
+	if opts.Image != "" {
+		if fs.NArg() > 0 {
+			return opts, fmt.Errorf("A build context can not be used with --image")
+		}
+		return opts, nil
+	}
+	err := setBuildContext(&opts.Build, fs.Args())
+
+	return opts, err
+}
+
+// nerdctl executes nerdctl with the stdio of pun, in the given namespace
+// of containerd.
+func nerdctl(ctx context.Context, bin string, namespace string, args ...string) error {
+	cmd := exec.CommandContext(ctx, bin, append([]string{"--namespace", namespace}, args...)...)
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+
+	return cmd.Run()
+}
+
+// buildForRun builds the image and loads it in containerd, through an OCI
+// tarball, since buildkitd might not share the image store of containerd.
+func buildForRun(ctx context.Context, opts RunCLIOpts) error {
+	tarball, err := os.CreateTemp("", "pun-run-*.tar")
+	if err != nil {
+		return err
+	}
+	tarball.Close()
+	defer os.Remove(tarball.Name())
+
+	buildOpts := opts.Build
+	buildOpts.Outputs = append(buildOpts.Outputs,
+		fmt.Sprintf("type=oci,name=%s,dest=%s", opts.Tag, tarball.Name()))
+	err = standaloneBuild(ctx, buildOpts)
+	if err != nil {
+		return err
+	}
+
+	err = nerdctl(ctx, opts.Nerdctl, opts.Build.Namespace, "load", "-i", tarball.Name())
+	if err != nil {
+		return fmt.Errorf("Failed to load %s: %w", opts.Tag, err)
+	}
+
+	return nil
+}
+
+func runMain(args []string) {
+	opts, err := parseRunCLIOpts(args)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+
+	ctx := appcontext.Context()
+	image := opts.Image
+	if image == "" {
+		err = buildForRun(ctx, opts)
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		image = opts.Tag
+	}
+
+	runArgs := append([]string{"run", "--rm", "--runtime", opts.Runtime}, opts.RunArgs...)
+	err = nerdctl(ctx, opts.Nerdctl, opts.Build.Namespace, append(runArgs, image)...)
+	if err != nil {
+		// Exit with the exit code of the unikernel
+		var exitErr *exec.ExitError
+		if errors.As(err, &exitErr) {
+			os.Exit(exitErr.ExitCode())
+		}
+		fmt.Println(err)
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,314 @@
+// Copyright (c) 2023-2024, Nubificus LTD
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"debug/elf"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/moby/buildkit/util/appcontext"
+)
+
+const (
+	s2iCmd           string = "s2i"
+	s2iRuntimeAuto   string = "auto"
+	s2iRuntimeELF    string = "elf"
+	s2iRuntimePython string = "python"
+	s2iRuntimeNode   string = "node"
+	s2iAppImage      string = "/app.ext4"
+)
+
+// S2IRuntime is a runtime kernel of the Unikraft catalog, which runs the
+// applications of a kind.
+type S2IRuntime struct {
+	App         string // The application of the catalog with the kernel
+	Interpreter string // The interpreter of the entry point, if any
+	MountPoint  string // Where the kernel mounts the ext4 image of the application
+}
+
+// s2iRuntimes are the runtimes that pun s2i pairs the applications with:
+// the ELF loader of Unikraft for binaries, which get the context as their
+// rootfs, and the interpreters, which keep their own.
+var s2iRuntimes = map[string]S2IRuntime{
+	s2iRuntimeELF:    {App: "base:latest", MountPoint: "/"},
+	s2iRuntimePython: {App: "python:3.12", Interpreter: "/usr/bin/python3", MountPoint: "/app"},
+	s2iRuntimeNode:   {App: "node:21", Interpreter: "/usr/bin/node", MountPoint: "/app"},
+}
+
+// elfArchs maps the machines of ELF binaries to the architectures of
+// the platforms.
+var elfArchs = map[elf.Machine]string{
+	elf.EM_X86_64:  "amd64",
+	elf.EM_AARCH64: "arm64",
+	elf.EM_RISCV:   "riscv64",
+}
+
+// S2IOpts are the options of pun s2i, besides the ones of the build.
+type S2IOpts struct {
+	// The kind of the application, elf, python, node or auto
+	Runtime    string
+	// The application of the catalog with the runtime kernel, by default
+	// the one of the runtime
+	RuntimeApp string
+	// The entry point of the application, relative to the context
+	Entry      string
+	// The arguments of the application
+	Args       string
+	Hypervisor string
+	// The architecture, by default the one of an ELF entry point or amd64
+	Arch       string
+	// The size of the ext4 image of the application
+	Size       string
+}
+
+func s2iUsage() {
+	fmt.Println("Usage of pun s2i")
+	fmt.Printf("%s %s [<args>] [<context>]\n\n", os.Args[0], s2iCmd)
+	fmt.Println("Supported command line arguments")
+	fmt.Println("\t--runtime name \t\t\tThe kind of the application, elf, python, node or auto (default auto)")
+	fmt.Println("\t--runtime-app app:tag \t\tThe application of the Unikraft catalog with the runtime kernel")
+	fmt.Println("\t--entry path \t\t\tThe entry point of the application in the context")
+	fmt.Println("\t--args string \t\t\tThe arguments of the application")
+	fmt.Println("\t--hypervisor name \t\tThe hypervisor to run the unikernel on (default qemu)")
+	fmt.Println("\t--arch name \t\t\tThe architecture of the unikernel (default the one of the binary, or amd64)")
+	fmt.Println("\t--size size \t\t\tThe size of the ext4 image of the application (default 256M)")
+	buildFlagsUsage()
+}
+
+// isELF returns true if the file is an ELF binary.
+func isELF(file string) bool {
+	f, err := elf.Open(file)
+	if err != nil {
+		return false
+	}
+	f.Close()
+
+	return true
+}
+
+// detectEntry returns the runtime and the entry point of the application in
+// the context, if they are not given: the main of package.json for node,
+// main.py or app.py for python, or the only ELF binary of the context.
+func detectEntry(ctxDir string, runtime string, entry string) (string, string, error) {
+	if entry != "" {
+		if !filepath.IsLocal(entry) {
+			return "", "", fmt.Errorf("The entry point %s is not in the context", entry)
+		}
+		if _, err := os.Stat(filepath.Join(ctxDir, entry)); err != nil {
+			return "", "", fmt.Errorf("The entry point %s is not in the context: %w", entry, err)
+		}
+		if runtime != s2iRuntimeAuto {
+			return runtime, entry, nil
+		}
+		switch {
+		case isELF(filepath.Join(ctxDir, entry)):
+			return s2iRuntimeELF, entry, nil
+		case strings.HasSuffix(entry, ".py"):
+			return s2iRuntimePython, entry, nil
+		case strings.HasSuffix(entry, ".js"), strings.HasSuffix(entry, ".mjs"), strings.HasSuffix(entry, ".cjs"):
+			return s2iRuntimeNode, entry, nil
+		}
+		return "", "", fmt.Errorf("Can not tell the runtime of %s, use --runtime", entry)
+	}
+
+	if runtime == s2iRuntimeAuto || runtime == s2iRuntimeNode {
+		dt, err := os.ReadFile(filepath.Join(ctxDir, "package.json"))
+		if err == nil {
+			var pkg struct {
+				Main string `json:"main"`
+			}
+			err = json.Unmarshal(dt, &pkg)
+			if err != nil {
+				return "", "", fmt.Errorf("Invalid package.json: %w", err)
+			}
+			if pkg.Main == "" {
+				pkg.Main = "index.js"
+			}
+			if _, err := os.Stat(filepath.Join(ctxDir, pkg.Main)); err != nil || !filepath.IsLocal(pkg.Main) {
+				return "", "", fmt.Errorf("The main %s of package.json is not in the context", pkg.Main)
+			}
+			return s2iRuntimeNode, pkg.Main, nil
+		}
+	}
+	if runtime == s2iRuntimeAuto || runtime == s2iRuntimePython {
+		for _, name := range []string{"main.py", "app.py"} {
+			if _, err := os.Stat(filepath.Join(ctxDir, name)); err == nil {
+				return s2iRuntimePython, name, nil
+			}
+		}
+	}
+	if runtime == s2iRuntimeAuto || runtime == s2iRuntimeELF {
+		entries, err := os.ReadDir(ctxDir)
+		if err != nil {
+			return "", "", err
+		}
+		var binaries []string
+		for _, e := range entries {
+			if e.Type().IsRegular() && isELF(filepath.Join(ctxDir, e.Name())) {
+				binaries = append(binaries, e.Name())
+			}
+		}
+		if len(binaries) == 1 {
+			return s2iRuntimeELF, binaries[0], nil
+		} else if len(binaries) > 1 {
+			return "", "", fmt.Errorf("The context has many binaries (%s), use --entry", strings.Join(binaries, ", "))
+		}
+	}
+
+	return "", "", fmt.Errorf("Found no application in %s, use --entry", ctxDir)
+}
+
+// elfArch returns the architecture of an ELF binary.
+func elfArch(file string) (string, error) {
+	f, err := elf.Open(file)
+	if err != nil {
+		return "", fmt.Errorf("Failed to read the binary %s: %w", file, err)
+	}
+	defer f.Close()
+	arch, ok := elfArchs[f.Machine]
+	if !ok {
+		return "", fmt.Errorf("The binary %s is for %s, which no runtime supports", file, f.Machine)
+	}
+
+	return arch, nil
+}
+
+// s2iSpec generates the Containerfile that packs the application in the
+// context with the kernel of its runtime. The context, except for the
+// Containerfile itself, becomes an ext4 image, which the kernel mounts in
+// the mount point of the runtime.
+func s2iSpec(img *CatalogImage, opts S2IOpts, runtime string, entry string, file string) string {
+	var b strings.Builder
+
+	mountPoint := s2iRuntimes[runtime].MountPoint
+	cmdline := path.Join(mountPoint, filepath.ToSlash(entry))
+	if interpreter := s2iRuntimes[runtime].Interpreter; interpreter != "" {
+		cmdline = interpreter + " " + cmdline
+	}
+	if opts.Args != "" {
+		cmdline += " " + opts.Args
+	}
+
+	fmt.Fprintf(&b, "FROM scratch AS app\n")
+	fmt.Fprintf(&b, "COPY . /\n")
+	fmt.Fprintf(&b, "RM /%s\n", file)
+	fmt.Fprintf(&b, "FROM --platform=%s/%s %s\n", img.Platform.OS, img.Platform.Architecture, img.Ref)
+	fmt.Fprintf(&b, "COPY --ext4=%s --from=app / %s\n", opts.Size, s2iAppImage)
+	fmt.Fprintf(&b, "LABEL %s=%s\n", uruncUnikernelType, strconv.Quote("unikraft"))
+	fmt.Fprintf(&b, "LABEL %s=%s\n", uruncHypervisorAnnot, strconv.Quote(opts.Hypervisor))
+	fmt.Fprintf(&b, "LABEL %s=%s\n", uruncBinaryAnnot, strconv.Quote(unikraftKernelPath))
+	fmt.Fprintf(&b, "LABEL %s=%s\n", uruncCmdlineAnnot, strconv.Quote(cmdline))
+	fmt.Fprintf(&b, "LABEL %s=%s\n", uruncBlkMntPointAnnot, strconv.Quote(mountPoint))
+
+	return b.String()
+}
+
+// s2iBuild packs the application of the build context with the runtime
+// kernel that runs it, without a Containerfile, by generating one in the
+// context for the duration of the build.
+func s2iBuild(ctx context.Context, opts S2IOpts, buildOpts BuildCLIOpts) error {
+	if _, ok := s2iRuntimes[opts.Runtime]; !ok && opts.Runtime != s2iRuntimeAuto {
+		return fmt.Errorf("Invalid runtime %s, expected one of: auto, elf, python, node", opts.Runtime)
+	}
+	_, err := parseExt4Size(opts.Size)
+	if err != nil {
+		return err
+	}
+	runtime, entry, err := detectEntry(buildOpts.ContextDir, opts.Runtime, opts.Entry)
+	if err != nil {
+		return err
+	}
+	entryPath := filepath.Join(buildOpts.ContextDir, entry)
+	if runtime == s2iRuntimeELF {
+		arch, err := elfArch(entryPath)
+		if err != nil {
+			return err
+		}
+		if opts.Arch != "" && opts.Arch != arch {
+			return fmt.Errorf("The binary %s is for %s, not %s", entry, arch, opts.Arch)
+		}
+		opts.Arch = arch
+		err = checkELFLoader(buildOpts.ContextDir, "/"+filepath.ToSlash(entry))
+		if err != nil {
+			return err
+		}
+	}
+	if opts.Arch == "" {
+		opts.Arch = "amd64"
+	}
+	runtimeApp := opts.RuntimeApp
+	if runtimeApp == "" {
+		runtimeApp = s2iRuntimes[runtime].App
+	}
+
+	img, err := selectCatalogImage(ctx, runtimeApp, opts.Hypervisor, opts.Arch)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(os.Stderr, "Packing the %s application %s with %s for %s\n", runtime, entry, img.Ref, opts.Hypervisor)
+
+	f, err := os.CreateTemp(buildOpts.ContextDir, ".pun-s2i-*")
+	if err != nil {
+		return fmt.Errorf("Failed to write the Containerfile: %w", err)
+	}
+	defer os.Remove(f.Name())
+	_, err = f.WriteString(s2iSpec(img, opts, runtime, entry, filepath.Base(f.Name())))
+	if err == nil {
+		err = f.Close()
+	}
+	if err != nil {
+		return fmt.Errorf("Failed to write the Containerfile: %w", err)
+	}
+	buildOpts.ContainerFile = f.Name()
+
+	return standaloneBuild(ctx, buildOpts)
+}
+
+func s2iMain(args []string) {
+	var opts S2IOpts
+	var buildOpts BuildCLIOpts
+
+	fs := flag.NewFlagSet(s2iCmd, flag.ExitOnError)
+	fs.StringVar(&opts.Runtime, "runtime", s2iRuntimeAuto, "The kind of the application, elf, python, node or auto")
+	fs.StringVar(&opts.RuntimeApp, "runtime-app", "", "The application of the Unikraft catalog with the runtime kernel")
+	fs.StringVar(&opts.Entry, "entry", "", "The entry point of the application in the context")
+	fs.StringVar(&opts.Args, "args", "", "The arguments of the application")
+	fs.StringVar(&opts.Hypervisor, "hypervisor", "qemu", "The hypervisor to run the unikernel on")
+	fs.StringVar(&opts.Arch, "arch", "", "The architecture of the unikernel")
+	fs.StringVar(&opts.Size, "size", "256M", "The size of the ext4 image of the application")
+	addBuildFlags(fs, &buildOpts)
+	fs.Usage = s2iUsage
+	fs.Parse(args)
+	if buildOpts.ContainerFile != "" {
+		fmt.Println("pun s2i generates the Containerfile, it does not take one")
+		os.Exit(2)
+	}
+	err := setBuildContext(&buildOpts, fs.Args())
+	if err == nil {
+		err = s2iBuild(appcontext.Context(), opts, buildOpts)
+	}
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,153 @@
+// Copyright (c) 2023-2024, Nubificus LTD
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"path"
+	"slices"
+	"strings"
+
+	"github.com/moby/buildkit/client/llb"
+	"github.com/moby/buildkit/frontend/gateway/client"
+	gatewaypb "github.com/moby/buildkit/frontend/gateway/pb"
+	"github.com/moby/buildkit/solver/result"
+)
+
+const (
+	clientOptScan              string = "scan"
+	clientOptScanCmd           string = "scan-cmd"
+	clientOptScanFailOn        string = "scan-fail-on"
+	clientOptScanPredicateType string = "scan-predicate-type"
+	defaultScanImage           string = "docker.io/aquasec/trivy:0.56.2"
+	// The predicate of trivy --format cosign-vuln
+	defaultScanPredicateType   string = "https://cosign.sigstore.dev/attestation/vuln/v1"
+	// The packed image gets mounted there in the scanner, which writes its
+	// results in scanOutput
+	scanRootfs                 string = "/unikernel"
+	scanOutputDir              string = "/pun-scan"
+	scanOutputFile             string = "scan.json"
+	scanCacheDir               string = "/root/.cache/trivy"
+)
+
+// The severities of the vulnerabilities, from the lowest to the highest
+var scanSeverities = []string{"UNKNOWN", "LOW", "MEDIUM", "HIGH", "CRITICAL"}
+
+// defaultScanCmd scans the rootfs of the packed image with trivy, which
+// finds the packages and the libraries of the base and of the unikernel that
+// it knows about, writing the results in the predicate of the attestation.
+// With PUN_FAIL_ON, it fails if there are vulnerabilities of these
+// severities.
+const defaultScanCmd string = `
+set -e
+trivy rootfs --quiet --format cosign-vuln --output "$PUN_SCAN_OUTPUT" "$PUN_ROOTFS"
+if [ -n "$PUN_FAIL_ON" ]; then
+	trivy rootfs --quiet --skip-db-update --exit-code 1 --severity "$PUN_FAIL_ON" "$PUN_ROOTFS"
+fi
+`
+
+// Scan describes the vulnerability scan of the packed image. The scan runs
+// in a container of Image and its results get attached to the image as an
+// in-toto attestation.
+type Scan struct {
+	Image         string
+	Cmd           string
+	FailOn        []string // The severities that fail the build
+	PredicateType string
+}
+
+// scanFromBuildOpts returns the scan of the build options, or nil if it is
+// not enabled. The scan option is the image of the scanner, or true for the
+// default one.
+func scanFromBuildOpts(opts map[string]string) (*Scan, error) {
+	val := opts[clientOptScan]
+	if val == "" || val == "false" {
+		return nil, nil
+	}
+
+	s := &Scan{
+		Image:         val,
+		Cmd:           defaultScanCmd,
+		PredicateType: defaultScanPredicateType,
+	}
+	if val == "true" {
+		s.Image = defaultScanImage
+	}
+	if cmd := opts[clientOptScanCmd]; cmd != "" {
+		s.Cmd = cmd
+	}
+	if t := opts[clientOptScanPredicateType]; t != "" {
+		s.PredicateType = t
+	}
+	if threshold := opts[clientOptScanFailOn]; threshold != "" {
+		i := slices.Index(scanSeverities, strings.ToUpper(threshold))
+		if i < 0 {
+			return nil, fmt.Errorf("Invalid %s %s, expected one of: %s", clientOptScanFailOn,
+					threshold, strings.Join(scanSeverities, ", "))
+		}
+		s.FailOn = scanSeverities[i:]
+	}
+
+	return s, nil
+}
+
+// runScan scans the packed image and returns the reference of the results.
+func runScan(ctx context.Context, c client.Client, s *Scan, ref client.Reference) (client.Reference, error) {
+	rootfs, err := ref.ToState()
+	if err != nil {
+		return nil, err
+	}
+	run := llb.Image(s.Image).Run(
+		llb.Args([]string{"/bin/sh", "-c", s.Cmd}),
+		llb.AddEnv("PUN_ROOTFS", scanRootfs),
+		llb.AddEnv("PUN_SCAN_OUTPUT", path.Join(scanOutputDir, scanOutputFile)),
+		llb.AddEnv("PUN_FAIL_ON", strings.Join(s.FailOn, ",")),
+		llb.AddMount(scanRootfs, rootfs, llb.Readonly),
+		// Keep the vulnerability database between the builds
+		llb.AddMount(scanCacheDir, llb.Scratch(), llb.AsPersistentCacheDir("pun-scan", llb.CacheMountShared)),
+		// New vulnerabilities get published every day
+		llb.IgnoreCache,
+		llb.WithCustomName("Scan the image for vulnerabilities"),
+	)
+	dt, err := run.AddMount(scanOutputDir, llb.Scratch()).Marshal(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to marshal the scan: %w", err)
+	}
+	res, err := c.Solve(ctx, client.SolveRequest{
+		Definition: dt.ToPB(),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("Failed to scan the image for vulnerabilities: %w", err)
+	}
+
+	return res.SingleRef()
+}
+
+// addScanAttestation attaches the results of the scan of a build to its
+// image in the result.
+func addScanAttestation(res *client.Result, b *platformBuild, s *Scan) {
+	res.AddAttestation(b.id(), client.Attestation{
+		Kind: gatewaypb.AttestationKindInToto,
+		Ref:  b.Scan,
+		Path: scanOutputFile,
+		InToto: result.InTotoAttestation{
+			PredicateType: s.PredicateType,
+			Subjects: []result.InTotoSubject{{
+				Kind: gatewaypb.InTotoSubjectKindSelf,
+			}},
+		},
+	})
+}
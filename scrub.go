@@ -0,0 +1,187 @@
+// Copyright (c) 2023-2024, Nubificus LTD
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"path"
+	"sort"
+	"strings"
+
+	"github.com/moby/buildkit/client/llb"
+	"github.com/moby/buildkit/frontend/gateway/client"
+)
+
+const (
+	clientOptSensitiveArgs    string = "sensitive-args"
+	clientOptSensitiveSecrets string = "sensitive-secrets"
+	clientOptScrubImage       string = "scrub-image"
+	defaultScrubImage         string = "docker.io/library/alpine:3.20"
+	// The packed image and the secrets get mounted there in the scanner
+	scrubRootfs               string = "/unikernel"
+	scrubSecretsDir           string = "/run/pun-secrets"
+	// Shorter values would match almost any image
+	minScrubLen               int    = 4
+)
+
+// defaultScrubCmd looks for the sensitive values in the files of the packed
+// image, both in plain text and in base64, as in urunc.json. The values of
+// the build args are in the PUN_SCRUB_* environment variables and the
+// secrets are mounted in scrubSecretsDir. Every line of a value is a pattern
+// on its own.
+const defaultScrubCmd string = `
+set -e
+: > /tmp/values
+for v in $(env | sed -n 's/^\(PUN_SCRUB_[0-9]*\)=.*/\1/p'); do
+	printenv "$v" >> /tmp/values
+done
+for f in "$PUN_SECRETS"/*; do
+	[ -f "$f" ] || continue
+	cat "$f" >> /tmp/values
+	echo >> /tmp/values
+done
+: > /tmp/patterns
+while IFS= read -r line; do
+	[ ${#line} -ge $PUN_MIN_LEN ] || continue
+	# The armor of PEM keys is the same in every key
+	case "$line" in -----*) continue ;; esac
+	printf '%s\n' "$line" >> /tmp/patterns
+	printf '%s' "$line" | base64 -w 0 >> /tmp/patterns
+	echo >> /tmp/patterns
+done < /tmp/values
+[ -s /tmp/patterns ] || exit 0
+if grep -r -l -F -f /tmp/patterns "$PUN_ROOTFS" > /tmp/leaks; then
+	echo "Sensitive values leaked in:"
+	sed "s|^$PUN_ROOTFS||" /tmp/leaks
+	exit 1
+fi
+echo "No sensitive values in the image"
+`
+
+// Scrub describes the check of the packed image for values of sensitive
+// build args and secrets, which must not end up in the image. The files of
+// the image get scanned in a container of Image.
+type Scrub struct {
+	Args    map[string]string // The values of the sensitive build args
+	Secrets []string          // The ids of the sensitive secrets
+	Image   string            // The image with a shell and grep
+}
+
+// splitList splits a comma separated list, skipping empty entries.
+func splitList(val string) []string {
+	var list []string
+	for _, s := range strings.Split(val, ",") {
+		if s = strings.TrimSpace(s); s != "" {
+			list = append(list, s)
+		}
+	}
+
+	return list
+}
+
+// scrubFromBuildOpts returns the check of the build options, or nil if
+// there is nothing sensitive. Sensitive build args without a value are
+// skipped.
+func scrubFromBuildOpts(opts map[string]string) (*Scrub, error) {
+	s := &Scrub{
+		Args:    make(map[string]string),
+		Secrets: splitList(opts[clientOptSensitiveSecrets]),
+		Image:   defaultScrubImage,
+	}
+	args := buildArgsFromOpts(opts)
+	for _, name := range splitList(opts[clientOptSensitiveArgs]) {
+		if val := args[name]; val != "" {
+			s.Args[name] = val
+		}
+	}
+	for _, id := range s.Secrets {
+		if strings.Contains(id, "/") {
+			return nil, fmt.Errorf("Invalid secret id %s in %s", id, clientOptSensitiveSecrets)
+		}
+	}
+	if len(s.Args) == 0 && len(s.Secrets) == 0 {
+		return nil, nil
+	}
+	if val := opts[clientOptScrubImage]; val != "" {
+		s.Image = val
+	}
+
+	return s, nil
+}
+
+// checkAnnots fails if the annotations of the image contain the value of a
+// sensitive build arg, since they do not reach the files of the image.
+func (s *Scrub) checkAnnots(instr *PackInstructions) error {
+	for annot, val := range artifactAnnots(*instr) {
+		for name, arg := range s.Args {
+			if len(arg) >= minScrubLen && strings.Contains(val, arg) {
+				return fmt.Errorf("The annotation %s contains the value of the sensitive build arg %s", annot, name)
+			}
+		}
+	}
+
+	return nil
+}
+
+// runScrub scans the files and the annotations of the packed image for the
+// values of the sensitive build args and secrets.
+func runScrub(ctx context.Context, c client.Client, s *Scrub, instr *PackInstructions, ref client.Reference) error {
+	err := s.checkAnnots(instr)
+	if err != nil {
+		return err
+	}
+
+	rootfs, err := ref.ToState()
+	if err != nil {
+		return err
+	}
+	runOpts := []llb.RunOption{
+		llb.Args([]string{"/bin/sh", "-c", defaultScrubCmd}),
+		llb.AddEnv("PUN_ROOTFS", scrubRootfs),
+		llb.AddEnv("PUN_SECRETS", scrubSecretsDir),
+		llb.AddEnv("PUN_MIN_LEN", fmt.Sprint(minScrubLen)),
+		llb.AddMount(scrubRootfs, rootfs, llb.Readonly),
+		// The secrets are not part of the cache key, so the check has
+		// to run in every build
+		llb.IgnoreCache,
+		llb.WithCustomName("Scan the image for sensitive values"),
+	}
+	// Sort the args, in order to get the same LLB in every build
+	names := make([]string, 0, len(s.Args))
+	for name := range s.Args {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for i, name := range names {
+		runOpts = append(runOpts, llb.AddEnv(fmt.Sprintf("PUN_SCRUB_%d", i), s.Args[name]))
+	}
+	for _, id := range s.Secrets {
+		runOpts = append(runOpts, llb.AddSecret(path.Join(scrubSecretsDir, id), llb.SecretID(id)))
+	}
+
+	dt, err := llb.Image(s.Image).Run(runOpts...).Root().Marshal(ctx)
+	if err != nil {
+		return fmt.Errorf("Failed to marshal the scan: %w", err)
+	}
+	_, err = c.Solve(ctx, client.SolveRequest{
+		Definition: dt.ToPB(),
+	})
+	if err != nil {
+		return fmt.Errorf("Failed to scan the image for sensitive values: %w", err)
+	}
+
+	return nil
+}
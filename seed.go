@@ -0,0 +1,177 @@
+// Copyright (c) 2023-2024, Nubificus LTD
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"path"
+	"strings"
+
+	"github.com/moby/buildkit/client/llb"
+	"github.com/moby/buildkit/frontend/dockerfile/parser"
+)
+
+const (
+	seedCmd            string = "seed"
+	seedFormatFlag     string = "format"
+	seedFormatISO      string = "iso"
+	seedFormatVFAT     string = "vfat"
+	clientOptSeedImage string = "seed-image"
+	defaultSeedImage   string = "docker.io/library/alpine:3.20"
+	uruncSeedAnnot     string = "com.urunc.unikernel.cloudInitSeed"
+	// The build context gets mounted there in the seed container
+	seedContextDir     string = "/context"
+	seedOutDir         string = "/out"
+)
+
+// defaultSeedCmd creates a cloud-init NoCloud seed with the cidata label,
+// either as an ISO image or as a FAT image. The tools get installed if the
+// image does not have them.
+const defaultSeedCmd string = `
+set -e
+mkdir -p /tmp/seed
+cp "$PUN_USER_DATA" /tmp/seed/user-data
+cp "$PUN_META_DATA" /tmp/seed/meta-data
+if [ -n "$PUN_NETWORK_CONFIG" ]; then
+	cp "$PUN_NETWORK_CONFIG" /tmp/seed/network-config
+fi
+case "$PUN_FORMAT" in
+iso)
+	if ! command -v xorriso > /dev/null; then
+		apk add --no-cache xorriso > /dev/null
+	fi
+	xorriso -as mkisofs -quiet -output "$PUN_OUT" -volid cidata -joliet -rock /tmp/seed
+	;;
+vfat)
+	if ! command -v mkfs.vfat > /dev/null || ! command -v mcopy > /dev/null; then
+		apk add --no-cache dosfstools mtools > /dev/null
+	fi
+	size=$(( $(du -sk /tmp/seed | cut -f 1) + 512 ))
+	mkfs.vfat -n CIDATA -C "$PUN_OUT" "$size" > /dev/null
+	mcopy -i "$PUN_OUT" /tmp/seed/* ::
+	;;
+esac
+`
+
+// SeedCommand is the SEED instruction of pun, which creates a cloud-init
+// NoCloud seed from files of the build context, for unikernels and micro-VMs
+// that read cloud-init at boot.
+//
+//	SEED [--format=iso|vfat] <user-data> <meta-data> [<network-config>] <dest>
+type SeedCommand struct {
+	UserData      string
+	MetaData      string
+	NetworkConfig string
+	Dest          string
+	Format        string
+	args          string // The arguments of the instruction, before the expansion
+	loc           []parser.Range
+}
+
+func (c *SeedCommand) Name() string {
+	return seedCmd
+}
+
+func (c *SeedCommand) Location() []parser.Range {
+	return c.loc
+}
+
+func isSeed(node *parser.Node) bool {
+	return strings.EqualFold(node.Value, seedCmd)
+}
+
+// parseSeed parses a SEED instruction, which the dockerfile parser does not
+// know about.
+func parseSeed(node *parser.Node) (*SeedCommand, error) {
+	c := &SeedCommand{
+		Format: seedFormatISO,
+		loc:    nodeLocation(node),
+	}
+	if val, ok := popFlag(node, seedFormatFlag); ok {
+		if val != seedFormatISO && val != seedFormatVFAT {
+			return nil, fmt.Errorf("Invalid format %s in SEED, expected %s or %s", val, seedFormatISO, seedFormatVFAT)
+		}
+		c.Format = val
+	}
+	if len(node.Flags) > 0 {
+		return nil, fmt.Errorf("Unknown flag %s in SEED", node.Flags[0])
+	}
+	c.args = rawArgs(node)
+	if c.args == "" {
+		return nil, fmt.Errorf("SEED requires the user-data, the meta-data and a destination")
+	}
+
+	return c, nil
+}
+
+// expand expands any args in the paths of the instruction.
+func (c *SeedCommand) expand(scope *argScope) error {
+	paths, err := scope.expandWords(c.args)
+	if err != nil {
+		return err
+	}
+	switch len(paths) {
+	case 3:
+		c.UserData, c.MetaData, c.Dest = paths[0], paths[1], paths[2]
+	case 4:
+		c.UserData, c.MetaData, c.NetworkConfig, c.Dest = paths[0], paths[1], paths[2], paths[3]
+	default:
+		return fmt.Errorf("SEED requires the user-data, the meta-data, an optional network-config and a destination, got %d paths", len(paths))
+	}
+	if strings.HasSuffix(c.Dest, "/") {
+		return fmt.Errorf("The destination of SEED is the path of the seed, got %s", c.Dest)
+	}
+
+	return nil
+}
+
+// sources returns the files of the build context that the seed needs.
+func (c *SeedCommand) sources() []string {
+	srcs := []string{c.UserData, c.MetaData}
+	if c.NetworkConfig != "" {
+		srcs = append(srcs, c.NetworkConfig)
+	}
+
+	return srcs
+}
+
+// seedIn creates the seed of a SEED instruction from the files of buildCtx
+// in a container of the seed image and copies it to its destination in base.
+func seedIn(base llb.State, buildCtx llb.State, c *SeedCommand, opts LLBOpts) llb.State {
+	name := path.Base(c.Dest)
+	ctxPath := func(p string) string {
+		return path.Join(seedContextDir, p)
+	}
+	runOpts := []llb.RunOption{
+		llb.Args([]string{"/bin/sh", "-c", defaultSeedCmd}),
+		llb.AddEnv("PUN_USER_DATA", ctxPath(c.UserData)),
+		llb.AddEnv("PUN_META_DATA", ctxPath(c.MetaData)),
+		llb.AddEnv("PUN_FORMAT", c.Format),
+		llb.AddEnv("PUN_OUT", path.Join(seedOutDir, name)),
+		llb.AddMount(seedContextDir, buildCtx, llb.Readonly),
+		llb.WithCustomName("Create the cloud-init seed " + c.Dest),
+	}
+	if c.NetworkConfig != "" {
+		runOpts = append(runOpts, llb.AddEnv("PUN_NETWORK_CONFIG", ctxPath(c.NetworkConfig)))
+	}
+	if opts.Normalize {
+		// xorriso takes the timestamps of the image from there
+		runOpts = append(runOpts, llb.AddEnv("SOURCE_DATE_EPOCH", fmt.Sprint(normalizedTime(opts).Unix())))
+	}
+	run := llb.Image(opts.SeedImage).Run(runOpts...)
+	out := run.AddMount(seedOutDir, llb.Scratch())
+
+	return base.File(llb.Copy(out, name, c.Dest, CopyFlags{}.copyInfo(opts)))
+}
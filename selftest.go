@@ -0,0 +1,220 @@
+// Copyright (c) 2023-2024, Nubificus LTD
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"embed"
+	"flag"
+	"fmt"
+	"io/fs"
+	"os"
+	"path"
+	"strings"
+
+	bkclient "github.com/moby/buildkit/client"
+	"github.com/moby/buildkit/client/llb"
+	"github.com/moby/buildkit/frontend/gateway/client"
+	"github.com/moby/buildkit/util/appcontext"
+)
+
+const (
+	selftestCmd     string = "selftest"
+	selftestDir     string = "selftest"
+	// The expected digest of the LLB of a fixture
+	selftestGolden  string = "llb.digest"
+	// The expected error of a fixture that must fail to parse
+	selftestError   string = "error"
+	selftestContent string = "pun selftest\n"
+)
+
+// The fixtures of the self-test, one directory with a Containerfile each
+//
+//go:embed selftest
+var selftestFS embed.FS
+
+// SelftestCLIOpts are the options of pun selftest, which checks that a pun
+// binary, or the frontend image that contains it, works as expected.
+type SelftestCLIOpts struct {
+	// The address of buildkitd, for the solve test
+	Addr           string
+	// Print the digests of the LLB of the fixtures, instead of checking them
+	PrintDigests   bool
+}
+
+func selftestUsage() {
+	fmt.Println("Usage of pun selftest")
+	fmt.Printf("%s %s [<args>]\n\n", os.Args[0], selftestCmd)
+	fmt.Println("Supported command line arguments")
+	fmt.Println("\t--addr address \t\t\tThe address of buildkitd for the solve test (default $BUILDKIT_HOST)")
+	fmt.Println("\t--print-digests bool \t\tPrint the digests of the LLB of the fixtures")
+}
+
+func parseSelftestCLIOpts(args []string) SelftestCLIOpts {
+	var opts SelftestCLIOpts
+
+	fs := flag.NewFlagSet(selftestCmd, flag.ExitOnError)
+	fs.StringVar(&opts.Addr, "addr", os.Getenv("BUILDKIT_HOST"), "The address of buildkitd for the solve test")
+	fs.BoolVar(&opts.PrintDigests, "print-digests", false, "Print the digests of the LLB of the fixtures")
+	fs.Usage = selftestUsage
+	fs.Parse(args)
+
+	return opts
+}
+
+// fixtureLLB returns the digest of the LLB of the target of a fixture.
+func fixtureLLB(fileBytes []byte) (string, error) {
+	images, err := parseFile(fileBytes, platformArgs(defaultLLBOpts().Platform, defaultLLBOpts().Platform))
+	if err != nil {
+		return "", err
+	}
+	target, err := selectImage(images, "")
+	if err != nil {
+		return "", err
+	}
+	// The local context gets a fixed ID, instead of a random one, so
+	// that the LLB has the same digest in every run
+	opts := defaultLLBOpts()
+	buildCtx := llb.Local(opts.ContextName, llb.LocalUniqueID(selftestCmd),
+			llb.FollowPaths(contextPaths(reachableImages(images, target))))
+	def, err := constructLLB(target, images, buildCtx, opts)
+	if err != nil {
+		return "", err
+	}
+	dgst, err := def.Head()
+	if err != nil {
+		return "", err
+	}
+
+	return dgst.String(), nil
+}
+
+// runFixture checks that a fixture either fails to parse with the expected
+// error or that its LLB has the expected digest.
+func runFixture(name string) error {
+	dir := path.Join(selftestDir, name)
+	fileBytes, err := selftestFS.ReadFile(path.Join(dir, defaultContainerFile))
+	if err != nil {
+		return err
+	}
+	dgst, err := fixtureLLB(fileBytes)
+	expected, readErr := selftestFS.ReadFile(path.Join(dir, selftestError))
+	if readErr == nil {
+		if err == nil {
+			return fmt.Errorf("Expected the error %q, but the fixture got parsed", strings.TrimSpace(string(expected)))
+		}
+		if !strings.Contains(err.Error(), strings.TrimSpace(string(expected))) {
+			return fmt.Errorf("Expected the error %q, but got %q", strings.TrimSpace(string(expected)), err)
+		}
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	expected, err = selftestFS.ReadFile(path.Join(dir, selftestGolden))
+	if err != nil {
+		return err
+	}
+	if dgst != strings.TrimSpace(string(expected)) {
+		return fmt.Errorf("The LLB has the digest %s, instead of %s", dgst, strings.TrimSpace(string(expected)))
+	}
+
+	return nil
+}
+
+// selftestSolve solves a trivial LLB in buildkitd and reads its result
+// back, which checks that pun can talk to buildkitd.
+func selftestSolve(ctx context.Context, addr string) error {
+	c, err := bkclient.New(ctx, addr)
+	if err != nil {
+		return fmt.Errorf("Failed to connect to buildkitd: %w", err)
+	}
+	defer c.Close()
+
+	buildFunc := func(ctx context.Context, c client.Client) (*client.Result, error) {
+		st := llb.Scratch().File(llb.Mkfile(selftestCmd, 0644, []byte(selftestContent)))
+		def, err := st.Marshal(ctx)
+		if err != nil {
+			return nil, err
+		}
+		res, err := c.Solve(ctx, client.SolveRequest{
+			Definition: def.ToPB(),
+		})
+		if err != nil {
+			return nil, err
+		}
+		ref, err := res.SingleRef()
+		if err != nil {
+			return nil, err
+		}
+		dt, err := ref.ReadFile(ctx, client.ReadRequest{
+			Filename: selftestCmd,
+		})
+		if err != nil {
+			return nil, err
+		}
+		if string(dt) != selftestContent {
+			return nil, fmt.Errorf("Read %q back, instead of %q", dt, selftestContent)
+		}
+		return res, nil
+	}
+	_, err = c.Build(ctx, bkclient.SolveOpt{}, "pun", buildFunc, nil)
+
+	return err
+}
+
+func selftestMain(args []string) {
+	opts := parseSelftestCLIOpts(args)
+
+	entries, err := fs.ReadDir(selftestFS, selftestDir)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	if opts.PrintDigests {
+		for _, entry := range entries {
+			fileBytes, _ := selftestFS.ReadFile(path.Join(selftestDir, entry.Name(), defaultContainerFile))
+			dgst, err := fixtureLLB(fileBytes)
+			if err != nil {
+				continue
+			}
+			fmt.Printf("%s\t%s\n", entry.Name(), dgst)
+		}
+		return
+	}
+
+	failed := 0
+	report := func(name string, err error) {
+		if err != nil {
+			failed++
+			fmt.Printf("FAIL\t%s: %v\n", name, err)
+			return
+		}
+		fmt.Printf("PASS\t%s\n", name)
+	}
+	for _, entry := range entries {
+		report("fixture/"+entry.Name(), runFixture(entry.Name()))
+	}
+	if opts.Addr == "" {
+		fmt.Println("SKIP\tsolve: no buildkitd address")
+	} else {
+		report("solve", selftestSolve(appcontext.Context(), opts.Addr))
+	}
+
+	if failed > 0 {
+		fmt.Printf("%d of the tests failed\n", failed)
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,548 @@
+// Copyright (c) 2023-2024, Nubificus LTD
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"os/user"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	bkclient "github.com/moby/buildkit/client"
+	"github.com/moby/buildkit/util/appcontext"
+	"github.com/moby/buildkit/util/progress/progressui"
+)
+
+const (
+	serveCmd           string        = "serve"
+	defaultServeSocket string        = "/run/pun/pun.sock"
+	defaultBaseTTL     time.Duration = 5 * time.Minute
+	serveBuildPath     string        = "/build"
+)
+
+// serveGuardedOpts are the build options that weaken or replace the
+// guarantees of the server, which the requests can only set if the server
+// allows them.
+var serveGuardedOpts = []string{
+	clientOptPolicy,
+	clientOptPreSolveHook,
+	clientOptPreSolveHook + "-cmd",
+	clientOptPostSolveHook,
+	clientOptPostSolveHook + "-cmd",
+}
+
+// ServeCLIOpts are the options of pun serve, which keeps a connection to
+// buildkitd and serves many builds over a unix socket, sharing the parsed
+// files and the resolved bases between them.
+type ServeCLIOpts struct {
+	// The unix socket that the builds get requested on
+	Socket         string
+	// How long a resolved base stays valid
+	BaseTTL        time.Duration
+	// The group that can request builds, besides the user of the server
+	Group          string
+	// The directory that the paths of the requests must be in
+	Root           string
+	// The URLs that the webhooks of the requests can post to, as prefixes
+	Webhooks       stringList
+	// The repositories that the requests can push to, with the credentials
+	// of the server, as patterns
+	Pushes         stringList
+	// The entitlements that the requests can allow
+	Entitlements   stringList
+	// The security-relevant build options that the requests can set
+	Opts           stringList
+	// The connection to buildkitd (--addr, --driver, --driver-opt)
+	Conn           BuildCLIOpts
+}
+
+// ServeRequest is a build that a client of pun serve requests. The args are
+// the ones of pun build, with absolute paths, since the server does not
+// share the working directory of the client.
+type ServeRequest struct {
+	Args []string `json:"args"`
+}
+
+// ServeResponse is the outcome of a requested build.
+type ServeResponse struct {
+	Digest string `json:"digest,omitempty"`
+	Error  string `json:"error,omitempty"`
+}
+
+func serveUsage() {
+	fmt.Println("Usage of pun serve")
+	fmt.Printf("%s %s [<args>]\n\n", os.Args[0], serveCmd)
+	fmt.Println("Supported command line arguments")
+	fmt.Println("\t--socket path \t\t\tThe unix socket to serve the builds on (default " + defaultServeSocket + ")")
+	fmt.Println("\t--base-ttl duration \t\tHow long a resolved base stays valid (default 5m)")
+	fmt.Println("\t--group name \t\t\tThe group that can request builds on the socket")
+	fmt.Println("\t--root dir \t\t\tThe directory that the paths of the requests must be in")
+	fmt.Println("\t--allow-webhook url \t\tAllow the webhooks under the URL (can be used multiple times)")
+	fmt.Println("\t--allow-push pattern \t\tAllow the pushes to the matching repositories (can be used multiple times)")
+	fmt.Println("\t--allow-entitlement name \tAllow the requests to allow the entitlement (can be used multiple times)")
+	fmt.Println("\t--allow-opt key \t\tAllow the requests to set the build option, e.g. policy (can be used multiple times)")
+	fmt.Println("\t--addr address \t\t\tThe address of buildkitd (default $BUILDKIT_HOST)")
+	fmt.Println("\t--driver name \t\t\tWhere buildkitd runs, remote or kubernetes (default remote)")
+	fmt.Println("\t--driver-opt KEY=VALUE \t\tSet an option of the driver (can be used multiple times)")
+}
+
+func parseServeCLIOpts(args []string) ServeCLIOpts {
+	var opts ServeCLIOpts
+
+	fs := flag.NewFlagSet(serveCmd, flag.ExitOnError)
+	fs.StringVar(&opts.Socket, "socket", defaultServeSocket, "The unix socket to serve the builds on")
+	fs.DurationVar(&opts.BaseTTL, "base-ttl", defaultBaseTTL, "How long a resolved base stays valid")
+	fs.StringVar(&opts.Group, "group", "", "The group that can request builds on the socket")
+	fs.StringVar(&opts.Root, "root", "", "The directory that the paths of the requests must be in")
+	fs.Var(&opts.Webhooks, "allow-webhook", "Allow the webhooks under the URL (can be used multiple times)")
+	fs.Var(&opts.Pushes, "allow-push", "Allow the pushes to the matching repositories (can be used multiple times)")
+	fs.Var(&opts.Entitlements, "allow-entitlement", "Allow the requests to allow the entitlement (can be used multiple times)")
+	fs.Var(&opts.Opts, "allow-opt", "Allow the requests to set the build option (can be used multiple times)")
+	fs.StringVar(&opts.Conn.Addr, "addr", os.Getenv("BUILDKIT_HOST"), "The address of buildkitd")
+	fs.StringVar(&opts.Conn.Driver, "driver", driverRemote, "Where buildkitd runs, remote or kubernetes")
+	fs.Var(&opts.Conn.DriverOpts, "driver-opt", "Set an option of the driver (can be used multiple times)")
+	fs.Usage = serveUsage
+	fs.Parse(args)
+	opts.Conn.Namespace = containerdNamespace()
+
+	return opts
+}
+
+// inRoot returns true if a path is in root, once the symlinks of the part
+// of the path that exists get resolved.
+func inRoot(root string, p string) bool {
+	p = filepath.Clean(p)
+	if !filepath.IsAbs(p) {
+		return false
+	}
+	rest := ""
+	for {
+		resolved, err := filepath.EvalSymlinks(p)
+		if err == nil {
+			p = filepath.Join(resolved, rest)
+			break
+		}
+		if p == filepath.Dir(p) {
+			return false
+		}
+		rest = filepath.Join(filepath.Base(p), rest)
+		p = filepath.Dir(p)
+	}
+	rel, err := filepath.Rel(root, p)
+
+	return err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
+
+// requestPaths returns the local paths that a requested build reads, and
+// the ones that it writes or that hold secrets.
+func requestPaths(opts BuildCLIOpts) ([]string, []string, error) {
+	reads := []string{opts.ContextDir, opts.ContainerFile}
+	var guarded []string
+	for _, p := range []string{opts.PolicyFile, opts.ConfigFile} {
+		if p != "" {
+			reads = append(reads, p)
+		}
+	}
+	for _, list := range [][]string{opts.Outputs, opts.DebugOutputs} {
+		for _, output := range list {
+			attrs, err := parseCSVAttrs("output", output)
+			if err != nil {
+				return nil, nil, err
+			}
+			if dest, ok := attrs["dest"]; ok {
+				guarded = append(guarded, dest)
+			}
+		}
+	}
+	for _, list := range [][]string{opts.CacheTo, opts.CacheFrom} {
+		for _, cache := range list {
+			attrs, err := parseCSVAttrs("cache", cache)
+			if err != nil {
+				return nil, nil, err
+			}
+			for _, key := range []string{"src", "dest"} {
+				if p, ok := attrs[key]; ok {
+					guarded = append(guarded, p)
+				}
+			}
+		}
+	}
+	for _, secret := range opts.Secrets {
+		attrs, err := parseCSVAttrs("secret", secret)
+		if err != nil {
+			return nil, nil, err
+		}
+		if _, ok := attrs["env"]; ok {
+			return nil, nil, fmt.Errorf("The secret %s would come from the environment of the server", secret)
+		}
+		if src, ok := attrs["src"]; ok {
+			guarded = append(guarded, src)
+		}
+	}
+	for _, p := range []string{opts.CacheDir, opts.Report, opts.KeepIntermediate} {
+		if p != "" {
+			guarded = append(guarded, p)
+		}
+	}
+
+	return reads, guarded, nil
+}
+
+// requestPushes returns the repositories that a requested build pushes
+// to, with the credentials of the server: the outputs that get pushed and
+// the caches that get exported to registries.
+func requestPushes(opts BuildCLIOpts) ([]string, error) {
+	var pushes []string
+
+	for _, list := range [][]string{opts.Outputs, opts.DebugOutputs} {
+		for _, output := range list {
+			entry, err := parseOutput(output)
+			if err != nil {
+				return nil, err
+			}
+			push, _ := strconv.ParseBool(entry.Attrs["push"])
+			if !(entry.Type == bkclient.ExporterImage && push) && entry.Type != "registry" {
+				continue
+			}
+			for _, name := range strings.Split(entry.Attrs["name"], ",") {
+				if name = strings.TrimSpace(name); name != "" {
+					pushes = append(pushes, name)
+				}
+			}
+		}
+	}
+	for _, cache := range opts.CacheTo {
+		attrs, err := parseCSVAttrs("cache", cache)
+		if err != nil {
+			return nil, err
+		}
+		if attrs["type"] == "registry" {
+			pushes = append(pushes, attrs["ref"])
+		}
+	}
+
+	return pushes, nil
+}
+
+// webhookAllowed returns true if a webhook is under one of the allowed
+// URLs, with the same scheme and host.
+func webhookAllowed(allowed []string, webhook string) bool {
+	u, err := url.Parse(webhook)
+	if err != nil {
+		return false
+	}
+	for _, prefix := range allowed {
+		a, err := url.Parse(prefix)
+		if err != nil || a.Scheme != u.Scheme || a.Host != u.Host {
+			continue
+		}
+		dir := strings.TrimSuffix(a.Path, "/")
+		if u.Path == dir || strings.HasPrefix(u.Path, dir+"/") {
+			return true
+		}
+	}
+
+	return false
+}
+
+// requestOpts returns the build options that a requested build sets, with
+// its options, its policy and its config.
+func requestOpts(opts BuildCLIOpts) ([]string, error) {
+	var keys []string
+
+	for _, opt := range opts.FrontendOpts {
+		key, _, _ := strings.Cut(opt, "=")
+		keys = append(keys, key)
+	}
+	if opts.PolicyFile != "" {
+		keys = append(keys, clientOptPolicy)
+	}
+	if opts.ConfigFile != "" {
+		config, err := loadConfig(opts.ConfigFile)
+		if err != nil {
+			return nil, err
+		}
+		for key := range config.buildOpts() {
+			keys = append(keys, key)
+		}
+	}
+
+	return keys, nil
+}
+
+// confineRequest checks a requested build, which the server runs with its
+// own privileges and credentials. With a root, all its paths must be in it.
+// Without one, the requests can only read their context, their
+// Containerfile, their policy and their config, and not write files or read
+// secrets. The webhooks, the pushes, the entitlements and the
+// security-relevant build options of the request must be allowed by the
+// server.
+func confineRequest(opts BuildCLIOpts, server ServeCLIOpts) error {
+	if opts.DebugOnError {
+		return fmt.Errorf("--debug-on-error is not supported in pun serve")
+	}
+	reads, guarded, err := requestPaths(opts)
+	if err != nil {
+		return err
+	}
+	if server.Root == "" {
+		if len(guarded) > 0 {
+			return fmt.Errorf("The request writes files or reads secrets (%s), which needs pun serve --root",
+					strings.Join(guarded, ", "))
+		}
+	} else {
+		for _, p := range append(reads, guarded...) {
+			if !inRoot(server.Root, p) {
+				return fmt.Errorf("The path %s is not in %s", p, server.Root)
+			}
+		}
+	}
+
+	for _, webhook := range opts.Webhooks {
+		if !webhookAllowed(server.Webhooks, webhook) {
+			return fmt.Errorf("The webhook %s is not allowed, see pun serve --allow-webhook", webhook)
+		}
+	}
+	pushes, err := requestPushes(opts)
+	if err != nil {
+		return err
+	}
+	for _, repo := range pushes {
+		if !matchAny(server.Pushes, repo) {
+			return fmt.Errorf("The push to %s is not allowed, see pun serve --allow-push", repo)
+		}
+	}
+	for _, ent := range opts.Allow {
+		if !slices.Contains(server.Entitlements, ent) {
+			return fmt.Errorf("The entitlement %s is not allowed, see pun serve --allow-entitlement", ent)
+		}
+	}
+	keys, err := requestOpts(opts)
+	if err != nil {
+		return err
+	}
+	for _, key := range keys {
+		if slices.Contains(serveGuardedOpts, key) && !slices.Contains(server.Opts, key) {
+			return fmt.Errorf("The build option %s is not allowed, see pun serve --allow-opt", key)
+		}
+	}
+
+	return nil
+}
+
+// parseServeRequest parses the args of a requested build. Unlike pun build,
+// bad args fail the request and not the server. The progress output of the
+// builds is quiet, unless the request asks for it, since the builds run
+// concurrently. The request must be allowed by the server.
+func parseServeRequest(req ServeRequest, server ServeCLIOpts) (BuildCLIOpts, error) {
+	var opts BuildCLIOpts
+
+	fs := flag.NewFlagSet(buildCmd, flag.ContinueOnError)
+	fs.SetOutput(io.Discard)
+	addBuildFlags(fs, &opts)
+	err := fs.Parse(req.Args)
+	if err != nil {
+		return opts, fmt.Errorf("Invalid build args: %w", err)
+	}
+	progress := false
+	fs.Visit(func(f *flag.Flag) {
+		progress = progress || f.Name == "progress"
+	})
+	if !progress {
+		opts.Progress = string(progressui.QuietMode)
+	}
+	err = setBuildContext(&opts, fs.Args())
+	if err != nil {
+		return opts, err
+	}
+
+	return opts, confineRequest(opts, server)
+}
+
+// serveBuild handles the request of a build, which runs with the shared
+// client of buildkitd.
+func serveBuild(c *bkclient.Client, server ServeCLIOpts, w http.ResponseWriter, r *http.Request) {
+	var resp ServeResponse
+	status := http.StatusOK
+
+	var req ServeRequest
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		err = fmt.Errorf("Invalid request: %w", err)
+		status = http.StatusBadRequest
+	}
+	var opts BuildCLIOpts
+	if err == nil {
+		opts, err = parseServeRequest(req, server)
+		if err != nil {
+			status = http.StatusBadRequest
+		}
+	}
+	if err == nil {
+		// The build ends with the request, e.g. if the client goes away
+		err = withBuildEvents(r.Context(), opts, func() (string, error) {
+			var err error
+			resp.Digest, err = clientBuild(r.Context(), c, opts)
+			return resp.Digest, err
+		})
+		if err != nil {
+			status = http.StatusInternalServerError
+		}
+	}
+	if err != nil {
+		resp.Error = err.Error()
+		fmt.Fprintf(os.Stderr, "Build failed: %v\n", err)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(resp)
+}
+
+// serve serves builds on the unix socket of the options until ctx is done.
+func serve(ctx context.Context, opts ServeCLIOpts) error {
+	resolvedBases.ttl = opts.BaseTTL
+	resolvedBases.scoped = true
+	if opts.Root != "" {
+		root, err := filepath.EvalSymlinks(opts.Root)
+		if err == nil {
+			root, err = filepath.Abs(root)
+		}
+		if err != nil {
+			return fmt.Errorf("Invalid root %s: %w", opts.Root, err)
+		}
+		opts.Root = root
+	}
+
+	addr, cleanup, err := driverAddr(ctx, opts.Conn)
+	if err != nil {
+		return err
+	}
+	defer cleanup()
+	c, err := bkclient.New(ctx, addr)
+	if err != nil {
+		return fmt.Errorf("Failed to connect to buildkitd: %w", err)
+	}
+	defer c.Close()
+
+	err = os.MkdirAll(filepath.Dir(opts.Socket), 0755)
+	if err != nil {
+		return fmt.Errorf("Failed to create the directory of %s: %w", opts.Socket, err)
+	}
+	l, err := listenSocket(opts.Socket, opts.Group)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(opts.Socket)
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST "+serveBuildPath, func(w http.ResponseWriter, r *http.Request) {
+		serveBuild(c, opts, w, r)
+	})
+	server := &http.Server{Handler: mux}
+	go func() {
+		<-ctx.Done()
+		server.Shutdown(context.WithoutCancel(ctx))
+	}()
+
+	fmt.Fprintf(os.Stderr, "Serving builds on %s\n", opts.Socket)
+	err = server.Serve(l)
+	if errors.Is(err, http.ErrServerClosed) {
+		return nil
+	}
+
+	return err
+}
+
+// listenSocket listens on the unix socket, which gets created and secured
+// in a private directory before it replaces the socket of a previous server,
+// if any, so that nobody else can connect to it in between.
+func listenSocket(socket string, group string) (net.Listener, error) {
+	dir, err := os.MkdirTemp(filepath.Dir(socket), ".pun-serve-")
+	if err != nil {
+		return nil, fmt.Errorf("Failed to create the directory of %s: %w", socket, err)
+	}
+	defer os.RemoveAll(dir)
+	tmpSocket := filepath.Join(dir, filepath.Base(socket))
+	l, err := net.Listen("unix", tmpSocket)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to listen on %s: %w", socket, err)
+	}
+	// The socket gets moved, it gets removed on exit instead
+	l.(*net.UnixListener).SetUnlinkOnClose(false)
+	err = secureSocket(tmpSocket, group)
+	if err == nil {
+		err = os.Rename(tmpSocket, socket)
+		if err != nil {
+			err = fmt.Errorf("Failed to create %s: %w", socket, err)
+		}
+	}
+	if err != nil {
+		l.Close()
+		return nil, err
+	}
+
+	return l, nil
+}
+
+// secureSocket restricts the socket to the user of the server, and to the
+// members of group, if given, since the builds that they request read and
+// write files with the privileges of the server.
+func secureSocket(socket string, group string) error {
+	mode := os.FileMode(0600)
+	if group != "" {
+		g, err := user.LookupGroup(group)
+		if err != nil {
+			return fmt.Errorf("Unknown group %s: %w", group, err)
+		}
+		gid, err := strconv.Atoi(g.Gid)
+		if err != nil {
+			return fmt.Errorf("Invalid gid of group %s: %w", group, err)
+		}
+		err = os.Chown(socket, -1, gid)
+		if err != nil {
+			return fmt.Errorf("Failed to give %s to group %s: %w", socket, group, err)
+		}
+		mode = 0660
+	}
+	err := os.Chmod(socket, mode)
+	if err != nil {
+		return fmt.Errorf("Failed to set the mode of %s: %w", socket, err)
+	}
+
+	return nil
+}
+
+func serveMain(args []string) {
+	opts := parseServeCLIOpts(args)
+
+	err := serve(appcontext.Context(), opts)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+}
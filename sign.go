@@ -0,0 +1,168 @@
+// Copyright (c) 2023-2024, Nubificus LTD
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"path"
+	"strings"
+
+	"github.com/moby/buildkit/client/llb"
+	"github.com/moby/buildkit/frontend/gateway/client"
+)
+
+const (
+	clientOptSignKey    string = "sign-key"
+	clientOptSignCert   string = "sign-cert"
+	clientOptSignCmd    string = "sign-cmd"
+	clientOptSignImage  string = "sign-image"
+	defaultSignImage    string = "docker.io/library/alpine:3.20"
+	// The packed image gets mounted there in the signing container
+	signRootfs          string = "/unikernel"
+	signSecretsDir      string = "/run/pun-secrets"
+	signKeyFile         string = "key"
+	signCertFile        string = "cert"
+	uruncSignatureAnnot string = "com.urunc.unikernel.binarySignature"
+	uruncSignCertAnnot  string = "com.urunc.unikernel.binarySignatureCert"
+)
+
+// defaultSignCmd signs the kernel with sbsign, writing a detached PKCS#7
+// signature, and copies the certificate next to it. sbsigntool gets
+// installed if the image does not have it.
+const defaultSignCmd string = `
+set -e
+if ! command -v sbsign > /dev/null; then
+	apk add --no-cache sbsigntool > /dev/null
+fi
+sbsign --key "$PUN_KEY" --cert "$PUN_CERT" --detached --output "$PUN_SIGNATURE" "$PUN_KERNEL"
+cp "$PUN_CERT" "$PUN_SIGNATURE_CERT"
+`
+
+// Sign describes the signing of the kernel of the packed image, for
+// platforms that only boot verified unikernels. The key and the certificate
+// are build secrets and the signer runs in a container of Image.
+type Sign struct {
+	Key   string // The id of the secret with the private key
+	Cert  string // The id of the secret with the certificate
+	Cmd   string // The shell command that signs the kernel
+	Image string // The image with the signer
+}
+
+// signFromBuildOpts returns the signing of the build options, or nil if
+// the kernel does not get signed. A custom command might get the key from
+// elsewhere, e.g. a KMS, so it does not need the secrets.
+func signFromBuildOpts(opts map[string]string) (*Sign, error) {
+	s := &Sign{
+		Key:   opts[clientOptSignKey],
+		Cert:  opts[clientOptSignCert],
+		Cmd:   opts[clientOptSignCmd],
+		Image: defaultSignImage,
+	}
+	if s.Key == "" && s.Cmd == "" {
+		if s.Cert != "" {
+			return nil, fmt.Errorf("The %s needs %s or %s", clientOptSignCert, clientOptSignKey, clientOptSignCmd)
+		}
+		return nil, nil
+	}
+	if s.Cmd == "" {
+		if s.Cert == "" {
+			return nil, fmt.Errorf("Signing with %s requires the %s", clientOptSignKey, clientOptSignCert)
+		}
+		s.Cmd = defaultSignCmd
+	}
+	for _, id := range []string{s.Key, s.Cert} {
+		if strings.Contains(id, "/") {
+			return nil, fmt.Errorf("Invalid secret id %s for signing", id)
+		}
+	}
+	if val := opts[clientOptSignImage]; val != "" {
+		s.Image = val
+	}
+
+	return s, nil
+}
+
+// runSign signs the kernel of the packed image and records the paths of
+// the signature and the certificate in the annotations of the target and in
+// urunc.json, returning the reference of the signed image.
+func runSign(ctx context.Context, c client.Client, s *Sign, instr *PackInstructions,
+		ref client.Reference, opts LLBOpts) (client.Reference, error) {
+	kernelPath, ok := instr.Annots[uruncBinaryAnnot]
+	if !ok {
+		return nil, fmt.Errorf("Signing the kernel requires the %s label", uruncBinaryAnnot)
+	}
+	signature := kernelPath + ".sig"
+	cert := kernelPath + ".crt"
+
+	rootfs, err := ref.ToState()
+	if err != nil {
+		return nil, err
+	}
+	runOpts := []llb.RunOption{
+		llb.Args([]string{"/bin/sh", "-c", s.Cmd}),
+		llb.AddEnv("PUN_ROOTFS", signRootfs),
+		llb.AddEnv("PUN_KERNEL", path.Join(signRootfs, kernelPath)),
+		llb.AddEnv("PUN_SIGNATURE", path.Join(signRootfs, signature)),
+		llb.AddEnv("PUN_SIGNATURE_CERT", path.Join(signRootfs, cert)),
+		// The secrets are not part of the cache key, so the kernel has
+		// to get signed in every build
+		llb.IgnoreCache,
+		llb.WithCustomName("Sign " + kernelPath),
+	}
+	if s.Key != "" {
+		runOpts = append(runOpts,
+				llb.AddEnv("PUN_KEY", path.Join(signSecretsDir, signKeyFile)),
+				llb.AddSecret(path.Join(signSecretsDir, signKeyFile), llb.SecretID(s.Key)))
+	}
+	if s.Cert != "" {
+		runOpts = append(runOpts,
+				llb.AddEnv("PUN_CERT", path.Join(signSecretsDir, signCertFile)),
+				llb.AddSecret(path.Join(signSecretsDir, signCertFile), llb.SecretID(s.Cert)))
+	}
+	signed := llb.Image(s.Image).Run(runOpts...).AddMount(signRootfs, rootfs)
+	dt, err := signed.Marshal(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to marshal the signing: %w", err)
+	}
+	res, err := c.Solve(ctx, client.SolveRequest{
+		Definition: dt.ToPB(),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("Failed to sign %s: %w", kernelPath, err)
+	}
+	ref, err = res.SingleRef()
+	if err != nil {
+		return nil, err
+	}
+
+	instr.Annots[uruncSignatureAnnot] = signature
+	found, err := fileExists(ctx, ref, cert)
+	if err != nil {
+		return nil, err
+	}
+	if found {
+		instr.Annots[uruncSignCertAnnot] = cert
+	}
+	instr.addHistory("pun: sign " + kernelPath)
+
+	ref, err = replaceUruncJSON(ctx, c, instr, ref, opts, "the signature of the kernel")
+	if err != nil {
+		return nil, err
+	}
+	instr.addHistory("pun: add the signature in " + opts.UruncJSONPath)
+
+	return ref, nil
+}
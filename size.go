@@ -0,0 +1,136 @@
+// Copyright (c) 2023-2024, Nubificus LTD
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"strings"
+
+	units "github.com/docker/go-units"
+	"github.com/moby/buildkit/client/llb"
+	"github.com/moby/buildkit/frontend/gateway/client"
+)
+
+// filesSize returns the total size of the regular files under dir in the
+// image of ref. A nil ref is an empty image.
+func filesSize(ctx context.Context, ref client.Reference, dir string) (int64, error) {
+	if ref == nil {
+		return 0, nil
+	}
+	entries, err := ref.ReadDir(ctx, client.ReadDirRequest{
+		Path: dir,
+	})
+	if err != nil {
+		return 0, fmt.Errorf("Failed to read %s: %w", dir, err)
+	}
+	var size int64
+	for _, e := range entries {
+		mode := os.FileMode(e.Mode)
+		if mode.IsDir() {
+			sub, err := filesSize(ctx, ref, path.Join(dir, e.Path))
+			if err != nil {
+				return 0, err
+			}
+			size += sub
+		} else if mode.IsRegular() {
+			size += e.Size_
+		}
+	}
+
+	return size, nil
+}
+
+// layerSizes returns the size of the files that every instruction of the
+// target adds, in the order of the instructions. The diffs are part of the
+// solved image, so they come from the cache.
+func layerSizes(ctx context.Context, c client.Client, b *platformBuild, buildCtx llb.State) ([]int64, error) {
+	before, err := baseState(b.Target, b.Images, buildCtx, b.LLBOpts)
+	if err != nil {
+		return nil, err
+	}
+	var sizes []int64
+	for _, cmd := range b.Target.Copies {
+		after, err := commandState(before, cmd, b.Target, b.Images, buildCtx, b.LLBOpts)
+		if err != nil {
+			return nil, err
+		}
+		def, err := llb.Diff(before, after).Marshal(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to marshal the layer of %s: %w", cmd.Name(), err)
+		}
+		res, err := c.Solve(ctx, client.SolveRequest{
+			Definition: def.ToPB(),
+		})
+		if err != nil {
+			return nil, fmt.Errorf("Failed to solve the layer of %s: %w", cmd.Name(), err)
+		}
+		ref, err := res.SingleRef()
+		if err != nil {
+			return nil, err
+		}
+		size, err := filesSize(ctx, ref, "/")
+		if err != nil {
+			return nil, err
+		}
+		sizes = append(sizes, size)
+		before = after
+	}
+
+	return sizes, nil
+}
+
+// checkSizes evaluates the size limits of the policy against the solved
+// image of a build, naming the instructions whose layers are too large.
+func (policy *Policy) checkSizes(ctx context.Context, c client.Client, b *platformBuild, buildCtx llb.State) error {
+	var errs []error
+
+	if policy.maxLayerSize > 0 {
+		sizes, err := layerSizes(ctx, c, b, buildCtx)
+		if err != nil {
+			return err
+		}
+		for i, size := range sizes {
+			if size <= policy.maxLayerSize {
+				continue
+			}
+			cmd := b.Target.Copies[i]
+			name := strings.ToUpper(cmd.Name())
+			if loc := cmd.Location(); len(loc) > 0 {
+				name = fmt.Sprintf("%s at line %d", name, loc[0].Start.Line)
+			}
+			errs = append(errs, fmt.Errorf("The layer of %s is %s, more than %s", name,
+					units.HumanSize(float64(size)), policy.MaxLayerSize))
+		}
+	}
+	if policy.maxImageSize > 0 {
+		size, err := filesSize(ctx, b.Ref, "/")
+		if err != nil {
+			return err
+		}
+		if size > policy.maxImageSize {
+			errs = append(errs, fmt.Errorf("The image is %s, more than %s",
+					units.HumanSize(float64(size)), policy.MaxImageSize))
+		}
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("The image violates the policy: %w", errors.Join(errs...))
+	}
+
+	return nil
+}
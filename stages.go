@@ -0,0 +1,109 @@
+// Copyright (c) 2023-2024, Nubificus LTD
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/containerd/platforms"
+	"github.com/moby/buildkit/frontend/dockerfile/instructions"
+	ocispecs "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// parseStagePlatform parses the --platform flag of a FROM instruction,
+// e.g. FROM --platform=$BUILDPLATFORM.
+func parseStagePlatform(flag string, scope *argScope) (*ocispecs.Platform, error) {
+	if flag == "" {
+		return nil, nil
+	}
+	expanded, err := scope.expand(flag)
+	if err != nil {
+		return nil, err
+	}
+	platform, err := platforms.Parse(expanded)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid platform %s: %w", expanded, err)
+	}
+
+	return &platform, nil
+}
+
+// imagePlatform returns the platform that we need to use for the base of
+// an image. If the platform was not set in FROM, the default unikernel
+// platform gets used.
+func imagePlatform(instr *PackInstructions, opts LLBOpts) ocispecs.Platform {
+	if instr.Platform != nil {
+		return *instr.Platform
+	}
+
+	return basePlatform(instr.Base, opts)
+}
+
+// findImage returns the image named name, which is defined before the
+// image instr. Images can only refer to previously defined images, as in
+// docker multi-stage builds.
+func findImage(images []*PackInstructions, instr *PackInstructions, name string) *PackInstructions {
+	if name == "" {
+		return nil
+	}
+	for _, image := range images {
+		if image == instr {
+			break
+		}
+		if strings.EqualFold(image.Name, name) {
+			return image
+		}
+	}
+
+	return nil
+}
+
+// reachableImages returns all the images that are needed to build the
+// target image, including the target itself. An image is needed if
+// it is used as a base or if we copy files from it.
+func reachableImages(images []*PackInstructions, target *PackInstructions) []*PackInstructions {
+	var reachable []*PackInstructions
+	seen := make(map[*PackInstructions]bool)
+
+	var visit func(instr *PackInstructions)
+	visit = func(instr *PackInstructions) {
+		if seen[instr] {
+			return
+		}
+		seen[instr] = true
+		if instr.Dockerfile != nil {
+			// The dockerfile frontend builds the dependencies of builders
+			reachable = append(reachable, instr)
+			return
+		}
+		if dep := findImage(images, instr, instr.Base); dep != nil {
+			visit(dep)
+		}
+		for _, cmd := range instr.Copies {
+			c, ok := cmd.(*instructions.CopyCommand)
+			if !ok {
+				continue
+			}
+			if dep := findImage(images, instr, c.From); dep != nil {
+				visit(dep)
+			}
+		}
+		reachable = append(reachable, instr)
+	}
+	visit(target)
+
+	return reachable
+}
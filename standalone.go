@@ -0,0 +1,828 @@
+// Copyright (c) 2023-2024, Nubificus LTD
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"encoding/csv"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/docker/cli/cli/config"
+	bkclient "github.com/moby/buildkit/client"
+	"github.com/moby/buildkit/exporter/containerimage/exptypes"
+	"github.com/moby/buildkit/frontend/gateway/client"
+	"github.com/moby/buildkit/session"
+	"github.com/moby/buildkit/session/auth/authprovider"
+	"github.com/moby/buildkit/session/filesync"
+	"github.com/moby/buildkit/session/secrets"
+	"github.com/moby/buildkit/session/secrets/secretsprovider"
+	"github.com/moby/buildkit/util/appcontext"
+	"github.com/moby/buildkit/util/entitlements"
+	"github.com/moby/buildkit/util/progress/progressui"
+	digest "github.com/opencontainers/go-digest"
+	ocispecs "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/tonistiigi/fsutil"
+	"golang.org/x/sync/errgroup"
+)
+
+const (
+	buildCmd             string = "build"
+	defaultContainerFile string = "Containerfile"
+	defaultDebugImage    string = "docker.io/library/busybox:latest"
+)
+
+// BuildCLIOpts are the options of the standalone mode, where pun connects
+// to a buildkitd and builds an image itself, without buildctl or docker.
+type BuildCLIOpts struct {
+	// The address of buildkitd
+	Addr           string
+	// The Containerfile, by default the Containerfile of the context
+	ContainerFile  string
+	// The local directory to use as the build context
+	ContextDir     string
+	// The name of the image to build, if the file defines more than one
+	Target         string
+	// Build args in the form of KEY=VALUE
+	BuildArgs      stringList
+	// The outputs of the build, in the form of type=<type>,<key>=<value>
+	Outputs        stringList
+	// Build options of the frontend in the form of KEY=VALUE
+	FrontendOpts   stringList
+	// Entitlements to allow, e.g. security.insecure
+	Allow          stringList
+	// Build secrets in the form of id=<id>,src=<path> or id=<id>,env=<var>
+	Secrets        stringList
+	// Keep the ownership of the files of the context, instead of 0:0
+	PreserveOwner  bool
+	// A local directory to import the build cache from and export it to
+	CacheDir       string
+	// Caches to export, in the form of type=<type>,<key>=<value>
+	CacheTo        stringList
+	// Caches to import, in the form of type=<type>,<key>=<value>
+	CacheFrom      stringList
+	// Fail if the build needs network access
+	Offline        bool
+	// Reset the ownership and the timestamps of all the copied files
+	Normalize      bool
+	// Strip the kernel and publish its debug symbols as a separate artifact
+	SplitDebug     bool
+	// The outputs of the debug artifact, by default the image outputs
+	DebugOutputs   stringList
+	// The policy that the image must follow
+	PolicyFile     string
+	// Encrypt the layers of COPY --encrypt in the oci outputs
+	Encrypt        bool
+	// The configuration file of pun, which the build options override
+	ConfigFile     string
+	// How many times to retry the build on transient errors
+	Retries        int
+	// Write a JSON report of the build to this file
+	Report         string
+	// The type of progress output (auto, plain, tty, quiet, json, rawjson)
+	Progress       string
+	// Drop into a shell in the snapshot of the failed step
+	DebugOnError   bool
+	// The image that provides the shell for debugging
+	DebugImage     string
+	// The URLs to post the events of the build to
+	Webhooks       stringList
+	// Where buildkitd runs, remote (--addr) or kubernetes
+	Driver         string
+	// The options of the driver in the form of KEY=VALUE
+	DriverOpts     stringList
+	// The namespace of containerd, for the buildkitd and the images of nerdctl
+	Namespace      string
+	// The device profile that adjusts the defaults of the build
+	DeviceProfile  string
+	// Export the intermediate states of the target in OCI layouts here
+	KeepIntermediate string
+	// The media types of the manifests of the image outputs, oci or docker
+	MediaTypes     string
+	// The media type of the configs of the images of the oci outputs
+	ConfigMediaType string
+	// The artifact type of the manifests of the oci outputs
+	ArtifactType   string
+	// The icon of the images of the oci outputs, for Harbor
+	Icon           string
+	// The readme of the images of the oci outputs, for Harbor
+	Readme         string
+	// Fail if a pushed tag already exists with a different digest
+	ImmutableTags  bool
+	// Overwrite the existing tags despite ImmutableTags
+	Force          bool
+	// Print the digests of the pushes instead of pushing
+	DryRun         bool
+	// The shared display of concurrent builds, e.g. of pun bake, which
+	// prefixes the steps of this build with progressPrefix
+	progress       *progressMux
+	progressPrefix string
+}
+
+func buildUsage() {
+	fmt.Println("Usage of pun build")
+	fmt.Printf("%s %s [<args>] [<context>]\n\n", os.Args[0], buildCmd)
+	fmt.Println("Supported command line arguments")
+	buildFlagsUsage()
+}
+
+func buildFlagsUsage() {
+	fmt.Println("\t--addr address \t\t\tThe address of buildkitd (default $BUILDKIT_HOST)")
+	fmt.Println("\t-f, --file filename \t\tPath to the Containerfile (default <context>/Containerfile)")
+	fmt.Println("\t--target name \t\t\tThe image to build, if the file defines many")
+	fmt.Println("\t--build-arg KEY=VALUE \t\tSet a build arg (can be used multiple times)")
+	fmt.Println("\t--config filename \t\tPath to the configuration file of pun, which --opt overrides")
+	fmt.Println("\t-o, --output type=<type>,... \tThe output of the build (can be used multiple times)")
+	fmt.Println("\t--opt KEY=VALUE \t\tSet a build option of pun (can be used multiple times)")
+	fmt.Println("\t--allow entitlement \t\tAllow an entitlement, e.g. security.insecure")
+	fmt.Println("\t--secret id=<id>,src=<path> \tExpose a secret to the build (can be used multiple times)")
+	fmt.Println("\t--preserve-owner bool \t\tKeep the ownership of the files of the build context")
+	fmt.Println("\t--cache-dir path \t\tImport and export the build cache in a local directory")
+	fmt.Println("\t--cache-to type=<type>,... \tExport the build cache, e.g. to s3 or gha (can be used multiple times)")
+	fmt.Println("\t--cache-from type=<type>,... \tImport a build cache, e.g. from s3 or gha (can be used multiple times)")
+	fmt.Println("\t--offline bool \t\t\tFail if the build needs network access")
+	fmt.Println("\t--normalize bool \t\tReset the owner and the timestamps of all the copied files")
+	fmt.Println("\t--split-debug bool \t\tStrip the kernel and publish its debug symbols separately")
+	fmt.Println("\t--debug-output type=<type>,... \tThe output of the debug symbols (default the image outputs)")
+	fmt.Println("\t--policy filename \t\tThe policy that the image must follow")
+	fmt.Println("\t--encrypt bool \t\t\tEncrypt the layers of COPY --encrypt for the encryption-key secrets")
+	fmt.Println("\t--retries number \t\tRetry the build on transient registry errors (default 0)")
+	fmt.Println("\t--report filename \t\tWrite a JSON report of the build to the file")
+	fmt.Println("\t--progress type \t\tThe type of progress output (auto, plain, tty, quiet, json, rawjson)")
+	fmt.Println("\t--debug-on-error bool \t\tStart a shell in the snapshot of the failed step")
+	fmt.Println("\t--debug-image image \t\tThe image that provides the debug shell")
+	fmt.Println("\t--webhook url \t\t\tPost the events of the build to the URL (default $PUN_WEBHOOK)")
+	fmt.Println("\t--driver name \t\t\tWhere buildkitd runs, remote or kubernetes (default remote)")
+	fmt.Println("\t--driver-opt KEY=VALUE \t\tSet an option of the driver (can be used multiple times)")
+	fmt.Println("\t--namespace name \t\tThe namespace of containerd (default $CONTAINERD_NAMESPACE or default)")
+	fmt.Println("\t--profile name \t\t\tAdjust the defaults of the build for a device, e.g. jetson or rpi4")
+	fmt.Println("\t--keep-intermediate dir \tExport the intermediate states of the target in OCI layouts in dir")
+	fmt.Println("\t--media-types type \t\tThe media types of the manifests of the image outputs, oci or docker")
+	fmt.Println("\t--config-media-type type \tThe media type of the configs of the images of the oci outputs, or urunc")
+	fmt.Println("\t--artifact-type type \t\tThe artifact type of the manifests of the oci outputs, or urunc")
+	fmt.Println("\t--icon filename \t\tAdd an icon to the images of the oci outputs, for Harbor")
+	fmt.Println("\t--readme filename \t\tAdd a readme to the images of the oci outputs, for Harbor")
+	fmt.Println("\t--immutable-tags bool \t\tFail if a pushed tag already exists with a different digest")
+	fmt.Println("\t--force bool \t\t\tOverwrite the existing tags despite --immutable-tags")
+	fmt.Println("\t--dry-run bool \t\t\tPrint the digests of the pushes instead of pushing")
+}
+
+// addBuildFlags adds the flags of the standalone build in fs, so that the
+// commands which build an image share them.
+func addBuildFlags(fs *flag.FlagSet, opts *BuildCLIOpts) {
+	fs.StringVar(&opts.Addr, "addr", os.Getenv("BUILDKIT_HOST"), "The address of buildkitd")
+	fs.StringVar(&opts.ContainerFile, "file", "", "Path to the Containerfile")
+	fs.StringVar(&opts.ContainerFile, "f", "", "Path to the Containerfile")
+	fs.StringVar(&opts.Target, "target", "", "The image to build, if the file defines many")
+	fs.Var(&opts.BuildArgs, "build-arg", "Set a build arg (can be used multiple times)")
+	fs.Var(&opts.Outputs, "output", "The output of the build (can be used multiple times)")
+	fs.Var(&opts.Outputs, "o", "The output of the build (can be used multiple times)")
+	fs.Var(&opts.FrontendOpts, "opt", "Set a build option of pun (can be used multiple times)")
+	fs.Var(&opts.Allow, "allow", "Allow an entitlement, e.g. security.insecure")
+	fs.Var(&opts.Secrets, "secret", "Expose a secret to the build (can be used multiple times)")
+	fs.BoolVar(&opts.PreserveOwner, "preserve-owner", false, "Keep the ownership of the files of the build context")
+	fs.StringVar(&opts.CacheDir, "cache-dir", "", "Import and export the build cache in a local directory")
+	fs.Var(&opts.CacheTo, "cache-to", "Export the build cache (can be used multiple times)")
+	fs.Var(&opts.CacheFrom, "cache-from", "Import a build cache (can be used multiple times)")
+	fs.BoolVar(&opts.Offline, "offline", false, "Fail if the build needs network access")
+	fs.BoolVar(&opts.Normalize, "normalize", false, "Reset the owner and the timestamps of all the copied files")
+	fs.BoolVar(&opts.SplitDebug, "split-debug", false, "Strip the kernel and publish its debug symbols separately")
+	fs.Var(&opts.DebugOutputs, "debug-output", "The output of the debug symbols")
+	fs.StringVar(&opts.PolicyFile, "policy", "", "The policy that the image must follow")
+	fs.BoolVar(&opts.Encrypt, "encrypt", false, "Encrypt the layers of COPY --encrypt for the encryption-key secrets")
+	fs.StringVar(&opts.ConfigFile, "config", "", "Path to the configuration file of pun")
+	fs.IntVar(&opts.Retries, "retries", 0, "Retry the build on transient registry errors")
+	fs.StringVar(&opts.Report, "report", "", "Write a JSON report of the build to the file")
+	fs.StringVar(&opts.Progress, "progress", string(progressui.AutoMode), "The type of progress output")
+	fs.BoolVar(&opts.DebugOnError, "debug-on-error", false, "Start a shell in the snapshot of the failed step")
+	fs.StringVar(&opts.DebugImage, "debug-image", defaultDebugImage, "The image that provides the debug shell")
+	fs.Var(&opts.Webhooks, "webhook", "Post the events of the build to the URL (can be used multiple times)")
+	fs.StringVar(&opts.Driver, "driver", driverRemote, "Where buildkitd runs, remote or kubernetes")
+	fs.Var(&opts.DriverOpts, "driver-opt", "Set an option of the driver (can be used multiple times)")
+	fs.StringVar(&opts.Namespace, "namespace", containerdNamespace(), "The namespace of containerd")
+	fs.StringVar(&opts.DeviceProfile, "profile", "", "Adjust the defaults of the build for a device, e.g. jetson or rpi4")
+	fs.StringVar(&opts.KeepIntermediate, "keep-intermediate", "", "Export the intermediate states of the target in OCI layouts in dir")
+	fs.StringVar(&opts.MediaTypes, "media-types", "", "The media types of the manifests of the image outputs, oci or docker")
+	fs.StringVar(&opts.ConfigMediaType, "config-media-type", "", "The media type of the configs of the images of the oci outputs, or urunc")
+	fs.StringVar(&opts.ArtifactType, "artifact-type", "", "The artifact type of the manifests of the oci outputs, or urunc")
+	fs.StringVar(&opts.Icon, "icon", "", "Add an icon to the images of the oci outputs, for Harbor")
+	fs.StringVar(&opts.Readme, "readme", "", "Add a readme to the images of the oci outputs, for Harbor")
+	fs.BoolVar(&opts.ImmutableTags, "immutable-tags", false, "Fail if a pushed tag already exists with a different digest")
+	fs.BoolVar(&opts.Force, "force", false, "Overwrite the existing tags despite --immutable-tags")
+	fs.BoolVar(&opts.DryRun, "dry-run", false, "Print the digests of the pushes instead of pushing")
+}
+
+// setBuildContext sets the build context from the positional arguments and
+// the Containerfile, if it was not given.
+func setBuildContext(opts *BuildCLIOpts, args []string) error {
+	switch len(args) {
+	case 0:
+		opts.ContextDir = "."
+	case 1:
+		opts.ContextDir = args[0]
+	default:
+		return fmt.Errorf("Only one build context can be specified")
+	}
+	if opts.ContainerFile == "" {
+		opts.ContainerFile = filepath.Join(opts.ContextDir, defaultContainerFile)
+	}
+
+	return nil
+}
+
+func parseBuildCLIOpts(args []string) (BuildCLIOpts, error) {
+	var opts BuildCLIOpts
+
+	fs := flag.NewFlagSet(buildCmd, flag.ExitOnError)
+	addBuildFlags(fs, &opts)
+	fs.Usage = buildUsage
+	fs.Parse(args)
+
+	err := setBuildContext(&opts, fs.Args())
+
+	return opts, err
+}
+
+// parseCSVAttrs parses a list of <key>=<value> fields, as the outputs and
+// the secrets of buildctl. The keys are case insensitive.
+func parseCSVAttrs(what string, list string) (map[string]string, error) {
+	fields, err := csv.NewReader(strings.NewReader(list)).Read()
+	if err != nil {
+		return nil, fmt.Errorf("Failed to parse %s %s: %w", what, list, err)
+	}
+	attrs := make(map[string]string)
+	for _, field := range fields {
+		key, val, ok := strings.Cut(field, "=")
+		if !ok {
+			return nil, fmt.Errorf("Invalid %s field %s, expected key=value", what, field)
+		}
+		attrs[strings.ToLower(key)] = val
+	}
+
+	return attrs, nil
+}
+
+// parseOutput parses an output in the form of type=<type>,<key>=<value>,...
+// as in buildctl. The local exporter writes in the directory of dest, while
+// the tarball exporters (oci, docker, tar) write in the file of dest.
+func parseOutput(output string) (bkclient.ExportEntry, error) {
+	var entry bkclient.ExportEntry
+
+	attrs, err := parseCSVAttrs("output", output)
+	if err != nil {
+		return entry, err
+	}
+	entry.Type = attrs["type"]
+	delete(attrs, "type")
+	entry.Attrs = attrs
+	if entry.Type == "" {
+		return entry, fmt.Errorf("The type of output %s is missing", output)
+	}
+
+	dest, hasDest := entry.Attrs["dest"]
+	delete(entry.Attrs, "dest")
+	switch entry.Type {
+	case exporterContainerd:
+		// The image output of a buildkitd with a containerd worker stores
+		// the image in containerd, unpacked for nerdctl run
+		if entry.Attrs["name"] == "" {
+			return entry, fmt.Errorf("The %s output requires name", entry.Type)
+		}
+		entry.Type = bkclient.ExporterImage
+		entry.Attrs["unpack"] = "true"
+	case bkclient.ExporterLocal:
+		if !hasDest {
+			return entry, fmt.Errorf("The %s output requires dest", entry.Type)
+		}
+		entry.OutputDir = dest
+	case bkclient.ExporterOCI, bkclient.ExporterDocker, bkclient.ExporterTar:
+		if !hasDest {
+			return entry, fmt.Errorf("The %s output requires dest", entry.Type)
+		}
+		entry.Output = func(map[string]string) (io.WriteCloser, error) {
+			if dest == "-" {
+				return os.Stdout, nil
+			}
+			return os.Create(dest)
+		}
+	}
+
+	return entry, nil
+}
+
+// secretStore returns the store of the build secrets, given in the form of
+// id=<id>,src=<path> or id=<id>,env=<var>, as in buildctl, and their ids.
+func secretStore(list []string) (secrets.SecretStore, []string, error) {
+	var sources []secretsprovider.Source
+	var ids []string
+	for _, secret := range list {
+		attrs, err := parseCSVAttrs("secret", secret)
+		if err != nil {
+			return nil, nil, err
+		}
+		src := secretsprovider.Source{
+			ID:       attrs["id"],
+			FilePath: attrs["src"],
+			Env:      attrs["env"],
+		}
+		if src.ID == "" {
+			return nil, nil, fmt.Errorf("The secret %s has no id", secret)
+		}
+		sources = append(sources, src)
+		ids = append(ids, src.ID)
+	}
+	store, err := secretsprovider.NewStore(sources)
+	if err != nil {
+		return nil, nil, fmt.Errorf("Failed to load the secrets: %w", err)
+	}
+
+	return store, ids, nil
+}
+
+// buildSolveOpt creates the options of the solve, passing the Containerfile
+// and the rest of the arguments as build options of the frontend, as
+// buildctl would do with pun as the frontend image.
+func buildSolveOpt(opts BuildCLIOpts) (bkclient.SolveOpt, error) {
+	var solveOpt bkclient.SolveOpt
+
+	// The Containerfile is read from the build context
+	ctxDir, err := filepath.Abs(opts.ContextDir)
+	if err != nil {
+		return solveOpt, err
+	}
+	file, err := filepath.Abs(opts.ContainerFile)
+	if err != nil {
+		return solveOpt, err
+	}
+	relFile, err := filepath.Rel(ctxDir, file)
+	if err != nil || relFile == ".." || strings.HasPrefix(relFile, ".."+string(filepath.Separator)) {
+		return solveOpt, fmt.Errorf("The file %s must be inside the build context %s", opts.ContainerFile, opts.ContextDir)
+	}
+	ctxFS, err := fsutil.NewFS(ctxDir)
+	if err != nil {
+		return solveOpt, fmt.Errorf("Failed to open the build context: %w", err)
+	}
+
+	attrs := make(map[string]string)
+	for _, opt := range opts.FrontendOpts {
+		key, val, ok := strings.Cut(opt, "=")
+		if !ok {
+			return solveOpt, fmt.Errorf("Invalid build option %s, expected KEY=VALUE", opt)
+		}
+		attrs[key] = val
+	}
+	if opts.ConfigFile != "" {
+		config, err := loadConfig(opts.ConfigFile)
+		if err != nil {
+			return solveOpt, err
+		}
+		for key, val := range config.buildOpts() {
+			if _, ok := attrs[key]; !ok {
+				attrs[key] = val
+			}
+		}
+	}
+	attrs[clientOptFilename] = filepath.ToSlash(relFile)
+	if opts.Offline {
+		attrs[clientOptOffline] = "true"
+	}
+	if opts.Normalize {
+		attrs[clientOptNormalize] = "true"
+	}
+	if opts.SplitDebug {
+		attrs[clientOptSplitDebug] = "true"
+	}
+	if opts.PolicyFile != "" {
+		policy, err := readLocalFile(opts.PolicyFile)
+		if err != nil {
+			return solveOpt, fmt.Errorf("Failed to read policy %s: %w", opts.PolicyFile, err)
+		}
+		attrs[clientOptPolicy] = string(policy)
+	}
+	if opts.Target != "" {
+		attrs[clientOptTarget] = opts.Target
+	}
+	userArgs, err := buildArgsFromCLI(opts.BuildArgs)
+	if err != nil {
+		return solveOpt, err
+	}
+	// As in buildx, SOURCE_DATE_EPOCH can also come from the environment
+	if val := os.Getenv(argSourceDateEpoch); val != "" {
+		if _, ok := userArgs[argSourceDateEpoch]; !ok {
+			userArgs[argSourceDateEpoch] = val
+		}
+	}
+	for k, v := range userArgs {
+		attrs[clientOptBuildArg+k] = v
+	}
+
+	for _, output := range opts.Outputs {
+		entry, err := parseOutput(output)
+		if err != nil {
+			return solveOpt, err
+		}
+		solveOpt.Exports = append(solveOpt.Exports, entry)
+	}
+	err = setMediaTypes(solveOpt.Exports, opts.MediaTypes)
+	if err != nil {
+		return solveOpt, err
+	}
+	if opts.DeviceProfile != "" {
+		attrs[clientOptDeviceProfile] = opts.DeviceProfile
+		profile, err := deviceProfileFromBuildOpts(attrs)
+		if err != nil {
+			return solveOpt, err
+		}
+		profile.setCompression(solveOpt.Exports)
+	}
+
+	for _, allow := range opts.Allow {
+		ent, err := entitlements.Parse(allow)
+		if err != nil {
+			return solveOpt, err
+		}
+		solveOpt.AllowedEntitlements = append(solveOpt.AllowedEntitlements, ent)
+	}
+
+	if opts.CacheDir != "" {
+		solveOpt.CacheExports, solveOpt.CacheImports = localCache(opts.CacheDir)
+	}
+	for _, cache := range opts.CacheTo {
+		entry, err := parseCacheEntry(cache)
+		if err != nil {
+			return solveOpt, err
+		}
+		solveOpt.CacheExports = append(solveOpt.CacheExports, entry)
+	}
+	for _, cache := range opts.CacheFrom {
+		entry, err := parseCacheEntry(cache)
+		if err != nil {
+			return solveOpt, err
+		}
+		solveOpt.CacheImports = append(solveOpt.CacheImports, entry)
+	}
+
+	solveOpt.FrontendAttrs = attrs
+	solveOpt.Session = []session.Attachable{
+		authprovider.NewDockerAuthProvider(config.LoadDefaultConfigFile(os.Stderr), nil),
+	}
+	if len(opts.Secrets) > 0 {
+		store, _, err := secretStore(opts.Secrets)
+		if err != nil {
+			return solveOpt, err
+		}
+		solveOpt.Session = append(solveOpt.Session, secretsprovider.NewSecretProvider(store))
+	}
+	if opts.PreserveOwner {
+		// The buildkit client resets the owner of the files of local
+		// mounts, so we need to provide the context ourselves
+		solveOpt.Session = append(solveOpt.Session, filesync.NewFSSyncProvider(filesync.StaticDirSource{
+			packContextName: ctxFS,
+		}))
+	} else {
+		solveOpt.LocalMounts = map[string]fsutil.FS{
+			packContextName: ctxFS,
+		}
+	}
+
+	return solveOpt, nil
+}
+
+// parseCacheEntry parses a cache in the form of type=<type>,<key>=<value>,...
+// as in buildctl --export-cache and --import-cache. As buildx does, the
+// caches of GitHub Actions and S3 get their credentials from the
+// environment, unless they are given, since CI runners provide them there.
+func parseCacheEntry(cache string) (bkclient.CacheOptionsEntry, error) {
+	var entry bkclient.CacheOptionsEntry
+
+	attrs, err := parseCSVAttrs("cache", cache)
+	if err != nil {
+		return entry, err
+	}
+	entry.Type = attrs["type"]
+	delete(attrs, "type")
+	entry.Attrs = attrs
+	if entry.Type == "" {
+		return entry, fmt.Errorf("The type of cache %s is missing", cache)
+	}
+
+	var env map[string]string
+	switch entry.Type {
+	case "gha":
+		env = map[string]string{
+			"url":   "ACTIONS_CACHE_URL",
+			"token": "ACTIONS_RUNTIME_TOKEN",
+		}
+	case "s3":
+		env = map[string]string{
+			"region":            "AWS_REGION",
+			"access_key_id":     "AWS_ACCESS_KEY_ID",
+			"secret_access_key": "AWS_SECRET_ACCESS_KEY",
+			"session_token":     "AWS_SESSION_TOKEN",
+		}
+	}
+	for attr, name := range env {
+		if _, ok := entry.Attrs[attr]; ok {
+			continue
+		}
+		if val := os.Getenv(name); val != "" {
+			entry.Attrs[attr] = val
+		}
+	}
+	if entry.Type == "gha" && (entry.Attrs["url"] == "" || entry.Attrs["token"] == "") {
+		return entry, fmt.Errorf("The gha cache requires url and token, or $ACTIONS_CACHE_URL and $ACTIONS_RUNTIME_TOKEN")
+	}
+	if entry.Type == "s3" && (entry.Attrs["bucket"] == "" || entry.Attrs["region"] == "") {
+		return entry, fmt.Errorf("The s3 cache requires bucket and region, or $AWS_REGION")
+	}
+
+	return entry, nil
+}
+
+// localCache returns the options to export the build cache to a local
+// directory, which is an OCI layout, and to import it from there if a
+// previous build has exported it. Since all the intermediate results get
+// exported, a build with the same inputs will neither pull the bases, nor
+// copy the files again.
+func localCache(dir string) ([]bkclient.CacheOptionsEntry, []bkclient.CacheOptionsEntry) {
+	var imports []bkclient.CacheOptionsEntry
+
+	exports := []bkclient.CacheOptionsEntry{{
+		Type: "local",
+		Attrs: map[string]string{
+			"dest": dir,
+			"mode": "max",
+		},
+	}}
+	if _, err := os.Stat(filepath.Join(dir, ocispecs.ImageIndexFile)); err == nil {
+		imports = append(imports, bkclient.CacheOptionsEntry{
+			Type: "local",
+			Attrs: map[string]string{
+				"src": dir,
+			},
+		})
+	}
+
+	return exports, imports
+}
+
+// standaloneBuild builds the image with punBuilder as the build function,
+// running in the client side instead of buildkitd.
+func standaloneBuild(ctx context.Context, opts BuildCLIOpts) error {
+	return withBuildEvents(ctx, opts, func() (string, error) {
+		addr, cleanup, err := driverAddr(ctx, opts)
+		if err != nil {
+			return "", err
+		}
+		defer cleanup()
+		c, err := bkclient.New(ctx, addr)
+		if err != nil {
+			return "", fmt.Errorf("Failed to connect to buildkitd: %w", err)
+		}
+		defer c.Close()
+
+		return clientBuild(ctx, c, opts)
+	})
+}
+
+// clientBuild builds the image with a client of buildkitd, which might
+// serve many builds, and returns the digest of the image, if any.
+func clientBuild(ctx context.Context, c *bkclient.Client, opts BuildCLIOpts) (string, error) {
+	var podmanLoads []podmanOutput
+	var err error
+	opts.Outputs, podmanLoads, err = podmanOutputs(opts.Outputs)
+	for _, o := range podmanLoads {
+		defer os.Remove(o.Tarball)
+	}
+	if err != nil {
+		return "", err
+	}
+	solveOpt, err := buildSolveOpt(opts)
+	if err != nil {
+		return "", err
+	}
+	if len(solveOpt.Exports) == 0 && !quietProgress(opts.Progress) {
+		fmt.Fprintln(os.Stderr, "No output was specified, the result will only remain in the build cache")
+	}
+
+	// buildkit can not encrypt layers, so the oci outputs get encrypted
+	// after the export
+	var encryption *archiveEncryption
+	if opts.Encrypt {
+		encryption, err = encryptionFromCLI(ctx, opts)
+		if err != nil {
+			return "", err
+		}
+	}
+
+	// Similarly, buildkit can not set the media type of the configs, the
+	// artifact type and the layers of the registries
+	edit, err := manifestEditFromCLI(opts)
+	if err != nil {
+		return "", err
+	}
+
+	if hasContainerdOutput(opts.Outputs) {
+		err = checkContainerdWorker(ctx, c, opts.Namespace)
+		if err != nil {
+			return "", err
+		}
+	}
+
+	// A dry run does not push, so it can not overwrite anything
+	if opts.DryRun {
+		return dryRunBuild(ctx, c, solveOpt, opts)
+	}
+	// Released images must not get overwritten by accident
+	if opts.ImmutableTags && !opts.Force {
+		err = checkImmutableTags(ctx, c, solveOpt, opts)
+		if err != nil {
+			return "", err
+		}
+	}
+
+	var report *BuildReport
+	buildFunc := func(ctx context.Context, c client.Client) (*client.Result, error) {
+		report = newBuildReport()
+		res, err := buildImage(ctx, c, report, encryption)
+		if err != nil && opts.DebugOnError {
+			debugShell(ctx, c, err, opts.DebugImage)
+		}
+		return res, err
+	}
+	resp, err := runBuild(ctx, c, solveOpt, buildFunc, opts)
+	if opts.KeepIntermediate != "" {
+		// The intermediate states help the most when the build fails
+		intErr := exportIntermediates(ctx, c, solveOpt, opts.KeepIntermediate, opts)
+		if intErr != nil && err == nil {
+			return "", intErr
+		} else if intErr != nil {
+			fmt.Fprintln(os.Stderr, intErr)
+		}
+	}
+	if err != nil {
+		return "", err
+	}
+	imageDigest := resp.ExporterResponse[exptypes.ExporterImageDigestKey]
+	for _, o := range podmanLoads {
+		err = o.load(ctx)
+		if err != nil {
+			return "", err
+		}
+	}
+	if encryption != nil {
+		err = encryption.encrypt()
+		if err != nil {
+			return "", err
+		}
+	}
+	for _, archive := range edit.outputs() {
+		err = editArchive(archive, edit)
+		if err != nil {
+			return "", fmt.Errorf("Failed to edit the manifests of %s: %w", archive, err)
+		}
+	}
+
+	// The layers are read back after the encryption, which changes them
+	images, err := outputLayers(ctx, solveOpt.Exports, opts.Outputs)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to read the layers of the image: %v\n", err)
+	} else if len(images) > 0 && !quietProgress(opts.Progress) {
+		printLayers(os.Stderr, images)
+	}
+
+	if opts.SplitDebug {
+		err = buildDebugArtifact(ctx, c, solveOpt, imageDigest, opts)
+		if err != nil {
+			return "", err
+		}
+	}
+
+	if opts.Report == "" {
+		return imageDigest, nil
+	}
+	report.OutputDigest = imageDigest
+	report.Images = images
+
+	return imageDigest, report.write(opts.Report)
+}
+
+// buildDebugArtifact builds the debug artifact of the image with the given
+// digest, after the image itself got built. The build is the same as the
+// one of the image, so everything but the export comes from the cache.
+func buildDebugArtifact(ctx context.Context, c *bkclient.Client, solveOpt bkclient.SolveOpt,
+		imageDigest string, opts BuildCLIOpts) error {
+	if imageDigest == "" {
+		return fmt.Errorf("The digest of the image is unknown, --split-debug requires an image output")
+	}
+	subject, err := digest.Parse(imageDigest)
+	if err != nil {
+		return fmt.Errorf("Invalid digest of the image %s: %w", imageDigest, err)
+	}
+
+	debugOpt := solveOpt
+	debugOpt.CacheExports = nil
+	debugOpt.FrontendAttrs = make(map[string]string)
+	for k, v := range solveOpt.FrontendAttrs {
+		debugOpt.FrontendAttrs[k] = v
+	}
+	debugOpt.FrontendAttrs[clientOptDebugArtifact] = subject.String()
+	// The checks of the image already ran in its own build
+	for _, opt := range []string{clientOptScan, clientOptSensitiveArgs, clientOptSensitiveSecrets} {
+		delete(debugOpt.FrontendAttrs, opt)
+	}
+	debugOpt.Exports = nil
+	for _, output := range opts.DebugOutputs {
+		entry, err := parseOutput(output)
+		if err != nil {
+			return err
+		}
+		debugOpt.Exports = append(debugOpt.Exports, entry)
+	}
+	if len(debugOpt.Exports) == 0 {
+		debugOpt.Exports, err = debugExports(solveOpt.Exports, subject)
+		if err != nil {
+			return err
+		}
+	}
+
+	buildFunc := func(ctx context.Context, c client.Client) (*client.Result, error) {
+		return buildImage(ctx, c, newBuildReport(), nil)
+	}
+	_, err = runBuild(ctx, c, debugOpt, buildFunc, opts)
+	if err != nil {
+		return fmt.Errorf("Failed to build the debug artifact: %w", err)
+	}
+
+	return nil
+}
+
+// runBuild runs a build with the progress output of the options.
+func runBuild(ctx context.Context, c *bkclient.Client, solveOpt bkclient.SolveOpt,
+		buildFunc client.BuildFunc, opts BuildCLIOpts) (*bkclient.SolveResponse, error) {
+	// Retry the whole build on transient errors, e.g. while pushing. The
+	// retries are cheap, since the results of the previous attempt are
+	// in the cache of buildkitd.
+	policy := RetryPolicy{
+		Attempts: opts.Retries + 1,
+		Delay:    defaultRetryDelay,
+	}
+	var resp *bkclient.SolveResponse
+	err := policy.retry(ctx, "build", func() error {
+		if opts.progress != nil {
+			var err error
+			resp, err = c.Build(ctx, solveOpt, "pun", buildFunc, opts.progress.add(opts.progressPrefix))
+			return err
+		}
+		display, err := newDisplay(os.Stderr, opts.Progress)
+		if err != nil {
+			return err
+		}
+
+		ch := make(chan *bkclient.SolveStatus)
+		eg, egCtx := errgroup.WithContext(ctx)
+		eg.Go(func() error {
+			var err error
+			resp, err = c.Build(egCtx, solveOpt, "pun", buildFunc, ch)
+			return err
+		})
+		eg.Go(func() error {
+			_, err := display.UpdateFrom(context.WithoutCancel(egCtx), ch)
+			return err
+		})
+
+		return eg.Wait()
+	})
+
+	return resp, err
+}
+
+func buildMain(args []string) {
+	opts, err := parseBuildCLIOpts(args)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+
+	err = standaloneBuild(appcontext.Context(), opts)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+}
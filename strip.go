@@ -0,0 +1,227 @@
+// Copyright (c) 2023-2024, Nubificus LTD
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"path"
+	"strconv"
+
+	"github.com/moby/buildkit/client/llb"
+	"github.com/moby/buildkit/frontend/gateway/client"
+)
+
+const (
+	clientOptStripKernel    string = "strip-kernel"
+	clientOptCompressInitrd string = "compress-initrd"
+	clientOptStripImage     string = "strip-image"
+	clientOptSplitDebug     string = "split-debug"
+	defaultStripImage       string = "docker.io/library/alpine:3.20"
+	// The packed image gets mounted there in the post-processing container
+	stripRootfs             string = "/unikernel"
+	// The debug symbols of the kernel get written there
+	debugRootfs             string = "/debug"
+)
+
+// defaultStripCmd strips the debug symbols of the kernel and compresses the
+// initrd with gzip, unless it is already compressed. binutils get installed
+// if the image does not have them. If PUN_DEBUG is set, the debug symbols
+// get kept there and the stripped kernel links to them.
+const defaultStripCmd string = `
+set -e
+size() { wc -c < "$1" | tr -d ' '; }
+if [ -n "$PUN_KERNEL" ]; then
+	if ! command -v strip > /dev/null; then
+		apk add --no-cache binutils > /dev/null
+	fi
+	before=$(size "$PUN_KERNEL")
+	if [ -n "$PUN_DEBUG" ]; then
+		objcopy --only-keep-debug "$PUN_KERNEL" "$PUN_DEBUG"
+	fi
+	strip --strip-debug "$PUN_KERNEL"
+	if [ -n "$PUN_DEBUG" ]; then
+		objcopy --add-gnu-debuglink="$PUN_DEBUG" "$PUN_KERNEL"
+	fi
+	echo "kernel: $before -> $(size "$PUN_KERNEL") bytes"
+fi
+if [ -n "$PUN_INITRD" ]; then
+	if gzip -t "$PUN_INITRD" 2> /dev/null; then
+		echo "initrd: already compressed"
+	else
+		before=$(size "$PUN_INITRD")
+		gzip -9 -n -c "$PUN_INITRD" > /tmp/initrd
+		cat /tmp/initrd > "$PUN_INITRD"
+		echo "initrd: $before -> $(size "$PUN_INITRD") bytes"
+	fi
+fi
+`
+
+// Strip describes the post-processing of the packed image, which makes the
+// artifacts of the unikernel smaller. It runs in a container of Image.
+type Strip struct {
+	Kernel     bool   // Strip the debug symbols of the kernel
+	Initrd     bool   // Compress the initrd
+	SplitDebug bool   // Keep the debug symbols of the kernel in a separate file
+	Image      string // The image with binutils and gzip
+}
+
+// stripFromBuildOpts returns the post-processing of the build options, or
+// nil if it is not enabled. Splitting the debug symbols implies stripping
+// the kernel.
+func stripFromBuildOpts(opts map[string]string) (*Strip, error) {
+	s := &Strip{
+		Image: defaultStripImage,
+	}
+	for key, val := range map[string]*bool{
+		clientOptStripKernel:    &s.Kernel,
+		clientOptCompressInitrd: &s.Initrd,
+		clientOptSplitDebug:     &s.SplitDebug,
+	} {
+		if opts[key] == "" {
+			continue
+		}
+		b, err := strconv.ParseBool(opts[key])
+		if err != nil {
+			return nil, fmt.Errorf("Invalid %s %s, expected a boolean", key, opts[key])
+		}
+		*val = b
+	}
+	if s.SplitDebug {
+		s.Kernel = true
+	}
+	if !s.Kernel && !s.Initrd {
+		return nil, nil
+	}
+	if val := opts[clientOptStripImage]; val != "" {
+		s.Image = val
+	}
+
+	return s, nil
+}
+
+// artifactSize returns the size of a file of the packed image.
+func artifactSize(ctx context.Context, ref client.Reference, p string) (int64, error) {
+	st, err := ref.StatFile(ctx, client.StatRequest{Path: p})
+	if err != nil {
+		return 0, fmt.Errorf("Failed to stat %s: %w", p, err)
+	}
+
+	return st.Size_, nil
+}
+
+// debugFile returns the name of the file with the debug symbols of kernel.
+func debugFile(kernel string) string {
+	return path.Base(kernel) + ".debug"
+}
+
+// solveState solves st and returns its reference.
+func solveState(ctx context.Context, c client.Client, st llb.State) (client.Reference, error) {
+	dt, err := st.Marshal(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to marshal strip: %w", err)
+	}
+	res, err := c.Solve(ctx, client.SolveRequest{
+		Definition: dt.ToPB(),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("Failed to strip the artifacts: %w", err)
+	}
+
+	return res.SingleRef()
+}
+
+// runStrip strips the kernel and compresses the initrd of the packed image,
+// returning the reference of the processed image and, if the debug symbols
+// get split, the reference of a filesystem with only the debug file. The
+// sizes of the artifacts before and after get recorded in the report.
+func runStrip(ctx context.Context, c client.Client, s *Strip, instr *PackInstructions,
+		ref client.Reference, report *BuildReport) (client.Reference, client.Reference, error) {
+	var paths []string
+	var kernel, initrd, debug string
+
+	if s.Kernel {
+		kernelPath, ok := instr.Annots[uruncBinaryAnnot]
+		if !ok {
+			return nil, nil, fmt.Errorf("Stripping the kernel requires the %s label", uruncBinaryAnnot)
+		}
+		kernel = path.Join(stripRootfs, kernelPath)
+		paths = append(paths, kernelPath)
+		if s.SplitDebug {
+			debug = path.Join(debugRootfs, debugFile(kernelPath))
+		}
+	}
+	if s.Initrd {
+		initrdPath, ok := instr.Annots[uruncInitrdAnnot]
+		if !ok {
+			return nil, nil, fmt.Errorf("Compressing the initrd requires the %s label", uruncInitrdAnnot)
+		}
+		initrd = path.Join(stripRootfs, initrdPath)
+		paths = append(paths, initrdPath)
+	}
+
+	before := make([]int64, len(paths))
+	for i, p := range paths {
+		size, err := artifactSize(ctx, ref, p)
+		if err != nil {
+			return nil, nil, err
+		}
+		before[i] = size
+	}
+
+	rootfs, err := ref.ToState()
+	if err != nil {
+		return nil, nil, err
+	}
+	run := llb.Image(s.Image).Run(
+		llb.Args([]string{"/bin/sh", "-c", defaultStripCmd}),
+		llb.AddEnv("PUN_KERNEL", kernel),
+		llb.AddEnv("PUN_INITRD", initrd),
+		llb.AddEnv("PUN_DEBUG", debug),
+		llb.WithCustomName("Strip the artifacts of the unikernel"),
+	)
+	// Add both mounts before solving any of them, so that the exec
+	// only runs once
+	strippedState := run.AddMount(stripRootfs, rootfs)
+	var debugState llb.State
+	if debug != "" {
+		debugState = run.AddMount(debugRootfs, llb.Scratch())
+	}
+	stripped, err := solveState(ctx, c, strippedState)
+	if err != nil {
+		return nil, nil, err
+	}
+	var debugRef client.Reference
+	if debug != "" {
+		debugRef, err = solveState(ctx, c, debugState)
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+
+	for i, p := range paths {
+		after, err := artifactSize(ctx, stripped, p)
+		if err != nil {
+			return nil, nil, err
+		}
+		report.Sizes = append(report.Sizes, ReportSize{
+			Path:   p,
+			Before: before[i],
+			After:  after,
+		})
+	}
+
+	return stripped, debugRef, nil
+}
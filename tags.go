@@ -0,0 +1,258 @@
+// Copyright (c) 2023-2024, Nubificus LTD
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/distribution/reference"
+	ocispecs "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+const (
+	// The layout of the calver helper, e.g. 2024.05.17
+	calverLayout string = "2006.01.02"
+)
+
+// TagData is the data of the tag templates of the bake targets, e.g.
+// {{.Version}}-{{.Hypervisor}}-{{.Arch}}. The version and the platform are
+// methods, so that only the templates that use them need a git repository
+// or a single platform.
+type TagData struct {
+	// The name of the expanded target, e.g. nginx-amd64-qemu-1.25
+	Target   string
+	// The values of the variables of the matrix of the target
+	Matrix   map[string]string
+	// The build args of the target
+	Args     map[string]string
+	tagger   *tagTemplater
+	platform string
+}
+
+// Version returns the version of the release, which is the version of the
+// bake definition, or the git describe of its directory.
+func (d *TagData) Version() (string, error) {
+	return d.tagger.version()
+}
+
+// Hypervisor returns the hypervisor of the platform of the target.
+func (d *TagData) Hypervisor() (string, error) {
+	platform, err := d.singlePlatform()
+	if err != nil {
+		return "", err
+	}
+
+	return platform.OS, nil
+}
+
+// Arch returns the architecture of the platform of the target, with the
+// variant, if any, e.g. arm64 or arm-v7.
+func (d *TagData) Arch() (string, error) {
+	platform, err := d.singlePlatform()
+	if err != nil {
+		return "", err
+	}
+	if platform.Variant != "" {
+		return platform.Architecture + "-" + platform.Variant, nil
+	}
+
+	return platform.Architecture, nil
+}
+
+func (d *TagData) singlePlatform() (*ocispecs.Platform, error) {
+	targets, err := platformsFromBuildOpts(map[string]string{clientOptPlatforms: d.platform})
+	if err != nil {
+		return nil, err
+	}
+	if len(targets) != 1 || targets[0] == nil {
+		return nil, fmt.Errorf("The tag refers to the platform of target %s, which needs a single platform, got %q",
+				d.Target, d.platform)
+	}
+
+	return targets[0], nil
+}
+
+// tagTemplater executes the tag templates of a bake definition. It runs git
+// at most once per helper, since all the targets share the results.
+type tagTemplater struct {
+	// The directory of the bake definition, where git runs
+	dir     string
+	// The version of the definition, which may be a template itself
+	release string
+	git     map[string]string
+}
+
+func newTagTemplater(dir string, version string) *tagTemplater {
+	return &tagTemplater{
+		dir:     dir,
+		release: version,
+		git:     make(map[string]string),
+	}
+}
+
+// runGit runs git in the directory of the definition and returns the first
+// line of its output.
+func (t *tagTemplater) runGit(args ...string) (string, error) {
+	key := strings.Join(args, " ")
+	if out, ok := t.git[key]; ok {
+		return out, nil
+	}
+	cmd := exec.Command("git", args...)
+	cmd.Dir = t.dir
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return "", fmt.Errorf("git %s failed: %w: %s", key, err, strings.TrimSpace(stderr.String()))
+	}
+	line, _, _ := strings.Cut(string(out), "\n")
+	t.git[key] = strings.TrimSpace(line)
+
+	return t.git[key], nil
+}
+
+func (t *tagTemplater) version() (string, error) {
+	if t.release == "" {
+		return t.runGit("describe", "--tags", "--always", "--dirty")
+	}
+	// The version can use the helpers, e.g. {{calver}}, but not the data of
+	// the targets
+	return t.execute("version", t.release, nil)
+}
+
+// tagTime returns the time of the date helpers, which is SOURCE_DATE_EPOCH
+// if it is set, so that a rebuild of a release gets the same tags.
+func tagTime() (time.Time, error) {
+	epoch, err := parseEpoch(os.Getenv(argSourceDateEpoch))
+	if err != nil {
+		return time.Time{}, err
+	}
+	if epoch != nil {
+		return *epoch, nil
+	}
+
+	return time.Now().UTC(), nil
+}
+
+// semverParts returns the major, minor and patch numbers of a semantic
+// version, with or without the v prefix, ignoring the pre-release and the
+// build metadata.
+func semverParts(version string) ([3]string, error) {
+	var parts [3]string
+
+	core, _, _ := strings.Cut(strings.TrimPrefix(version, "v"), "+")
+	core, _, _ = strings.Cut(core, "-")
+	fields := strings.Split(core, ".")
+	if len(fields) != 3 {
+		return parts, fmt.Errorf("Invalid semantic version %s", version)
+	}
+	for i, f := range fields {
+		_, err := strconv.ParseUint(f, 10, 64)
+		if err != nil {
+			return parts, fmt.Errorf("Invalid semantic version %s", version)
+		}
+		parts[i] = f
+	}
+
+	return parts, nil
+}
+
+func (t *tagTemplater) funcs() template.FuncMap {
+	semverPart := func(i int) func(string) (string, error) {
+		return func(version string) (string, error) {
+			parts, err := semverParts(version)
+			return parts[i], err
+		}
+	}
+
+	return template.FuncMap{
+		"gitDescribe": func() (string, error) {
+			return t.runGit("describe", "--tags", "--always", "--dirty")
+		},
+		"gitCommit": func() (string, error) {
+			return t.runGit("rev-parse", "--short", "HEAD")
+		},
+		"gitBranch": func() (string, error) {
+			return t.runGit("rev-parse", "--abbrev-ref", "HEAD")
+		},
+		"date": func(layout string) (string, error) {
+			n, err := tagTime()
+			return n.Format(layout), err
+		},
+		"calver": func() (string, error) {
+			n, err := tagTime()
+			return n.Format(calverLayout), err
+		},
+		// The version without the v prefix, if it is a semantic version
+		"semver": func(version string) (string, error) {
+			_, err := semverParts(version)
+			return strings.TrimPrefix(version, "v"), err
+		},
+		"major": semverPart(0),
+		"minor": semverPart(1),
+		"patch": semverPart(2),
+	}
+}
+
+func (t *tagTemplater) execute(name string, text string, data *TagData) (string, error) {
+	tmpl, err := template.New(name).Option("missingkey=error").Funcs(t.funcs()).Parse(text)
+	if err != nil {
+		return "", fmt.Errorf("Invalid template %s: %w", text, err)
+	}
+	var b strings.Builder
+	err = tmpl.Execute(&b, data)
+	if err != nil {
+		return "", fmt.Errorf("Failed to expand %s: %w", text, err)
+	}
+
+	return b.String(), nil
+}
+
+// tags expands the tag templates of an expanded target and checks that they
+// are valid references. Tags without templates are returned as they are.
+func (t *tagTemplater) tags(name string, target *BakeTarget, matrix map[string]string) ([]string, error) {
+	var tags []string
+
+	data := &TagData{
+		Target:   name,
+		Matrix:   matrix,
+		Args:     target.Args,
+		tagger:   t,
+		platform: target.Platform,
+	}
+	for _, tag := range target.Tags {
+		if strings.Contains(tag, "{{") {
+			expanded, err := t.execute("tag", tag, data)
+			if err != nil {
+				return nil, err
+			}
+			tag = expanded
+		}
+		_, err := reference.ParseNormalizedNamed(tag)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid tag %s: %w", tag, err)
+		}
+		tags = append(tags, tag)
+	}
+
+	return tags, nil
+}
@@ -0,0 +1,81 @@
+// Copyright (c) 2023-2024, Nubificus LTD
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"path"
+	"strings"
+
+	"github.com/moby/buildkit/client/llb"
+	"github.com/moby/buildkit/frontend/dockerfile/instructions"
+)
+
+const (
+	tlsFlag       string = "tls"
+	uruncTLSAnnot string = "com.urunc.unikernel.tlsPaths"
+)
+
+// tlsCopies returns the COPY instructions of the image with --tls, whose
+// files get copied in the last layers of the image, after urunc.json, so
+// that rotating them only changes these layers.
+func tlsCopies(instr *PackInstructions) []*instructions.CopyCommand {
+	var copies []*instructions.CopyCommand
+	for _, cmd := range instr.Copies {
+		c, ok := cmd.(*instructions.CopyCommand)
+		if ok && instr.CopyFlags[c].TLS {
+			copies = append(copies, c)
+		}
+	}
+
+	return copies
+}
+
+// copyDest returns the path of the source of a COPY in the image. As in
+// copyIn, a destination with a trailing slash is a directory that gets the
+// source.
+func copyDest(c *instructions.CopyCommand) string {
+	dst := c.DestPath
+	if strings.HasSuffix(dst, "/") {
+		dst = path.Join(dst, path.Base(c.SourcePaths[0]))
+	}
+
+	return path.Clean("/" + dst)
+}
+
+// tlsPathsAnnot returns the value of the annotation with the paths of the
+// TLS material, a comma separated list.
+func tlsPathsAnnot(copies []*instructions.CopyCommand) string {
+	var paths []string
+	for _, c := range copies {
+		paths = append(paths, copyDest(c))
+	}
+
+	return strings.Join(paths, ",")
+}
+
+// tlsIn copies the TLS material of the image in base, every COPY --tls in a
+// layer of its own.
+func tlsIn(base llb.State, instr *PackInstructions, images []*PackInstructions,
+		buildCtx llb.State, opts LLBOpts) (llb.State, error) {
+	for _, c := range tlsCopies(instr) {
+		var err error
+		base, err = copyCommandState(base, c, instr, images, buildCtx, opts)
+		if err != nil {
+			return base, err
+		}
+	}
+
+	return base, nil
+}
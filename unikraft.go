@@ -0,0 +1,331 @@
+// Copyright (c) 2023-2024, Nubificus LTD
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"path"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/moby/buildkit/client/llb"
+	"github.com/moby/buildkit/frontend/gateway/client"
+	gatewaypb "github.com/moby/buildkit/frontend/gateway/pb"
+	"github.com/moby/buildkit/solver/result"
+	digest "github.com/opencontainers/go-digest"
+	ocispecs "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+const (
+	clientOptUnikraftConfig string = "unikraft-config"
+	// buildx sets it with --sbom
+	clientOptSBOM           string = "attest:sbom"
+	defaultUnikraftConfig   string = "/unikraft/bin/config"
+	annotUnikraftLibs       string = "com.nubificus.pun.unikraft.libraries"
+	sbomPredicateType       string = "https://spdx.dev/Document"
+	sbomFile                string = "sbom.spdx.json"
+	// The labels of kraft-built bases with the target of their kernel
+	labelUnikraftPlat       string = "org.unikraft.kernel.plat"
+	labelUnikraftArch       string = "org.unikraft.kernel.arch"
+)
+
+// unikraftPlatHypervisors are the hypervisors that can boot the kernels of
+// every Unikraft platform.
+var unikraftPlatHypervisors = map[string][]string{
+	"qemu":        {"qemu"},
+	"kvm":         {"qemu", "firecracker"},
+	"fc":          {"firecracker"},
+	"firecracker": {"firecracker"},
+	"xen":         {"xen"},
+}
+
+// unikraftArchs maps the architectures of Unikraft to the ones of OCI.
+var unikraftArchs = map[string]string{
+	"x86_64":  "amd64",
+	"arm64":   "arm64",
+	"arm":     "arm",
+	"riscv64": "riscv64",
+}
+
+// UnikraftLib is a library of a unikraft kernel, as enabled in its kconfig.
+type UnikraftLib struct {
+	Name    string
+	Version string
+}
+
+// unikraftConfigFromBuildOpts returns the path of the kconfig of unikraft
+// kernels in the image.
+func unikraftConfigFromBuildOpts(opts map[string]string) string {
+	if p := opts[clientOptUnikraftConfig]; p != "" {
+		return p
+	}
+
+	return defaultUnikraftConfig
+}
+
+// sbomFromBuildOpts returns true if the build needs an SBOM attestation.
+// buildx passes the options of the SBOM generator in the value, which pun
+// ignores, since it generates the SBOM itself.
+func sbomFromBuildOpts(opts map[string]string) bool {
+	val, ok := opts[clientOptSBOM]
+	if !ok {
+		return false
+	}
+	for _, opt := range strings.Split(val, ",") {
+		if opt == "disabled=true" {
+			return false
+		}
+	}
+
+	return true
+}
+
+// fileExists returns true if p exists in the image of ref. Stat fails with
+// an opaque error for missing files, so the directories get listed instead.
+func fileExists(ctx context.Context, ref client.Reference, p string) (bool, error) {
+	dir := "/"
+	for _, name := range strings.Split(strings.Trim(path.Clean(p), "/"), "/") {
+		entries, err := ref.ReadDir(ctx, client.ReadDirRequest{
+			Path:           dir,
+			IncludePattern: name,
+		})
+		if err != nil {
+			return false, fmt.Errorf("Failed to read %s: %w", dir, err)
+		}
+		if len(entries) == 0 {
+			return false, nil
+		}
+		dir = path.Join(dir, name)
+	}
+
+	return true, nil
+}
+
+// parseUnikraftConfig returns the libraries that a unikraft kconfig enables.
+// Libraries are enabled with CONFIG_LIB<NAME>=y, while their options are
+// CONFIG_LIB<NAME>_<OPTION>, so the enabled options whose prefix is an
+// enabled library are skipped. Libraries get the version of their
+// CONFIG_LIB<NAME>_VERSION, if they have one, or the version of unikraft.
+func parseUnikraftConfig(dt []byte) []UnikraftLib {
+	values := make(map[string]string)
+	var enabled []string
+	scanner := bufio.NewScanner(bytes.NewReader(dt))
+	for scanner.Scan() {
+		key, val, ok := strings.Cut(strings.TrimSpace(scanner.Text()), "=")
+		if !ok || strings.HasPrefix(key, "#") {
+			continue
+		}
+		values[key] = strings.Trim(val, "\"")
+		if strings.HasPrefix(key, "CONFIG_LIB") && val == "y" {
+			enabled = append(enabled, key)
+		}
+	}
+
+	version := values["CONFIG_UK_FULLVERSION"]
+	libs := []UnikraftLib{{Name: "unikraft", Version: version}}
+	for _, key := range enabled {
+		isOption := slices.ContainsFunc(enabled, func(lib string) bool {
+			return strings.HasPrefix(key, lib+"_")
+		})
+		if isOption {
+			continue
+		}
+		lib := UnikraftLib{
+			Name:    strings.ToLower(strings.TrimPrefix(key, "CONFIG_")),
+			Version: version,
+		}
+		if v := values[key+"_VERSION"]; v != "" {
+			lib.Version = v
+		}
+		libs = append(libs, lib)
+	}
+	slices.SortFunc(libs[1:], func(a, b UnikraftLib) int {
+		return strings.Compare(a.Name, b.Name)
+	})
+
+	return libs
+}
+
+// unikraftLibs returns the libraries of the unikraft kernel of the packed
+// image, or nil if the image has no kconfig.
+func unikraftLibs(ctx context.Context, ref client.Reference, config string) ([]UnikraftLib, error) {
+	found, err := fileExists(ctx, ref, config)
+	if err != nil || !found {
+		return nil, err
+	}
+	dt, err := ref.ReadFile(ctx, client.ReadRequest{
+		Filename: config,
+		Range: &client.FileRange{
+			Length: int(maxFileSize),
+		},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("Failed to read %s: %w", config, err)
+	}
+
+	return parseUnikraftConfig(dt), nil
+}
+
+// unikraftLibsAnnot returns the value of the annotation with the libraries,
+// a JSON object with their versions.
+func unikraftLibsAnnot(libs []UnikraftLib) string {
+	versions := make(map[string]string)
+	for _, lib := range libs {
+		versions[lib.Name] = lib.Version
+	}
+	dt, _ := json.Marshal(versions)
+
+	return string(dt)
+}
+
+type spdxCreationInfo struct {
+	Created  string   `json:"created"`
+	Creators []string `json:"creators"`
+}
+
+type spdxPackage struct {
+	Name             string `json:"name"`
+	SPDXID           string `json:"SPDXID"`
+	VersionInfo      string `json:"versionInfo,omitempty"`
+	DownloadLocation string `json:"downloadLocation"`
+}
+
+// spdxDocument is the part of an SPDX 2.3 document that pun fills in.
+type spdxDocument struct {
+	SPDXVersion       string           `json:"spdxVersion"`
+	DataLicense       string           `json:"dataLicense"`
+	SPDXID            string           `json:"SPDXID"`
+	Name              string           `json:"name"`
+	DocumentNamespace string           `json:"documentNamespace"`
+	CreationInfo      spdxCreationInfo `json:"creationInfo"`
+	Packages          []spdxPackage    `json:"packages"`
+}
+
+// unikraftSBOM returns the SPDX document with the libraries of the target.
+// The namespace is derived from the libraries, so that the same kernel gets
+// the same document.
+func unikraftSBOM(instr *PackInstructions, opts LLBOpts) ([]byte, error) {
+	created := time.Now().UTC()
+	if opts.Epoch != nil {
+		created = *opts.Epoch
+	}
+	doc := spdxDocument{
+		SPDXVersion: "SPDX-2.3",
+		DataLicense: "CC0-1.0",
+		SPDXID:      "SPDXRef-DOCUMENT",
+		Name:        instr.Base,
+		DocumentNamespace: "https://github.com/nubificus/pun/spdx/" +
+			digest.FromString(unikraftLibsAnnot(instr.Libraries)).Encoded(),
+		CreationInfo: spdxCreationInfo{
+			Created:  created.Format(time.RFC3339),
+			Creators: []string{"Tool: pun-" + version},
+		},
+	}
+	for _, lib := range instr.Libraries {
+		doc.Packages = append(doc.Packages, spdxPackage{
+			Name:             lib.Name,
+			SPDXID:           "SPDXRef-Package-" + lib.Name,
+			VersionInfo:      lib.Version,
+			DownloadLocation: "NOASSERTION",
+		})
+	}
+	dt, err := json.Marshal(doc)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to marshal the SBOM: %w", err)
+	}
+
+	return dt, nil
+}
+
+// addSBOMAttestation attaches the SBOM of a build to its image in the
+// result. Builds without unikraft libraries get no SBOM.
+func addSBOMAttestation(ctx context.Context, c client.Client, res *client.Result, b *platformBuild) error {
+	if len(b.Target.Libraries) == 0 {
+		return nil
+	}
+	dt, err := unikraftSBOM(b.Target, b.LLBOpts)
+	if err != nil {
+		return err
+	}
+	st := llb.Scratch().File(llb.Mkfile(sbomFile, 0644, dt),
+			llb.WithCustomName("Create the SBOM of the unikraft libraries"))
+	def, err := st.Marshal(ctx)
+	if err != nil {
+		return fmt.Errorf("Failed to marshal the SBOM: %w", err)
+	}
+	sbomRes, err := c.Solve(ctx, client.SolveRequest{
+		Definition: def.ToPB(),
+	})
+	if err != nil {
+		return fmt.Errorf("Failed to create the SBOM: %w", err)
+	}
+	ref, err := sbomRes.SingleRef()
+	if err != nil {
+		return err
+	}
+	res.AddAttestation(b.id(), client.Attestation{
+		Kind: gatewaypb.AttestationKindInToto,
+		Ref:  ref,
+		Path: sbomFile,
+		InToto: result.InTotoAttestation{
+			PredicateType: sbomPredicateType,
+			Subjects: []result.InTotoSubject{{
+				Kind: gatewaypb.InTotoSubjectKindSelf,
+			}},
+		},
+	})
+
+	return nil
+}
+
+// checkUnikraftTarget checks that the kernels of the kraft-built bases of
+// the target, which declare their Unikraft platform and architecture in
+// their labels, can run on the hypervisor and the architecture of the build,
+// e.g. that a build for firecracker does not pack a kernel for qemu.
+func checkUnikraftTarget(b *platformBuild, reachable []*PackInstructions) error {
+	hypervisor, ok := b.Target.Annots[uruncHypervisorAnnot]
+	if !ok && b.Platform != nil {
+		hypervisor = b.Platform.OS
+	}
+	for _, image := range reachable {
+		if image.Resolved == nil {
+			continue
+		}
+		var config ocispecs.Image
+		err := json.Unmarshal(image.Resolved.Config, &config)
+		if err != nil {
+			return fmt.Errorf("Failed to parse the config of %s: %w", image.Base, err)
+		}
+
+		plat := config.Config.Labels[labelUnikraftPlat]
+		hypervisors, known := unikraftPlatHypervisors[plat]
+		if known && hypervisor != "" && !slices.Contains(hypervisors, hypervisor) {
+			return fmt.Errorf("The base %s ships a kernel for the %s platform of Unikraft, which %s can not boot",
+					image.Base, plat, hypervisor)
+		}
+		arch := config.Config.Labels[labelUnikraftArch]
+		if ociArch, ok := unikraftArchs[arch]; ok && ociArch != b.LLBOpts.Platform.Architecture {
+			return fmt.Errorf("The base %s ships a kernel for %s, but the build is for %s",
+					image.Base, arch, b.LLBOpts.Platform.Architecture)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,174 @@
+// Copyright (c) 2023-2024, Nubificus LTD
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	"path"
+	"strings"
+
+	"github.com/moby/buildkit/client/llb"
+	"github.com/moby/buildkit/frontend/gateway/client"
+)
+
+const (
+	clientOptUruncJSONHMACKey   string = "urunc-json-hmac-key"
+	clientOptUruncJSONSignKey   string = "urunc-json-sign-key"
+	clientOptUruncJSONSignImage string = "urunc-json-sign-image"
+	defaultUruncJSONSignImage   string = "docker.io/library/alpine:3.20"
+	uruncJSONSignatureAnnot     string = "com.urunc.unikernel.uruncJSONSignature"
+	uruncJSONSigHMAC            string = "hmac-sha256"
+	uruncJSONSigSHA256          string = "sha256"
+	// The packed image and the key get mounted there in the signing
+	// container
+	uruncJSONSignRootfs         string = "/unikernel"
+	uruncJSONSignKey            string = "/run/pun-secrets/key"
+)
+
+// defaultUruncJSONSignCmd writes the HMAC-SHA256 of urunc.json with the key,
+// or its signature with the private key, in PUN_SIGNATURE. openssl gets
+// installed if the image does not have it. openssl only takes the keys of
+// HMACs in its arguments, which other processes can read, so the HMAC gets
+// computed from its definition, with the padded key in the builtin printf
+// of the shell and pipes.
+const defaultUruncJSONSignCmd string = `
+set -e
+if ! command -v openssl > /dev/null; then
+	apk add --no-cache openssl > /dev/null
+fi
+key_bytes() {
+	if [ "$(wc -c < "$PUN_KEY")" -gt 64 ]; then
+		openssl dgst -sha256 -binary "$PUN_KEY" | od -A n -t u1 -v
+	else
+		od -A n -t u1 -v "$PUN_KEY"
+	fi
+}
+case "$PUN_ALG" in
+hmac-sha256)
+	ipad= opad= n=0
+	for b in $(key_bytes); do
+		ipad="$ipad$(printf '\\%03o' $((b ^ 54)))"
+		opad="$opad$(printf '\\%03o' $((b ^ 92)))"
+		n=$((n + 1))
+	done
+	while [ $n -lt 64 ]; do
+		ipad="$ipad\\066" opad="$opad\\134" n=$((n + 1))
+	done
+	{
+		printf "$opad"
+		{ printf "$ipad"; cat "$PUN_URUNC_JSON"; } | openssl dgst -sha256 -binary
+	} | openssl dgst -sha256 -binary -out "$PUN_SIGNATURE"
+	;;
+sha256)
+	openssl dgst -sha256 -sign "$PUN_KEY" -out "$PUN_SIGNATURE" "$PUN_URUNC_JSON"
+	;;
+esac
+`
+
+// UruncJSONSign describes the signature of urunc.json, so that urunc can
+// refuse to boot images whose metadata changed after the build. The key is
+// a build secret, either the key of an HMAC or a private key, and the
+// signature gets computed in a container of Image.
+type UruncJSONSign struct {
+	Alg   string // hmac-sha256 or sha256, for signatures with a private key
+	Key   string // The id of the secret with the key
+	Image string // The image with openssl
+}
+
+// uruncJSONSignFromBuildOpts returns the signature of urunc.json of the
+// build options, or nil if urunc.json does not get signed.
+func uruncJSONSignFromBuildOpts(opts map[string]string) (*UruncJSONSign, error) {
+	hmacKey := opts[clientOptUruncJSONHMACKey]
+	signKey := opts[clientOptUruncJSONSignKey]
+	if hmacKey != "" && signKey != "" {
+		return nil, fmt.Errorf("Only one of %s and %s can be set", clientOptUruncJSONHMACKey, clientOptUruncJSONSignKey)
+	}
+
+	s := &UruncJSONSign{
+		Image: defaultUruncJSONSignImage,
+	}
+	switch {
+	case hmacKey != "":
+		s.Alg, s.Key = uruncJSONSigHMAC, hmacKey
+	case signKey != "":
+		s.Alg, s.Key = uruncJSONSigSHA256, signKey
+	default:
+		return nil, nil
+	}
+	if strings.Contains(s.Key, "/") {
+		return nil, fmt.Errorf("Invalid secret id %s for the signature of urunc.json", s.Key)
+	}
+	if val := opts[clientOptUruncJSONSignImage]; val != "" {
+		s.Image = val
+	}
+
+	return s, nil
+}
+
+// uruncJSONSigFile returns the path of the signature of urunc.json.
+func uruncJSONSigFile(opts LLBOpts) string {
+	return opts.UruncJSONPath + ".sig"
+}
+
+// runUruncJSONSign signs the urunc.json of the packed image, writing the
+// signature next to it and in the annotations of the target, as
+// <alg>:<base64>. It runs after every step that changes urunc.json, so the
+// annotation is not part of urunc.json.
+func runUruncJSONSign(ctx context.Context, c client.Client, s *UruncJSONSign, instr *PackInstructions,
+		ref client.Reference, opts LLBOpts) (client.Reference, error) {
+	sigFile := uruncJSONSigFile(opts)
+	rootfs, err := ref.ToState()
+	if err != nil {
+		return nil, err
+	}
+	signed := llb.Image(s.Image).Run(
+		llb.Args([]string{"/bin/sh", "-c", defaultUruncJSONSignCmd}),
+		llb.AddEnv("PUN_ALG", s.Alg),
+		llb.AddEnv("PUN_KEY", uruncJSONSignKey),
+		llb.AddEnv("PUN_URUNC_JSON", path.Join(uruncJSONSignRootfs, opts.UruncJSONPath)),
+		llb.AddEnv("PUN_SIGNATURE", path.Join(uruncJSONSignRootfs, sigFile)),
+		llb.AddSecret(uruncJSONSignKey, llb.SecretID(s.Key)),
+		// The secret is not part of the cache key, so urunc.json has to
+		// get signed in every build
+		llb.IgnoreCache,
+		llb.WithCustomName("Sign " + opts.UruncJSONPath),
+	).AddMount(uruncJSONSignRootfs, rootfs)
+	dt, err := signed.Marshal(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to marshal the signing of %s: %w", opts.UruncJSONPath, err)
+	}
+	res, err := c.Solve(ctx, client.SolveRequest{
+		Definition: dt.ToPB(),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("Failed to sign %s: %w", opts.UruncJSONPath, err)
+	}
+	ref, err = res.SingleRef()
+	if err != nil {
+		return nil, err
+	}
+	sig, err := ref.ReadFile(ctx, client.ReadRequest{
+		Filename: sigFile,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("Failed to read %s: %w", sigFile, err)
+	}
+	instr.Annots[uruncJSONSignatureAnnot] = s.Alg + ":" + base64.StdEncoding.EncodeToString(sig)
+	instr.addHistory("pun: sign " + opts.UruncJSONPath)
+
+	return ref, nil
+}
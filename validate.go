@@ -0,0 +1,125 @@
+// Copyright (c) 2023-2024, Nubificus LTD
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/moby/buildkit/frontend/subrequests/outline"
+	"github.com/moby/buildkit/util/appcontext"
+)
+
+const validateCmd string = "validate"
+
+// ValidateCLIOpts are the options of pun validate, which checks a
+// Containerfile without building it.
+type ValidateCLIOpts struct {
+	// The Containerfile to validate
+	ContainerFile  string
+	// The name of the image to validate, if the file defines more than one
+	Target         string
+	// Build args in the form of KEY=VALUE
+	BuildArgs      stringList
+	// The configuration file of pun
+	ConfigFile     string
+	// The policy that the image must follow
+	PolicyFile     string
+	// Print the args of the target with their defaults and descriptions
+	Describe       bool
+}
+
+func validateUsage() {
+	fmt.Println("Usage of pun validate")
+	fmt.Printf("%s %s [<args>]\n\n", os.Args[0], validateCmd)
+	fmt.Println("Supported command line arguments")
+	fmt.Println("\t-f, --file filename \t\tPath to the Containerfile (default " + defaultContainerFile + ")")
+	fmt.Println("\t--target name \t\t\tThe image to validate, if the file defines many")
+	fmt.Println("\t--build-arg KEY=VALUE \t\tSet a build arg (can be used multiple times)")
+	fmt.Println("\t--config filename \t\tPath to the configuration file of pun")
+	fmt.Println("\t--policy filename \t\tThe policy that the image must follow (default $PUN_POLICY)")
+	fmt.Println("\t--describe bool \t\tPrint the args of the target and their descriptions")
+}
+
+func parseValidateCLIOpts(args []string) ValidateCLIOpts {
+	var opts ValidateCLIOpts
+
+	fs := flag.NewFlagSet(validateCmd, flag.ExitOnError)
+	fs.StringVar(&opts.ContainerFile, "file", defaultContainerFile, "Path to the Containerfile")
+	fs.StringVar(&opts.ContainerFile, "f", defaultContainerFile, "Path to the Containerfile")
+	fs.StringVar(&opts.Target, "target", "", "The image to validate, if the file defines many")
+	fs.Var(&opts.BuildArgs, "build-arg", "Set a build arg (can be used multiple times)")
+	fs.StringVar(&opts.ConfigFile, "config", "", "Path to the configuration file of pun")
+	fs.StringVar(&opts.PolicyFile, "policy", "", "The policy that the image must follow")
+	fs.BoolVar(&opts.Describe, "describe", false, "Print the args of the target and their descriptions")
+	fs.Usage = validateUsage
+	fs.Parse(args)
+
+	return opts
+}
+
+// validateLocalBuild checks that the LLB of the target can get created,
+// which catches errors like missing stages, without contacting buildkit.
+func validateLocalBuild(local *LocalBuild) error {
+	buildCtx, err := contextState("", local.LLBOpts,
+			contextPaths(reachableImages(local.Images, local.Target)))
+	if err != nil {
+		return err
+	}
+	_, err = constructLLB(local.Target, local.Images, buildCtx, local.LLBOpts)
+
+	return err
+}
+
+func validateMain(args []string) {
+	opts := parseValidateCLIOpts(args)
+
+	local, err := loadLocalBuild(opts.ContainerFile, opts.BuildArgs, opts.ConfigFile, opts.Target)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	err = validateLocalBuild(local)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	policy, err := loadPolicy(opts.PolicyFile)
+	if err == nil && policy != nil {
+		err = policy.check(appcontext.Context(), local.Images, local.Target,
+				policyBaseExpander(nil, local.LLBOpts.Aliases))
+	}
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+
+	if !opts.Describe {
+		fmt.Printf("%s is valid\n", opts.ContainerFile)
+		return
+	}
+	dt, err := json.Marshal(targetOutline(local.FileBytes, local.Images, local.Target))
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	err = outline.PrintOutline(dt, os.Stdout)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+}
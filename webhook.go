@@ -0,0 +1,160 @@
+// Copyright (c) 2023-2024, Nubificus LTD
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/moby/buildkit/util/grpcerrors"
+	"google.golang.org/grpc/codes"
+)
+
+const (
+	// The webhook of the builds, if --webhook is not given
+	webhookEnv      string        = "PUN_WEBHOOK"
+	webhookTimeout  time.Duration = 10 * time.Second
+	buildStarted    string        = "started"
+	buildSucceeded  string        = "succeeded"
+	buildFailed     string        = "failed"
+	// The classes of the errors of failed builds
+	errorCanceled   string        = "canceled"
+	errorConnection string        = "connection"
+	errorTransient  string        = "transient"
+	errorBuild      string        = "build"
+)
+
+// BuildEvent is the body of the requests to the webhooks, for every event
+// of the lifecycle of a standalone build. Text is a summary of the event,
+// which chat services show as the message.
+type BuildEvent struct {
+	Event      string    `json:"event"`
+	Time       time.Time `json:"time"`
+	File       string    `json:"file"`
+	Context    string    `json:"context"`
+	Target     string    `json:"target,omitempty"`
+	Digest     string    `json:"digest,omitempty"`
+	Error      string    `json:"error,omitempty"`
+	ErrorClass string    `json:"errorClass,omitempty"`
+	Text       string    `json:"text"`
+}
+
+// errorClass returns the class of the error of a failed build, so that
+// automations can tell the builds to retry from the broken ones.
+func errorClass(err error) string {
+	switch {
+	case errors.Is(err, context.Canceled) || grpcerrors.Code(err) == codes.Canceled:
+		return errorCanceled
+	case grpcerrors.Code(err) == codes.Unavailable:
+		return errorConnection
+	case isTransient(err):
+		return errorTransient
+	}
+
+	return errorBuild
+}
+
+// newBuildEvent returns the event of a build. The digest is set for the
+// builds that succeeded and the error for the ones that failed.
+func newBuildEvent(event string, opts BuildCLIOpts, imageDigest string, err error) BuildEvent {
+	e := BuildEvent{
+		Event:   event,
+		Time:    time.Now().UTC(),
+		File:    opts.ContainerFile,
+		Context: opts.ContextDir,
+		Target:  opts.Target,
+		Digest:  imageDigest,
+	}
+	e.Text = fmt.Sprintf("pun: the build of %s %s", e.File, event)
+	if imageDigest != "" {
+		e.Text += ": " + imageDigest
+	}
+	if err != nil {
+		e.Error = err.Error()
+		e.ErrorClass = errorClass(err)
+		e.Text += fmt.Sprintf(" (%s): %s", e.ErrorClass, e.Error)
+	}
+
+	return e
+}
+
+// webhooksFromCLI returns the webhooks of the build, or the one of
+// $PUN_WEBHOOK, if none was given.
+func webhooksFromCLI(opts BuildCLIOpts) []string {
+	if len(opts.Webhooks) > 0 {
+		return opts.Webhooks
+	}
+	if url := os.Getenv(webhookEnv); url != "" {
+		return strings.Split(url, ",")
+	}
+
+	return nil
+}
+
+// postBuildEvent posts the event to the webhooks of the build. Webhooks
+// that fail only get reported, since they should not fail the build.
+func postBuildEvent(ctx context.Context, opts BuildCLIOpts, e BuildEvent) {
+	webhooks := webhooksFromCLI(opts)
+	if len(webhooks) == 0 {
+		return
+	}
+	dt, err := json.Marshal(e)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to marshal the %s event: %v\n", e.Event, err)
+		return
+	}
+
+	// The failed event gets posted even if the build got canceled
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), webhookTimeout)
+	defer cancel()
+	for _, url := range webhooks {
+		req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(dt))
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Invalid webhook %s: %v\n", url, err)
+			continue
+		}
+		req.Header.Set("Content-Type", "application/json")
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to post the %s event to %s: %v\n", e.Event, url, err)
+			continue
+		}
+		resp.Body.Close()
+		if resp.StatusCode >= 300 {
+			fmt.Fprintf(os.Stderr, "Failed to post the %s event to %s: %s\n", e.Event, url, resp.Status)
+		}
+	}
+}
+
+// withBuildEvents runs build, which returns the digest of the image, posting
+// the events of its start and its end to the webhooks of the build.
+func withBuildEvents(ctx context.Context, opts BuildCLIOpts, build func() (string, error)) error {
+	postBuildEvent(ctx, opts, newBuildEvent(buildStarted, opts, "", nil))
+	imageDigest, err := build()
+	if err != nil {
+		postBuildEvent(ctx, opts, newBuildEvent(buildFailed, opts, "", err))
+	} else {
+		postBuildEvent(ctx, opts, newBuildEvent(buildSucceeded, opts, imageDigest, nil))
+	}
+
+	return err
+}
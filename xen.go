@@ -0,0 +1,140 @@
+// Copyright (c) 2023-2024, Nubificus LTD
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"debug/elf"
+	"fmt"
+	"io"
+	"maps"
+
+	"github.com/moby/buildkit/frontend/gateway/client"
+)
+
+const (
+	xenHypervisor   string = "xen"
+	// The name of the ELF notes of PV and PVH kernels
+	xenNoteName     string = "Xen"
+	// The section of the PV kernels that predate the ELF notes
+	xenGuestSection string = "__xen_guest"
+)
+
+// xenHubs returns the hubs of the build, with the hubs that serve qemu
+// images (e.g. unikraft.org) switched to the xen images, when the target
+// runs on xen. The hubs of the build options are left untouched, since they
+// are shared between the platforms.
+func xenHubs(instr *PackInstructions, opts LLBOpts) map[string]string {
+	if platformHypervisor(instr, opts.Platform) != xenHypervisor {
+		return opts.Hubs
+	}
+	hubs := maps.Clone(opts.Hubs)
+	for hub, platform := range hubs {
+		if platform == "qemu" {
+			hubs[hub] = xenHypervisor
+		}
+	}
+
+	return hubs
+}
+
+// refReaderAt reads a file of the image of ref at random offsets, so that
+// only the headers and the notes of a kernel get transferred.
+type refReaderAt struct {
+	ctx  context.Context
+	ref  client.Reference
+	path string
+}
+
+func (r refReaderAt) ReadAt(p []byte, off int64) (int, error) {
+	dt, err := r.ref.ReadFile(r.ctx, client.ReadRequest{
+		Filename: r.path,
+		Range: &client.FileRange{
+			Offset: int(off),
+			Length: len(p),
+		},
+	})
+	if err != nil {
+		return 0, err
+	}
+	n := copy(p, dt)
+	if n < len(p) {
+		return n, io.EOF
+	}
+
+	return n, nil
+}
+
+// xenNotes returns the types of the Xen ELF notes of a kernel, e.g. the
+// entry point of PV kernels, or the 32-bit entry point of PVH kernels.
+func xenNotes(f *elf.File) ([]uint32, error) {
+	var types []uint32
+	for _, prog := range f.Progs {
+		if prog.Type != elf.PT_NOTE {
+			continue
+		}
+		dt, err := io.ReadAll(prog.Open())
+		if err != nil {
+			return nil, err
+		}
+		// Every note is its name and descriptor sizes, its type, and then
+		// its name and descriptor, padded to 4 bytes
+		for len(dt) >= 12 {
+			nameSize := f.ByteOrder.Uint32(dt[0:4])
+			descSize := f.ByteOrder.Uint32(dt[4:8])
+			noteType := f.ByteOrder.Uint32(dt[8:12])
+			nameEnd := 12 + (uint64(nameSize)+3)&^3
+			descEnd := nameEnd + (uint64(descSize)+3)&^3
+			if descEnd > uint64(len(dt)) {
+				break
+			}
+			name := bytes.TrimRight(dt[12:12+nameSize], "\x00")
+			if string(name) == xenNoteName {
+				types = append(types, noteType)
+			}
+			dt = dt[descEnd:]
+		}
+	}
+
+	return types, nil
+}
+
+// checkXenKernel fails if the kernel of the packed image can not boot on
+// xen, i.e. it is not an ELF with the Xen notes of PV or PVH kernels.
+func checkXenKernel(ctx context.Context, instr *PackInstructions, ref client.Reference) error {
+	kernelPath, ok := instr.Annots[uruncBinaryAnnot]
+	if !ok {
+		kernelPath = defaultKernelPath
+	}
+	f, err := elf.NewFile(refReaderAt{ctx: ctx, ref: ref, path: kernelPath})
+	if err != nil {
+		return fmt.Errorf("The kernel %s is not an ELF binary, which xen requires: %w", kernelPath, err)
+	}
+	defer f.Close()
+
+	if f.Section(xenGuestSection) != nil {
+		return nil
+	}
+	notes, err := xenNotes(f)
+	if err != nil {
+		return fmt.Errorf("Failed to read the notes of %s: %w", kernelPath, err)
+	}
+	if len(notes) == 0 {
+		return fmt.Errorf("The kernel %s is not a Xen PV or PVH binary, it has no Xen ELF notes", kernelPath)
+	}
+
+	return nil
+}